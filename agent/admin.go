@@ -0,0 +1,111 @@
+package agent
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/observiq/stanza/errors"
+	"github.com/observiq/stanza/pipeline"
+	"go.uber.org/zap"
+)
+
+// adminShutdownTimeout is the time the admin server waits for requests to finish when the agent stops
+const adminShutdownTimeout = 5 * time.Second
+
+// startAdmin starts the admin HTTP server of the agent if it has an admin address
+func (a *LogAgent) startAdmin() error {
+	if a.adminAddress == "" {
+		return nil
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", a.buildContext.Metrics.Handler())
+	mux.HandleFunc("/healthz", a.serveHealth)
+	mux.HandleFunc("/readyz", a.serveReady)
+
+	listener, err := net.Listen("tcp", a.adminAddress)
+	if err != nil {
+		return errors.Wrap(err, "start admin server")
+	}
+	a.adminListener = listener
+	a.adminServer = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	a.adminWg.Add(1)
+	go func() {
+		defer a.adminWg.Done()
+		if err := a.adminServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+			a.Errorw("Admin server failed", zap.Error(err))
+		}
+	}()
+	a.Infow("Started admin server", "address", listener.Addr().String())
+	return nil
+}
+
+// stopAdmin stops the admin HTTP server of the agent if it is running
+func (a *LogAgent) stopAdmin() {
+	if a.adminServer == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), adminShutdownTimeout)
+	defer cancel()
+	if err := a.adminServer.Shutdown(ctx); err != nil {
+		a.Warnw("Failed to shut down admin server", zap.Error(err))
+	}
+	a.adminWg.Wait()
+}
+
+// serveHealth reports whether the pipeline of the agent is started. It does not wait for
+// reloads, so that the agent is not considered dead while it reloads its config.
+func (a *LogAgent) serveHealth(w http.ResponseWriter, _ *http.Request) {
+	if atomic.LoadInt32(&a.running) == 0 {
+		writeStatus(w, http.StatusServiceUnavailable, "pipeline is not started")
+		return
+	}
+	writeStatus(w, http.StatusOK, "ok")
+}
+
+// serveReady reports whether the operators of the agent are running, and whether its outputs
+// are within the limits of its readiness. Each reason why the agent is not ready is on a line.
+// It does not wait for a reload of the config, and reports that the agent is not ready during one.
+func (a *LogAgent) serveReady(w http.ResponseWriter, _ *http.Request) {
+	if atomic.LoadInt32(&a.running) == 0 {
+		writeStatus(w, http.StatusServiceUnavailable, "pipeline is not started")
+		return
+	}
+
+	// The operators are being stopped and started while the config is reloaded
+	if atomic.LoadInt32(&a.reloading) == 1 {
+		writeStatus(w, http.StatusServiceUnavailable, "config is being reloaded")
+		return
+	}
+
+	a.pipelineMux.RLock()
+	p, ok := a.pipeline.(*pipeline.DirectedPipeline)
+	a.pipelineMux.RUnlock()
+
+	var reasons []string
+	if ok {
+		reasons = p.NotReady(a.readiness)
+	}
+
+	if len(reasons) > 0 {
+		writeStatus(w, http.StatusServiceUnavailable, a.redactor.Redact(strings.Join(reasons, "\n")))
+		return
+	}
+	writeStatus(w, http.StatusOK, "ok")
+}
+
+// writeStatus writes a plain text response with a status code
+func writeStatus(w http.ResponseWriter, code int, body string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(code)
+	_, _ = w.Write([]byte(body + "\n"))
+}
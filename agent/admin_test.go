@@ -0,0 +1,187 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/observiq/stanza/entry"
+	"github.com/observiq/stanza/operator"
+	"github.com/observiq/stanza/operator/helper"
+	"github.com/observiq/stanza/pipeline"
+	"github.com/observiq/stanza/testutil"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// healthOperator is an output that reports a fixed health
+type healthOperator struct {
+	helper.OutputOperator
+	health operator.Health
+}
+
+func (o *healthOperator) Process(ctx context.Context, e *entry.Entry) error { return nil }
+
+func (o *healthOperator) Health() operator.Health { return o.health }
+
+func TestAdminServer(t *testing.T) {
+	t.Run("Metrics", func(t *testing.T) {
+		tempDir := t.TempDir()
+		configPath := filepath.Join(tempDir, "config.yaml")
+		writeReloadConfig(t, configPath, "value")
+
+		agent, err := NewBuilder(zap.NewNop().Sugar()).
+			WithConfigFiles([]string{configPath}).
+			WithAdminAddress("127.0.0.1:0").
+			Build()
+		require.NoError(t, err)
+		require.NoError(t, agent.Start())
+		defer agent.Stop()
+
+		resp, err := http.Get(fmt.Sprintf("http://%s/metrics", agent.adminListener.Addr()))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Contains(t, string(body), `stanza_operator_entries_in_total{operator_id="$.second",operator_type="add"} 0`)
+		require.Contains(t, string(body), `stanza_operator_entries_out_total{operator_id="$.first",operator_type="noop"} 0`)
+	})
+
+	t.Run("Health", func(t *testing.T) {
+		tempDir := t.TempDir()
+		configPath := filepath.Join(tempDir, "config.yaml")
+		writeReloadConfig(t, configPath, "value")
+
+		agent, err := NewBuilder(zap.NewNop().Sugar()).
+			WithConfigFiles([]string{configPath}).
+			WithAdminAddress("127.0.0.1:0").
+			Build()
+		require.NoError(t, err)
+		require.NoError(t, agent.Start())
+		defer agent.Stop()
+
+		for _, path := range []string{"/healthz", "/readyz"} {
+			resp, err := http.Get(fmt.Sprintf("http://%s%s", agent.adminListener.Addr(), path))
+			require.NoError(t, err)
+			body, err := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			require.NoError(t, err)
+			require.Equal(t, http.StatusOK, resp.StatusCode, path)
+			require.Equal(t, "ok\n", string(body), path)
+		}
+	})
+
+	t.Run("NotStarted", func(t *testing.T) {
+		agent := &LogAgent{SugaredLogger: zap.NewNop().Sugar()}
+		for _, serve := range []http.HandlerFunc{agent.serveHealth, agent.serveReady} {
+			recorder := httptest.NewRecorder()
+			serve(recorder, httptest.NewRequest("GET", "/", nil))
+			require.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+			require.Equal(t, "pipeline is not started\n", recorder.Body.String())
+		}
+	})
+
+	t.Run("NotReady", func(t *testing.T) {
+		output, err := helper.NewOutputConfig("output", "health").Build(testutil.NewBuildContext(t))
+		require.NoError(t, err)
+		p, err := pipeline.NewDirectedPipeline([]operator.Operator{
+			&healthOperator{OutputOperator: output, health: operator.Health{RetryingFor: 10 * time.Minute, BufferUsage: 0.5}},
+		})
+		require.NoError(t, err)
+		require.NoError(t, p.Start())
+		defer p.Stop()
+
+		agent := &LogAgent{
+			SugaredLogger: zap.NewNop().Sugar(),
+			pipeline:      p,
+			readiness:     pipeline.Readiness{MaxRetryDuration: 5 * time.Minute, MaxBufferUsage: 0.9},
+			running:       1,
+		}
+		recorder := httptest.NewRecorder()
+		agent.serveReady(recorder, httptest.NewRequest("GET", "/readyz", nil))
+		require.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+		require.Equal(t, "operator '$.output' has been retrying for 10m0s, longer than 5m0s\n", recorder.Body.String())
+
+		// The agent is still alive
+		recorder = httptest.NewRecorder()
+		agent.serveHealth(recorder, httptest.NewRequest("GET", "/healthz", nil))
+		require.Equal(t, http.StatusOK, recorder.Code)
+	})
+
+	t.Run("Reloading", func(t *testing.T) {
+		output, err := helper.NewOutputConfig("output", "health").Build(testutil.NewBuildContext(t))
+		require.NoError(t, err)
+		p, err := pipeline.NewDirectedPipeline([]operator.Operator{&healthOperator{OutputOperator: output}})
+		require.NoError(t, err)
+		require.NoError(t, p.Start())
+		defer p.Stop()
+
+		agent := &LogAgent{
+			SugaredLogger: zap.NewNop().Sugar(),
+			pipeline:      p,
+			running:       1,
+			reloading:     1,
+		}
+
+		// Readiness checks do not wait for the reload to complete
+		agent.reloadMux.Lock()
+		defer agent.reloadMux.Unlock()
+		serveReady := func() *httptest.ResponseRecorder {
+			recorder := httptest.NewRecorder()
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				agent.serveReady(recorder, httptest.NewRequest("GET", "/readyz", nil))
+			}()
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+				require.FailNow(t, "readiness check waited for the reload")
+			}
+			return recorder
+		}
+
+		recorder := serveReady()
+		require.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+		require.Equal(t, "config is being reloaded\n", recorder.Body.String())
+
+		agent.reloading = 0
+		recorder = serveReady()
+		require.Equal(t, http.StatusOK, recorder.Code)
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		agent, err := NewBuilder(zap.NewNop().Sugar()).
+			WithConfig(&Config{}).
+			Build()
+		require.NoError(t, err)
+		require.NoError(t, agent.Start())
+		defer agent.Stop()
+
+		require.Nil(t, agent.adminServer)
+		require.Nil(t, agent.buildContext.Metrics)
+	})
+
+	t.Run("AddressInUse", func(t *testing.T) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer listener.Close()
+
+		agent, err := NewBuilder(zap.NewNop().Sugar()).
+			WithConfig(&Config{}).
+			WithAdminAddress(listener.Addr().String()).
+			Build()
+		require.NoError(t, err)
+		err = agent.Start()
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "start admin server")
+	})
+}
@@ -1,17 +1,55 @@
 package agent
 
 import (
+	"context"
+	"net"
+	"net/http"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/observiq/stanza/database"
+	"github.com/observiq/stanza/operator"
+	"github.com/observiq/stanza/operator/deadletter"
 	"github.com/observiq/stanza/pipeline"
 	"go.uber.org/zap"
 )
 
 // LogAgent is an entity that handles log monitoring.
 type LogAgent struct {
-	database database.Database
-	pipeline pipeline.Pipeline
+	database     database.Database
+	pipeline     pipeline.Pipeline
+	deadLetter   *deadletter.Queue
+	buildContext operator.BuildContext
+
+	// configFiles are the globs of the config files that the agent reloads
+	configFiles []string
+	config      *Config
+	// configHash is the hash of the contents of the config files that were last read
+	configHash     string
+	reloadInterval time.Duration
+
+	// reloadMux guards reloading the pipeline, and stopped prevents reloads after the agent is stopped
+	reloadMux   sync.Mutex
+	stopped     bool
+	cancelWatch context.CancelFunc
+	watchWg     sync.WaitGroup
+
+	// adminAddress is the address of the admin HTTP server. It is not started if it is empty.
+	adminAddress  string
+	adminListener net.Listener
+	adminServer   *http.Server
+	adminWg       sync.WaitGroup
+	// readiness holds the limits beyond which the agent is not ready, and running is set
+	// atomically while the pipeline of the agent is started
+	readiness pipeline.Readiness
+	running   int32
+	// reloading is set atomically while the config is reloaded, and pipelineMux guards replacing
+	// the pipeline, so that readiness checks do not wait for a reload to complete
+	reloading   int32
+	pipelineMux sync.RWMutex
+	// redactor removes the values substituted into the config files from logs and errors
+	redactor *Redactor
 
 	startOnce sync.Once
 	stopOnce  sync.Once
@@ -22,10 +60,24 @@ type LogAgent struct {
 // Start will start the log monitoring process
 func (a *LogAgent) Start() (err error) {
 	a.startOnce.Do(func() {
+		err = a.startAdmin()
+		if err != nil {
+			return
+		}
+
 		err = a.pipeline.Start()
 		if err != nil {
+			a.stopAdmin()
 			return
 		}
+		atomic.StoreInt32(&a.running, 1)
+
+		if a.reloadInterval > 0 && len(a.configFiles) > 0 {
+			var ctx context.Context
+			ctx, a.cancelWatch = context.WithCancel(context.Background())
+			a.watchWg.Add(1)
+			go a.watchConfigFiles(ctx)
+		}
 	})
 	return
 }
@@ -33,11 +85,30 @@ func (a *LogAgent) Start() (err error) {
 // Stop will stop the log monitoring process
 func (a *LogAgent) Stop() (err error) {
 	a.stopOnce.Do(func() {
+		atomic.StoreInt32(&a.running, 0)
+		a.stopAdmin()
+
+		if a.cancelWatch != nil {
+			a.cancelWatch()
+			a.watchWg.Wait()
+		}
+
+		a.reloadMux.Lock()
+		defer a.reloadMux.Unlock()
+		a.stopped = true
+
 		err = a.pipeline.Stop()
 		if err != nil {
 			return
 		}
 
+		if a.deadLetter != nil {
+			err = a.deadLetter.Close()
+			if err != nil {
+				return
+			}
+		}
+
 		err = a.database.Close()
 		if err != nil {
 			return
@@ -1,11 +1,15 @@
 package agent
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/observiq/stanza/database"
 	"github.com/observiq/stanza/errors"
+	"github.com/observiq/stanza/metrics"
 	"github.com/observiq/stanza/operator"
+	"github.com/observiq/stanza/operator/deadletter"
+	"github.com/observiq/stanza/pipeline"
 	"github.com/observiq/stanza/plugin"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
@@ -13,12 +17,15 @@ import (
 
 // LogAgentBuilder is a construct used to build a log agent
 type LogAgentBuilder struct {
-	configFiles   []string
-	config        *Config
-	logger        *zap.SugaredLogger
-	pluginDir     string
-	databaseFile  string
-	defaultOutput operator.Operator
+	configFiles    []string
+	config         *Config
+	logger         *zap.SugaredLogger
+	pluginDir      string
+	databaseFile   string
+	defaultOutput  operator.Operator
+	reloadInterval time.Duration
+	adminAddress   string
+	readiness      pipeline.Readiness
 }
 
 // NewBuilder creates a new LogAgentBuilder
@@ -58,6 +65,27 @@ func (b *LogAgentBuilder) WithDefaultOutput(defaultOutput operator.Operator) *Lo
 	return b
 }
 
+// WithReloadInterval sets the interval at which the agent checks its config files for changes
+// and reloads them. The config files are not watched if it is 0.
+func (b *LogAgentBuilder) WithReloadInterval(interval time.Duration) *LogAgentBuilder {
+	b.reloadInterval = interval
+	return b
+}
+
+// WithAdminAddress sets the address of the admin HTTP server, which serves the metrics of the
+// agent at /metrics, and its health at /healthz and /readyz. Metrics are not recorded and the
+// server is not started if it is empty.
+func (b *LogAgentBuilder) WithAdminAddress(address string) *LogAgentBuilder {
+	b.adminAddress = address
+	return b
+}
+
+// WithReadiness sets the limits beyond which the admin HTTP server reports that the agent is not ready
+func (b *LogAgentBuilder) WithReadiness(readiness pipeline.Readiness) *LogAgentBuilder {
+	b.readiness = readiness
+	return b
+}
+
 // Build will build a new log agent using the values defined on the builder
 func (b *LogAgentBuilder) Build() (*LogAgent, error) {
 	db, err := database.OpenDatabase(b.databaseFile)
@@ -75,28 +103,86 @@ func (b *LogAgentBuilder) Build() (*LogAgent, error) {
 		return nil, errors.NewError("agent can be built WithConfig or WithConfigFiles, but not both", "")
 	} else if b.config == nil && len(b.configFiles) == 0 {
 		return nil, errors.NewError("agent cannot be built without WithConfig or WithConfigFiles", "")
-	} else if len(b.configFiles) > 0 {
+	}
+
+	var configHash string
+	if len(b.configFiles) > 0 {
+		configHash, err = hashConfigFiles(b.configFiles)
+		if err != nil {
+			return nil, errors.Wrap(err, "read config files")
+		}
 		b.config, err = NewConfigFromGlobs(b.configFiles)
 		if err != nil {
 			return nil, errors.Wrap(err, "read configs from globs")
 		}
 	}
 
-	sampledLogger := b.logger.Desugar().WithOptions(
+	// The values substituted into the config files are redacted from the logs and errors of the
+	// agent. Reloading the config files can add secrets later.
+	redactor := NewRedactor(b.config.Secrets)
+	logger := b.logger
+	if len(b.configFiles) > 0 || len(b.config.Secrets) > 0 {
+		logger = redactor.WrapLogger(logger)
+	}
+	sampledLogger := logger.Desugar().WithOptions(
 		zap.WrapCore(func(core zapcore.Core) zapcore.Core {
 			return zapcore.NewSamplerWithOptions(core, time.Second, 1, 10000)
 		}),
 	).Sugar()
 
-	buildContext := operator.NewBuildContext(db, sampledLogger)
+	deadLetter, err := b.config.BuildDeadLetter()
+	if err != nil {
+		return nil, redactor.RedactError(err)
+	}
+
+	buildContext := b.config.WithGlobals(operator.NewBuildContext(db, sampledLogger))
+	buildContext.DeadLetter = deadLetter
+	if b.adminAddress != "" {
+		buildContext.Metrics = metrics.NewRegistry()
+	}
 	pipeline, err := b.config.Pipeline.BuildPipeline(buildContext, b.defaultOutput)
 	if err != nil {
-		return nil, err
+		return nil, redactor.RedactError(err)
+	}
+
+	if err := connectDeadLetter(deadLetter, buildContext, pipeline.Operators()); err != nil {
+		return nil, redactor.RedactError(err)
 	}
 
 	return &LogAgent{
-		pipeline:      pipeline,
-		database:      db,
-		SugaredLogger: b.logger,
+		pipeline:       pipeline,
+		database:       db,
+		deadLetter:     deadLetter,
+		buildContext:   buildContext,
+		configFiles:    b.configFiles,
+		config:         b.config,
+		configHash:     configHash,
+		reloadInterval: b.reloadInterval,
+		adminAddress:   b.adminAddress,
+		readiness:      b.readiness,
+		redactor:       redactor,
+		SugaredLogger:  logger,
 	}, nil
 }
+
+// connectDeadLetter connects the dead-letter queue to its output if it sends entries to one
+func connectDeadLetter(deadLetter *deadletter.Queue, bc operator.BuildContext, operators []operator.Operator) error {
+	if deadLetter == nil || deadLetter.OutputID() == "" {
+		return nil
+	}
+
+	id := bc.PrependNamespace(deadLetter.OutputID())
+	for _, op := range operators {
+		if op.ID() == id {
+			if !op.CanProcess() {
+				return errors.NewError(fmt.Sprintf("dead-letter output '%s' cannot process entries", id), "")
+			}
+			deadLetter.Connect(op)
+			return nil
+		}
+	}
+	return errors.NewError(
+		fmt.Sprintf("dead-letter output '%s' does not exist", id),
+		"ensure that the 'output' of 'dead_letter' is the id of an operator in the pipeline",
+	)
+}
@@ -1,10 +1,15 @@
 package agent
 
 import (
+	"context"
+	"fmt"
 	"io/ioutil"
 	"path/filepath"
 	"testing"
 
+	"github.com/observiq/stanza/entry"
+	"github.com/observiq/stanza/operator"
+	"github.com/observiq/stanza/operator/deadletter"
 	"github.com/observiq/stanza/testutil"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
@@ -116,3 +121,84 @@ func TestBuildAgentFailureNonexistGlobs(t *testing.T) {
 	require.Contains(t, err.Error(), "read configs from globs")
 	require.Nil(t, agent)
 }
+
+func TestBuildAgentRedactsSecrets(t *testing.T) {
+	tempDir := testutil.NewTempDir(t)
+	configPath := filepath.Join(tempDir, "config.yaml")
+	config := `
+pipeline:
+  - type: noop
+    output: ${env:secret:STANZA_TEST_OUTPUT}
+`
+	require.NoError(t, ioutil.WriteFile(configPath, []byte(config), 0600))
+	t.Setenv("STANZA_TEST_OUTPUT", "secret-output")
+
+	agent, err := NewBuilder(zap.NewNop().Sugar()).
+		WithConfigFiles([]string{configPath}).
+		WithDatabaseFile("").
+		Build()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "${env:secret:STANZA_TEST_OUTPUT}")
+	require.NotContains(t, err.Error(), "secret-output")
+	require.Nil(t, agent)
+}
+
+func TestBuildAgentKeepsValuesThatAreNotSecrets(t *testing.T) {
+	tempDir := testutil.NewTempDir(t)
+	configPath := filepath.Join(tempDir, "config.yaml")
+	config := `
+labels:
+  env: ${env:STANZA_TEST_ENV}
+  level: ${env:STANZA_TEST_LEVEL}
+pipeline:
+  - type: noop
+    output: ${env:STANZA_TEST_ENV}_${env:STANZA_TEST_LEVEL}_${env:STANZA_TEST_PORT}
+`
+	require.NoError(t, ioutil.WriteFile(configPath, []byte(config), 0600))
+	t.Setenv("STANZA_TEST_ENV", "prod")
+	t.Setenv("STANZA_TEST_LEVEL", "info")
+	t.Setenv("STANZA_TEST_PORT", "8080")
+
+	agent, err := NewBuilder(zap.NewNop().Sugar()).
+		WithConfigFiles([]string{configPath}).
+		WithDatabaseFile("").
+		Build()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "prod_info_8080")
+	require.NotContains(t, err.Error(), "${env:")
+	require.Nil(t, agent)
+}
+
+func TestConnectDeadLetter(t *testing.T) {
+	bc := testutil.NewBuildContext(t)
+	output := testutil.NewFakeOutput(t)
+
+	t.Run("NoQueue", func(t *testing.T) {
+		require.NoError(t, connectDeadLetter(nil, bc, []operator.Operator{output}))
+	})
+
+	t.Run("FileQueue", func(t *testing.T) {
+		queue := deadletter.NewFileQueue(filepath.Join(testutil.NewTempDir(t), "dead_letter.jsonl"))
+		require.NoError(t, connectDeadLetter(queue, bc, []operator.Operator{output}))
+	})
+
+	t.Run("Output", func(t *testing.T) {
+		queue, err := deadletter.Config{Output: output.ID()}.Build()
+		require.NoError(t, err)
+		require.NoError(t, connectDeadLetter(queue, bc, []operator.Operator{output}))
+
+		e := entry.New()
+		require.NoError(t, queue.Add(context.Background(), "$.other_output", []*entry.Entry{e}, fmt.Errorf("rejected")))
+		received := <-output.Received
+		require.Equal(t, "rejected", received.Labels[deadletter.ReasonLabel])
+		require.Equal(t, "$.other_output", received.Labels[deadletter.OperatorLabel])
+	})
+
+	t.Run("MissingOutput", func(t *testing.T) {
+		queue, err := deadletter.Config{Output: "missing"}.Build()
+		require.NoError(t, err)
+		err = connectDeadLetter(queue, bc, []operator.Operator{output})
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "dead-letter output '$.missing' does not exist")
+	})
+}
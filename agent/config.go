@@ -4,40 +4,123 @@ import (
 	"fmt"
 	"io/ioutil"
 	"path/filepath"
+	"regexp"
 
+	"github.com/observiq/stanza/operator"
+	"github.com/observiq/stanza/operator/buffer"
+	"github.com/observiq/stanza/operator/deadletter"
+	"github.com/observiq/stanza/operator/flusher"
+	"github.com/observiq/stanza/operator/helper"
 	"github.com/observiq/stanza/pipeline"
 	yaml "gopkg.in/yaml.v2"
 )
 
+// shortenedValueRegex matches the values that are shortened in the errors of parsing yaml
+var shortenedValueRegex = regexp.MustCompile("`[^`]*\\.\\.\\.`")
+
 // Config is the configuration of the stanza log agent.
 type Config struct {
-	Pipeline pipeline.Config `json:"pipeline"                yaml:"pipeline"`
+	Agent      *Settings          `json:"agent,omitempty"       yaml:"agent,omitempty"`
+	Resource   map[string]string  `json:"resource,omitempty"    yaml:"resource,omitempty"`
+	Labels     map[string]string  `json:"labels,omitempty"      yaml:"labels,omitempty"`
+	Defaults   *Defaults          `json:"defaults,omitempty"    yaml:"defaults,omitempty"`
+	Pipeline   pipeline.Config    `json:"pipeline"              yaml:"pipeline"`
+	DeadLetter *deadletter.Config `json:"dead_letter,omitempty" yaml:"dead_letter,omitempty"`
+
+	// Secrets are the values that were substituted into the config files
+	Secrets Secrets `json:"-" yaml:"-"`
+}
+
+// Settings are the settings of the agent process. They mirror the flags of the stanza
+// command, which take precedence over them.
+type Settings struct {
+	LogLevel       string           `json:"log_level,omitempty"        yaml:"log_level,omitempty"`
+	LogFile        string           `json:"log_file,omitempty"         yaml:"log_file,omitempty"`
+	MaxLogSize     *int             `json:"max_log_size,omitempty"     yaml:"max_log_size,omitempty"`
+	MaxLogBackups  *int             `json:"max_log_backups,omitempty"  yaml:"max_log_backups,omitempty"`
+	MaxLogAge      *int             `json:"max_log_age,omitempty"      yaml:"max_log_age,omitempty"`
+	Database       string           `json:"database,omitempty"         yaml:"database,omitempty"`
+	PluginDir      string           `json:"plugin_dir,omitempty"       yaml:"plugin_dir,omitempty"`
+	ReloadInterval *helper.Duration `json:"reload_interval,omitempty"  yaml:"reload_interval,omitempty"`
+	AdminAddress   string           `json:"admin_address,omitempty"    yaml:"admin_address,omitempty"`
+	ReadyMaxRetry  *helper.Duration `json:"ready_max_retry,omitempty"  yaml:"ready_max_retry,omitempty"`
+	ReadyMaxBuffer *float64         `json:"ready_max_buffer,omitempty" yaml:"ready_max_buffer,omitempty"`
+}
+
+// Defaults holds the buffer and flusher configs that outputs inherit unless they override them
+type Defaults struct {
+	Buffer  *buffer.Config  `json:"buffer,omitempty"  yaml:"buffer,omitempty"`
+	Flusher *flusher.Config `json:"flusher,omitempty" yaml:"flusher,omitempty"`
+}
+
+// UnmarshalYAML unmarshals the defaults. The settings of the flusher that are not set
+// keep their default values, so that outputs do not inherit them.
+func (d *Defaults) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	keys := map[string]interface{}{}
+	if err := unmarshal(&keys); err != nil {
+		return err
+	}
+
+	flusherConfig := flusher.NewConfig()
+	raw := struct {
+		Buffer  *buffer.Config  `yaml:"buffer,omitempty"`
+		Flusher *flusher.Config `yaml:"flusher,omitempty"`
+	}{Flusher: &flusherConfig}
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	d.Buffer = raw.Buffer
+	if _, ok := keys["flusher"]; ok {
+		d.Flusher = raw.Flusher
+	}
+	return nil
 }
 
-// NewConfigFromFile will create a new agent config from a YAML file.
+// NewConfigFromFile will create a new agent config from a YAML file. The references to environment
+// variables and files in the file are substituted before it is parsed.
 func NewConfigFromFile(file string) (*Config, error) {
-	contents, err := ioutil.ReadFile(file) // #nosec - configs load based on user specified directory
+	contents, err := readConfigFile(file)
 	if err != nil {
-		return nil, fmt.Errorf("could not find config file: %s", err)
+		return nil, err
 	}
 
-	config := Config{}
+	config := Config{Secrets: Secrets{}}
+	if contents, err = interpolate(contents, filepath.Dir(file), config.Secrets); err != nil {
+		return nil, fmt.Errorf("failed to interpolate config file: %s", err)
+	}
 	if err := yaml.UnmarshalStrict(contents, &config); err != nil {
-		return nil, fmt.Errorf("failed to read config file as yaml: %s", err)
+		return nil, fmt.Errorf("failed to read config file as yaml: %s", redactYAMLError(err, config.Secrets))
 	}
 
 	return &config, nil
 }
 
+// redactYAMLError returns the message of an error of parsing a config without its secrets
+func redactYAMLError(err error, secrets Secrets) string {
+	if len(secrets) == 0 {
+		return err.Error()
+	}
+
+	// Long values are shortened in the errors, which could leave the start of a secret
+	message := shortenedValueRegex.ReplaceAllString(err.Error(), "`...`")
+	return NewRedactor(secrets).Redact(message)
+}
+
+// readConfigFile reads the contents of a config file
+func readConfigFile(file string) ([]byte, error) {
+	contents, err := ioutil.ReadFile(file) // #nosec - configs load based on user specified directory
+	if err != nil {
+		return nil, fmt.Errorf("could not find config file: %s", err)
+	}
+	return contents, nil
+}
+
 // NewConfigFromGlobs will create an agent config from multiple files matching a pattern.
 func NewConfigFromGlobs(globs []string) (*Config, error) {
-	paths := make([]string, 0, len(globs))
-	for _, glob := range globs {
-		matches, err := filepath.Glob(glob)
-		if err != nil {
-			return nil, err
-		}
-		paths = append(paths, matches...)
+	paths, err := globPaths(globs)
+	if err != nil {
+		return nil, err
 	}
 
 	if len(paths) == 0 {
@@ -57,8 +140,161 @@ func NewConfigFromGlobs(globs []string) (*Config, error) {
 	return config, nil
 }
 
-// mergeConfigs will merge two agent configs.
+// NewSettingsFromGlobs reads the agent settings of the config files matching the globs. Only the
+// `agent` sections are read, so that they can be applied before the plugins are registered.
+// The settings of later files replace those of earlier ones.
+func NewSettingsFromGlobs(globs []string) (*Settings, error) {
+	paths, err := globPaths(globs)
+	if err != nil {
+		return nil, err
+	}
+
+	settings := &Settings{}
+	for _, path := range paths {
+		contents, err := readConfigFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if contents, err = interpolate(contents, filepath.Dir(path), Secrets{}); err != nil {
+			return nil, fmt.Errorf("failed to interpolate %s: %s", path, err)
+		}
+
+		var raw struct {
+			Agent *Settings `yaml:"agent"`
+		}
+		if err := yaml.Unmarshal(contents, &raw); err != nil {
+			return nil, fmt.Errorf("failed to read agent settings from %s: %s", path, err)
+		}
+		if raw.Agent != nil {
+			settings = mergeSettings(settings, raw.Agent)
+		}
+	}
+	return settings, nil
+}
+
+// globPaths returns the paths of the files matching the globs
+func globPaths(globs []string) ([]string, error) {
+	paths := make([]string, 0, len(globs))
+	for _, glob := range globs {
+		matches, err := filepath.Glob(glob)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, matches...)
+	}
+	return paths, nil
+}
+
+// WithGlobals returns a copy of the build context that adds the global labels and resource of
+// the config to every entry, and passes the buffer and flusher defaults to outputs
+func (c *Config) WithGlobals(bc operator.BuildContext) operator.BuildContext {
+	bc = bc.Copy()
+	bc.Labels = c.Labels
+	bc.Resource = c.Resource
+	if c.Defaults != nil {
+		bc.Defaults = make(map[string]interface{})
+		if c.Defaults.Buffer != nil {
+			bc.Defaults[buffer.DefaultsKey] = *c.Defaults.Buffer
+		}
+		if c.Defaults.Flusher != nil {
+			bc.Defaults[flusher.DefaultsKey] = *c.Defaults.Flusher
+		}
+	}
+	return bc
+}
+
+// BuildDeadLetter builds the dead-letter queue of the pipeline, or returns nil if none is configured.
+func (c *Config) BuildDeadLetter() (*deadletter.Queue, error) {
+	if c.DeadLetter == nil {
+		return nil, nil
+	}
+
+	queue, err := c.DeadLetter.Build()
+	if err != nil {
+		return nil, fmt.Errorf("invalid 'dead_letter': %s", err)
+	}
+	return queue, nil
+}
+
+// mergeConfigs will merge two agent configs. The agent settings, labels and resource keys that a
+// later config sets replace those of an earlier one, and so do its dead-letter queue and defaults.
+// The secrets of both configs are kept.
 func mergeConfigs(dst *Config, src *Config) *Config {
 	dst.Pipeline = append(dst.Pipeline, src.Pipeline...)
+	dst.Secrets = mergeMaps(dst.Secrets, src.Secrets)
+	if src.DeadLetter != nil {
+		dst.DeadLetter = src.DeadLetter
+	}
+	if src.Agent != nil {
+		if dst.Agent == nil {
+			dst.Agent = &Settings{}
+		}
+		dst.Agent = mergeSettings(dst.Agent, src.Agent)
+	}
+	dst.Labels = mergeMaps(dst.Labels, src.Labels)
+	dst.Resource = mergeMaps(dst.Resource, src.Resource)
+	if src.Defaults != nil {
+		if dst.Defaults == nil {
+			dst.Defaults = &Defaults{}
+		}
+		if src.Defaults.Buffer != nil {
+			dst.Defaults.Buffer = src.Defaults.Buffer
+		}
+		if src.Defaults.Flusher != nil {
+			dst.Defaults.Flusher = src.Defaults.Flusher
+		}
+	}
+	return dst
+}
+
+// mergeSettings will merge two agent settings. The settings that are set in src replace those of dst.
+func mergeSettings(dst *Settings, src *Settings) *Settings {
+	if src.LogLevel != "" {
+		dst.LogLevel = src.LogLevel
+	}
+	if src.LogFile != "" {
+		dst.LogFile = src.LogFile
+	}
+	if src.MaxLogSize != nil {
+		dst.MaxLogSize = src.MaxLogSize
+	}
+	if src.MaxLogBackups != nil {
+		dst.MaxLogBackups = src.MaxLogBackups
+	}
+	if src.MaxLogAge != nil {
+		dst.MaxLogAge = src.MaxLogAge
+	}
+	if src.Database != "" {
+		dst.Database = src.Database
+	}
+	if src.PluginDir != "" {
+		dst.PluginDir = src.PluginDir
+	}
+	if src.ReloadInterval != nil {
+		dst.ReloadInterval = src.ReloadInterval
+	}
+	if src.AdminAddress != "" {
+		dst.AdminAddress = src.AdminAddress
+	}
+	if src.ReadyMaxRetry != nil {
+		dst.ReadyMaxRetry = src.ReadyMaxRetry
+	}
+	if src.ReadyMaxBuffer != nil {
+		dst.ReadyMaxBuffer = src.ReadyMaxBuffer
+	}
+	return dst
+}
+
+// mergeMaps will merge two maps. The values of src replace those of dst with the same key.
+func mergeMaps(dst, src map[string]string) map[string]string {
+	if len(src) == 0 {
+		return dst
+	}
+	if dst == nil {
+		dst = make(map[string]string, len(src))
+	}
+	for k, v := range src {
+		dst[k] = v
+	}
 	return dst
 }
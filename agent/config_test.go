@@ -6,8 +6,13 @@ import (
 	"testing"
 
 	"github.com/observiq/stanza/operator"
-	_ "github.com/observiq/stanza/operator/builtin/transformer/noop"
+	"github.com/observiq/stanza/operator/buffer"
+	"github.com/observiq/stanza/operator/builtin/transformer/noop"
+	"github.com/observiq/stanza/operator/deadletter"
+	"github.com/observiq/stanza/operator/flusher"
+	"github.com/observiq/stanza/operator/helper"
 	"github.com/observiq/stanza/pipeline"
+	"github.com/observiq/stanza/plugin"
 	"github.com/observiq/stanza/testutil"
 	"github.com/stretchr/testify/require"
 )
@@ -114,3 +119,284 @@ func TestMergeConfigs(t *testing.T) {
 	config3 := mergeConfigs(&config1, &config2)
 	require.Equal(t, len(config3.Pipeline), 2)
 }
+
+func TestMergeConfigsDeadLetter(t *testing.T) {
+	config1 := Config{DeadLetter: &deadletter.Config{Path: "/first.jsonl"}}
+	config2 := Config{}
+	config3 := Config{DeadLetter: &deadletter.Config{Path: "/third.jsonl"}}
+
+	merged := mergeConfigs(mergeConfigs(&config1, &config2), &config3)
+	require.Equal(t, &deadletter.Config{Path: "/third.jsonl"}, merged.DeadLetter)
+}
+
+func TestNewConfigFromFileWithDeadLetter(t *testing.T) {
+	tempDir := testutil.NewTempDir(t)
+	configFile := filepath.Join(tempDir, "config.yaml")
+	configContents := `
+pipeline:
+  - type: noop
+dead_letter:
+  output: dead_letter_output
+`
+	require.NoError(t, ioutil.WriteFile(configFile, []byte(configContents), 0600))
+
+	config, err := NewConfigFromFile(configFile)
+	require.NoError(t, err)
+	require.Equal(t, &deadletter.Config{Output: "dead_letter_output"}, config.DeadLetter)
+
+	queue, err := config.BuildDeadLetter()
+	require.NoError(t, err)
+	require.Equal(t, "dead_letter_output", queue.OutputID())
+}
+
+func TestBuildDeadLetter(t *testing.T) {
+	queue, err := (&Config{}).BuildDeadLetter()
+	require.NoError(t, err)
+	require.Nil(t, queue)
+
+	_, err = (&Config{DeadLetter: &deadletter.Config{}}).BuildDeadLetter()
+	require.EqualError(t, err, "invalid 'dead_letter': one of 'path' or 'output' is required")
+}
+
+func TestNewConfigFromFileWithGlobals(t *testing.T) {
+	tempDir := testutil.NewTempDir(t)
+	configFile := filepath.Join(tempDir, "config.yaml")
+	configContents := `
+agent:
+  log_level: debug
+  database: /var/lib/stanza/stanza.db
+  max_log_age: 3
+  reload_interval: 0s
+  admin_address: localhost:8888
+resource:
+  host: web-1
+labels:
+  env: prod
+defaults:
+  buffer:
+    type: memory
+    max_entries: 100
+  flusher:
+    max_concurrent: 4
+    retry:
+      max_attempts: 5
+pipeline:
+  - type: noop
+`
+	require.NoError(t, ioutil.WriteFile(configFile, []byte(configContents), 0600))
+
+	config, err := NewConfigFromFile(configFile)
+	require.NoError(t, err)
+
+	maxLogAge := 3
+	require.Equal(t, &Settings{
+		LogLevel:       "debug",
+		Database:       "/var/lib/stanza/stanza.db",
+		MaxLogAge:      &maxLogAge,
+		ReloadInterval: &helper.Duration{},
+		AdminAddress:   "localhost:8888",
+	}, config.Agent)
+	require.Equal(t, map[string]string{"host": "web-1"}, config.Resource)
+	require.Equal(t, map[string]string{"env": "prod"}, config.Labels)
+
+	memory := buffer.NewMemoryBufferConfig()
+	memory.MaxEntries = 100
+	require.NotNil(t, config.Defaults.Buffer)
+	require.Equal(t, memory, config.Defaults.Buffer.Builder)
+
+	// The flusher settings that are not set keep their defaults
+	expected := flusher.NewConfig()
+	expected.MaxConcurrent = 4
+	expected.Retry.MaxAttempts = 5
+	require.NotNil(t, config.Defaults.Flusher)
+	require.Equal(t, expected.MaxConcurrent, config.Defaults.Flusher.MaxConcurrent)
+	require.Equal(t, expected.Adaptive, config.Defaults.Flusher.Adaptive)
+	require.Equal(t, expected.Retry, config.Defaults.Flusher.Retry)
+	require.Equal(t, expected.DeadLetter, config.Defaults.Flusher.DeadLetter)
+}
+
+func TestNewConfigFromFileWithInvalidGlobals(t *testing.T) {
+	cases := map[string]string{
+		"AgentSetting":   "agent:\n  unknown: true\n",
+		"DefaultsKey":    "defaults:\n  unknown: true\n",
+		"FlusherSetting": "defaults:\n  flusher:\n    unknown: true\n",
+	}
+	for name, contents := range cases {
+		t.Run(name, func(t *testing.T) {
+			configFile := filepath.Join(testutil.NewTempDir(t), "config.yaml")
+			require.NoError(t, ioutil.WriteFile(configFile, []byte(contents), 0600))
+			_, err := NewConfigFromFile(configFile)
+			require.Error(t, err)
+			require.Contains(t, err.Error(), "unknown")
+		})
+	}
+}
+
+func TestNewConfigFromFileWithoutFlusherDefaults(t *testing.T) {
+	configFile := filepath.Join(testutil.NewTempDir(t), "config.yaml")
+	require.NoError(t, ioutil.WriteFile(configFile, []byte("defaults:\n  buffer:\n    type: memory\n"), 0600))
+
+	config, err := NewConfigFromFile(configFile)
+	require.NoError(t, err)
+	require.NotNil(t, config.Defaults.Buffer)
+	require.Nil(t, config.Defaults.Flusher)
+}
+
+func TestMergeConfigsGlobals(t *testing.T) {
+	maxLogAge := 3
+	flusherConfig := flusher.NewConfig()
+	config1 := Config{
+		Agent:    &Settings{LogLevel: "debug", Database: "/first.db"},
+		Labels:   map[string]string{"env": "dev", "team": "platform"},
+		Defaults: &Defaults{Flusher: &flusherConfig},
+	}
+	config2 := Config{
+		Agent:    &Settings{Database: "/second.db", MaxLogAge: &maxLogAge},
+		Labels:   map[string]string{"env": "prod"},
+		Resource: map[string]string{"host": "web-1"},
+		Defaults: &Defaults{Buffer: &buffer.Config{Builder: buffer.NewMemoryBufferConfig()}},
+	}
+
+	merged := mergeConfigs(&config1, &config2)
+	require.Equal(t, &Settings{LogLevel: "debug", Database: "/second.db", MaxLogAge: &maxLogAge}, merged.Agent)
+	require.Equal(t, map[string]string{"env": "prod", "team": "platform"}, merged.Labels)
+	require.Equal(t, map[string]string{"host": "web-1"}, merged.Resource)
+	require.Equal(t, &flusherConfig, merged.Defaults.Flusher)
+	require.NotNil(t, merged.Defaults.Buffer)
+}
+
+func TestNewSettingsFromGlobs(t *testing.T) {
+	tempDir := testutil.NewTempDir(t)
+	// The pipeline is not read, so operators of plugins that are not registered yet are allowed
+	first := `
+agent:
+  plugin_dir: /opt/plugins
+  log_level: debug
+pipeline:
+  - type: unregistered_plugin
+`
+	second := `
+agent:
+  log_level: warn
+`
+	require.NoError(t, ioutil.WriteFile(filepath.Join(tempDir, "1.yaml"), []byte(first), 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(tempDir, "2.yaml"), []byte(second), 0600))
+
+	settings, err := NewSettingsFromGlobs([]string{filepath.Join(tempDir, "*.yaml")})
+	require.NoError(t, err)
+	require.Equal(t, &Settings{PluginDir: "/opt/plugins", LogLevel: "warn"}, settings)
+
+	settings, err = NewSettingsFromGlobs([]string{filepath.Join(tempDir, "missing.yaml")})
+	require.NoError(t, err)
+	require.Equal(t, &Settings{}, settings)
+}
+
+func TestWithGlobals(t *testing.T) {
+	flusherConfig := flusher.NewConfig()
+	bufferConfig := buffer.Config{Builder: buffer.NewMemoryBufferConfig()}
+	config := &Config{
+		Labels:   map[string]string{"env": "prod"},
+		Resource: map[string]string{"host": "web-1"},
+		Defaults: &Defaults{Buffer: &bufferConfig, Flusher: &flusherConfig},
+	}
+
+	bc := config.WithGlobals(testutil.NewBuildContext(t))
+	require.Equal(t, config.Labels, bc.Labels)
+	require.Equal(t, config.Resource, bc.Resource)
+	require.Equal(t, map[string]interface{}{
+		buffer.DefaultsKey:  bufferConfig,
+		flusher.DefaultsKey: flusherConfig,
+	}, bc.Defaults)
+
+	bc = (&Config{}).WithGlobals(testutil.NewBuildContext(t))
+	require.Nil(t, bc.Labels)
+	require.Nil(t, bc.Defaults)
+}
+
+func TestNewConfigFromFileInterpolated(t *testing.T) {
+	p, err := plugin.NewPlugin("interpolated_plugin", []byte(`
+parameters:
+  - name: value
+    type: string
+pipeline:
+  - id: {{ .input }}
+    type: noop
+    output: {{ .output }}
+`))
+	require.NoError(t, err)
+	operator.RegisterPlugin(p.ID, p.NewBuilder)
+
+	tempDir := testutil.NewTempDir(t)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(tempDir, "token"), []byte("secret-token\n"), 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(tempDir, "cert"), []byte("-----BEGIN-----\nkey: value # not a comment\n-----END-----\n"), 0600))
+	t.Setenv("STANZA_TEST_CLUSTER", "test-cluster")
+	t.Setenv("STANZA_TEST_OWNER", `team: "logs" #1`)
+
+	configFile := filepath.Join(tempDir, "config.yaml")
+	configContents := `
+labels:
+  cluster: ${env:STANZA_TEST_CLUSTER}
+  region: ${env:STANZA_TEST_REGION:-local}
+  owner: ${env:secret:STANZA_TEST_OWNER}
+  cert: ${file:cert}
+  # zone: ${env:STANZA_TEST_MISSING}
+pipeline:
+  - id: plugin
+    type: interpolated_plugin
+    value: ${file:token}
+  - id: escaped
+    type: noop
+    output: $${env:STANZA_TEST_CLUSTER}
+`
+	require.NoError(t, ioutil.WriteFile(configFile, []byte(configContents), 0600))
+
+	config, err := NewConfigFromFile(configFile)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"cluster": "test-cluster",
+		"region":  "local",
+		"owner":   `team: "logs" #1`,
+		"cert":    "-----BEGIN-----\nkey: value # not a comment\n-----END-----",
+	}, config.Labels)
+	require.Equal(t, "secret-token", config.Pipeline[0].Builder.(*plugin.Config).Parameters["value"])
+	require.Equal(t, helper.OutputIDs{"${env:STANZA_TEST_CLUSTER}"}, config.Pipeline[1].Builder.(*noop.NoopOperatorConfig).OutputIDs)
+	require.Equal(t, Secrets{
+		"secret-token":    "${file:token}",
+		`team: "logs" #1`: "${env:secret:STANZA_TEST_OWNER}",
+		"-----BEGIN-----\nkey: value # not a comment\n-----END-----": "${file:cert}",
+	}, config.Secrets)
+}
+
+func TestNewConfigFromFileInterpolatedInvalid(t *testing.T) {
+	tempDir := testutil.NewTempDir(t)
+	t.Setenv("STANZA_TEST_TOKEN", "secret-token")
+
+	configFile := filepath.Join(tempDir, "config.yaml")
+	require.NoError(t, ioutil.WriteFile(configFile, []byte("pipeline: ${env:STANZA_TEST_MISSING}\n"), 0600))
+	_, err := NewConfigFromFile(configFile)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "environment variable 'STANZA_TEST_MISSING' is not set")
+
+	// The error of an invalid value does not contain the substituted value
+	require.NoError(t, ioutil.WriteFile(configFile, []byte("pipeline: ${env:secret:STANZA_TEST_TOKEN}\n"), 0600))
+	_, err = NewConfigFromFile(configFile)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "line 1: cannot unmarshal !!str `...`")
+	require.NotContains(t, err.Error(), "secret")
+
+	require.NoError(t, ioutil.WriteFile(configFile, []byte("pipeline: [${env:secret:STANZA_TEST_TOKEN}]\n"), 0600))
+	_, err = NewConfigFromFile(configFile)
+	require.Error(t, err)
+	require.NotContains(t, err.Error(), "secret")
+}
+
+func TestMergeConfigsSecrets(t *testing.T) {
+	config1 := &Config{Secrets: Secrets{"first-value": "${env:FIRST}"}}
+	config2 := &Config{Secrets: Secrets{"second-value": "${env:SECOND}"}}
+
+	config := mergeConfigs(mergeConfigs(&Config{}, config1), config2)
+	require.Equal(t, Secrets{
+		"first-value":  "${env:FIRST}",
+		"second-value": "${env:SECOND}",
+	}, config.Secrets)
+}
@@ -0,0 +1,197 @@
+package agent
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// envNameRegex matches the names of environment variables that can be referenced in configs
+var envNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Secrets maps the values that were substituted into config files to the references they replaced
+type Secrets map[string]string
+
+// interpolate replaces the references to environment variables and files in the values of a config
+// file. References look like `${env:NAME}`, `${env:NAME:-default}`, `${env:secret:NAME}` or `${file:/path}`,
+// and `$${` is replaced with a literal `${`. Relative file paths are relative to the directory of the config
+// file. Other uses of `${` are kept as they are. The values of files and of environment variables that are
+// marked with `secret:` are added to secrets.
+//
+// The references are replaced in the scalars of the parsed document rather than in its text, so that
+// references in comments are ignored, and values that contain newlines or characters that YAML treats
+// specially do not change the structure of the document. The contents are returned as they are if
+// they contain no references, or cannot be parsed, so that parsing them reports the error.
+func interpolate(contents []byte, dir string, secrets Secrets) ([]byte, error) {
+	if !bytes.Contains(contents, []byte("${")) {
+		return contents, nil
+	}
+
+	var document yaml.Node
+	if err := yaml.Unmarshal(contents, &document); err != nil {
+		return contents, nil
+	}
+
+	changed, err := interpolateNode(&document, dir, secrets)
+	if err != nil {
+		return nil, err
+	}
+	if !changed {
+		return contents, nil
+	}
+
+	var result bytes.Buffer
+	encoder := yaml.NewEncoder(&result)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&document); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return result.Bytes(), nil
+}
+
+// interpolateNode replaces the references in the scalars of a node and its children, and
+// returns true if a scalar changed
+func interpolateNode(node *yaml.Node, dir string, secrets Secrets) (bool, error) {
+	if node.Kind != yaml.ScalarNode {
+		changed := false
+		for _, child := range node.Content {
+			childChanged, err := interpolateNode(child, dir, secrets)
+			if err != nil {
+				return false, err
+			}
+			changed = changed || childChanged
+		}
+		return changed, nil
+	}
+
+	value, err := substitute(node.Value, dir, secrets)
+	if err != nil {
+		return false, fmt.Errorf("line %d: %s", node.Line, err)
+	}
+	if value == node.Value {
+		return false, nil
+	}
+
+	node.Value = value
+	if node.Style&(yaml.SingleQuotedStyle|yaml.DoubleQuotedStyle|yaml.LiteralStyle|yaml.FoldedStyle) == 0 && node.Style&yaml.TaggedStyle == 0 {
+		// A plain value is resolved as if it had been written into the config, so that numbers and
+		// booleans can be referenced. The encoder quotes it if it cannot be written as a plain value.
+		node.Tag = ""
+	}
+	return true, nil
+}
+
+// substitute replaces the references in a value of a config file
+func substitute(value string, dir string, secrets Secrets) (string, error) {
+	var result strings.Builder
+	for {
+		start := strings.Index(value, "${")
+		if start == -1 {
+			result.WriteString(value)
+			return result.String(), nil
+		}
+
+		// An escaped reference is written without the escaping dollar sign
+		if start > 0 && value[start-1] == '$' {
+			result.WriteString(value[:start-1])
+			result.WriteString("${")
+			value = value[start+2:]
+			continue
+		}
+
+		result.WriteString(value[:start])
+		rest := value[start+2:]
+		if !strings.HasPrefix(rest, "env:") && !strings.HasPrefix(rest, "file:") {
+			result.WriteString("${")
+			value = rest
+			continue
+		}
+
+		end := strings.IndexByte(rest, '}')
+		if end == -1 || strings.IndexByte(rest[:end], '\n') != -1 {
+			return "", fmt.Errorf("reference '${%s' is not closed with '}'", firstLine(rest))
+		}
+
+		reference := value[start : start+end+3]
+		resolved, secret, err := resolve(rest[:end], dir)
+		if err != nil {
+			return "", fmt.Errorf("resolve '%s': %s", reference, err)
+		}
+		if secret && resolved != "" {
+			secrets[resolved] = reference
+		}
+		result.WriteString(resolved)
+		value = rest[end+1:]
+	}
+}
+
+// resolve returns the value of a reference without its `${` and `}`, and whether the value is a
+// secret. The contents of files are secrets, and environment variables are only secrets if their
+// name is marked with `secret:`, so that ordinary values such as `prod` are not redacted.
+func resolve(reference string, dir string) (value string, secret bool, err error) {
+	if path := strings.TrimPrefix(reference, "file:"); path != reference {
+		if path == "" {
+			return "", false, fmt.Errorf("missing file path")
+		}
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		contents, err := ioutil.ReadFile(path) // #nosec - files are referenced by the user specified config
+		if err != nil {
+			return "", false, err
+		}
+		return strings.TrimRight(string(contents), "\r\n"), true, nil
+	}
+
+	name := strings.TrimPrefix(reference, "env:")
+	name, fallback, hasFallback := cut(name, ":-")
+	name, isSecret := cutPrefix(name, "secret:")
+	if !envNameRegex.MatchString(name) {
+		return "", false, fmt.Errorf("'%s' is not a valid environment variable name", name)
+	}
+
+	value, ok := os.LookupEnv(name)
+	switch {
+	case value != "":
+		return value, isSecret, nil
+	case hasFallback:
+		return fallback, false, nil
+	case ok:
+		return "", isSecret, nil
+	default:
+		return "", false, fmt.Errorf("environment variable '%s' is not set", name)
+	}
+}
+
+// cut slices s around the first instance of sep
+func cut(s, sep string) (before, after string, found bool) {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
+
+// cutPrefix returns s without the prefix, and whether s started with it
+func cutPrefix(s, prefix string) (after string, found bool) {
+	if !strings.HasPrefix(s, prefix) {
+		return s, false
+	}
+	return s[len(prefix):], true
+}
+
+// firstLine returns the first line of a value
+func firstLine(value string) string {
+	if i := strings.IndexByte(value, '\n'); i >= 0 {
+		return value[:i]
+	}
+	return value
+}
@@ -0,0 +1,208 @@
+package agent
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/observiq/stanza/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInterpolate(t *testing.T) {
+	tempDir := testutil.NewTempDir(t)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(tempDir, "token"), []byte("file-token\n"), 0600))
+	t.Setenv("STANZA_TEST_HOST", "example.com")
+	t.Setenv("STANZA_TEST_EMPTY", "")
+	t.Setenv("STANZA_TEST_PORT", "9200")
+	t.Setenv("STANZA_TEST_SPECIAL", `a: b # "c"`)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(tempDir, "cert"), []byte("line one\nline two: value\n"), 0600))
+
+	cases := []struct {
+		name     string
+		contents string
+		expected string
+		secrets  Secrets
+	}{
+		{
+			"Plain",
+			"host: localhost",
+			"host: localhost",
+			Secrets{},
+		},
+		{
+			"Env",
+			"host: ${env:STANZA_TEST_HOST}:9200",
+			"host: example.com:9200\n",
+			Secrets{},
+		},
+		{
+			"EnvSecret",
+			"host: ${env:secret:STANZA_TEST_HOST}:9200",
+			"host: example.com:9200\n",
+			Secrets{"example.com": "${env:secret:STANZA_TEST_HOST}"},
+		},
+		{
+			"EnvDefault",
+			"host: ${env:STANZA_TEST_MISSING:-localhost}",
+			"host: localhost\n",
+			Secrets{},
+		},
+		{
+			"EnvDefaultEmpty",
+			"host: ${env:STANZA_TEST_EMPTY:-localhost}",
+			"host: localhost\n",
+			Secrets{},
+		},
+		{
+			"EnvDefaultSet",
+			"host: ${env:STANZA_TEST_HOST:-localhost}",
+			"host: example.com\n",
+			Secrets{},
+		},
+		{
+			"EnvSecretDefaultSet",
+			"host: ${env:secret:STANZA_TEST_HOST:-localhost}",
+			"host: example.com\n",
+			Secrets{"example.com": "${env:secret:STANZA_TEST_HOST:-localhost}"},
+		},
+		{
+			"EnvSecretDefault",
+			"host: ${env:secret:STANZA_TEST_MISSING:-localhost}",
+			"host: localhost\n",
+			Secrets{},
+		},
+		{
+			"EnvEmpty",
+			"host: '${env:STANZA_TEST_EMPTY}'",
+			"host: ''\n",
+			Secrets{},
+		},
+		{
+			"AbsoluteFile",
+			"token: ${file:" + filepath.Join(tempDir, "token") + "}",
+			"token: file-token\n",
+			Secrets{"file-token": "${file:" + filepath.Join(tempDir, "token") + "}"},
+		},
+		{
+			"RelativeFile",
+			"token: ${file:token}",
+			"token: file-token\n",
+			Secrets{"file-token": "${file:token}"},
+		},
+		{
+			"Escaped",
+			"value: $${env:STANZA_TEST_HOST} and $${file:token}",
+			"value: ${env:STANZA_TEST_HOST} and ${file:token}\n",
+			Secrets{},
+		},
+		{
+			"OtherReferences",
+			"expr: ${not_a_reference} and $ and ${",
+			"expr: ${not_a_reference} and $ and ${",
+			Secrets{},
+		},
+		{
+			"Number",
+			"port: ${env:STANZA_TEST_PORT}",
+			"port: 9200\n",
+			Secrets{},
+		},
+		{
+			"SpecialCharacters",
+			"password: ${env:secret:STANZA_TEST_SPECIAL}",
+			"password: 'a: b # \"c\"'\n",
+			Secrets{`a: b # "c"`: "${env:secret:STANZA_TEST_SPECIAL}"},
+		},
+		{
+			"QuotedSpecialCharacters",
+			`password: "${env:secret:STANZA_TEST_SPECIAL}"`,
+			`password: "a: b # \"c\""` + "\n",
+			Secrets{`a: b # "c"`: "${env:secret:STANZA_TEST_SPECIAL}"},
+		},
+		{
+			"MultiLineFile",
+			"cert: ${file:cert}\nhost: localhost",
+			"cert: |-\n  line one\n  line two: value\nhost: localhost\n",
+			Secrets{"line one\nline two: value": "${file:cert}"},
+		},
+		{
+			"CommentedOutReference",
+			"# token: ${env:STANZA_TEST_MISSING}\nhost: localhost # ${env:STANZA_TEST_MISSING}",
+			"# token: ${env:STANZA_TEST_MISSING}\nhost: localhost # ${env:STANZA_TEST_MISSING}",
+			Secrets{},
+		},
+		{
+			"CommentedOutReferenceWithOtherReference",
+			"# token: ${env:STANZA_TEST_MISSING}\nhost: ${env:STANZA_TEST_HOST}",
+			"# token: ${env:STANZA_TEST_MISSING}\nhost: example.com\n",
+			Secrets{},
+		},
+		{
+			"Key",
+			"${env:STANZA_TEST_HOST}: value",
+			"example.com: value\n",
+			Secrets{},
+		},
+		{
+			"Multiple",
+			"url: https://${env:STANZA_TEST_HOST}/?token=${file:token}",
+			"url: https://example.com/?token=file-token\n",
+			Secrets{"file-token": "${file:token}"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			secrets := Secrets{}
+			result, err := interpolate([]byte(tc.contents), tempDir, secrets)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, string(result))
+			require.Equal(t, tc.secrets, secrets)
+		})
+	}
+}
+
+func TestInterpolateInvalid(t *testing.T) {
+	tempDir := testutil.NewTempDir(t)
+
+	cases := []struct {
+		name     string
+		contents string
+		expected string
+	}{
+		{
+			"MissingEnv",
+			"host: ${env:STANZA_TEST_MISSING}",
+			"environment variable 'STANZA_TEST_MISSING' is not set",
+		},
+		{
+			"InvalidEnvName",
+			"host: ${env:NOT-VALID}",
+			"'NOT-VALID' is not a valid environment variable name",
+		},
+		{
+			"MissingFile",
+			"token: ${file:missing}",
+			"resolve '${file:missing}'",
+		},
+		{
+			"EmptyFile",
+			"token: ${file:}",
+			"missing file path",
+		},
+		{
+			"NotClosed",
+			"host: ${env:STANZA_TEST_HOST\nport: 9200}",
+			"reference '${env:STANZA_TEST_HOST' is not closed with '}'",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := interpolate([]byte(tc.contents), tempDir, Secrets{})
+			require.Error(t, err)
+			require.Contains(t, err.Error(), tc.expected)
+		})
+	}
+}
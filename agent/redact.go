@@ -0,0 +1,205 @@
+package agent
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/observiq/stanza/errors"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// minSecretLength is the length below which secrets are not redacted, because
+// replacing every occurrence of a short value would make messages unreadable
+const minSecretLength = 4
+
+// Redactor replaces the secrets that were substituted into config files with the references
+// they replaced, so that they do not appear in logs and errors
+type Redactor struct {
+	mux      sync.RWMutex
+	secrets  Secrets
+	replacer *strings.Replacer
+}
+
+// NewRedactor creates a redactor for the secrets of a config
+func NewRedactor(secrets Secrets) *Redactor {
+	r := &Redactor{secrets: Secrets{}}
+	r.Add(secrets)
+	return r
+}
+
+// Add adds secrets to the redactor
+func (r *Redactor) Add(secrets Secrets) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	for value, reference := range secrets {
+		if len(value) >= minSecretLength {
+			r.secrets[value] = reference
+		}
+	}
+
+	// The longest values are replaced first, so that no part of them is left when a
+	// value contains another
+	values := make([]string, 0, len(r.secrets))
+	for value := range r.secrets {
+		values = append(values, value)
+	}
+	sort.Slice(values, func(i, j int) bool {
+		if len(values[i]) != len(values[j]) {
+			return len(values[i]) > len(values[j])
+		}
+		return values[i] < values[j]
+	})
+
+	oldnew := make([]string, 0, 2*len(values))
+	for _, value := range values {
+		oldnew = append(oldnew, value, r.secrets[value])
+	}
+	r.replacer = strings.NewReplacer(oldnew...)
+}
+
+// Redact replaces the secrets in text. A nil redactor returns the text as it is.
+func (r *Redactor) Redact(text string) string {
+	if r == nil {
+		return text
+	}
+
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	if len(r.secrets) == 0 {
+		return text
+	}
+	return r.replacer.Replace(text)
+}
+
+// empty returns true if the redactor has no secrets to replace
+func (r *Redactor) empty() bool {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	return len(r.secrets) == 0
+}
+
+// RedactError replaces the secrets in the description, suggestion and details of an error
+func (r *Redactor) RedactError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	agentErr, ok := err.(errors.AgentError)
+	if !ok {
+		return errors.NewError(r.Redact(err.Error()), "")
+	}
+
+	redacted := errors.NewError(r.Redact(agentErr.Description), r.Redact(agentErr.Suggestion))
+	for key, value := range agentErr.Details {
+		redacted.Details[key] = r.Redact(value)
+	}
+	return redacted
+}
+
+// WrapLogger returns a logger that replaces the secrets in the messages and fields it logs
+func (r *Redactor) WrapLogger(logger *zap.SugaredLogger) *zap.SugaredLogger {
+	return logger.Desugar().WithOptions(
+		zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+			return &redactingCore{Core: core, redactor: r}
+		}),
+	).Sugar()
+}
+
+// redactingCore is a zapcore.Core that redacts entries before writing them to the core it wraps
+type redactingCore struct {
+	zapcore.Core
+	redactor *Redactor
+}
+
+// With adds redacted fields to the core
+func (c *redactingCore) With(fields []zapcore.Field) zapcore.Core {
+	return &redactingCore{
+		Core:     c.Core.With(c.redactor.redactFields(fields)),
+		redactor: c.redactor,
+	}
+}
+
+// Check adds the core to the checked entry if its level is enabled
+func (c *redactingCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+// Write redacts the message and fields of an entry, and writes it to the wrapped core
+func (c *redactingCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	ent.Message = c.redactor.Redact(ent.Message)
+	return c.Core.Write(ent, c.redactor.redactFields(fields))
+}
+
+// redactFields redacts the strings of fields. Fields that are not strings or numbers are
+// encoded first, so that errors and objects are redacted as they would be logged.
+func (r *Redactor) redactFields(fields []zapcore.Field) []zapcore.Field {
+	if r.empty() {
+		return fields
+	}
+
+	redacted := make([]zapcore.Field, 0, len(fields))
+	for _, field := range fields {
+		switch field.Type {
+		case zapcore.StringType:
+			field.String = r.Redact(field.String)
+			redacted = append(redacted, field)
+		case zapcore.ByteStringType, zapcore.StringerType, zapcore.ErrorType,
+			zapcore.ObjectMarshalerType, zapcore.ArrayMarshalerType, zapcore.ReflectType:
+			encoder := zapcore.NewMapObjectEncoder()
+			field.AddTo(encoder)
+
+			keys := make([]string, 0, len(encoder.Fields))
+			for key := range encoder.Fields {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				redacted = append(redacted, zap.Any(key, r.redactValue(encoder.Fields[key])))
+			}
+		default:
+			redacted = append(redacted, field)
+		}
+	}
+	return redacted
+}
+
+// redactValue redacts the strings of a value that was encoded by a zapcore.MapObjectEncoder
+func (r *Redactor) redactValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		return r.Redact(v)
+	case map[string]interface{}:
+		redacted := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			redacted[key] = r.redactValue(value)
+		}
+		return redacted
+	case []interface{}:
+		redacted := make([]interface{}, 0, len(v))
+		for _, value := range v {
+			redacted = append(redacted, r.redactValue(value))
+		}
+		return redacted
+	case nil, bool, float64:
+		return v
+	}
+
+	// Reflected values are kept as they are, unless they contain a secret when they are marshalled
+	raw, err := json.Marshal(value)
+	if err != nil || r.Redact(string(raw)) == string(raw) {
+		return value
+	}
+	var generic interface{}
+	if err := json.Unmarshal(raw, &generic); err != nil {
+		return value
+	}
+	return r.redactValue(generic)
+}
@@ -0,0 +1,78 @@
+package agent
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/observiq/stanza/errors"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestRedactorRedact(t *testing.T) {
+	redactor := NewRedactor(Secrets{
+		"secret-token":      "${env:TOKEN}",
+		"secret-token-long": "${file:/token}",
+		"abc":               "${env:SHORT}",
+	})
+
+	require.Equal(t, "token ${env:TOKEN}", redactor.Redact("token secret-token"))
+	require.Equal(t, "token ${file:/token}", redactor.Redact("token secret-token-long"))
+	require.Equal(t, "abc", redactor.Redact("abc"), "short values are not redacted")
+
+	redactor.Add(Secrets{"added-secret": "${env:ADDED}"})
+	require.Equal(t, "${env:ADDED}", redactor.Redact("added-secret"))
+
+	var empty *Redactor
+	require.Equal(t, "secret-token", empty.Redact("secret-token"))
+}
+
+func TestRedactorRedactError(t *testing.T) {
+	redactor := NewRedactor(Secrets{"secret-token": "${env:TOKEN}"})
+	require.NoError(t, redactor.RedactError(nil))
+
+	err := redactor.RedactError(fmt.Errorf("invalid token secret-token"))
+	require.Equal(t, "invalid token ${env:TOKEN}", err.Error())
+
+	err = redactor.RedactError(errors.NewError(
+		"invalid token secret-token",
+		"replace secret-token",
+		"token", "secret-token",
+	))
+	agentErr, ok := err.(errors.AgentError)
+	require.True(t, ok)
+	require.Equal(t, "invalid token ${env:TOKEN}", agentErr.Description)
+	require.Equal(t, "replace ${env:TOKEN}", agentErr.Suggestion)
+	require.Equal(t, "${env:TOKEN}", agentErr.Details["token"])
+}
+
+func TestRedactorWrapLogger(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	redactor := NewRedactor(Secrets{"secret-token": "${env:TOKEN}"})
+	logger := redactor.WrapLogger(zap.New(core).Sugar()).With("url", "https://host/?token=secret-token")
+
+	logger.Errorw("Failed with secret-token",
+		"token", "secret-token",
+		"count", 1,
+		zap.Error(fmt.Errorf("invalid secret-token")),
+		zap.Any("agent_error", errors.NewError("invalid", "", "token", "secret-token")),
+		zap.Any("config", map[string]interface{}{"token": "secret-token"}),
+	)
+
+	entries := logs.AllUntimed()
+	require.Len(t, entries, 1)
+	require.Equal(t, "Failed with ${env:TOKEN}", entries[0].Message)
+	require.Equal(t, map[string]interface{}{
+		"url":   "https://host/?token=${env:TOKEN}",
+		"token": "${env:TOKEN}",
+		"count": int64(1),
+		"error": "invalid ${env:TOKEN}",
+		"agent_error": map[string]interface{}{
+			"description": "invalid",
+			"details":     map[string]interface{}{"token": "${env:TOKEN}"},
+		},
+		"config": map[string]interface{}{"token": "${env:TOKEN}"},
+	}, entries[0].ContextMap())
+}
@@ -0,0 +1,145 @@
+package agent
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/observiq/stanza/errors"
+	"github.com/observiq/stanza/pipeline"
+	"go.uber.org/zap"
+)
+
+// Reload reads the config files of the agent again and applies the changes to its pipeline.
+// The operators whose config did not change keep running, so they keep their state. If the
+// new config is invalid, the agent keeps running the previous config and the error is returned.
+func (a *LogAgent) Reload() error {
+	a.reloadMux.Lock()
+	defer a.reloadMux.Unlock()
+
+	if a.stopped {
+		return errors.NewError("agent cannot be reloaded, because it is stopped", "")
+	}
+	if len(a.configFiles) == 0 {
+		return errors.NewError("agent cannot be reloaded, because it was not built from config files", "")
+	}
+	running, ok := a.pipeline.(*pipeline.DirectedPipeline)
+	if !ok {
+		return errors.NewError("agent cannot be reloaded, because its pipeline cannot be reloaded", "")
+	}
+
+	// The hash is updated before the config is read, so that an invalid config is only reported once
+	hash, err := hashConfigFiles(a.configFiles)
+	if err != nil {
+		return errors.Wrap(err, "read config files")
+	}
+	a.configHash = hash
+
+	config, err := NewConfigFromGlobs(a.configFiles)
+	if err != nil {
+		return errors.Wrap(err, "read configs from globs")
+	}
+
+	a.redactor.Add(config.Secrets)
+
+	atomic.StoreInt32(&a.reloading, 1)
+	next, changes, err := running.Reload(config.Pipeline)
+	if next != nil {
+		a.pipelineMux.Lock()
+		a.pipeline = next
+		a.pipelineMux.Unlock()
+	}
+	atomic.StoreInt32(&a.reloading, 0)
+	if err != nil {
+		return a.redactor.RedactError(err)
+	}
+
+	if !sameJSON(a.config.DeadLetter, config.DeadLetter) {
+		a.Warn("Changes to 'dead_letter' take effect when the agent is restarted")
+	}
+	if !sameJSON(globals(a.config), globals(config)) {
+		a.Warn("Changes to 'agent', 'resource', 'labels' and 'defaults' take effect when the agent is restarted")
+	}
+	config.DeadLetter = a.config.DeadLetter
+	config.Agent, config.Resource, config.Labels, config.Defaults = a.config.Agent, a.config.Resource, a.config.Labels, a.config.Defaults
+	a.config = config
+
+	if err := connectDeadLetter(a.deadLetter, a.buildContext, next.Operators()); err != nil {
+		a.Errorw("Failed to connect dead-letter queue", zap.Any("error", err))
+	}
+
+	a.Infow("Reloaded config", "started", changes.Started, "stopped", changes.Stopped, "kept", len(changes.Kept))
+	return nil
+}
+
+// watchConfigFiles reloads the agent whenever the contents of its config files change
+func (a *LogAgent) watchConfigFiles(ctx context.Context) {
+	defer a.watchWg.Done()
+
+	ticker := time.NewTicker(a.reloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		hash, err := hashConfigFiles(a.configFiles)
+		if err != nil {
+			a.Warnw("Failed to read config files", zap.Error(err))
+			continue
+		}
+
+		a.reloadMux.Lock()
+		changed := hash != a.configHash
+		a.reloadMux.Unlock()
+		if !changed {
+			continue
+		}
+
+		a.Info("Config files changed, reloading config")
+		if err := a.Reload(); err != nil {
+			a.Errorw("Failed to reload config, the previous config keeps running", zap.Any("error", err))
+		}
+	}
+}
+
+// hashConfigFiles returns a hash of the paths and contents of the files matching the globs
+func hashConfigFiles(globs []string) (string, error) {
+	hash := sha256.New()
+	for _, glob := range globs {
+		matches, err := filepath.Glob(glob)
+		if err != nil {
+			return "", err
+		}
+		for _, path := range matches {
+			contents, err := ioutil.ReadFile(path) // #nosec - configs load based on user specified directory
+			if err != nil {
+				return "", err
+			}
+			_, _ = hash.Write([]byte(path))
+			_, _ = hash.Write([]byte{0})
+			_, _ = hash.Write(contents)
+			_, _ = hash.Write([]byte{0})
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// globals returns the sections of a config that apply to the whole agent
+func globals(c *Config) []interface{} {
+	return []interface{}{c.Agent, c.Resource, c.Labels, c.Defaults}
+}
+
+// sameJSON returns true if two sections of configs are the same
+func sameJSON(a, b interface{}) bool {
+	rawA, errA := json.Marshal(a)
+	rawB, errB := json.Marshal(b)
+	return errA == nil && errB == nil && string(rawA) == string(rawB)
+}
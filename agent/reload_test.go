@@ -0,0 +1,234 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/observiq/stanza/entry"
+	"github.com/observiq/stanza/operator"
+	_ "github.com/observiq/stanza/operator/builtin/input/generate"
+	_ "github.com/observiq/stanza/operator/builtin/output/drop"
+	_ "github.com/observiq/stanza/operator/builtin/output/forward"
+	_ "github.com/observiq/stanza/operator/builtin/transformer/add"
+	"github.com/observiq/stanza/testutil"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// writeReloadConfig writes a config whose second operator adds a label with the given value
+func writeReloadConfig(t *testing.T, path, value string) {
+	config := fmt.Sprintf(`
+pipeline:
+  - id: first
+    type: noop
+  - id: second
+    type: add
+    field: $labels.value
+    value: %s
+  - id: last
+    type: drop_output
+`, value)
+	require.NoError(t, ioutil.WriteFile(path, []byte(config), 0600))
+}
+
+// agentOperators returns the operators of the pipeline of an agent by id
+func agentOperators(a *LogAgent) map[string]operator.Operator {
+	a.reloadMux.Lock()
+	defer a.reloadMux.Unlock()
+
+	operators := make(map[string]operator.Operator)
+	for _, op := range a.pipeline.Operators() {
+		operators[op.ID()] = op
+	}
+	return operators
+}
+
+func newReloadAgent(t *testing.T, interval time.Duration) (*LogAgent, string) {
+	tempDir := testutil.NewTempDir(t)
+	configPath := filepath.Join(tempDir, "config.yaml")
+	writeReloadConfig(t, configPath, "before")
+
+	agent, err := NewBuilder(zap.NewNop().Sugar()).
+		WithConfigFiles([]string{configPath}).
+		WithDatabaseFile(filepath.Join(tempDir, "stanza.db")).
+		WithReloadInterval(interval).
+		Build()
+	require.NoError(t, err)
+	require.NoError(t, agent.Start())
+	return agent, configPath
+}
+
+func TestAgentReload(t *testing.T) {
+	t.Run("ChangedOperatorsAreReplaced", func(t *testing.T) {
+		agent, configPath := newReloadAgent(t, 0)
+		defer agent.Stop()
+		before := agentOperators(agent)
+
+		writeReloadConfig(t, configPath, "after")
+		require.NoError(t, agent.Reload())
+
+		after := agentOperators(agent)
+		require.NotEqual(t, before["$.second"], after["$.second"])
+		require.Equal(t, before["$.first"], after["$.first"], "operators that write to a replaced operator keep running")
+		require.Equal(t, []operator.Operator{after["$.second"]}, after["$.first"].Outputs())
+		require.Equal(t, before["$.last"], after["$.last"])
+	})
+
+	t.Run("InvalidConfigKeepsPipeline", func(t *testing.T) {
+		agent, configPath := newReloadAgent(t, 0)
+		defer agent.Stop()
+		before := agentOperators(agent)
+
+		require.NoError(t, ioutil.WriteFile(configPath, []byte("pipeline:\n  - type: missing\n"), 0600))
+		err := agent.Reload()
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "unsupported type 'missing'")
+		require.Equal(t, before, agentOperators(agent))
+	})
+
+	t.Run("WatchConfigFiles", func(t *testing.T) {
+		agent, configPath := newReloadAgent(t, 10*time.Millisecond)
+		defer agent.Stop()
+		before := agentOperators(agent)
+
+		writeReloadConfig(t, configPath, "after")
+		require.Eventually(t, func() bool {
+			return agentOperators(agent)["$.second"] != before["$.second"]
+		}, 10*time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("Stopped", func(t *testing.T) {
+		agent, _ := newReloadAgent(t, 0)
+		require.NoError(t, agent.Stop())
+		require.Error(t, agent.Reload())
+	})
+
+	t.Run("WithConfig", func(t *testing.T) {
+		agent, err := NewBuilder(zap.NewNop().Sugar()).
+			WithConfig(&Config{}).
+			Build()
+		require.NoError(t, err)
+		defer agent.Stop()
+		err = agent.Reload()
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "not built from config files")
+	})
+}
+
+// forwardReceiver is a forward server that counts the entries it accepts, or rejects every
+// request if reject is set
+type forwardReceiver struct {
+	reject   bool
+	mux      sync.Mutex
+	requests int
+	records  map[string]int
+}
+
+func (f *forwardReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var entries []*entry.Entry
+	if err := json.NewDecoder(r.Body).Decode(&entries); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.requests++
+	if f.reject {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	for _, e := range entries {
+		f.records[fmt.Sprint(e.Record)]++
+	}
+}
+
+func (f *forwardReceiver) count(record string) int {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return f.records[record]
+}
+
+func (f *forwardReceiver) requested() bool {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return f.requests > 0
+}
+
+// writeBufferedConfig writes a config that generates entries with the given record, and
+// forwards them through a buffer with the given max delay
+func writeBufferedConfig(t *testing.T, path, address, buffer, record, delay string) {
+	config := fmt.Sprintf(`
+pipeline:
+  - id: generate
+    type: generate_input
+    count: 5
+    entry:
+      record: %s
+  - id: forward
+    type: forward_output
+    address: %s
+    buffer:
+      %s
+      max_delay: %s
+`, record, address, buffer, delay)
+	require.NoError(t, ioutil.WriteFile(path, []byte(config), 0600))
+}
+
+func TestAgentReloadBufferedOutput(t *testing.T) {
+	buffers := map[string]func(tempDir string) string{
+		"Memory": func(string) string { return "type: memory" },
+		"Disk": func(tempDir string) string {
+			return fmt.Sprintf("type: disk\n      path: %s", filepath.Join(tempDir, "buffer"))
+		},
+	}
+
+	for name, buffer := range buffers {
+		t.Run(name, func(t *testing.T) {
+			rejecter := &forwardReceiver{reject: true}
+			rejecting := httptest.NewServer(rejecter)
+			defer rejecting.Close()
+			receiver := &forwardReceiver{records: make(map[string]int)}
+			receiving := httptest.NewServer(receiver)
+			defer receiving.Close()
+
+			tempDir := testutil.NewTempDir(t)
+			configPath := filepath.Join(tempDir, "config.yaml")
+			newAgent := func() *LogAgent {
+				agent, err := NewBuilder(zap.NewNop().Sugar()).
+					WithConfigFiles([]string{configPath}).
+					WithDatabaseFile(filepath.Join(tempDir, "stanza.db")).
+					Build()
+				require.NoError(t, err)
+				require.NoError(t, agent.Start())
+				return agent
+			}
+
+			// The entries stay in the buffer, because every request is rejected
+			writeBufferedConfig(t, configPath, rejecting.URL, buffer(tempDir), "before", "10ms")
+			agent := newAgent()
+			require.Eventually(t, rejecter.requested, 10*time.Second, 10*time.Millisecond)
+
+			writeBufferedConfig(t, configPath, rejecting.URL, buffer(tempDir), "before", "20ms")
+			require.NoError(t, agent.Reload())
+			require.NoError(t, agent.Stop())
+
+			// After a restart, the entries of the buffer are sent to a server that accepts them
+			writeBufferedConfig(t, configPath, receiving.URL, buffer(tempDir), "after", "20ms")
+			agent = newAgent()
+			defer agent.Stop()
+
+			require.Eventually(t, func() bool {
+				return receiver.count("before") >= 5 && receiver.count("after") >= 5
+			}, 10*time.Second, 10*time.Millisecond)
+			require.Equal(t, 5, receiver.count("before"), "no entries are lost or sent twice")
+		})
+	}
+}
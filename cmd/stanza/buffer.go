@@ -0,0 +1,352 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"text/tabwriter"
+	"time"
+
+	"github.com/antonmedv/expr"
+	"github.com/antonmedv/expr/vm"
+	"github.com/observiq/stanza/agent"
+	"github.com/observiq/stanza/database"
+	"github.com/observiq/stanza/entry"
+	"github.com/observiq/stanza/operator"
+	"github.com/observiq/stanza/operator/buffer"
+	"github.com/observiq/stanza/operator/helper"
+	"github.com/observiq/stanza/plugin"
+	"github.com/spf13/cobra"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// errStopDump stops reading entries once the limit of a dump is reached
+var errStopDump = fmt.Errorf("stop dump")
+
+// BufferDumpFlags are the flags of the buffer dump command
+type BufferDumpFlags struct {
+	Expr  string
+	Limit int
+}
+
+// NewBufferCmd returns the root command for inspecting and maintaining the buffers of outputs
+func NewBufferCmd(rootFlags *RootFlags) *cobra.Command {
+	buffer := &cobra.Command{
+		Use:   "buffer",
+		Short: "Inspect and maintain the buffers of outputs while the agent is stopped",
+		Args:  cobra.NoArgs,
+		// The subcommands use the config files and database of the root flags
+		PersistentPreRunE: withSettings(rootFlags),
+	}
+
+	buffer.AddCommand(NewBufferStatsCmd(rootFlags))
+	buffer.AddCommand(NewBufferDumpCmd(rootFlags))
+	buffer.AddCommand(NewBufferPurgeCmd(rootFlags))
+	buffer.AddCommand(NewBufferMigrateCmd(rootFlags))
+
+	return buffer
+}
+
+// NewBufferStatsCmd returns the command for showing the entries stored in buffers
+func NewBufferStatsCmd(rootFlags *RootFlags) *cobra.Command {
+	return &cobra.Command{
+		Use:   "stats [operator_ids]",
+		Short: "Show the entries stored in the buffers of outputs",
+		Args:  cobra.ArbitraryArgs,
+		Run: func(command *cobra.Command, args []string) {
+			exitOnErr("Failed to read buffer stats", runBufferStats(rootFlags, args, time.Now()))
+		},
+	}
+}
+
+// NewBufferDumpCmd returns the command for printing the entries stored in a buffer
+func NewBufferDumpCmd(rootFlags *RootFlags) *cobra.Command {
+	flags := &BufferDumpFlags{}
+
+	dump := &cobra.Command{
+		Use:   "dump operator_id",
+		Short: "Print the entries stored in the buffer of an output as JSON lines",
+		Args:  cobra.ExactArgs(1),
+		Run: func(command *cobra.Command, args []string) {
+			exitOnErr("Failed to dump buffer", runBufferDump(rootFlags, args[0], flags))
+		},
+	}
+
+	dump.Flags().StringVar(&flags.Expr, "expr", "", "only print entries that match this expression")
+	dump.Flags().IntVar(&flags.Limit, "limit", 0, "print at most this many entries (0 prints every entry)")
+
+	return dump
+}
+
+// NewBufferPurgeCmd returns the command for removing the entries stored in a buffer
+func NewBufferPurgeCmd(rootFlags *RootFlags) *cobra.Command {
+	return &cobra.Command{
+		Use:   "purge operator_id",
+		Short: "Remove every entry stored in the buffer of an output",
+		Args:  cobra.ExactArgs(1),
+		Run: func(command *cobra.Command, args []string) {
+			exitOnErr("Failed to purge buffer", runBufferPurge(rootFlags, args[0]))
+		},
+	}
+}
+
+// NewBufferMigrateCmd returns the command for moving entries between buffers
+func NewBufferMigrateCmd(rootFlags *RootFlags) *cobra.Command {
+	var from string
+
+	migrate := &cobra.Command{
+		Use:   "migrate operator_id --from buffer_config",
+		Short: "Move the entries stored by a previous buffer of an output into its configured buffer",
+		Args:  cobra.ExactArgs(1),
+		Run: func(command *cobra.Command, args []string) {
+			exitOnErr("Failed to migrate buffer", runBufferMigrate(rootFlags, args[0], from))
+		},
+	}
+
+	migrate.Flags().StringVar(&from, "from", "", "the previous buffer config of the output as YAML, such as '{type: memory}'")
+
+	return migrate
+}
+
+func runBufferStats(rootFlags *RootFlags, operatorIDs []string, now time.Time) error {
+	bc, operators, closeDB, err := loadBuffered(rootFlags)
+	if err != nil {
+		return err
+	}
+	defer closeDB()
+
+	if len(operatorIDs) > 0 {
+		selected := make([]buffer.Buffered, 0, len(operatorIDs))
+		for _, id := range operatorIDs {
+			op, err := findBuffered(operators, id)
+			if err != nil {
+				return err
+			}
+			selected = append(selected, op)
+		}
+		operators = selected
+	}
+
+	w := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "OPERATOR\tTYPE\tENTRIES\tBYTES\tOLDEST\tDEAD RANGE")
+	for _, op := range operators {
+		stats, err := offlineStats(op, bc)
+		if err != nil {
+			return fmt.Errorf("%s: %s", op.ID(), err)
+		}
+
+		for _, s := range stats {
+			typ := s.Type
+			if s.Lane != "" {
+				typ += " (lane " + s.Lane + ")"
+			}
+			if s.Spill {
+				typ += " (spill)"
+			}
+			oldest := "-"
+			if s.Entries > 0 {
+				oldest = now.Sub(s.Oldest).Round(time.Second).String()
+			}
+			deadRange := "-"
+			if s.Type == "disk" {
+				deadRange = fmt.Sprint(s.DeadRangeBytes)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\t%s\n", op.ID(), typ, s.Entries, s.Bytes, oldest, deadRange)
+		}
+	}
+	return w.Flush()
+}
+
+// offlineStats opens the buffer of an operator and returns its stats
+func offlineStats(op buffer.Buffered, bc operator.BuildContext) ([]buffer.OfflineStats, error) {
+	offline, err := buffer.OpenOffline(op.Buffer(), bc, op.ID())
+	if err != nil {
+		return nil, err
+	}
+	stats, err := offline.Stats()
+	if closeErr := offline.Close(); err == nil {
+		err = closeErr
+	}
+	return stats, err
+}
+
+func runBufferDump(rootFlags *RootFlags, operatorID string, flags *BufferDumpFlags) error {
+	var program *vm.Program
+	if flags.Expr != "" {
+		var err error
+		program, err = expr.Compile(flags.Expr, expr.AsBool(), expr.AllowUndefinedVariables())
+		if err != nil {
+			return fmt.Errorf("compile expression '%s': %s", flags.Expr, err)
+		}
+	}
+
+	offline, closeDB, err := openBuffered(rootFlags, operatorID)
+	if err != nil {
+		return err
+	}
+	defer closeDB()
+
+	encoder := json.NewEncoder(stdout)
+	dumped := 0
+	err = offline.ForEach(func(e *entry.Entry) error {
+		if program != nil {
+			matches, err := matchEntry(program, e)
+			if err != nil || !matches {
+				return err
+			}
+		}
+		if err := encoder.Encode(e); err != nil {
+			return err
+		}
+		dumped++
+		if flags.Limit > 0 && dumped >= flags.Limit {
+			return errStopDump
+		}
+		return nil
+	})
+	if err == errStopDump {
+		err = nil
+	}
+	if closeErr := offline.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// matchEntry returns true if an entry matches an expression
+func matchEntry(program *vm.Program, e *entry.Entry) (bool, error) {
+	env := helper.GetExprEnv(e)
+	defer helper.PutExprEnv(env)
+
+	matches, err := vm.Run(program, env)
+	if err != nil {
+		return false, err
+	}
+	return matches.(bool), nil
+}
+
+func runBufferPurge(rootFlags *RootFlags, operatorID string) error {
+	offline, closeDB, err := openBuffered(rootFlags, operatorID)
+	if err != nil {
+		return err
+	}
+	defer closeDB()
+
+	purged, err := offline.Purge()
+	if closeErr := offline.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stdout, "Purged %d entries from %s\n", purged, operatorID)
+	return nil
+}
+
+func runBufferMigrate(rootFlags *RootFlags, operatorID string, from string) error {
+	if from == "" {
+		return fmt.Errorf("missing required flag --from")
+	}
+	var fromConfig buffer.Config
+	if err := yaml.UnmarshalStrict([]byte(from), &fromConfig); err != nil {
+		return fmt.Errorf("parse --from: %s", err)
+	}
+
+	bc, operators, closeDB, err := loadBuffered(rootFlags)
+	if err != nil {
+		return err
+	}
+	defer closeDB()
+
+	op, err := findBuffered(operators, operatorID)
+	if err != nil {
+		return err
+	}
+
+	src, err := buffer.OpenOffline(fromConfig, bc, op.ID())
+	if err != nil {
+		return fmt.Errorf("open previous buffer: %s", err)
+	}
+	dst, err := buffer.OpenOffline(op.Buffer(), bc, op.ID())
+	if err != nil {
+		_ = src.Close()
+		return fmt.Errorf("open configured buffer: %s", err)
+	}
+
+	migrated, err := src.MigrateTo(dst)
+	if closeErr := src.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stdout, "Migrated %d entries of %s\n", migrated, operatorID)
+	return nil
+}
+
+// openBuffered opens the buffer of an operator in the config. The returned function closes the database.
+func openBuffered(rootFlags *RootFlags, operatorID string) (*buffer.Offline, func(), error) {
+	bc, operators, closeDB, err := loadBuffered(rootFlags)
+	if err != nil {
+		return nil, nil, err
+	}
+	op, err := findBuffered(operators, operatorID)
+	if err != nil {
+		closeDB()
+		return nil, nil, err
+	}
+
+	offline, err := buffer.OpenOffline(op.Buffer(), bc, op.ID())
+	if err != nil {
+		closeDB()
+		return nil, nil, err
+	}
+	return offline, closeDB, nil
+}
+
+// loadBuffered reads the config, opens the database, and returns the context that buffers
+// are built with and the configs of the operators in the pipeline that have a buffer. The
+// buffers of operators in plugins are not returned. The returned function closes the database.
+func loadBuffered(rootFlags *RootFlags) (operator.BuildContext, []buffer.Buffered, func(), error) {
+	logger := newLogger(*rootFlags).Sugar()
+	if errs := plugin.RegisterPlugins(rootFlags.PluginDir, operator.DefaultRegistry); len(errs) != 0 {
+		logger.Errorw("Got errors parsing plugins", "errors", errs)
+	}
+
+	cfg, err := agent.NewConfigFromGlobs(rootFlags.ConfigFiles)
+	if err != nil {
+		_ = logger.Sync()
+		return operator.BuildContext{}, nil, nil, fmt.Errorf("read configs from glob: %s", err)
+	}
+	logger = agent.NewRedactor(cfg.Secrets).WrapLogger(logger)
+
+	var operators []buffer.Buffered
+	for _, op := range cfg.Pipeline {
+		if buffered, ok := op.Builder.(buffer.Buffered); ok {
+			operators = append(operators, buffered)
+		}
+	}
+
+	db, err := database.OpenDatabase(rootFlags.DatabaseFile)
+	if err != nil {
+		_ = logger.Sync()
+		return operator.BuildContext{}, nil, nil, fmt.Errorf("open database (stop the agent first): %s", err)
+	}
+
+	closeDB := func() {
+		_ = db.Close()
+		_ = logger.Sync()
+	}
+	return cfg.WithGlobals(operator.NewBuildContext(db, logger)), operators, closeDB, nil
+}
+
+// findBuffered returns the operator with the given id
+func findBuffered(operators []buffer.Buffered, id string) (buffer.Buffered, error) {
+	for _, op := range operators {
+		if op.ID() == id {
+			return op, nil
+		}
+	}
+	return nil, fmt.Errorf("operator '%s' does not exist or has no buffer", id)
+}
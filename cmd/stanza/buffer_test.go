@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/observiq/stanza/database"
+	"github.com/observiq/stanza/entry"
+	"github.com/observiq/stanza/operator"
+	"github.com/observiq/stanza/operator/buffer"
+	"github.com/observiq/stanza/testutil"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestBufferCmd(t *testing.T) {
+	tempDir := testutil.NewTempDir(t)
+	databasePath := filepath.Join(tempDir, "stanza.db")
+	diskPath := filepath.Join(tempDir, "buffer")
+	require.NoError(t, os.Mkdir(diskPath, 0700))
+
+	config := fmt.Sprintf(`
+pipeline:
+  - type: generate_input
+    entry:
+      record: test
+  - id: es
+    type: elastic_output
+    buffer:
+      type: disk
+      path: %s
+`, diskPath)
+	configPath := filepath.Join(tempDir, "config.yaml")
+	require.NoError(t, ioutil.WriteFile(configPath, []byte(config), 0600))
+
+	// The output used to have a memory buffer, which saved its entries to the database
+	db, err := database.OpenDatabase(databasePath)
+	require.NoError(t, err)
+	memory, err := buffer.NewConfig().Build(operator.NewBuildContext(db, zap.NewNop().Sugar()), "es")
+	require.NoError(t, err)
+	timestamp := time.Now().Add(-time.Hour)
+	for _, record := range []string{"first", "second", "third"} {
+		e := entry.New()
+		e.Timestamp = timestamp
+		e.Record = record
+		require.NoError(t, memory.Add(context.Background(), e))
+	}
+	require.NoError(t, memory.Close())
+	require.NoError(t, db.Close())
+
+	buf := &bytes.Buffer{}
+	stdout = buf
+	rootFlags := &RootFlags{ConfigFiles: []string{configPath}, DatabaseFile: databasePath}
+
+	t.Run("MissingOperator", func(t *testing.T) {
+		err := runBufferPurge(rootFlags, "missing")
+		require.EqualError(t, err, "operator 'missing' does not exist or has no buffer")
+	})
+
+	t.Run("Migrate", func(t *testing.T) {
+		buf.Reset()
+		require.NoError(t, runBufferMigrate(rootFlags, "es", "{type: memory}"))
+		require.Equal(t, "Migrated 3 entries of es\n", buf.String())
+	})
+
+	t.Run("Stats", func(t *testing.T) {
+		buf.Reset()
+		require.NoError(t, runBufferStats(rootFlags, nil, timestamp.Add(time.Hour)))
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		require.Len(t, lines, 2)
+		require.Equal(t, []string{"OPERATOR", "TYPE", "ENTRIES", "BYTES", "OLDEST", "DEAD", "RANGE"}, strings.Fields(lines[0]))
+		fields := strings.Fields(lines[1])
+		require.Equal(t, []string{"es", "disk", "3"}, fields[:3])
+		require.Equal(t, []string{"1h0m0s", "0"}, fields[4:])
+	})
+
+	t.Run("Dump", func(t *testing.T) {
+		buf.Reset()
+		require.NoError(t, runBufferDump(rootFlags, "es", &BufferDumpFlags{Expr: `$record != "second"`, Limit: 1}))
+		var dumped entry.Entry
+		require.NoError(t, json.Unmarshal(buf.Bytes(), &dumped))
+		require.Equal(t, "first", dumped.Record)
+
+		buf.Reset()
+		require.NoError(t, runBufferDump(rootFlags, "es", &BufferDumpFlags{Expr: `$record != "second"`}))
+		require.Len(t, strings.Split(strings.TrimSpace(buf.String()), "\n"), 2)
+
+		err := runBufferDump(rootFlags, "es", &BufferDumpFlags{Expr: `$record ==`})
+		require.Error(t, err)
+	})
+
+	t.Run("Purge", func(t *testing.T) {
+		buf.Reset()
+		require.NoError(t, runBufferPurge(rootFlags, "es"))
+		require.Equal(t, "Purged 3 entries from es\n", buf.String())
+
+		buf.Reset()
+		require.NoError(t, runBufferPurge(rootFlags, "es"))
+		require.Equal(t, "Purged 0 entries from es\n", buf.String())
+	})
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/observiq/stanza/agent"
+	"github.com/observiq/stanza/database"
+	"github.com/observiq/stanza/errors"
+	"github.com/observiq/stanza/operator"
+	"github.com/observiq/stanza/plugin"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+// NewCheckOutputsCommand creates a command for checking the connections of the outputs in a config
+func NewCheckOutputsCommand(rootFlags *RootFlags) *cobra.Command {
+	var timeout time.Duration
+
+	checkOutputs := &cobra.Command{
+		Use:     "check-outputs",
+		Args:    cobra.NoArgs,
+		Short:   "Check the connections of the outputs in the config without starting the agent",
+		PreRunE: withSettings(rootFlags),
+		Run: func(command *cobra.Command, args []string) {
+			if !runCheckOutputs(command.Context(), rootFlags, timeout) {
+				os.Exit(1)
+			}
+		},
+	}
+
+	checkOutputs.Flags().DurationVar(&timeout, "timeout", time.Minute, "maximum time to wait for all checks to complete")
+
+	return checkOutputs
+}
+
+// runCheckOutputs builds the operators of the config and runs the check of every
+// operator that supports one. Operators are built but never started, so inputs do
+// not read any entries. It returns false if the config could not be built or a check failed.
+func runCheckOutputs(ctx context.Context, flags *RootFlags, timeout time.Duration) bool {
+	logger := newLogger(*flags).Sugar()
+	defer func() {
+		_ = logger.Sync()
+	}()
+
+	cfg, err := agent.NewConfigFromGlobs(flags.ConfigFiles)
+	if err != nil {
+		logger.Errorw("Failed to read configs from glob", zap.Any("error", err))
+		return false
+	}
+	redactor := agent.NewRedactor(cfg.Secrets)
+	logger = redactor.WrapLogger(logger)
+
+	if errs := plugin.RegisterPlugins(flags.PluginDir, operator.DefaultRegistry); len(errs) != 0 {
+		logger.Errorw("Got errors parsing plugins", "errors", errs)
+	}
+
+	// The queue is never used, because the operators are not started
+	deadLetter, err := cfg.BuildDeadLetter()
+	if err != nil {
+		logger.Errorw("Failed to build dead-letter queue", zap.Any("error", err))
+		return false
+	}
+	if deadLetter != nil {
+		defer func() {
+			_ = deadLetter.Close()
+		}()
+	}
+
+	// The buffers of the outputs are built in memory, so that the buffers of a running agent are left as they are
+	buildContext := cfg.WithGlobals(operator.NewBuildContext(database.NewStubDatabase(), logger))
+	buildContext.DeadLetter = deadLetter
+	buildContext.MemoryBuffers = true
+	operators, err := cfg.Pipeline.BuildOperators(buildContext)
+	if err != nil {
+		logger.Errorw("Failed to build operators", zap.Any("error", err))
+		return false
+	}
+	defer closeOperators(operators, logger)
+
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	checked, ok := 0, true
+	for _, op := range operators {
+		checker, isChecker := op.(operator.Checker)
+		if !isChecker {
+			continue
+		}
+		checked++
+
+		if err := checker.Check(ctx); err != nil {
+			ok = false
+			err = redactor.RedactError(err)
+			fmt.Fprintf(stdout, "FAIL %s: %s\n", op.ID(), err)
+			if agentErr, isAgentErr := err.(errors.AgentError); isAgentErr && agentErr.Suggestion != "" {
+				fmt.Fprintf(stdout, "     suggestion: %s\n", agentErr.Suggestion)
+			}
+			continue
+		}
+		fmt.Fprintf(stdout, "OK   %s\n", op.ID())
+	}
+
+	if checked == 0 {
+		fmt.Fprintln(stdout, "No outputs in the config support connection checks")
+	}
+
+	return ok
+}
+
+// closeOperators releases the resources of operators that were built but not started
+func closeOperators(operators []operator.Operator, logger *zap.SugaredLogger) {
+	for _, op := range operators {
+		closer, ok := op.(operator.Closer)
+		if !ok {
+			continue
+		}
+		if err := closer.Close(); err != nil {
+			logger.Errorw("Failed to close operator", "operator_id", op.ID(), zap.Error(err))
+		}
+	}
+}
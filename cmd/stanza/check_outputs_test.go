@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/observiq/stanza/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckOutputs(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Api-Token valid" {
+			rw.WriteHeader(http.StatusForbidden)
+			return
+		}
+		rw.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	runCheck := func(t *testing.T, config string) (bool, string) {
+		configPath := filepath.Join(testutil.NewTempDir(t), "config.yaml")
+		require.NoError(t, ioutil.WriteFile(configPath, []byte(config), 0600))
+
+		buf := &bytes.Buffer{}
+		stdout = buf
+
+		ok := runCheckOutputs(context.Background(), &RootFlags{ConfigFiles: []string{configPath}}, 5*time.Second)
+		return ok, buf.String()
+	}
+
+	t.Run("Success", func(t *testing.T) {
+		config := fmt.Sprintf(`
+pipeline:
+  - type: generate_input
+    entry:
+      record: test
+  - type: dynatrace_output
+    api_key: valid
+    base_uri: %s/e/abc12345/api/v2/logs/ingest
+`, srv.URL)
+
+		ok, output := runCheck(t, config)
+		require.True(t, ok)
+		require.Equal(t, "OK   $.dynatrace_output\n", output)
+	})
+
+	t.Run("Failure", func(t *testing.T) {
+		config := fmt.Sprintf(`
+pipeline:
+  - type: generate_input
+    entry:
+      record: test
+  - id: logs
+    type: dynatrace_output
+    api_key: invalid
+    base_uri: %s/e/abc12345/api/v2/logs/ingest
+  - id: metrics
+    type: dynatrace_metrics_output
+    api_key: valid
+    base_uri: %s/e/abc12345/api/v2/metrics/ingest
+    metric_key: test.count
+`, srv.URL, srv.URL)
+
+		ok, output := runCheck(t, config)
+		require.False(t, ok)
+		require.Contains(t, output, "FAIL $.logs: "+srv.URL+"/e/abc12345/api/v2/logs/ingest: the API token does not have the 'logs.ingest' scope\n")
+		require.Contains(t, output, "     suggestion: create an API token with the 'logs.ingest' scope\n")
+		require.Contains(t, output, "OK   $.metrics\n")
+	})
+
+	t.Run("RedactedFailure", func(t *testing.T) {
+		t.Setenv("STANZA_TEST_ENVIRONMENT", "abc12345")
+		config := fmt.Sprintf(`
+pipeline:
+  - type: generate_input
+    entry:
+      record: test
+  - id: logs
+    type: dynatrace_output
+    api_key: invalid
+    base_uri: %s/e/${env:secret:STANZA_TEST_ENVIRONMENT}/api/v2/logs/ingest
+`, srv.URL)
+
+		ok, output := runCheck(t, config)
+		require.False(t, ok)
+		require.Contains(t, output, "FAIL $.logs: "+srv.URL+"/e/${env:secret:STANZA_TEST_ENVIRONMENT}/api/v2/logs/ingest: ")
+		require.NotContains(t, output, "abc12345")
+	})
+
+	t.Run("DiskBuffersAreNotOpened", func(t *testing.T) {
+		bufferPath := filepath.Join(testutil.NewTempDir(t), "buffer")
+		config := fmt.Sprintf(`
+pipeline:
+  - type: generate_input
+    entry:
+      record: test
+  - type: dynatrace_output
+    api_key: valid
+    base_uri: %s/e/abc12345/api/v2/logs/ingest
+    buffer:
+      type: disk
+      path: %s
+`, srv.URL, bufferPath)
+
+		ok, output := runCheck(t, config)
+		require.True(t, ok)
+		require.Equal(t, "OK   $.dynatrace_output\n", output)
+		_, err := os.Stat(bufferPath)
+		require.True(t, os.IsNotExist(err), "the disk buffer of the output is not opened")
+	})
+
+	t.Run("NoCheckableOutputs", func(t *testing.T) {
+		config := `
+pipeline:
+  - type: generate_input
+    entry:
+      record: test
+  - type: stdout
+`
+
+		ok, output := runCheck(t, config)
+		require.True(t, ok)
+		require.Equal(t, "No outputs in the config support connection checks\n", output)
+	})
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/observiq/stanza/agent"
+	"github.com/observiq/stanza/database"
+	"github.com/observiq/stanza/entry"
+	"github.com/observiq/stanza/operator"
+	"github.com/observiq/stanza/operator/deadletter"
+	"github.com/observiq/stanza/plugin"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+// DLQReplayFlags are the flags of the dlq replay command
+type DLQReplayFlags struct {
+	File   string
+	Output string
+	Wait   time.Duration
+}
+
+// NewDLQCmd returns the root command for managing dead-lettered entries
+func NewDLQCmd(rootFlags *RootFlags) *cobra.Command {
+	dlq := &cobra.Command{
+		Use:   "dlq",
+		Short: "Manage entries that outputs failed to deliver",
+		Args:  cobra.NoArgs,
+		// The subcommands use the config files and database of the root flags
+		PersistentPreRunE: withSettings(rootFlags),
+	}
+
+	dlq.AddCommand(NewDLQReplayCmd(rootFlags))
+
+	return dlq
+}
+
+// NewDLQReplayCmd returns the command for replaying dead-lettered entries
+func NewDLQReplayCmd(rootFlags *RootFlags) *cobra.Command {
+	flags := &DLQReplayFlags{}
+
+	replay := &cobra.Command{
+		Use:   "replay --output operator_id [--file path]",
+		Short: "Send dead-lettered entries to an output of the config",
+		Args:  cobra.NoArgs,
+		Run: func(command *cobra.Command, args []string) {
+			if !runDLQReplay(command.Context(), rootFlags, flags) {
+				os.Exit(1)
+			}
+		},
+	}
+
+	replay.Flags().StringVar(&flags.File, "file", "", "dead-letter file to replay (defaults to the 'dead_letter' path of the config)")
+	replay.Flags().StringVar(&flags.Output, "output", "", "id of the output that the entries are sent to")
+	replay.Flags().DurationVar(&flags.Wait, "wait", 30*time.Second, "time to let the output flush the entries before stopping it")
+
+	return replay
+}
+
+// runDLQReplay builds the operators of the config, starts the chosen output, and sends
+// it every entry in the dead-letter file. Other operators are built but never started.
+// Entries that the output has not flushed when it is stopped stay in its buffer if
+// the buffer is persisted. It returns false if the entries could not be replayed.
+func runDLQReplay(ctx context.Context, rootFlags *RootFlags, flags *DLQReplayFlags) bool {
+	logger := newLogger(*rootFlags).Sugar()
+	defer func() {
+		_ = logger.Sync()
+	}()
+
+	if flags.Output == "" {
+		logger.Errorw("Missing required flag --output")
+		return false
+	}
+
+	cfg, err := agent.NewConfigFromGlobs(rootFlags.ConfigFiles)
+	if err != nil {
+		logger.Errorw("Failed to read configs from glob", zap.Any("error", err))
+		return false
+	}
+	logger = agent.NewRedactor(cfg.Secrets).WrapLogger(logger)
+
+	file := flags.File
+	if file == "" {
+		if cfg.DeadLetter == nil || cfg.DeadLetter.Path == "" {
+			logger.Errorw("Missing flag --file, and the config has no 'dead_letter' path")
+			return false
+		}
+		file = cfg.DeadLetter.Path
+	}
+
+	if errs := plugin.RegisterPlugins(rootFlags.PluginDir, operator.DefaultRegistry); len(errs) != 0 {
+		logger.Errorw("Got errors parsing plugins", "errors", errs)
+	}
+
+	db, err := database.OpenDatabase(rootFlags.DatabaseFile)
+	if err != nil {
+		logger.Errorw("Failed to open database. Stop the agent before replaying entries", zap.Any("error", err))
+		return false
+	}
+	defer db.Close()
+
+	deadLetter, err := cfg.BuildDeadLetter()
+	if err != nil {
+		logger.Errorw("Failed to build dead-letter queue", zap.Any("error", err))
+		return false
+	}
+	if deadLetter != nil {
+		defer deadLetter.Close()
+	}
+
+	buildContext := cfg.WithGlobals(operator.NewBuildContext(db, logger))
+	buildContext.DeadLetter = deadLetter
+	operators, err := cfg.Pipeline.BuildOperators(buildContext)
+	if err != nil {
+		logger.Errorw("Failed to build operators", zap.Any("error", err))
+		return false
+	}
+
+	output := findOperator(operators, buildContext.PrependNamespace(flags.Output))
+	if output == nil || !output.CanProcess() {
+		logger.Errorw("Output does not exist in the config", "output", flags.Output)
+		return false
+	}
+
+	// Entries that fail again are dead-lettered, so the dead-letter output must run as well
+	started := []operator.Operator{output}
+	if deadLetter != nil && deadLetter.OutputID() != "" {
+		deadLetterOutput := findOperator(operators, buildContext.PrependNamespace(deadLetter.OutputID()))
+		if deadLetterOutput == nil {
+			logger.Errorw("Dead-letter output does not exist in the config", "output", deadLetter.OutputID())
+			return false
+		}
+		if deadLetterOutput != output {
+			deadLetter.Connect(deadLetterOutput)
+			started = append(started, deadLetterOutput)
+		}
+	}
+
+	for i, op := range started {
+		if err := op.Start(); err != nil {
+			logger.Errorw("Failed to start operator", "operator_id", op.ID(), zap.Any("error", err))
+			stopOperators(started[:i], logger)
+			return false
+		}
+	}
+
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	replayed := 0
+	err = deadletter.ReadFile(file, func(e *entry.Entry) error {
+		if err := output.Process(ctx, e); err != nil {
+			return err
+		}
+		replayed++
+		return nil
+	})
+	if err != nil {
+		logger.Errorw("Failed to replay entries", zap.Any("error", err), "replayed", replayed)
+	} else {
+		select {
+		case <-ctx.Done():
+		case <-time.After(flags.Wait):
+		}
+	}
+
+	stopOperators(started, logger)
+	fmt.Fprintf(stdout, "Replayed %d entries from %s to %s\n", replayed, file, output.ID())
+	return err == nil
+}
+
+// findOperator returns the operator with the given id, or nil if there is none
+func findOperator(operators []operator.Operator, id string) operator.Operator {
+	for _, op := range operators {
+		if op.ID() == id {
+			return op
+		}
+	}
+	return nil
+}
+
+// stopOperators stops operators in order
+func stopOperators(operators []operator.Operator, logger *zap.SugaredLogger) {
+	for _, op := range operators {
+		if err := op.Stop(); err != nil {
+			logger.Errorw("Failed to stop operator", "operator_id", op.ID(), zap.Any("error", err))
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/observiq/stanza/entry"
+	"github.com/observiq/stanza/operator/deadletter"
+	"github.com/observiq/stanza/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDLQReplay(t *testing.T) {
+	tempDir := testutil.NewTempDir(t)
+	deadLetterPath := filepath.Join(tempDir, "dead_letter.jsonl")
+	replayedPath := filepath.Join(tempDir, "replayed.jsonl")
+
+	queue := deadletter.NewFileQueue(deadLetterPath)
+	entries := []*entry.Entry{entry.New(), entry.New()}
+	entries[0].Record = "first"
+	entries[1].Record = "second"
+	require.NoError(t, queue.Add(context.Background(), "$.failing_output", entries, fmt.Errorf("rejected")))
+	require.NoError(t, queue.Close())
+
+	config := fmt.Sprintf(`
+pipeline:
+  - type: generate_input
+    entry:
+      record: test
+  - id: failing_output
+    type: file_output
+    path: %s
+  - id: replay_output
+    type: file_output
+    path: %s
+dead_letter:
+  path: %s
+`, filepath.Join(tempDir, "failing.jsonl"), replayedPath, deadLetterPath)
+	configPath := filepath.Join(tempDir, "config.yaml")
+	require.NoError(t, ioutil.WriteFile(configPath, []byte(config), 0600))
+
+	buf := &bytes.Buffer{}
+	stdout = buf
+	rootFlags := &RootFlags{ConfigFiles: []string{configPath}}
+
+	t.Run("MissingOutput", func(t *testing.T) {
+		require.False(t, runDLQReplay(context.Background(), rootFlags, &DLQReplayFlags{Output: "missing"}))
+	})
+
+	t.Run("Success", func(t *testing.T) {
+		buf.Reset()
+		require.True(t, runDLQReplay(context.Background(), rootFlags, &DLQReplayFlags{Output: "replay_output", Wait: time.Millisecond}))
+		require.Equal(t, fmt.Sprintf("Replayed 2 entries from %s to $.replay_output\n", deadLetterPath), buf.String())
+
+		contents, err := ioutil.ReadFile(replayedPath)
+		require.NoError(t, err)
+		lines := strings.Split(strings.TrimSpace(string(contents)), "\n")
+		require.Len(t, lines, 2)
+		for i, line := range lines {
+			var replayed entry.Entry
+			require.NoError(t, json.Unmarshal([]byte(line), &replayed))
+			require.Equal(t, entries[i].Record, replayed.Record)
+		}
+	})
+}
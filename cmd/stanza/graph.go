@@ -19,10 +19,11 @@ type GraphFlags struct {
 // NewGraphCommand creates a command for printing the pipeline as a graph
 func NewGraphCommand(rootFlags *RootFlags) *cobra.Command {
 	return &cobra.Command{
-		Use:   "graph",
-		Args:  cobra.NoArgs,
-		Short: "Export a dot-formatted representation of the operator graph",
-		Run:   func(command *cobra.Command, args []string) { runGraph(command, args, rootFlags) },
+		Use:     "graph",
+		Args:    cobra.NoArgs,
+		Short:   "Export a dot-formatted representation of the operator graph",
+		PreRunE: withSettings(rootFlags),
+		Run:     func(command *cobra.Command, args []string) { runGraph(command, args, rootFlags) },
 	}
 }
 
@@ -37,12 +38,20 @@ func runGraph(_ *cobra.Command, _ []string, flags *RootFlags) {
 		logger.Errorw("Failed to read configs from glob", zap.Any("error", err))
 		os.Exit(1)
 	}
+	logger = agent.NewRedactor(cfg.Secrets).WrapLogger(logger)
 
 	if errs := plugin.RegisterPlugins(flags.PluginDir, operator.DefaultRegistry); len(errs) != 0 {
 		logger.Errorw("Got errors parsing parsing", "errors", err)
 	}
 
-	buildContext := operator.NewBuildContext(database.NewStubDatabase(), logger)
+	deadLetter, err := cfg.BuildDeadLetter()
+	if err != nil {
+		logger.Errorw("Failed to build dead-letter queue", zap.Any("error", err))
+		os.Exit(1)
+	}
+
+	buildContext := cfg.WithGlobals(operator.NewBuildContext(database.NewStubDatabase(), logger))
+	buildContext.DeadLetter = deadLetter
 	pipeline, err := cfg.Pipeline.BuildPipeline(buildContext, nil)
 	if err != nil {
 		logger.Errorw("Failed to build operator pipeline", zap.Any("error", err))
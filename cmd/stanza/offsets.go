@@ -20,6 +20,8 @@ func NewOffsetsCmd(rootFlags *RootFlags) *cobra.Command {
 		Use:   "offsets",
 		Short: "Manage input operator offsets",
 		Args:  cobra.NoArgs,
+		// The subcommands use the database of the root flags
+		PersistentPreRunE: withSettings(rootFlags),
 	}
 
 	offsets.AddCommand(NewOffsetsClearCmd(rootFlags))
@@ -15,6 +15,7 @@ import (
 	"time"
 
 	agent "github.com/observiq/stanza/agent"
+	"github.com/observiq/stanza/pipeline"
 	"github.com/spf13/cobra"
 	"go.uber.org/zap"
 )
@@ -24,6 +25,10 @@ type RootFlags struct {
 	DatabaseFile       string
 	ConfigFiles        []string
 	PluginDir          string
+	ReloadInterval     time.Duration
+	AdminAddress       string
+	ReadyMaxRetry      time.Duration
+	ReadyMaxBuffer     float64
 	PprofPort          int
 	CPUProfile         string
 	CPUProfileDuration time.Duration
@@ -47,7 +52,9 @@ func NewRootCmd() *cobra.Command {
 		Short: "A log parser and router",
 		Long:  "A log parser and router",
 		Args:  cobra.NoArgs,
-		Run:   func(command *cobra.Command, args []string) { runRoot(command, args, rootFlags) },
+		// Flags that are not given on the command line are taken from the config files
+		PreRunE: withSettings(rootFlags),
+		Run:     func(command *cobra.Command, args []string) { runRoot(command, args, rootFlags) },
 	}
 
 	rootFlagSet := root.PersistentFlags()
@@ -61,6 +68,10 @@ func NewRootCmd() *cobra.Command {
 	rootFlagSet.StringSliceVarP(&rootFlags.ConfigFiles, "config", "c", []string{defaultConfig()}, "path to a config file")
 	rootFlagSet.StringVar(&rootFlags.PluginDir, "plugin_dir", defaultPluginDir(), "path to the plugin directory")
 	rootFlagSet.StringVar(&rootFlags.DatabaseFile, "database", "", "path to the stanza offset database")
+	rootFlagSet.DurationVar(&rootFlags.ReloadInterval, "reload_interval", 10*time.Second, "interval at which config files are checked for changes and reloaded (0 disables reloading on changes)")
+	rootFlagSet.StringVar(&rootFlags.AdminAddress, "admin_address", "", "address of the admin HTTP server, which serves metrics at /metrics and health at /healthz and /readyz (disabled if empty)")
+	rootFlagSet.DurationVar(&rootFlags.ReadyMaxRetry, "ready_max_retry", 5*time.Minute, "time an output may retry to flush a chunk before /readyz reports the agent is not ready (0 disables the check)")
+	rootFlagSet.Float64Var(&rootFlags.ReadyMaxBuffer, "ready_max_buffer", 0.9, "fraction of the buffer of an output that may be used before /readyz reports the agent is not ready (0 disables the check)")
 
 	// Profiling flags
 	rootFlagSet.IntVar(&rootFlags.PprofPort, "pprof_port", 0, "listen port for pprof profiling")
@@ -82,6 +93,9 @@ func NewRootCmd() *cobra.Command {
 	root.AddCommand(NewGraphCommand(rootFlags))
 	root.AddCommand(NewVersionCommand())
 	root.AddCommand(NewOffsetsCmd(rootFlags))
+	root.AddCommand(NewCheckOutputsCommand(rootFlags))
+	root.AddCommand(NewDLQCmd(rootFlags))
+	root.AddCommand(NewBufferCmd(rootFlags))
 
 	return root
 }
@@ -96,6 +110,12 @@ func runRoot(command *cobra.Command, _ []string, flags *RootFlags) {
 		WithConfigFiles(flags.ConfigFiles).
 		WithPluginDir(flags.PluginDir).
 		WithDatabaseFile(flags.DatabaseFile).
+		WithReloadInterval(flags.ReloadInterval).
+		WithAdminAddress(flags.AdminAddress).
+		WithReadiness(pipeline.Readiness{
+			MaxRetryDuration: flags.ReadyMaxRetry,
+			MaxBufferUsage:   flags.ReadyMaxBuffer,
+		}).
 		Build()
 	if err != nil {
 		logger.Errorw("Failed to build agent", zap.Any("error", err))
@@ -44,6 +44,14 @@ func (a *AgentService) Stop(s service.Service) error {
 	return nil
 }
 
+// reload will reload the config of the stanza agent.
+func (a *AgentService) reload() {
+	a.agent.Info("Reloading stanza agent config")
+	if err := a.agent.Reload(); err != nil {
+		a.agent.Errorw("Failed to reload config, the previous config keeps running", zap.Any("error", err))
+	}
+}
+
 // newAgentService creates a new agent service with the provided agent.
 func newAgentService(ctx context.Context, agent *agent.LogAgent, cancel context.CancelFunc) (service.Service, error) {
 	agentService := &AgentService{cancel, agent}
@@ -54,10 +62,17 @@ func newAgentService(ctx context.Context, agent *agent.LogAgent, cancel context.
 		Option: service.KeyValue{
 			"RunWait": func() {
 				var sigChan = make(chan os.Signal, 3)
-				signal.Notify(sigChan, syscall.SIGTERM, os.Interrupt)
-				select {
-				case <-sigChan:
-				case <-ctx.Done():
+				signal.Notify(sigChan, syscall.SIGTERM, os.Interrupt, syscall.SIGHUP)
+				for {
+					select {
+					case sig := <-sigChan:
+						if sig == syscall.SIGHUP {
+							agentService.reload()
+							continue
+						}
+					case <-ctx.Done():
+					}
+					return
 				}
 			},
 		},
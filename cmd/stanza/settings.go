@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/observiq/stanza/agent"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// withSettings returns a hook that applies the settings of the config files to the root flags
+// before a command runs. It is only added to the commands that use the root flags, so that
+// commands such as version do not fail if the config files cannot be read.
+func withSettings(flags *RootFlags) func(*cobra.Command, []string) error {
+	return func(command *cobra.Command, _ []string) error {
+		return applySettings(command.Flags(), flags)
+	}
+}
+
+// applySettings sets the root flags that were not given on the command line to the
+// settings in the `agent` sections of the config files
+func applySettings(flagSet *pflag.FlagSet, flags *RootFlags) error {
+	settings, err := agent.NewSettingsFromGlobs(flags.ConfigFiles)
+	if err != nil {
+		return fmt.Errorf("read agent settings: %s", err)
+	}
+
+	unset := func(name string) bool {
+		return !flagSet.Changed(name)
+	}
+
+	if settings.LogLevel != "" && unset("log_level") {
+		flags.LogLevel = settings.LogLevel
+	}
+	if settings.LogFile != "" && unset("log_file") {
+		flags.LogFile = settings.LogFile
+	}
+	if settings.MaxLogSize != nil && unset("max_log_size") {
+		flags.MaxLogSize = *settings.MaxLogSize
+	}
+	if settings.MaxLogBackups != nil && unset("max_log_backups") {
+		flags.MaxLogBackups = *settings.MaxLogBackups
+	}
+	if settings.MaxLogAge != nil && unset("max_log_age") {
+		flags.MaxLogAge = *settings.MaxLogAge
+	}
+	if settings.Database != "" && unset("database") {
+		flags.DatabaseFile = settings.Database
+	}
+	if settings.PluginDir != "" && unset("plugin_dir") {
+		flags.PluginDir = settings.PluginDir
+	}
+	if settings.ReloadInterval != nil && unset("reload_interval") {
+		flags.ReloadInterval = settings.ReloadInterval.Raw()
+	}
+	if settings.AdminAddress != "" && unset("admin_address") {
+		flags.AdminAddress = settings.AdminAddress
+	}
+	if settings.ReadyMaxRetry != nil && unset("ready_max_retry") {
+		flags.ReadyMaxRetry = settings.ReadyMaxRetry.Raw()
+	}
+	if settings.ReadyMaxBuffer != nil && unset("ready_max_buffer") {
+		flags.ReadyMaxBuffer = *settings.ReadyMaxBuffer
+	}
+	return nil
+}
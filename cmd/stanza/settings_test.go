@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplySettings(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	config := `
+agent:
+  log_level: debug
+  database: /var/lib/stanza/stanza.db
+  max_log_size: 0
+  reload_interval: 0s
+  ready_max_buffer: 0.5
+pipeline:
+  - type: unregistered_plugin
+`
+	require.NoError(t, ioutil.WriteFile(configPath, []byte(config), 0600))
+
+	flags := &RootFlags{
+		ConfigFiles:    []string{configPath},
+		LogLevel:       "error",
+		MaxLogSize:     10,
+		ReloadInterval: 10 * time.Second,
+		ReadyMaxBuffer: 0.9,
+	}
+	flagSet := pflag.NewFlagSet("stanza", pflag.ContinueOnError)
+	flagSet.StringVar(&flags.LogLevel, "log_level", "INFO", "")
+	require.NoError(t, flagSet.Parse([]string{"--log_level", "error"}))
+
+	require.NoError(t, applySettings(flagSet, flags))
+	require.Equal(t, "error", flags.LogLevel, "flags given on the command line take precedence")
+	require.Equal(t, "/var/lib/stanza/stanza.db", flags.DatabaseFile)
+	require.Equal(t, 0, flags.MaxLogSize)
+	require.Equal(t, time.Duration(0), flags.ReloadInterval)
+	require.Equal(t, 0.5, flags.ReadyMaxBuffer)
+}
+
+func TestApplySettingsInvalid(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, ioutil.WriteFile(configPath, []byte("agent:\n  log_level: [debug]\n"), 0600))
+
+	flags := &RootFlags{ConfigFiles: []string{configPath}}
+	err := applySettings(pflag.NewFlagSet("stanza", pflag.ContinueOnError), flags)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "read agent settings")
+}
+
+func TestSettingsOnlyReadByCommandsThatUseThem(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	config := "agent:\n  database: ${env:STANZA_TEST_MISSING_DATABASE}\n"
+	require.NoError(t, ioutil.WriteFile(configPath, []byte(config), 0600))
+
+	// The version command does not read the config files
+	root := NewRootCmd()
+	root.SetArgs([]string{"version", "-c", configPath})
+	require.NoError(t, root.Execute())
+
+	// The commands that use the root flags fail if the settings cannot be read
+	root = NewRootCmd()
+	root.SetOut(ioutil.Discard)
+	root.SetErr(ioutil.Discard)
+	root.SetArgs([]string{"offsets", "list", "-c", configPath})
+	err := root.Execute()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "read agent settings")
+}
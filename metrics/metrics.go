@@ -0,0 +1,198 @@
+package metrics
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Labels of every operator metric
+const (
+	labelOperatorID   = "operator_id"
+	labelOperatorType = "operator_type"
+	labelResult       = "result"
+	labelEndpoint     = "endpoint"
+)
+
+var (
+	operatorLabels = []string{labelOperatorID, labelOperatorType}
+	endpointLabels = []string{labelOperatorID, labelOperatorType, labelEndpoint}
+)
+
+var (
+	entriesInDesc = prometheus.NewDesc(
+		"stanza_operator_entries_in_total",
+		"Number of entries written to the operator by other operators.",
+		operatorLabels, nil,
+	)
+	entriesOutDesc = prometheus.NewDesc(
+		"stanza_operator_entries_out_total",
+		"Number of entries the operator wrote to other operators, or flushed to its destination.",
+		operatorLabels, nil,
+	)
+	entryErrorsDesc = prometheus.NewDesc(
+		"stanza_operator_entry_errors_total",
+		"Number of entries the operator failed to process.",
+		operatorLabels, nil,
+	)
+	bufferEntriesDesc = prometheus.NewDesc(
+		"stanza_buffer_entries",
+		"Number of entries in the buffer of the operator that were not read for flushing yet.",
+		operatorLabels, nil,
+	)
+	bufferDroppedDesc = prometheus.NewDesc(
+		"stanza_buffer_dropped_entries_total",
+		"Number of entries the buffer of the operator dropped because it was full.",
+		operatorLabels, nil,
+	)
+	flushDurationDesc = prometheus.NewDesc(
+		"stanza_flush_duration_seconds",
+		"Duration of the attempts to flush a chunk.",
+		operatorLabels, nil,
+	)
+	flushRetriesDesc = prometheus.NewDesc(
+		"stanza_flush_retries_total",
+		"Number of failed attempts to flush a chunk that were retried.",
+		operatorLabels, nil,
+	)
+	flushChunksDesc = prometheus.NewDesc(
+		"stanza_flush_chunks_total",
+		"Number of chunks that were flushed, dropped or dead-lettered.",
+		[]string{labelOperatorID, labelOperatorType, labelResult}, nil,
+	)
+	flushUndeliveredDesc = prometheus.NewDesc(
+		"stanza_flush_undelivered_entries_total",
+		"Number of entries that were dropped or dead-lettered instead of flushed.",
+		[]string{labelOperatorID, labelOperatorType, labelResult}, nil,
+	)
+	flushPartialDesc = prometheus.NewDesc(
+		"stanza_flush_partial_requests_total",
+		"Number of requests whose destination accepted only some of their entries.",
+		operatorLabels, nil,
+	)
+	flushConcurrencyDesc = prometheus.NewDesc(
+		"stanza_flush_concurrency_limit",
+		"Maximum number of chunks the operator currently flushes concurrently.",
+		operatorLabels, nil,
+	)
+	endpointRequestsDesc = prometheus.NewDesc(
+		"stanza_endpoint_requests_total",
+		"Number of requests the operator sent to the endpoint.",
+		endpointLabels, nil,
+	)
+	endpointFailuresDesc = prometheus.NewDesc(
+		"stanza_endpoint_failures_total",
+		"Number of requests to the endpoint that failed because of the endpoint.",
+		endpointLabels, nil,
+	)
+	endpointEjectionsDesc = prometheus.NewDesc(
+		"stanza_endpoint_ejections_total",
+		"Number of times the endpoint was ejected because it failed too many times in a row.",
+		endpointLabels, nil,
+	)
+	endpointInflightDesc = prometheus.NewDesc(
+		"stanza_endpoint_inflight_requests",
+		"Number of requests to the endpoint that are in progress.",
+		endpointLabels, nil,
+	)
+	endpointHealthyDesc = prometheus.NewDesc(
+		"stanza_endpoint_healthy",
+		"Whether the endpoint receives requests (1), or is ejected (0).",
+		endpointLabels, nil,
+	)
+)
+
+// Registry holds the metrics of the operators of a pipeline, and exposes them
+// together with the metrics of the process in the Prometheus text format
+type Registry struct {
+	mux       sync.Mutex
+	operators map[string]*Operator
+	gatherer  *prometheus.Registry
+}
+
+// NewRegistry creates a new registry
+func NewRegistry() *Registry {
+	r := &Registry{
+		operators: make(map[string]*Operator),
+		gatherer:  prometheus.NewRegistry(),
+	}
+	r.gatherer.MustRegister(
+		r,
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+	return r
+}
+
+// Handler returns an HTTP handler that serves the metrics of the registry
+func (r *Registry) Handler() http.Handler {
+	return promhttp.HandlerFor(r.gatherer, promhttp.HandlerOpts{})
+}
+
+// Operator returns the metrics of the operator with the given id, creating them if they do
+// not exist yet. It returns nil if the registry is nil, and nothing is recorded in that case.
+func (r *Registry) Operator(id string) *Operator {
+	if r == nil {
+		return nil
+	}
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	op, ok := r.operators[id]
+	if !ok {
+		op = newOperator(id)
+		r.operators[id] = op
+	}
+	return op
+}
+
+// Retain removes the metrics of every operator whose id is not in ids. It is
+// called when operators are removed from a pipeline that keeps running.
+func (r *Registry) Retain(ids []string) {
+	if r == nil {
+		return
+	}
+
+	keep := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		keep[id] = true
+	}
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	for id := range r.operators {
+		if !keep[id] {
+			delete(r.operators, id)
+		}
+	}
+}
+
+// Describe sends the descriptions of the operator metrics to ch
+func (r *Registry) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{
+		entriesInDesc, entriesOutDesc, entryErrorsDesc,
+		bufferEntriesDesc, bufferDroppedDesc,
+		flushDurationDesc, flushRetriesDesc, flushChunksDesc, flushUndeliveredDesc, flushPartialDesc,
+		flushConcurrencyDesc,
+		endpointRequestsDesc, endpointFailuresDesc, endpointEjectionsDesc, endpointInflightDesc, endpointHealthyDesc,
+	} {
+		ch <- desc
+	}
+}
+
+// Collect sends the current values of the operator metrics to ch
+func (r *Registry) Collect(ch chan<- prometheus.Metric) {
+	r.mux.Lock()
+	operators := make([]*Operator, 0, len(r.operators))
+	for _, op := range r.operators {
+		operators = append(operators, op)
+	}
+	r.mux.Unlock()
+
+	for _, op := range operators {
+		op.collect(ch)
+	}
+}
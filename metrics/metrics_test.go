@@ -0,0 +1,124 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// scrape returns the metrics served by the handler of a registry
+func scrape(t *testing.T, r *Registry) string {
+	recorder := httptest.NewRecorder()
+	r.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	require.Equal(t, 200, recorder.Code)
+	return recorder.Body.String()
+}
+
+func TestRegistry(t *testing.T) {
+	t.Run("Operator", func(t *testing.T) {
+		r := NewRegistry()
+		op := r.Operator("$.parser")
+		require.Equal(t, op, r.Operator("$.parser"))
+
+		op.SetType("json_parser")
+		op.AddEntriesIn(3)
+		op.AddEntriesOut(2)
+		op.AddEntryError()
+
+		body := scrape(t, r)
+		require.Contains(t, body, `stanza_operator_entries_in_total{operator_id="$.parser",operator_type="json_parser"} 3`)
+		require.Contains(t, body, `stanza_operator_entries_out_total{operator_id="$.parser",operator_type="json_parser"} 2`)
+		require.Contains(t, body, `stanza_operator_entry_errors_total{operator_id="$.parser",operator_type="json_parser"} 1`)
+		require.NotContains(t, body, "stanza_buffer_entries")
+		require.NotContains(t, body, "stanza_flush_duration_seconds")
+		require.Contains(t, body, "go_goroutines")
+	})
+
+	t.Run("BufferAndFlusher", func(t *testing.T) {
+		r := NewRegistry()
+		op := r.Operator("$.output")
+		op.SetType("elastic_output")
+		op.SetBuffer(func() int64 { return 7 }, func() uint64 { return 4 })
+		op.SetFlusher(func() int { return 16 })
+		op.ObserveFlush(20 * time.Millisecond)
+		op.ObserveFlush(2 * time.Second)
+		op.AddFlushRetry()
+		op.AddChunk(ChunkFlushed)
+		op.AddChunk(ChunkFlushed)
+		op.AddChunk(ChunkDeadLettered)
+		op.AddUndelivered(ChunkDeadLettered, 5)
+		op.AddPartialRequest()
+
+		body := scrape(t, r)
+		labels := `operator_id="$.output",operator_type="elastic_output"`
+		require.Contains(t, body, `stanza_buffer_entries{`+labels+`} 7`)
+		require.Contains(t, body, `stanza_buffer_dropped_entries_total{`+labels+`} 4`)
+		require.Contains(t, body, `stanza_flush_duration_seconds_bucket{`+labels+`,le="0.025"} 1`)
+		require.Contains(t, body, `stanza_flush_duration_seconds_bucket{`+labels+`,le="+Inf"} 2`)
+		require.Contains(t, body, `stanza_flush_duration_seconds_count{`+labels+`} 2`)
+		require.Contains(t, body, `stanza_flush_retries_total{`+labels+`} 1`)
+		require.Contains(t, body, `stanza_flush_chunks_total{`+labels+`,result="flushed"} 2`)
+		require.Contains(t, body, `stanza_flush_chunks_total{`+labels+`,result="dropped"} 0`)
+		require.Contains(t, body, `stanza_flush_chunks_total{`+labels+`,result="dead_lettered"} 1`)
+		require.Contains(t, body, `stanza_flush_undelivered_entries_total{`+labels+`,result="dropped"} 0`)
+		require.Contains(t, body, `stanza_flush_undelivered_entries_total{`+labels+`,result="dead_lettered"} 5`)
+		require.Contains(t, body, `stanza_flush_partial_requests_total{`+labels+`} 1`)
+		require.Contains(t, body, `stanza_flush_concurrency_limit{`+labels+`} 16`)
+	})
+
+	t.Run("Endpoints", func(t *testing.T) {
+		r := NewRegistry()
+		op := r.Operator("$.output")
+		op.SetType("dynatrace_output")
+		op.SetEndpoints(func() []Endpoint {
+			return []Endpoint{
+				{URL: "https://a", Requests: 5, Failures: 3, Ejects: 1, Healthy: false},
+				{URL: "https://b", Requests: 7, Inflight: 2, Healthy: true},
+			}
+		})
+
+		body := scrape(t, r)
+		labels := `operator_id="$.output",operator_type="dynatrace_output"`
+		require.Contains(t, body, `stanza_endpoint_requests_total{endpoint="https://a",`+labels+`} 5`)
+		require.Contains(t, body, `stanza_endpoint_failures_total{endpoint="https://a",`+labels+`} 3`)
+		require.Contains(t, body, `stanza_endpoint_ejections_total{endpoint="https://a",`+labels+`} 1`)
+		require.Contains(t, body, `stanza_endpoint_healthy{endpoint="https://a",`+labels+`} 0`)
+		require.Contains(t, body, `stanza_endpoint_inflight_requests{endpoint="https://b",`+labels+`} 2`)
+		require.Contains(t, body, `stanza_endpoint_healthy{endpoint="https://b",`+labels+`} 1`)
+		require.NotContains(t, body, "stanza_flush_duration_seconds")
+	})
+
+	t.Run("Retain", func(t *testing.T) {
+		r := NewRegistry()
+		r.Operator("$.kept").AddEntriesIn(1)
+		r.Operator("$.removed").AddEntriesIn(1)
+
+		r.Retain([]string{"$.kept"})
+		body := scrape(t, r)
+		require.Contains(t, body, `operator_id="$.kept"`)
+		require.NotContains(t, body, `operator_id="$.removed"`)
+	})
+
+	t.Run("Nil", func(t *testing.T) {
+		var r *Registry
+		op := r.Operator("$.parser")
+		require.Nil(t, op)
+
+		// Nothing is recorded, and nothing panics
+		op.SetType("json_parser")
+		op.AddEntriesIn(1)
+		op.AddEntriesOut(1)
+		op.AddEntryError()
+		op.SetBuffer(nil, nil)
+		op.SetFlusher(nil)
+		op.SetEndpoints(nil)
+		op.ObserveFlush(time.Second)
+		op.AddFlushRetry()
+		op.AddChunk(ChunkDropped)
+		op.AddUndelivered(ChunkDropped, 1)
+		op.AddPartialRequest()
+		r.Retain(nil)
+	})
+}
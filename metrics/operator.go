@@ -0,0 +1,271 @@
+package metrics
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Results of flushing a chunk
+const (
+	// ChunkFlushed is the result of a chunk that was flushed to its destination
+	ChunkFlushed = "flushed"
+	// ChunkDropped is the result of a chunk that was dropped after its retries were exhausted,
+	// or whose destination rejected entries that were dropped
+	ChunkDropped = "dropped"
+	// ChunkDeadLettered is the result of a chunk that was dead-lettered after its retries were
+	// exhausted, or whose destination rejected entries that were dead-lettered
+	ChunkDeadLettered = "dead_lettered"
+)
+
+// Endpoint is a snapshot of the state of an endpoint that an operator sends entries to
+type Endpoint struct {
+	URL      string
+	Requests uint64
+	Failures uint64
+	Ejects   uint64
+	Inflight int64
+	Healthy  bool
+}
+
+// flushBuckets are the upper bounds in seconds of the buckets of the flush duration histogram
+var flushBuckets = prometheus.DefBuckets
+
+// Operator holds the metrics of an operator. All of its methods can be called on a nil
+// Operator, which records nothing, so that operators do not have to check whether
+// metrics are enabled.
+type Operator struct {
+	// The counters are first in the struct to guarantee 64-bit alignment for atomic operations
+	entriesIn           uint64
+	entriesOut          uint64
+	entryErrors         uint64
+	flushRetries        uint64
+	chunksFlushed       uint64
+	chunksDropped       uint64
+	chunksDeadLettered  uint64
+	entriesDropped      uint64
+	entriesDeadLettered uint64
+	partialRequests     uint64
+
+	id string
+
+	mux sync.Mutex
+	typ string
+
+	// bufferEntries and bufferDropped report the state of the buffer of the operator.
+	// They are nil if the operator has no buffer.
+	bufferEntries func() int64
+	bufferDropped func() uint64
+
+	// concurrencyLimit reports the concurrency limit of the flusher of the operator.
+	// It is nil if the operator has no flusher, and the flush metrics are not collected.
+	concurrencyLimit func() int
+
+	// endpoints reports the state of the endpoints of the operator. It is nil if the
+	// operator does not balance requests over endpoints.
+	endpoints func() []Endpoint
+
+	// flushCounts holds the number of flush attempts per bucket of flushBuckets,
+	// and the last count is the number of attempts that took longer
+	flushCounts []uint64
+	flushSum    float64
+	flushCount  uint64
+}
+
+func newOperator(id string) *Operator {
+	return &Operator{
+		id:          id,
+		flushCounts: make([]uint64, len(flushBuckets)+1),
+	}
+}
+
+// SetType sets the type of the operator, which is used as a label of its metrics
+func (o *Operator) SetType(typ string) {
+	if o == nil {
+		return
+	}
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	o.typ = typ
+}
+
+// AddEntriesIn counts entries written to the operator
+func (o *Operator) AddEntriesIn(n int) {
+	if o == nil {
+		return
+	}
+	atomic.AddUint64(&o.entriesIn, uint64(n))
+}
+
+// AddEntriesOut counts entries that the operator wrote to its outputs or flushed
+func (o *Operator) AddEntriesOut(n int) {
+	if o == nil {
+		return
+	}
+	atomic.AddUint64(&o.entriesOut, uint64(n))
+}
+
+// AddEntryError counts an entry that the operator failed to process
+func (o *Operator) AddEntryError() {
+	if o == nil {
+		return
+	}
+	atomic.AddUint64(&o.entryErrors, 1)
+}
+
+// SetBuffer reports the state of the buffer of the operator. The functions are called
+// whenever the metrics are collected. dropped is nil if the buffer does not drop entries.
+func (o *Operator) SetBuffer(entries func() int64, dropped func() uint64) {
+	if o == nil {
+		return
+	}
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	o.bufferEntries, o.bufferDropped = entries, dropped
+}
+
+// SetFlusher reports the concurrency limit of the flusher of the operator. The function
+// is called whenever the metrics are collected.
+func (o *Operator) SetFlusher(concurrencyLimit func() int) {
+	if o == nil {
+		return
+	}
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	o.concurrencyLimit = concurrencyLimit
+}
+
+// SetEndpoints reports the state of the endpoints of the operator. The function is
+// called whenever the metrics are collected.
+func (o *Operator) SetEndpoints(endpoints func() []Endpoint) {
+	if o == nil {
+		return
+	}
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	o.endpoints = endpoints
+}
+
+// ObserveFlush records the duration of an attempt to flush a chunk
+func (o *Operator) ObserveFlush(d time.Duration) {
+	if o == nil {
+		return
+	}
+	seconds := d.Seconds()
+
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	i := 0
+	for i < len(flushBuckets) && seconds > flushBuckets[i] {
+		i++
+	}
+	o.flushCounts[i]++
+	o.flushSum += seconds
+	o.flushCount++
+}
+
+// AddFlushRetry counts a failed attempt to flush a chunk that is retried
+func (o *Operator) AddFlushRetry() {
+	if o == nil {
+		return
+	}
+	atomic.AddUint64(&o.flushRetries, 1)
+}
+
+// AddChunk counts a chunk that was flushed, dropped or dead-lettered
+func (o *Operator) AddChunk(result string) {
+	if o == nil {
+		return
+	}
+	switch result {
+	case ChunkFlushed:
+		atomic.AddUint64(&o.chunksFlushed, 1)
+	case ChunkDropped:
+		atomic.AddUint64(&o.chunksDropped, 1)
+	case ChunkDeadLettered:
+		atomic.AddUint64(&o.chunksDeadLettered, 1)
+	}
+}
+
+// AddUndelivered counts entries that were dropped or dead-lettered instead of flushed
+func (o *Operator) AddUndelivered(result string, n int) {
+	if o == nil {
+		return
+	}
+	switch result {
+	case ChunkDropped:
+		atomic.AddUint64(&o.entriesDropped, uint64(n))
+	case ChunkDeadLettered:
+		atomic.AddUint64(&o.entriesDeadLettered, uint64(n))
+	}
+}
+
+// AddPartialRequest counts a request whose destination accepted only some of its entries
+func (o *Operator) AddPartialRequest() {
+	if o == nil {
+		return
+	}
+	atomic.AddUint64(&o.partialRequests, 1)
+}
+
+// collect sends the current values of the metrics of the operator to ch
+func (o *Operator) collect(ch chan<- prometheus.Metric) {
+	o.mux.Lock()
+	typ := o.typ
+	bufferEntries, bufferDropped, concurrencyLimit := o.bufferEntries, o.bufferDropped, o.concurrencyLimit
+	endpoints := o.endpoints
+	buckets := make(map[float64]uint64, len(flushBuckets))
+	var cumulative uint64
+	for i, upperBound := range flushBuckets {
+		cumulative += o.flushCounts[i]
+		buckets[upperBound] = cumulative
+	}
+	flushSum, flushCount := o.flushSum, o.flushCount
+	o.mux.Unlock()
+
+	counter := func(desc *prometheus.Desc, value uint64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(value), append([]string{o.id, typ}, labels...)...)
+	}
+	gauge := func(desc *prometheus.Desc, value float64) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, o.id, typ)
+	}
+
+	counter(entriesInDesc, atomic.LoadUint64(&o.entriesIn))
+	counter(entriesOutDesc, atomic.LoadUint64(&o.entriesOut))
+	counter(entryErrorsDesc, atomic.LoadUint64(&o.entryErrors))
+
+	if bufferEntries != nil {
+		gauge(bufferEntriesDesc, float64(bufferEntries()))
+	}
+	if bufferDropped != nil {
+		counter(bufferDroppedDesc, bufferDropped())
+	}
+
+	if concurrencyLimit != nil {
+		ch <- prometheus.MustNewConstHistogram(flushDurationDesc, flushCount, flushSum, buckets, o.id, typ)
+		counter(flushRetriesDesc, atomic.LoadUint64(&o.flushRetries))
+		counter(flushChunksDesc, atomic.LoadUint64(&o.chunksFlushed), ChunkFlushed)
+		counter(flushChunksDesc, atomic.LoadUint64(&o.chunksDropped), ChunkDropped)
+		counter(flushChunksDesc, atomic.LoadUint64(&o.chunksDeadLettered), ChunkDeadLettered)
+		counter(flushUndeliveredDesc, atomic.LoadUint64(&o.entriesDropped), ChunkDropped)
+		counter(flushUndeliveredDesc, atomic.LoadUint64(&o.entriesDeadLettered), ChunkDeadLettered)
+		counter(flushPartialDesc, atomic.LoadUint64(&o.partialRequests))
+		gauge(flushConcurrencyDesc, float64(concurrencyLimit()))
+	}
+
+	if endpoints != nil {
+		for _, e := range endpoints() {
+			healthy := 0.0
+			if e.Healthy {
+				healthy = 1
+			}
+			ch <- prometheus.MustNewConstMetric(endpointRequestsDesc, prometheus.CounterValue, float64(e.Requests), o.id, typ, e.URL)
+			ch <- prometheus.MustNewConstMetric(endpointFailuresDesc, prometheus.CounterValue, float64(e.Failures), o.id, typ, e.URL)
+			ch <- prometheus.MustNewConstMetric(endpointEjectionsDesc, prometheus.CounterValue, float64(e.Ejects), o.id, typ, e.URL)
+			ch <- prometheus.MustNewConstMetric(endpointInflightDesc, prometheus.GaugeValue, float64(e.Inflight), o.id, typ, e.URL)
+			ch <- prometheus.MustNewConstMetric(endpointHealthyDesc, prometheus.GaugeValue, healthy, o.id, typ, e.URL)
+		}
+	}
+}
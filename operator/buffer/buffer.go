@@ -4,6 +4,8 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"reflect"
+	"strings"
 	"time"
 
 	"github.com/observiq/stanza/entry"
@@ -23,9 +25,27 @@ type Buffer interface {
 	SetMaxChunkSize(uint)
 }
 
+// UnreadCounter is implemented by buffers that can report how many entries wait to be read
+type UnreadCounter interface {
+	// Unread returns the number of entries in the buffer that have not been read
+	Unread() int64
+}
+
+// UsageReporter is implemented by buffers that can report how much of their capacity is used
+type UsageReporter interface {
+	// Usage returns the fraction of the capacity of the buffer that is used, from 0 to 1
+	Usage() float64
+}
+
+// DefaultsKey is the key of the buffer config that outputs inherit in the defaults of a build context
+const DefaultsKey = "buffer"
+
 // Config is a struct that wraps a Builder
 type Config struct {
 	Builder
+
+	// set is true if the config was unmarshalled, so that it is not inherited from the defaults
+	set bool
 }
 
 // NewConfig returns a default Config
@@ -35,6 +55,58 @@ func NewConfig() Config {
 	}
 }
 
+// Build builds the buffer of the operator with the given id, and reports its unread
+// and dropped entries with the metrics of the operator
+func (bc Config) Build(context operator.BuildContext, pluginID string) (Buffer, error) {
+	builder := bc.inherit(context, pluginID).Builder
+	if context.MemoryBuffers {
+		builder = NewMemoryBufferConfig()
+	}
+
+	b, err := builder.Build(context, pluginID)
+	if err != nil {
+		return nil, err
+	}
+
+	var unread func() int64
+	if counter, ok := b.(UnreadCounter); ok {
+		unread = counter.Unread
+	}
+	var dropped func() uint64
+	if counter, ok := b.(DropCounter); ok {
+		dropped = counter.Dropped
+	}
+	context.Metrics.Operator(context.PrependNamespace(pluginID)).SetBuffer(unread, dropped)
+	return b, nil
+}
+
+// inherit returns the buffer config in the defaults of a build context if the config is not
+// set, and the config itself otherwise. The config is not set if the config of the output was
+// unmarshalled without a buffer, or if it was not unmarshalled and the buffer is left at its
+// default. Since every output that inherits the config needs a path of its own, the inherited
+// paths are joined with the id of the output.
+func (bc Config) inherit(context operator.BuildContext, pluginID string) Config {
+	parent, ok := context.Defaults[DefaultsKey].(Config)
+	if ok && !bc.set && reflect.DeepEqual(bc.Builder, NewConfig().Builder) {
+		return parent.joinPath(strings.TrimPrefix(context.PrependNamespace(pluginID), "$."))
+	}
+	return bc
+}
+
+// pathJoiner is implemented by buffer configs that store entries in a path
+type pathJoiner interface {
+	// joinPath returns a copy of the config whose paths are joined with elem
+	joinPath(elem string) Builder
+}
+
+// joinPath returns a copy of the config whose paths are joined with elem
+func (bc Config) joinPath(elem string) Config {
+	if joiner, ok := bc.Builder.(pathJoiner); ok {
+		return Config{Builder: joiner.joinPath(elem)}
+	}
+	return bc
+}
+
 // Builder builds a Buffer given build context
 type Builder interface {
 	Build(context operator.BuildContext, pluginID string) (Buffer, error)
@@ -59,6 +131,7 @@ func (bc *Config) unmarshal(unmarshal func(interface{}) error) error {
 		return err
 	}
 
+	bc.set = true
 	switch m["type"] {
 	case "memory":
 		bc.Builder = NewMemoryBufferConfig()
@@ -66,6 +139,12 @@ func (bc *Config) unmarshal(unmarshal func(interface{}) error) error {
 	case "disk":
 		bc.Builder = NewDiskBufferConfig()
 		return unmarshal(bc.Builder)
+	case "wal":
+		bc.Builder = NewWALBufferConfig()
+		return unmarshal(bc.Builder)
+	case "priority":
+		bc.Builder = NewPriorityBufferConfig()
+		return unmarshal(bc.Builder)
 	default:
 		return fmt.Errorf("unknown buffer type '%s'", m["type"])
 	}
@@ -83,3 +162,14 @@ type Clearer interface {
 	MarkAllAsFlushed() error
 	MarkRangeAsFlushed(uint, uint) error
 }
+
+// usage returns the fraction of a capacity that is used, from 0 to 1
+func usage(used, capacity int64) float64 {
+	if capacity <= 0 {
+		return 0
+	}
+	if used >= capacity {
+		return 1
+	}
+	return float64(used) / float64(capacity)
+}
@@ -2,10 +2,14 @@ package buffer
 
 import (
 	"encoding/json"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/observiq/stanza/metrics"
 	"github.com/observiq/stanza/operator/helper"
+	"github.com/observiq/stanza/testutil"
 	"github.com/stretchr/testify/require"
 	yaml "gopkg.in/yaml.v2"
 )
@@ -48,6 +52,85 @@ func TestBufferUnmarshalYAML(t *testing.T) {
 			},
 			false,
 		},
+		{
+			"MaxChunkBytes",
+			[]byte("type: disk\nmax_chunk_bytes: 4MiB\npath: /var/log/testpath\n"),
+			[]byte(`{"type": "disk", "max_chunk_bytes": "4MiB", "path": "/var/log/testpath"}`),
+			Config{
+				Builder: &DiskBufferConfig{
+					Type:          "disk",
+					MaxSize:       1 << 32,
+					Path:          "/var/log/testpath",
+					Sync:          true,
+					MaxChunkDelay: helper.NewDuration(time.Second),
+					MaxChunkSize:  1000,
+					MaxChunkBytes: 4 << 20,
+				},
+			},
+			false,
+		},
+		{
+			"SimpleWAL",
+			[]byte("type: wal\nmax_size: 1234\nsegment_size: 123\npath: /var/log/testpath\n"),
+			[]byte(`{"type": "wal", "max_size": 1234, "segment_size": 123, "path": "/var/log/testpath"}`),
+			Config{
+				Builder: &WALBufferConfig{
+					Type:          "wal",
+					MaxSize:       1234,
+					SegmentSize:   123,
+					Path:          "/var/log/testpath",
+					Sync:          true,
+					MaxChunkDelay: helper.NewDuration(time.Second),
+					MaxChunkSize:  1000,
+				},
+			},
+			false,
+		},
+		{
+			"MemorySpill",
+			[]byte("type: memory\nmax_entries: 30\noverflow: spill\nspill:\n  type: disk\n  path: /var/log/testpath\n"),
+			[]byte(`{"type": "memory", "max_entries": 30, "overflow": "spill", "spill": {"type": "disk", "path": "/var/log/testpath"}}`),
+			Config{
+				Builder: &MemoryBufferConfig{
+					Type:          "memory",
+					MaxEntries:    30,
+					MaxChunkDelay: helper.NewDuration(time.Second),
+					MaxChunkSize:  1000,
+					OverflowConfig: OverflowConfig{
+						Overflow: OverflowSpill,
+						Spill: &Config{
+							Builder: &DiskBufferConfig{
+								Type:          "disk",
+								MaxSize:       1 << 32,
+								Path:          "/var/log/testpath",
+								Sync:          true,
+								MaxChunkDelay: helper.NewDuration(time.Second),
+								MaxChunkSize:  1000,
+							},
+							set: true,
+						},
+					},
+				},
+			},
+			false,
+		},
+		{
+			"DiskDropNewest",
+			[]byte("type: disk\nmax_size: 1234\npath: /var/log/testpath\noverflow: drop_newest\n"),
+			[]byte(`{"type": "disk", "max_size": 1234, "path": "/var/log/testpath", "overflow": "drop_newest"}`),
+			Config{
+				Builder: &DiskBufferConfig{
+					Type:           "disk",
+					MaxSize:        1234,
+					Path:           "/var/log/testpath",
+					Sync:           true,
+					MaxChunkDelay:  helper.NewDuration(time.Second),
+					MaxChunkSize:   1000,
+					OverflowConfig: OverflowConfig{Overflow: OverflowDropNewest},
+				},
+			},
+			false,
+		},
 		{
 			"UnknownType",
 			[]byte("type: invalid\n"),
@@ -92,7 +175,9 @@ func TestBufferUnmarshalYAML(t *testing.T) {
 					return
 				}
 				require.NoError(t, err)
-				require.Equal(t, tc.expected, b)
+				expected := tc.expected
+				expected.set = true
+				require.Equal(t, expected, b)
 			})
 
 			t.Run("JSON", func(t *testing.T) {
@@ -103,7 +188,9 @@ func TestBufferUnmarshalYAML(t *testing.T) {
 					return
 				}
 				require.NoError(t, err)
-				require.Equal(t, tc.expected, b)
+				expected := tc.expected
+				expected.set = true
+				require.Equal(t, expected, b)
 			})
 		})
 	}
@@ -123,3 +210,225 @@ func TestBuffer(t *testing.T) {
 		require.Equal(t, expected, cfg)
 	})
 }
+
+func TestBufferInherit(t *testing.T) {
+	parent := NewDiskBufferConfig()
+	parent.Path = testutil.NewTempDir(t)
+	bc := testutil.NewBuildContext(t)
+	bc.Defaults = map[string]interface{}{DefaultsKey: Config{Builder: parent}}
+
+	// An output that keeps the default buffer inherits the buffer of the defaults,
+	// in a directory of its own
+	b, err := NewConfig().Build(bc, "test")
+	require.NoError(t, err)
+	require.IsType(t, &DiskBuffer{}, b)
+	require.NoError(t, b.Close())
+	require.FileExists(t, filepath.Join(parent.Path, "test", "data"))
+
+	b, err = NewConfig().Build(bc.WithSubNamespace("plugin"), "test")
+	require.NoError(t, err)
+	require.NoError(t, b.Close())
+	require.FileExists(t, filepath.Join(parent.Path, "plugin.test", "data"))
+
+	// An output that sets its own buffer keeps it
+	memory := NewMemoryBufferConfig()
+	memory.MaxEntries = 10
+	b, err = Config{Builder: memory}.Build(bc, "test")
+	require.NoError(t, err)
+	require.IsType(t, &MemoryBuffer{}, b)
+	require.NoError(t, b.Close())
+
+	// An output that sets the default buffer explicitly keeps it too
+	var explicit Config
+	require.NoError(t, yaml.Unmarshal([]byte("type: memory\n"), &explicit))
+	b, err = explicit.Build(bc, "explicit")
+	require.NoError(t, err)
+	require.IsType(t, &MemoryBuffer{}, b)
+	require.NoError(t, b.Close())
+	require.NoDirExists(t, filepath.Join(parent.Path, "explicit"))
+}
+
+func TestBufferMetrics(t *testing.T) {
+	cases := []struct {
+		name    string
+		builder func(t *testing.T) Builder
+		dropped string
+	}{
+		{
+			"Memory",
+			func(t *testing.T) Builder {
+				return NewMemoryBufferConfig()
+			},
+			"",
+		},
+		{
+			"Disk",
+			func(t *testing.T) Builder {
+				cfg := NewDiskBufferConfig()
+				cfg.Path = testutil.NewTempDir(t)
+				return cfg
+			},
+			"",
+		},
+		{
+			"WAL",
+			func(t *testing.T) Builder {
+				cfg := NewWALBufferConfig()
+				cfg.Path = testutil.NewTempDir(t)
+				return cfg
+			},
+			"",
+		},
+		{
+			"DropNewest",
+			func(t *testing.T) Builder {
+				cfg := NewMemoryBufferConfig()
+				cfg.MaxEntries = 3
+				cfg.Overflow = OverflowDropNewest
+				return cfg
+			},
+			"1",
+		},
+		{
+			"Spill",
+			func(t *testing.T) Builder {
+				cfg := NewMemoryBufferConfig()
+				cfg.MaxEntries = 1
+				cfg.Overflow = OverflowSpill
+				cfg.Spill = newSpillConfig(t)
+				return cfg
+			},
+			"",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			bc := testutil.NewBuildContext(t)
+			bc.Metrics = metrics.NewRegistry()
+			b, err := Config{Builder: tc.builder(t)}.Build(bc, "test")
+			require.NoError(t, err)
+			defer b.Close()
+
+			// Four entries are added, or three if the newest is dropped, and one is read
+			writeN(t, b, 4, 0)
+			readN(t, b, 1, 0)
+
+			labels := `operator_id="$.test",operator_type=""`
+			var body string
+			require.Eventually(t, func() bool {
+				body = testutil.ScrapeMetrics(t, bc.Metrics)
+				if tc.dropped != "" {
+					return strings.Contains(body, `stanza_buffer_entries{`+labels+`} 2`)
+				}
+				return strings.Contains(body, `stanza_buffer_entries{`+labels+`} 3`)
+			}, time.Second, 10*time.Millisecond, body)
+
+			if tc.dropped != "" {
+				require.Contains(t, body, `stanza_buffer_dropped_entries_total{`+labels+`} `+tc.dropped)
+			} else {
+				require.NotContains(t, body, "stanza_buffer_dropped_entries_total")
+			}
+		})
+	}
+}
+
+func TestBufferUsage(t *testing.T) {
+	t.Run("Memory", func(t *testing.T) {
+		cfg := NewMemoryBufferConfig()
+		cfg.MaxEntries = 4
+		b, err := cfg.Build(testutil.NewBuildContext(t), "test")
+		require.NoError(t, err)
+		defer b.Close()
+		reporter := b.(UsageReporter)
+		require.Equal(t, 0.0, reporter.Usage())
+
+		// Entries that were read count until they are flushed
+		writeN(t, b, 3, 0)
+		clearer := readN(t, b, 1, 0)
+		require.Equal(t, 0.75, reporter.Usage())
+		require.NoError(t, clearer.MarkAllAsFlushed())
+		require.Equal(t, 0.5, reporter.Usage())
+	})
+
+	for _, tc := range []struct {
+		name    string
+		builder func(t *testing.T) Builder
+	}{
+		{
+			"Disk",
+			func(t *testing.T) Builder {
+				cfg := NewDiskBufferConfig()
+				cfg.Path = testutil.NewTempDir(t)
+				cfg.MaxSize = 1 << 20
+				return cfg
+			},
+		},
+		{
+			"WAL",
+			func(t *testing.T) Builder {
+				cfg := NewWALBufferConfig()
+				cfg.Path = testutil.NewTempDir(t)
+				cfg.MaxSize = 1 << 20
+				cfg.SegmentSize = 1 << 16
+				return cfg
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b, err := tc.builder(t).Build(testutil.NewBuildContext(t), "test")
+			require.NoError(t, err)
+			defer b.Close()
+			reporter := b.(UsageReporter)
+			require.Equal(t, 0.0, reporter.Usage())
+
+			writeN(t, b, 10, 0)
+			usage := reporter.Usage()
+			require.Greater(t, usage, 0.0)
+			require.Less(t, usage, 0.01)
+		})
+	}
+
+	t.Run("Priority", func(t *testing.T) {
+		high := NewMemoryBufferConfig()
+		high.MaxEntries = 2
+		low := NewMemoryBufferConfig()
+		low.MaxEntries = 10
+		b := &PriorityBuffer{}
+		for _, cfg := range []*MemoryBufferConfig{high, low} {
+			l, err := cfg.Build(testutil.NewBuildContext(t), "test")
+			require.NoError(t, err)
+			defer l.Close()
+			writeN(t, l, 1, 0)
+			b.lanes = append(b.lanes, &lane{buffer: l})
+		}
+		require.Equal(t, 0.5, b.Usage())
+	})
+}
+
+func TestBufferJoinPath(t *testing.T) {
+	disk := NewDiskBufferConfig()
+	disk.Path = "/buffers/disk"
+	wal := NewWALBufferConfig()
+	wal.Path = "/buffers/wal"
+	memory := NewMemoryBufferConfig()
+	memory.Overflow = OverflowSpill
+	memory.Spill = &Config{Builder: wal}
+	priority := NewPriorityBufferConfig()
+	priority.Lanes = []LaneConfig{
+		{Name: "high", Expr: "true", Buffer: &Config{Builder: disk}},
+		{Name: "low"},
+	}
+
+	joined := Config{Builder: disk}.joinPath("output").Builder.(*DiskBufferConfig)
+	require.Equal(t, filepath.Join("/buffers/disk", "output"), joined.Path)
+	require.Equal(t, "/buffers/disk", disk.Path, "the config itself is not changed")
+
+	spill := Config{Builder: memory}.joinPath("output").Builder.(*MemoryBufferConfig).Spill
+	require.Equal(t, filepath.Join("/buffers/wal", "output"), spill.Builder.(*WALBufferConfig).Path)
+	require.Equal(t, "/buffers/wal", wal.Path)
+
+	lanes := Config{Builder: priority}.joinPath("output").Builder.(*PriorityBufferConfig).Lanes
+	require.Equal(t, filepath.Join("/buffers/disk", "output"), lanes[0].Buffer.Builder.(*DiskBufferConfig).Path)
+	require.Nil(t, lanes[1].Buffer)
+}
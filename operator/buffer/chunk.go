@@ -0,0 +1,92 @@
+package buffer
+
+import (
+	"github.com/observiq/stanza/entry"
+)
+
+// entryOverhead is the estimated size of the fields of an encoded entry other than its
+// record, labels and resource: the timestamp, the severity and the JSON punctuation
+const entryOverhead = 70
+
+// estimateSize estimates the size in bytes of an entry encoded as JSON. It walks the
+// entry instead of encoding it, so that chunks can be limited by size cheaply.
+func estimateSize(e *entry.Entry) int {
+	size := entryOverhead + len(e.SeverityText)
+	size += estimateMapSize(e.Labels)
+	size += estimateMapSize(e.Resource)
+	return size + estimateValueSize(e.Record)
+}
+
+func estimateMapSize(m map[string]string) int {
+	size := 0
+	for k, v := range m {
+		// Quotes, colon and comma
+		size += len(k) + len(v) + 6
+	}
+	return size
+}
+
+func estimateValueSize(v interface{}) int {
+	switch v := v.(type) {
+	case nil:
+		return 4
+	case string:
+		return len(v) + 2
+	case []byte:
+		// Bytes are encoded as base64
+		return len(v)*4/3 + 4
+	case map[string]interface{}:
+		size := 2
+		for k, value := range v {
+			size += len(k) + 4 + estimateValueSize(value)
+		}
+		return size
+	case map[string]string:
+		return estimateMapSize(v) + 2
+	case []interface{}:
+		size := 2
+		for _, value := range v {
+			size += estimateValueSize(value) + 1
+		}
+		return size
+	case []string:
+		size := 2
+		for _, value := range v {
+			size += len(value) + 3
+		}
+		return size
+	case bool:
+		return 5
+	default:
+		// Numbers and other values
+		return 10
+	}
+}
+
+// chunkSizer tracks the size of a chunk that is being read, and decides whether
+// another entry fits into it
+type chunkSizer struct {
+	maxBytes int
+	bytes    int
+}
+
+// fits returns true if an entry fits into the chunk, and adds it to the size of the chunk.
+// The first entry always fits, so that entries larger than the limit are still read.
+// Every entry fits if the size of chunks is not limited.
+func (c *chunkSizer) fits(e *entry.Entry) bool {
+	if c.maxBytes <= 0 {
+		return true
+	}
+
+	size := estimateSize(e)
+	if c.bytes > 0 && c.bytes+size > c.maxBytes {
+		return false
+	}
+	c.bytes += size
+	return true
+}
+
+// full returns true if no more entries should be added to the chunk
+func (c *chunkSizer) full() bool {
+	return c.maxBytes > 0 && c.bytes >= c.maxBytes
+}
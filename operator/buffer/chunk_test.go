@@ -0,0 +1,78 @@
+package buffer
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/observiq/stanza/entry"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEstimateSize(t *testing.T) {
+	cases := []struct {
+		name   string
+		modify func(*entry.Entry)
+	}{
+		{"Empty", func(*entry.Entry) {}},
+		{"String", func(e *entry.Entry) { e.Record = strings.Repeat("a", 2000) }},
+		{"Map", func(e *entry.Entry) {
+			e.Record = map[string]interface{}{
+				"message": strings.Repeat("a", 500),
+				"status":  200,
+				"nested":  map[string]interface{}{"list": []interface{}{"one", "two", true}},
+			}
+		}},
+		{"LabelsAndResource", func(e *entry.Entry) {
+			e.Record = "message"
+			e.SeverityText = "ERROR"
+			e.Labels = map[string]string{"file_name": "app.log", "env": "production"}
+			e.Resource = map[string]string{"host": strings.Repeat("h", 100)}
+		}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			e := intEntry(0)
+			tc.modify(e)
+			encoded, err := json.Marshal(e)
+			require.NoError(t, err)
+
+			// The estimate is within a quarter of the encoded size
+			require.InDelta(t, len(encoded), estimateSize(e), float64(len(encoded))/4)
+		})
+	}
+}
+
+func TestChunkSizer(t *testing.T) {
+	size := estimateSize(intEntry(0))
+
+	t.Run("Unlimited", func(t *testing.T) {
+		sizer := chunkSizer{}
+		for i := 0; i < 100; i++ {
+			require.True(t, sizer.fits(intEntry(i)))
+		}
+		require.False(t, sizer.full())
+	})
+
+	t.Run("Limited", func(t *testing.T) {
+		sizer := chunkSizer{maxBytes: 2*size + 1}
+		require.True(t, sizer.fits(intEntry(0)))
+		require.True(t, sizer.fits(intEntry(1)))
+		require.False(t, sizer.full())
+		require.False(t, sizer.fits(intEntry(2)))
+	})
+
+	t.Run("Full", func(t *testing.T) {
+		sizer := chunkSizer{maxBytes: 2 * size}
+		require.True(t, sizer.fits(intEntry(0)))
+		require.True(t, sizer.fits(intEntry(1)))
+		require.True(t, sizer.full())
+	})
+
+	t.Run("LargeFirstEntry", func(t *testing.T) {
+		sizer := chunkSizer{maxBytes: size / 2}
+		require.True(t, sizer.fits(intEntry(0)), "the first entry always fits")
+		require.False(t, sizer.fits(intEntry(1)))
+	})
+}
@@ -0,0 +1,359 @@
+package buffer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/observiq/stanza/entry"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Codecs that entries are encoded with in a buffer
+const (
+	CodecJSON    = "json"
+	CodecMsgpack = "msgpack"
+	CodecBinary  = "binary"
+)
+
+// Compression algorithms of encoded entries
+const (
+	CompressionNone   = "none"
+	CompressionZstd   = "zstd"
+	CompressionSnappy = "snappy"
+)
+
+// Codec encodes entries to bytes and decodes them again
+type Codec interface {
+	// Encode appends the encoded entry to dst and returns the extended slice
+	Encode(dst []byte, e *entry.Entry) ([]byte, error)
+
+	// Decode decodes an entry that was encoded by Encode into e
+	Decode(data []byte, e *entry.Entry) error
+}
+
+// The ids of the codecs and compression algorithms are stored in the header of every
+// record, so they must never change. A header byte is the codec id in the high nibble
+// and the compression id in the low nibble. A header can never be '{' (0x7B), which
+// is the first byte of a record that was encoded as JSON without a header.
+var (
+	codecIDs = map[string]byte{
+		CodecJSON:    1,
+		CodecMsgpack: 2,
+		CodecBinary:  3,
+	}
+	codecsByID = map[byte]Codec{
+		1: jsonCodec{},
+		2: msgpackCodec{},
+		3: binaryCodec{},
+	}
+
+	compressionIDs = map[string]byte{
+		CompressionNone:   0,
+		CompressionZstd:   1,
+		CompressionSnappy: 2,
+	}
+	compressorsByID = map[byte]compressor{
+		0: nopCompressor{},
+		1: &zstdCompressor{},
+		2: snappyCompressor{},
+	}
+)
+
+// CodecConfig configures how entries are encoded in a buffer
+type CodecConfig struct {
+	// Codec is the codec that new entries are encoded with. It defaults to json.
+	Codec string `json:"codec,omitempty" yaml:"codec,omitempty"`
+
+	// Compression is the compression algorithm that new entries are compressed with.
+	// It defaults to none.
+	Compression string `json:"compression,omitempty" yaml:"compression,omitempty"`
+}
+
+// build creates the recordCodec of the config
+func (c CodecConfig) build() (*recordCodec, error) {
+	codec := strings.ToLower(c.Codec)
+	if codec == "" {
+		codec = CodecJSON
+	}
+	codecID, ok := codecIDs[codec]
+	if !ok {
+		return nil, fmt.Errorf("unsupported codec '%s'", c.Codec)
+	}
+
+	compression := strings.ToLower(c.Compression)
+	if compression == "" {
+		compression = CompressionNone
+	}
+	compressionID, ok := compressionIDs[compression]
+	if !ok {
+		return nil, fmt.Errorf("unsupported compression '%s'", c.Compression)
+	}
+
+	return newRecordCodec(codecID, compressionID), nil
+}
+
+// recordCodec encodes entries into the records that are stored by a buffer. Records
+// start with a header byte that identifies their codec and compression, so records
+// that were encoded with a different config can always be decoded. Records encoded
+// as JSON without compression have no header, so that they can be read by previous
+// versions, and records written by previous versions can be read.
+type recordCodec struct {
+	header     byte
+	codec      Codec
+	compressor compressor
+}
+
+// defaultRecordCodec encodes entries as JSON without compression
+var defaultRecordCodec = newRecordCodec(codecIDs[CodecJSON], compressionIDs[CompressionNone])
+
+func newRecordCodec(codecID, compressionID byte) *recordCodec {
+	return &recordCodec{
+		header:     codecID<<4 | compressionID,
+		codec:      codecsByID[codecID],
+		compressor: compressorsByID[compressionID],
+	}
+}
+
+// legacy returns true if records are encoded without a header
+func (c *recordCodec) legacy() bool {
+	return c.header == codecIDs[CodecJSON]<<4|compressionIDs[CompressionNone]
+}
+
+// encode encodes an entry into a record
+func (c *recordCodec) encode(e *entry.Entry) ([]byte, error) {
+	if c.legacy() {
+		return c.codec.Encode(nil, e)
+	}
+
+	if _, ok := c.compressor.(nopCompressor); ok {
+		return c.codec.Encode([]byte{c.header}, e)
+	}
+
+	encoded, err := c.codec.Encode(nil, e)
+	if err != nil {
+		return nil, err
+	}
+	return c.compressor.compress([]byte{c.header}, encoded), nil
+}
+
+// decodeRecord decodes a record that was encoded by any recordCodec
+func decodeRecord(record []byte) (*entry.Entry, error) {
+	if len(record) == 0 {
+		return nil, fmt.Errorf("empty record")
+	}
+
+	var e entry.Entry
+	if record[0] == '{' {
+		if err := json.Unmarshal(record, &e); err != nil {
+			return nil, err
+		}
+		return &e, nil
+	}
+
+	codec, ok := codecsByID[record[0]>>4]
+	if !ok {
+		return nil, fmt.Errorf("unknown codec %d", record[0]>>4)
+	}
+	compressor, ok := compressorsByID[record[0]&0x0F]
+	if !ok {
+		return nil, fmt.Errorf("unknown compression %d", record[0]&0x0F)
+	}
+
+	data, err := compressor.decompress(record[1:])
+	if err != nil {
+		return nil, fmt.Errorf("decompress: %s", err)
+	}
+	if err := codec.Decode(data, &e); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// jsonCodec encodes entries as JSON
+type jsonCodec struct{}
+
+func (jsonCodec) Encode(dst []byte, e *entry.Entry) ([]byte, error) {
+	encoded, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	return append(dst, encoded...), nil
+}
+
+func (jsonCodec) Decode(data []byte, e *entry.Entry) error {
+	return json.Unmarshal(data, e)
+}
+
+// msgpackCodec encodes entries as a MessagePack array of their fields
+type msgpackCodec struct{}
+
+// msgpackFields is the number of fields in the array of an encoded entry
+const msgpackFields = 8
+
+func (msgpackCodec) Encode(dst []byte, e *entry.Entry) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	enc := msgpack.GetEncoder()
+	defer msgpack.PutEncoder(enc)
+	enc.Reset(buf)
+
+	sec, nsec, offset := splitTimestamp(e.Timestamp)
+	if err := enc.EncodeArrayLen(msgpackFields); err != nil {
+		return nil, err
+	}
+	if err := enc.EncodeInt(sec); err != nil {
+		return nil, err
+	}
+	if err := enc.EncodeInt(nsec); err != nil {
+		return nil, err
+	}
+	if err := enc.EncodeInt(offset); err != nil {
+		return nil, err
+	}
+	if err := enc.EncodeInt(int64(e.Severity)); err != nil {
+		return nil, err
+	}
+	if err := enc.EncodeString(e.SeverityText); err != nil {
+		return nil, err
+	}
+	if err := enc.Encode(e.Labels); err != nil {
+		return nil, err
+	}
+	if err := enc.Encode(e.Resource); err != nil {
+		return nil, err
+	}
+	if err := enc.Encode(e.Record); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) Decode(data []byte, e *entry.Entry) error {
+	dec := msgpack.GetDecoder()
+	defer msgpack.PutDecoder(dec)
+	dec.Reset(bytes.NewReader(data))
+	// Numbers in the record are decoded as int64, uint64 or float64
+	dec.UseLooseInterfaceDecoding(true)
+
+	n, err := dec.DecodeArrayLen()
+	if err != nil {
+		return err
+	}
+	if n != msgpackFields {
+		return fmt.Errorf("expected %d fields, got %d", msgpackFields, n)
+	}
+
+	sec, err := dec.DecodeInt64()
+	if err != nil {
+		return err
+	}
+	nsec, err := dec.DecodeInt64()
+	if err != nil {
+		return err
+	}
+	offset, err := dec.DecodeInt64()
+	if err != nil {
+		return err
+	}
+	e.Timestamp = joinTimestamp(sec, nsec, offset)
+
+	severity, err := dec.DecodeInt64()
+	if err != nil {
+		return err
+	}
+	e.Severity = entry.Severity(severity)
+
+	if e.SeverityText, err = dec.DecodeString(); err != nil {
+		return err
+	}
+	if err = dec.Decode(&e.Labels); err != nil {
+		return err
+	}
+	if err = dec.Decode(&e.Resource); err != nil {
+		return err
+	}
+	e.Record, err = dec.DecodeInterfaceLoose()
+	return err
+}
+
+// splitTimestamp splits a timestamp into seconds and nanoseconds since the
+// Unix epoch and the offset of its time zone in seconds
+func splitTimestamp(t time.Time) (sec, nsec, offset int64) {
+	_, zoneOffset := t.Zone()
+	return t.Unix(), int64(t.Nanosecond()), int64(zoneOffset)
+}
+
+// joinTimestamp is the inverse of splitTimestamp. Like a timestamp decoded from JSON,
+// the time zone is UTC if the offset is zero, or a fixed zone otherwise.
+func joinTimestamp(sec, nsec, offset int64) time.Time {
+	t := time.Unix(sec, nsec)
+	if offset == 0 {
+		return t.UTC()
+	}
+	return t.In(time.FixedZone("", int(offset)))
+}
+
+// compressor compresses the records of a buffer
+type compressor interface {
+	// compress appends the compressed src to dst and returns the extended slice
+	compress(dst, src []byte) []byte
+
+	// decompress returns the decompressed src
+	decompress(src []byte) ([]byte, error)
+}
+
+type nopCompressor struct{}
+
+func (nopCompressor) compress(dst, src []byte) []byte       { return append(dst, src...) }
+func (nopCompressor) decompress(src []byte) ([]byte, error) { return src, nil }
+
+// zstdCompressor compresses records with zstd. The encoder and decoder are
+// created on first use, and are safe for concurrent use by all buffers.
+type zstdCompressor struct {
+	once    sync.Once
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+	err     error
+}
+
+func (c *zstdCompressor) init() error {
+	c.once.Do(func() {
+		// Records are compressed one by one, so a small window is enough and saves memory
+		if c.encoder, c.err = zstd.NewWriter(nil, zstd.WithWindowSize(1<<16)); c.err != nil {
+			return
+		}
+		c.decoder, c.err = zstd.NewReader(nil)
+	})
+	return c.err
+}
+
+func (c *zstdCompressor) compress(dst, src []byte) []byte {
+	if err := c.init(); err != nil {
+		// The options of the encoder are constant and valid
+		panic(err)
+	}
+	return c.encoder.EncodeAll(src, dst)
+}
+
+func (c *zstdCompressor) decompress(src []byte) ([]byte, error) {
+	if err := c.init(); err != nil {
+		return nil, err
+	}
+	return c.decoder.DecodeAll(src, nil)
+}
+
+// snappyCompressor compresses records with the snappy block format
+type snappyCompressor struct{}
+
+func (snappyCompressor) compress(dst, src []byte) []byte {
+	return append(dst, snappy.Encode(nil, src)...)
+}
+
+func (snappyCompressor) decompress(src []byte) ([]byte, error) {
+	return snappy.Decode(nil, src)
+}
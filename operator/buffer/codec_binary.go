@@ -0,0 +1,345 @@
+package buffer
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+
+	"github.com/observiq/stanza/entry"
+)
+
+// binaryCodec encodes entries in a compact binary format. The layout of an encoded entry is as follows:
+// - Varint seconds since the Unix epoch of the timestamp
+// - Uvarint nanoseconds of the timestamp
+// - Varint offset of the time zone of the timestamp in seconds
+// - Varint severity
+// - String severity text
+// - String map labels
+// - String map resource
+// - Value record
+//
+// Strings are a uvarint length followed by the bytes of the string. String maps are a uvarint
+// of the number of keys plus one, or zero for a nil map, followed by the string key and string
+// value of every key. Values are a type byte followed by the value, as described by the
+// binaryType constants.
+type binaryCodec struct{}
+
+// Types of values in the binary encoding
+const (
+	// binaryNil has no value
+	binaryNil byte = iota
+	// binaryFalse has no value
+	binaryFalse
+	// binaryTrue has no value
+	binaryTrue
+	// binaryInt is a varint
+	binaryInt
+	// binaryUint is a uvarint
+	binaryUint
+	// binaryFloat is 8 bytes of the IEEE 754 bits as LittleEndian uint64
+	binaryFloat
+	// binaryString is a string
+	binaryString
+	// binaryBytes is a uvarint length followed by the bytes
+	binaryBytes
+	// binaryMap is a uvarint number of keys followed by the string key and value of every key
+	binaryMap
+	// binaryStringMap is a uvarint number of keys followed by the string key and string value of every key
+	binaryStringMap
+	// binarySlice is a uvarint length followed by the values
+	binarySlice
+	// binaryJSON is a string containing a value of any other type encoded as JSON
+	binaryJSON
+)
+
+func (binaryCodec) Encode(dst []byte, e *entry.Entry) ([]byte, error) {
+	sec, nsec, offset := splitTimestamp(e.Timestamp)
+	dst = appendVarint(dst, sec)
+	dst = appendUvarint(dst, uint64(nsec))
+	dst = appendVarint(dst, offset)
+	dst = appendVarint(dst, int64(e.Severity))
+	dst = appendString(dst, e.SeverityText)
+	dst = appendStringMap(dst, e.Labels)
+	dst = appendStringMap(dst, e.Resource)
+	return appendValue(dst, e.Record)
+}
+
+func (binaryCodec) Decode(data []byte, e *entry.Entry) error {
+	d := binaryDecoder{data: data}
+	sec := d.varint()
+	nsec := d.uvarint()
+	offset := d.varint()
+	severity := d.varint()
+	e.SeverityText = d.string()
+	e.Labels = d.stringMap()
+	e.Resource = d.stringMap()
+	e.Record = d.value()
+	if d.err != nil {
+		return d.err
+	}
+	if len(d.data) != 0 {
+		return fmt.Errorf("%d unexpected bytes after entry", len(d.data))
+	}
+
+	e.Timestamp = joinTimestamp(sec, int64(nsec), offset)
+	e.Severity = entry.Severity(severity)
+	return nil
+}
+
+func appendVarint(dst []byte, v int64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(buf[:], v)
+	return append(dst, buf[:n]...)
+}
+
+func appendUvarint(dst []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(dst, buf[:n]...)
+}
+
+func appendString(dst []byte, s string) []byte {
+	dst = appendUvarint(dst, uint64(len(s)))
+	return append(dst, s...)
+}
+
+func appendStringMap(dst []byte, m map[string]string) []byte {
+	if m == nil {
+		return appendUvarint(dst, 0)
+	}
+
+	dst = appendUvarint(dst, uint64(len(m))+1)
+	for k, v := range m {
+		dst = appendString(dst, k)
+		dst = appendString(dst, v)
+	}
+	return dst
+}
+
+func appendValue(dst []byte, v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case nil:
+		return append(dst, binaryNil), nil
+	case bool:
+		if v {
+			return append(dst, binaryTrue), nil
+		}
+		return append(dst, binaryFalse), nil
+	case int:
+		return appendVarint(append(dst, binaryInt), int64(v)), nil
+	case int8:
+		return appendVarint(append(dst, binaryInt), int64(v)), nil
+	case int16:
+		return appendVarint(append(dst, binaryInt), int64(v)), nil
+	case int32:
+		return appendVarint(append(dst, binaryInt), int64(v)), nil
+	case int64:
+		return appendVarint(append(dst, binaryInt), v), nil
+	case uint:
+		return appendUvarint(append(dst, binaryUint), uint64(v)), nil
+	case uint8:
+		return appendUvarint(append(dst, binaryUint), uint64(v)), nil
+	case uint16:
+		return appendUvarint(append(dst, binaryUint), uint64(v)), nil
+	case uint32:
+		return appendUvarint(append(dst, binaryUint), uint64(v)), nil
+	case uint64:
+		return appendUvarint(append(dst, binaryUint), v), nil
+	case float32:
+		return appendFloat(dst, float64(v)), nil
+	case float64:
+		return appendFloat(dst, v), nil
+	case string:
+		return appendString(append(dst, binaryString), v), nil
+	case []byte:
+		dst = appendUvarint(append(dst, binaryBytes), uint64(len(v)))
+		return append(dst, v...), nil
+	case map[string]string:
+		dst = appendUvarint(append(dst, binaryStringMap), uint64(len(v)))
+		for k, s := range v {
+			dst = appendString(dst, k)
+			dst = appendString(dst, s)
+		}
+		return dst, nil
+	case map[string]interface{}:
+		dst = appendUvarint(append(dst, binaryMap), uint64(len(v)))
+		var err error
+		for k, value := range v {
+			dst = appendString(dst, k)
+			if dst, err = appendValue(dst, value); err != nil {
+				return nil, err
+			}
+		}
+		return dst, nil
+	case []interface{}:
+		dst = appendUvarint(append(dst, binarySlice), uint64(len(v)))
+		var err error
+		for _, value := range v {
+			if dst, err = appendValue(dst, value); err != nil {
+				return nil, err
+			}
+		}
+		return dst, nil
+	default:
+		encoded, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		return appendString(append(dst, binaryJSON), string(encoded)), nil
+	}
+}
+
+func appendFloat(dst []byte, v float64) []byte {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], math.Float64bits(v))
+	return append(append(dst, binaryFloat), buf[:]...)
+}
+
+// binaryDecoder decodes the binary encoding. Once an error occurs,
+// it is kept in err and every following call returns a zero value.
+type binaryDecoder struct {
+	data []byte
+	err  error
+}
+
+func (d *binaryDecoder) fail(format string, args ...interface{}) {
+	if d.err == nil {
+		d.err = fmt.Errorf(format, args...)
+	}
+	d.data = nil
+}
+
+func (d *binaryDecoder) byte() byte {
+	if len(d.data) < 1 {
+		d.fail("unexpected end of entry")
+		return 0
+	}
+	b := d.data[0]
+	d.data = d.data[1:]
+	return b
+}
+
+func (d *binaryDecoder) varint() int64 {
+	v, n := binary.Varint(d.data)
+	if n <= 0 {
+		d.fail("invalid varint")
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *binaryDecoder) uvarint() uint64 {
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.fail("invalid uvarint")
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+// length decodes a uvarint length of something that takes at least one byte per unit
+func (d *binaryDecoder) length() int {
+	n := d.uvarint()
+	if n > uint64(len(d.data)) {
+		d.fail("length %d exceeds the size of the entry", n)
+		return 0
+	}
+	return int(n)
+}
+
+func (d *binaryDecoder) bytes() []byte {
+	n := d.length()
+	if d.err != nil {
+		return nil
+	}
+	b := make([]byte, n)
+	copy(b, d.data[:n])
+	d.data = d.data[n:]
+	return b
+}
+
+func (d *binaryDecoder) string() string {
+	n := d.length()
+	if d.err != nil {
+		return ""
+	}
+	s := string(d.data[:n])
+	d.data = d.data[n:]
+	return s
+}
+
+func (d *binaryDecoder) stringMap() map[string]string {
+	n := d.length()
+	if n == 0 || d.err != nil {
+		return nil
+	}
+	return d.stringMapEntries(n - 1)
+}
+
+func (d *binaryDecoder) stringMapEntries(n int) map[string]string {
+	m := make(map[string]string, n)
+	for i := 0; i < n && d.err == nil; i++ {
+		k := d.string()
+		m[k] = d.string()
+	}
+	return m
+}
+
+func (d *binaryDecoder) value() interface{} {
+	switch t := d.byte(); t {
+	case binaryNil:
+		return nil
+	case binaryFalse:
+		return false
+	case binaryTrue:
+		return true
+	case binaryInt:
+		return d.varint()
+	case binaryUint:
+		return d.uvarint()
+	case binaryFloat:
+		if len(d.data) < 8 {
+			d.fail("unexpected end of entry")
+			return nil
+		}
+		v := math.Float64frombits(binary.LittleEndian.Uint64(d.data))
+		d.data = d.data[8:]
+		return v
+	case binaryString:
+		return d.string()
+	case binaryBytes:
+		return d.bytes()
+	case binaryStringMap:
+		n := d.length()
+		return d.stringMapEntries(n)
+	case binaryMap:
+		n := d.length()
+		m := make(map[string]interface{}, n)
+		for i := 0; i < n && d.err == nil; i++ {
+			k := d.string()
+			m[k] = d.value()
+		}
+		return m
+	case binarySlice:
+		n := d.length()
+		s := make([]interface{}, 0, n)
+		for i := 0; i < n && d.err == nil; i++ {
+			s = append(s, d.value())
+		}
+		return s
+	case binaryJSON:
+		var v interface{}
+		if err := json.Unmarshal([]byte(d.string()), &v); err != nil && d.err == nil {
+			d.fail("decode JSON value: %s", err)
+		}
+		return v
+	default:
+		if d.err == nil {
+			d.fail("unknown value type %d", t)
+		}
+		return nil
+	}
+}
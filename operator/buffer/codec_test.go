@@ -0,0 +1,346 @@
+package buffer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/observiq/stanza/entry"
+	"github.com/observiq/stanza/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	testCodecs       = []string{CodecJSON, CodecMsgpack, CodecBinary}
+	testCompressions = []string{CompressionNone, CompressionZstd, CompressionSnappy}
+)
+
+// testCodecEntry returns an entry with a record that is decoded to the same value by every codec
+func testCodecEntry() *entry.Entry {
+	return &entry.Entry{
+		Timestamp:    time.Date(2006, 01, 02, 03, 04, 05, 06, time.UTC),
+		Severity:     entry.Error,
+		SeverityText: "E",
+		Labels:       map[string]string{"label": "value"},
+		Resource:     map[string]string{"host": "test"},
+		Record: map[string]interface{}{
+			"message": "a log message",
+			"ratio":   0.5,
+			"nested": map[string]interface{}{
+				"ok":   true,
+				"list": []interface{}{"a", nil, false},
+			},
+		},
+	}
+}
+
+func TestCodecConfigBuild(t *testing.T) {
+	cases := []struct {
+		name        string
+		config      CodecConfig
+		expectedErr string
+	}{
+		{"Default", CodecConfig{}, ""},
+		{"UpperCase", CodecConfig{Codec: "MSGPACK", Compression: "ZSTD"}, ""},
+		{"UnsupportedCodec", CodecConfig{Codec: "protobuf"}, "unsupported codec 'protobuf'"},
+		{"UnsupportedCompression", CodecConfig{Compression: "gzip"}, "unsupported compression 'gzip'"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := tc.config.build()
+			if tc.expectedErr != "" {
+				require.EqualError(t, err, tc.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestRecordCodec(t *testing.T) {
+	for _, codec := range testCodecs {
+		for _, compression := range testCompressions {
+			t.Run(codec+"/"+compression, func(t *testing.T) {
+				rc, err := CodecConfig{Codec: codec, Compression: compression}.build()
+				require.NoError(t, err)
+
+				record, err := rc.encode(testCodecEntry())
+				require.NoError(t, err)
+				require.Equal(t, rc.legacy(), record[0] == '{', "only uncompressed JSON records are encoded without a header")
+
+				decoded, err := decodeRecord(record)
+				require.NoError(t, err)
+				require.Equal(t, testCodecEntry(), decoded)
+			})
+		}
+	}
+
+	t.Run("LegacyJSON", func(t *testing.T) {
+		// Entries were encoded by a json.Encoder, which appends a newline
+		var buf bytes.Buffer
+		require.NoError(t, json.NewEncoder(&buf).Encode(testCodecEntry()))
+
+		decoded, err := decodeRecord(buf.Bytes())
+		require.NoError(t, err)
+		require.Equal(t, testCodecEntry(), decoded)
+	})
+
+	t.Run("UnknownCodec", func(t *testing.T) {
+		_, err := decodeRecord([]byte{0xF0, 0x00})
+		require.EqualError(t, err, "unknown codec 15")
+	})
+
+	t.Run("UnknownCompression", func(t *testing.T) {
+		_, err := decodeRecord([]byte{0x1F, 0x00})
+		require.EqualError(t, err, "unknown compression 15")
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		_, err := decodeRecord(nil)
+		require.Error(t, err)
+	})
+}
+
+func TestCodecTypes(t *testing.T) {
+	newEntry := func(record interface{}) *entry.Entry {
+		e := testCodecEntry()
+		e.Record = record
+		return e
+	}
+
+	cases := []struct {
+		name     string
+		record   interface{}
+		expected map[string]interface{}
+	}{
+		{
+			"Int",
+			int(-3),
+			map[string]interface{}{CodecJSON: float64(-3), CodecMsgpack: int64(-3), CodecBinary: int64(-3)},
+		},
+		{
+			"Uint",
+			uint32(3),
+			map[string]interface{}{CodecJSON: float64(3), CodecMsgpack: uint64(3), CodecBinary: uint64(3)},
+		},
+		{
+			"Bytes",
+			[]byte("test"),
+			map[string]interface{}{CodecJSON: "dGVzdA==", CodecMsgpack: "test", CodecBinary: []byte("test")},
+		},
+		{
+			"StringMap",
+			map[string]string{"key": "value"},
+			map[string]interface{}{
+				CodecJSON:    map[string]interface{}{"key": "value"},
+				CodecMsgpack: map[string]interface{}{"key": "value"},
+				CodecBinary:  map[string]string{"key": "value"},
+			},
+		},
+		{
+			"Struct",
+			struct {
+				Key string `json:"key"`
+			}{"value"},
+			map[string]interface{}{
+				CodecJSON:    map[string]interface{}{"key": "value"},
+				CodecMsgpack: map[string]interface{}{"Key": "value"},
+				CodecBinary:  map[string]interface{}{"key": "value"},
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		for _, codec := range testCodecs {
+			t.Run(tc.name+"/"+codec, func(t *testing.T) {
+				rc, err := CodecConfig{Codec: codec}.build()
+				require.NoError(t, err)
+
+				record, err := rc.encode(newEntry(tc.record))
+				require.NoError(t, err)
+				decoded, err := decodeRecord(record)
+				require.NoError(t, err)
+				require.Equal(t, newEntry(tc.expected[codec]), decoded)
+			})
+		}
+	}
+}
+
+func TestCodecTimestamp(t *testing.T) {
+	cases := []struct {
+		name      string
+		timestamp time.Time
+	}{
+		{"Zero", time.Time{}},
+		{"FixedZone", time.Date(2006, 01, 02, 03, 04, 05, 06, time.FixedZone("", -7*60*60))},
+		{"BeforeEpoch", time.Date(1900, 01, 02, 03, 04, 05, 06, time.UTC)},
+	}
+
+	for _, tc := range cases {
+		for _, codec := range []string{CodecMsgpack, CodecBinary} {
+			t.Run(tc.name+"/"+codec, func(t *testing.T) {
+				rc, err := CodecConfig{Codec: codec}.build()
+				require.NoError(t, err)
+
+				e := testCodecEntry()
+				e.Timestamp = tc.timestamp
+				record, err := rc.encode(e)
+				require.NoError(t, err)
+				decoded, err := decodeRecord(record)
+				require.NoError(t, err)
+				require.True(t, tc.timestamp.Equal(decoded.Timestamp))
+				_, expectedOffset := tc.timestamp.Zone()
+				_, offset := decoded.Timestamp.Zone()
+				require.Equal(t, expectedOffset, offset)
+			})
+		}
+	}
+}
+
+func TestBinaryCodecInvalid(t *testing.T) {
+	record, err := binaryCodec{}.Encode(nil, testCodecEntry())
+	require.NoError(t, err)
+
+	for i := 0; i < len(record); i++ {
+		var e entry.Entry
+		require.Error(t, binaryCodec{}.Decode(record[:i], &e), "truncated to %d bytes", i)
+	}
+
+	var e entry.Entry
+	require.EqualError(t, binaryCodec{}.Decode(append(record, 0), &e), "1 unexpected bytes after entry")
+}
+
+func TestBufferCodecs(t *testing.T) {
+	builders := map[string]func(t *testing.T, dir string, codec CodecConfig) Builder{
+		"Memory": func(t *testing.T, _ string, codec CodecConfig) Builder {
+			cfg := NewMemoryBufferConfig()
+			cfg.CodecConfig = codec
+			return cfg
+		},
+		"Disk": func(t *testing.T, dir string, codec CodecConfig) Builder {
+			cfg := NewDiskBufferConfig()
+			cfg.Path = dir
+			cfg.CodecConfig = codec
+			return cfg
+		},
+		"WAL": func(t *testing.T, dir string, codec CodecConfig) Builder {
+			cfg := NewWALBufferConfig()
+			cfg.Path = dir
+			cfg.SegmentSize = 1 << 16
+			cfg.CodecConfig = codec
+			return cfg
+		},
+	}
+
+	for name, newBuilder := range builders {
+		newBuilder := newBuilder
+		t.Run(name, func(t *testing.T) {
+			for _, codec := range testCodecs {
+				for _, compression := range testCompressions {
+					config := CodecConfig{Codec: codec, Compression: compression}
+					t.Run(codec+"/"+compression, func(t *testing.T) {
+						t.Parallel()
+						bc := testutil.NewBuildContext(t)
+						dir := testutil.NewTempDir(t)
+
+						b, err := newBuilder(t, dir, config).Build(bc, "test")
+						require.NoError(t, err)
+						writeN(t, b, 20, 0)
+						flushN(t, b, 5, 0)
+						require.NoError(t, b.Close())
+
+						b, err = newBuilder(t, dir, config).Build(bc, "test")
+						require.NoError(t, err)
+						defer b.Close()
+						readN(t, b, 15, 5)
+					})
+				}
+			}
+
+			t.Run("ChangeCodec", func(t *testing.T) {
+				t.Parallel()
+				bc := testutil.NewBuildContext(t)
+				dir := testutil.NewTempDir(t)
+
+				// Entries written with every config can be read after the config changes
+				start := 0
+				for _, codec := range testCodecs {
+					for _, compression := range testCompressions {
+						b, err := newBuilder(t, dir, CodecConfig{Codec: codec, Compression: compression}).Build(bc, "test")
+						require.NoError(t, err)
+						writeN(t, b, 3, start)
+						start += 3
+						require.NoError(t, b.Close())
+					}
+				}
+
+				b, err := newBuilder(t, dir, CodecConfig{}).Build(bc, "test")
+				require.NoError(t, err)
+				defer b.Close()
+				readN(t, b, start, 0)
+			})
+		})
+	}
+}
+
+func BenchmarkCodecs(b *testing.B) {
+	e := entry.New()
+	e.Labels = map[string]string{"file_name": "app.log", "environment": "production"}
+	e.Record = map[string]interface{}{
+		"message":  strings.Repeat("a log message with some repetition ", 4),
+		"level":    "info",
+		"status":   float64(200),
+		"duration": 0.1234,
+	}
+
+	for _, codec := range testCodecs {
+		for _, compression := range testCompressions {
+			rc, err := CodecConfig{Codec: codec, Compression: compression}.build()
+			require.NoError(b, err)
+			record, err := rc.encode(e)
+			require.NoError(b, err)
+
+			name := fmt.Sprintf("%s/%s", codec, compression)
+			b.Run(name+"/Encode", func(b *testing.B) {
+				b.ReportAllocs()
+				b.ReportMetric(float64(len(record)), "bytes/entry")
+				for i := 0; i < b.N; i++ {
+					_, err := rc.encode(e)
+					panicOnErr(err)
+				}
+			})
+
+			b.Run(name+"/Decode", func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					_, err := decodeRecord(record)
+					panicOnErr(err)
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkDiskBufferCodecs(b *testing.B) {
+	for _, codec := range testCodecs {
+		for _, compression := range []string{CompressionNone, CompressionSnappy} {
+			b.Run(codec+"/"+compression, func(b *testing.B) {
+				cfg := NewDiskBufferConfig()
+				cfg.Path = testutil.NewTempDir(b)
+				cfg.MaxSize = 1 << 30
+				cfg.Sync = false
+				cfg.Codec = codec
+				cfg.Compression = compression
+				buffer, err := cfg.Build(testutil.NewBuildContext(b), "test")
+				require.NoError(b, err)
+				defer buffer.Close()
+
+				benchmarkBacklog(b, buffer)
+			})
+		}
+	}
+}
@@ -1,14 +1,15 @@
 package buffer
 
 import (
-	"bytes"
+	"bufio"
 	"context"
-	"encoding/json"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/observiq/stanza/entry"
@@ -34,6 +35,13 @@ type DiskBufferConfig struct {
 
 	MaxChunkDelay helper.Duration `json:"max_delay"   yaml:"max_delay"`
 	MaxChunkSize  uint            `json:"max_chunk_size" yaml:"max_chunk_size"`
+
+	// MaxChunkBytes is the estimated size in bytes after which a chunk is closed.
+	// Chunks are not limited by size if it is zero.
+	MaxChunkBytes helper.ByteSize `json:"max_chunk_bytes,omitempty" yaml:"max_chunk_bytes,omitempty"`
+
+	CodecConfig    `yaml:",inline"`
+	OverflowConfig `yaml:",inline"`
 }
 
 // NewDiskBufferConfig creates a new default disk buffer config
@@ -47,8 +55,14 @@ func NewDiskBufferConfig() *DiskBufferConfig {
 	}
 }
 
+func (c DiskBufferConfig) joinPath(elem string) Builder {
+	c.Path = filepath.Join(c.Path, elem)
+	c.OverflowConfig = c.joinSpillPath(elem)
+	return &c
+}
+
 // Build creates a new Buffer from a DiskBufferConfig
-func (c DiskBufferConfig) Build(context operator.BuildContext, _ string) (Buffer, error) {
+func (c DiskBufferConfig) Build(context operator.BuildContext, pluginID string) (Buffer, error) {
 	maxSize := c.MaxSize
 	if maxSize == 0 {
 		maxSize = 1 << 32
@@ -57,18 +71,32 @@ func (c DiskBufferConfig) Build(context operator.BuildContext, _ string) (Buffer
 	if c.Path == "" {
 		return nil, fmt.Errorf("missing required field 'path'")
 	}
+	if c.MaxChunkBytes < 0 {
+		return nil, fmt.Errorf("'max_chunk_bytes' cannot be negative")
+	}
+	codec, err := c.CodecConfig.build()
+	if err != nil {
+		return nil, err
+	}
+
 	b := NewDiskBuffer(int64(maxSize))
+	b.codec = codec
 	if err := b.Open(c.Path, c.Sync); err != nil {
 		return nil, err
 	}
 	b.maxChunkSize = c.MaxChunkSize
 	b.maxChunkDelay = c.MaxChunkDelay.Raw()
-	return b, nil
+	b.maxChunkBytes = int(c.MaxChunkBytes)
+	return c.OverflowConfig.wrap(context, pluginID, b)
 }
 
 // DiskBuffer is a buffer for storing entries on disk until they are flushed to their
 // final destination.
 type DiskBuffer struct {
+	// unreadBytes is the size of the unread entries in the data file. It is
+	// accessed atomically so that readers can check it without the lock.
+	unreadBytes int64
+
 	// Metadata holds information about the current state of the buffered entries
 	metadata *Metadata
 
@@ -103,6 +131,10 @@ type DiskBuffer struct {
 
 	maxChunkDelay time.Duration
 	maxChunkSize  uint
+	maxChunkBytes int
+
+	// codec encodes new entries
+	codec *recordCodec
 
 	reconfigMutex sync.RWMutex
 }
@@ -114,11 +146,17 @@ func NewDiskBuffer(maxDiskSize int64) *DiskBuffer {
 		entryAdded:        make(chan int64, 1),
 		copyBuffer:        make([]byte, 1<<16),
 		diskSizeSemaphore: semaphore.NewWeighted(int64(maxDiskSize)),
+		codec:             defaultRecordCodec,
 	}
 }
 
 // Open opens the disk buffer files from a database directory
 func (d *DiskBuffer) Open(path string, sync bool) error {
+	// The directory of an output that inherits the buffer from the defaults may not exist yet
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return err
+	}
+
 	var err error
 	dataPath := filepath.Join(path, "data")
 	flags := os.O_CREATE | os.O_RDWR
@@ -156,6 +194,10 @@ func (d *DiskBuffer) Open(path string, sync bool) error {
 
 	// Once everything is compacted, we can safely reset all previously read, but
 	// unflushed entries to unread
+	if info, err = d.data.Stat(); err != nil {
+		return err
+	}
+	atomic.StoreInt64(&d.unreadBytes, info.Size())
 	d.metadata.unreadStartOffset = 0
 	d.addUnreadCount(int64(len(d.metadata.read)))
 	d.metadata.read = d.metadata.read[:0]
@@ -176,29 +218,114 @@ func (d *DiskBuffer) Close() error {
 // Add adds an entry to the buffer, blocking until it is either added or the context
 // is cancelled.
 func (d *DiskBuffer) Add(ctx context.Context, newEntry *entry.Entry) error {
-	var buf bytes.Buffer
-	var err error
-	enc := json.NewEncoder(&buf)
-	if err := enc.Encode(newEntry); err != nil {
+	record, err := d.encode(newEntry)
+	if err != nil {
 		return err
 	}
 
-	if err = d.diskSizeSemaphore.Acquire(ctx, int64(buf.Len())); err != nil {
+	if err := d.diskSizeSemaphore.Acquire(ctx, int64(len(record))); err != nil {
 		return err
 	}
 
+	return d.write(record)
+}
+
+// tryAdd adds an entry to the buffer if there is space for it. If there is not,
+// flushed entries are compacted first to make space.
+func (d *DiskBuffer) tryAdd(newEntry *entry.Entry) (bool, error) {
+	record, err := d.encode(newEntry)
+	if err != nil {
+		return false, err
+	}
+
+	size := int64(len(record))
+	if !d.diskSizeSemaphore.TryAcquire(size) {
+		d.Lock()
+		flushedBytes := d.flushedBytes
+		d.Unlock()
+		if flushedBytes < size {
+			return false, nil
+		}
+
+		if err := d.Compact(); err != nil {
+			return false, err
+		}
+		if !d.diskSizeSemaphore.TryAcquire(size) {
+			return false, nil
+		}
+	}
+
+	return true, d.write(record)
+}
+
+// encode encodes an entry into a record of the data file. Records encoded as JSON
+// without compression end with a newline. Other records are framed by their header
+// byte, followed by the length of the rest of the record as a uvarint.
+func (d *DiskBuffer) encode(newEntry *entry.Entry) ([]byte, error) {
+	record, err := d.codec.encode(newEntry)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.codec.legacy() {
+		return append(record, '\n'), nil
+	}
+
+	framed := make([]byte, 0, len(record)+binary.MaxVarintLen64)
+	framed = append(framed, record[0])
+	framed = appendUvarint(framed, uint64(len(record)-1))
+	return append(framed, record[1:]...), nil
+}
+
+// readRecord reads and decodes the next record of the data file. It returns
+// the decoded entry and the length of the record in the data file.
+func readRecord(rd *bufio.Reader) (*entry.Entry, int64, error) {
+	header, err := rd.ReadByte()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if header == '{' {
+		if err := rd.UnreadByte(); err != nil {
+			return nil, 0, err
+		}
+		line, err := rd.ReadBytes('\n')
+		if err != nil {
+			return nil, 0, err
+		}
+		e, err := decodeRecord(line)
+		return e, int64(len(line)), err
+	}
+
+	size, err := binary.ReadUvarint(rd)
+	if err != nil {
+		return nil, 0, err
+	}
+	record := make([]byte, size+1)
+	record[0] = header
+	if _, err := io.ReadFull(rd, record[1:]); err != nil {
+		return nil, 0, err
+	}
+	e, err := decodeRecord(record)
+	return e, int64(len(record) + len(appendUvarint(nil, size))), err
+}
+
+// write appends an encoded entry to the end of the data file. Space for
+// the entry must have been acquired from the disk size semaphore.
+func (d *DiskBuffer) write(encoded []byte) error {
 	d.Lock()
 	defer d.Unlock()
 
 	// Seek to end of the file if we're not there
-	if err = d.seekToEnd(); err != nil {
+	if err := d.seekToEnd(); err != nil {
 		return err
 	}
 
-	if _, err = d.data.Write(buf.Bytes()); err != nil {
+	if _, err := d.data.Write(encoded); err != nil {
 		return err
 	}
 
+	atomic.AddInt64(&d.unreadBytes, int64(len(encoded)))
 	d.addUnreadCount(1)
 
 	return nil
@@ -220,14 +347,16 @@ func (d *DiskBuffer) addUnreadCount(i int64) {
 }
 
 // ReadWait reads entries from the buffer, waiting until either there are enough entries in the
-// buffer to fill dst or the context is cancelled. This amortizes the cost of reading from the
-// disk. It returns a function that, when called, marks the read entries as flushed, the
-// number of entries read, and an error.
+// buffer to fill dst or the maximum size of a chunk, or the context is cancelled. This amortizes
+// the cost of reading from the disk. It returns a function that, when called, marks the read
+// entries as flushed, the number of entries read, and an error.
 func (d *DiskBuffer) ReadWait(ctx context.Context, dst []*entry.Entry) (Clearer, int, error) {
 	d.readerLock.Lock()
 	defer d.readerLock.Unlock()
 
-	// Wait until the timeout is hit, or there are enough unread entries to fill the destination buffer
+	// Wait until the timeout is hit, or there are enough unread entries to fill the destination buffer.
+	// The size of the unread entries in the data file approximates the size of a chunk of them.
+	maxChunkBytes := int64(d.MaxChunkBytes())
 LOOP:
 	for {
 		select {
@@ -235,6 +364,9 @@ LOOP:
 			if n >= int64(len(dst)) {
 				break LOOP
 			}
+			if maxChunkBytes > 0 && atomic.LoadInt64(&d.unreadBytes) >= maxChunkBytes {
+				break LOOP
+			}
 		case <-ctx.Done():
 			break LOOP
 		}
@@ -262,8 +394,9 @@ func (d *DiskBuffer) ReadChunk(ctx context.Context) ([]*entry.Entry, Clearer, er
 	}
 }
 
-// Read copies entries from the disk into the destination buffer. It returns a function that,
-// when called, marks the entries as flushed, the number of entries read, and an error.
+// Read copies entries from the disk into the destination buffer, until it is full or the chunk
+// has reached its maximum size. It returns a function that, when called, marks the entries
+// as flushed, the number of entries read, and an error.
 func (d *DiskBuffer) Read(dst []*entry.Entry) (f Clearer, i int, err error) {
 	d.Lock()
 	defer d.Unlock()
@@ -281,20 +414,26 @@ func (d *DiskBuffer) Read(dst []*entry.Entry) (f Clearer, i int, err error) {
 	readCount := min(len(dst), int(d.metadata.unreadCount))
 	newRead := make([]*readEntry, readCount)
 
-	dec := json.NewDecoder(d.data)
+	rd := bufio.NewReader(d.data)
+	sizer := chunkSizer{maxBytes: d.MaxChunkBytes()}
 	startOffset := d.metadata.unreadStartOffset
 	for i := 0; i < readCount; i++ {
 		// Decode an entry from the file
-		var entry entry.Entry
-		err := dec.Decode(&entry)
+		entry, length, err := readRecord(rd)
 		if err != nil {
 			return nil, 0, fmt.Errorf("decode: %s", err)
 		}
-		dst[i] = &entry
 
-		// Calculate the end offset of the entry. We add one because
-		// the decoder doesn't consume the newline at the end of every entry
-		endOffset := d.metadata.unreadStartOffset + dec.InputOffset() + 1
+		// An entry that does not fit into the chunk stays unread
+		if !sizer.fits(entry) {
+			readCount = i
+			newRead = newRead[:i]
+			break
+		}
+		dst[i] = entry
+
+		// Calculate the end offset of the entry
+		endOffset := startOffset + length
 		newRead[i] = &readEntry{
 			startOffset: startOffset,
 			length:      endOffset - startOffset,
@@ -305,6 +444,7 @@ func (d *DiskBuffer) Read(dst []*entry.Entry) (f Clearer, i int, err error) {
 	}
 
 	// Set the offset for the next unread entry
+	atomic.AddInt64(&d.unreadBytes, d.metadata.unreadStartOffset-startOffset)
 	d.metadata.unreadStartOffset = startOffset
 
 	// Keep track of the newly read entries
@@ -316,6 +456,24 @@ func (d *DiskBuffer) Read(dst []*entry.Entry) (f Clearer, i int, err error) {
 	return d.newClearer(newRead), readCount, nil
 }
 
+// Unread returns the number of entries in the buffer that have not been read
+func (d *DiskBuffer) Unread() int64 {
+	d.Lock()
+	defer d.Unlock()
+	return d.metadata.unreadCount
+}
+
+// Usage returns the fraction of the max size of the buffer that the data file takes
+func (d *DiskBuffer) Usage() float64 {
+	d.Lock()
+	defer d.Unlock()
+	info, err := d.data.Stat()
+	if err != nil {
+		return 0
+	}
+	return usage(info.Size(), d.maxBytes)
+}
+
 func (d *DiskBuffer) MaxChunkSize() uint {
 	d.reconfigMutex.RLock()
 	defer d.reconfigMutex.RUnlock()
@@ -328,6 +486,13 @@ func (d *DiskBuffer) MaxChunkDelay() time.Duration {
 	return d.maxChunkDelay
 }
 
+// MaxChunkBytes returns the estimated size in bytes after which a chunk is closed
+func (d *DiskBuffer) MaxChunkBytes() int {
+	d.reconfigMutex.RLock()
+	defer d.reconfigMutex.RUnlock()
+	return d.maxChunkBytes
+}
+
 func (d *DiskBuffer) SetMaxChunkSize(size uint) {
 	d.reconfigMutex.Lock()
 	d.maxChunkSize = size
@@ -340,6 +505,13 @@ func (d *DiskBuffer) SetMaxChunkDelay(delay time.Duration) {
 	d.reconfigMutex.Unlock()
 }
 
+// SetMaxChunkBytes sets the estimated size in bytes after which a chunk is closed
+func (d *DiskBuffer) SetMaxChunkBytes(size int) {
+	d.reconfigMutex.Lock()
+	d.maxChunkBytes = size
+	d.reconfigMutex.Unlock()
+}
+
 // newFlushFunc returns a function that marks read entries as flushed
 func (d *DiskBuffer) newClearer(newRead []*readEntry) Clearer {
 	return &diskClearer{
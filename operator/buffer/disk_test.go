@@ -11,6 +11,7 @@ import (
 	"testing"
 
 	"github.com/observiq/stanza/entry"
+	"github.com/observiq/stanza/operator/helper"
 	"github.com/observiq/stanza/testutil"
 	"github.com/stretchr/testify/require"
 )
@@ -255,6 +256,43 @@ func TestDiskBuffer(t *testing.T) {
 	})
 }
 
+func TestDiskBufferMaxChunkBytes(t *testing.T) {
+	cfg := NewDiskBufferConfig()
+	cfg.Path = testutil.NewTempDir(t)
+	cfg.Sync = false
+	cfg.MaxChunkDelay = helper.NewDuration(time.Minute)
+	cfg.MaxChunkBytes = helper.ByteSize(2*estimateSize(intEntry(0)) + 1)
+	b, err := cfg.Build(testutil.NewBuildContext(t), "test")
+	require.NoError(t, err)
+
+	writeN(t, b, 5, 0)
+
+	// The chunk is closed by size before max_delay or max_chunk_size is hit
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	entries, clearer, err := b.ReadChunk(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []*entry.Entry{intEntry(0), intEntry(1)}, entries)
+	require.NoError(t, clearer.MarkAllAsFlushed())
+
+	// The entry that did not fit into the chunk stays unread
+	readN(t, b, 2, 2)
+	readN(t, b, 1, 4)
+	require.Zero(t, b.(*DiskBuffer).unreadBytes)
+
+	// Read but unflushed entries are unread again after reopening
+	require.NoError(t, b.Close())
+	b, err = cfg.Build(testutil.NewBuildContext(t), "test")
+	require.NoError(t, err)
+	defer b.Close()
+	diskBuffer := b.(*DiskBuffer)
+	require.Equal(t, int64(3), diskBuffer.metadata.unreadCount)
+	info, err := diskBuffer.data.Stat()
+	require.NoError(t, err)
+	require.Equal(t, info.Size(), diskBuffer.unreadBytes)
+	readN(t, b, 2, 2)
+}
+
 func TestDiskBufferBuild(t *testing.T) {
 	t.Run("Default", func(t *testing.T) {
 		cfg := NewDiskBufferConfig()
@@ -1,11 +1,10 @@
 package buffer
 
 import (
-	"bytes"
 	"context"
 	"encoding/binary"
-	"encoding/json"
 	"fmt"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -15,6 +14,7 @@ import (
 	"github.com/observiq/stanza/operator"
 	"github.com/observiq/stanza/operator/helper"
 	"go.etcd.io/bbolt"
+	"go.uber.org/zap"
 	"golang.org/x/sync/semaphore"
 )
 
@@ -24,6 +24,17 @@ type MemoryBufferConfig struct {
 	MaxEntries    int             `json:"max_entries" yaml:"max_entries"`
 	MaxChunkDelay helper.Duration `json:"max_delay"   yaml:"max_delay"`
 	MaxChunkSize  uint            `json:"max_chunk_size" yaml:"max_chunk_size"`
+
+	// MaxChunkBytes is the estimated size in bytes after which a chunk is closed.
+	// Chunks are not limited by size if it is zero.
+	MaxChunkBytes helper.ByteSize `json:"max_chunk_bytes,omitempty" yaml:"max_chunk_bytes,omitempty"`
+
+	// CheckpointInterval is the interval at which new entries are saved to the database
+	// and flushed entries are removed from it. Checkpointing is disabled if it is zero.
+	CheckpointInterval helper.Duration `json:"checkpoint_interval,omitempty" yaml:"checkpoint_interval,omitempty"`
+
+	CodecConfig    `yaml:",inline"`
+	OverflowConfig `yaml:",inline"`
 }
 
 // NewMemoryBufferConfig creates a new default MemoryBufferConfig
@@ -36,39 +47,91 @@ func NewMemoryBufferConfig() *MemoryBufferConfig {
 	}
 }
 
+func (c MemoryBufferConfig) joinPath(elem string) Builder {
+	c.OverflowConfig = c.joinSpillPath(elem)
+	return &c
+}
+
 // Build builds a MemoryBufferConfig into a Buffer, loading any entries that were previously unflushed
 // back into memory
 func (c MemoryBufferConfig) Build(context operator.BuildContext, pluginID string) (Buffer, error) {
+	if c.CheckpointInterval.Raw() < 0 {
+		return nil, fmt.Errorf("'checkpoint_interval' cannot be negative")
+	}
+	if c.MaxChunkBytes < 0 {
+		return nil, fmt.Errorf("'max_chunk_bytes' cannot be negative")
+	}
+
+	codec, err := c.CodecConfig.build()
+	if err != nil {
+		return nil, err
+	}
+
 	mb := &MemoryBuffer{
-		db:            context.Database,
-		pluginID:      pluginID,
-		buf:           make(chan *entry.Entry, c.MaxEntries),
-		sem:           semaphore.NewWeighted(int64(c.MaxEntries)),
-		inFlight:      make(map[uint64]*entry.Entry, c.MaxEntries),
-		maxChunkDelay: c.MaxChunkDelay.Raw(),
-		maxChunkSize:  c.MaxChunkSize,
+		db:                 context.Database,
+		pluginID:           pluginID,
+		buf:                make(chan memoryEntry, c.MaxEntries),
+		sem:                semaphore.NewWeighted(int64(c.MaxEntries)),
+		inFlight:           make(map[uint64]*entry.Entry, c.MaxEntries),
+		maxChunkDelay:      c.MaxChunkDelay.Raw(),
+		maxChunkSize:       c.MaxChunkSize,
+		maxChunkBytes:      int(c.MaxChunkBytes),
+		checkpointInterval: c.CheckpointInterval.Raw(),
+		codec:              codec,
+		logger:             zap.NewNop().Sugar(),
+	}
+	if context.Logger != nil {
+		mb.logger = context.Logger.SugaredLogger
 	}
 	if err := mb.loadFromDB(); err != nil {
 		return nil, err
 	}
+	mb.startCheckpoints()
 
-	return mb, nil
+	return c.OverflowConfig.wrap(context, pluginID, mb)
 }
 
 // MemoryBuffer is a buffer that holds all entries in memory until Close() is called,
-// at which point it saves the entries into a database. It provides no guarantees about
-// lost entries if shut down uncleanly.
+// at which point it saves the entries into a database. Unless checkpointing is enabled,
+// it provides no guarantees about lost entries if shut down uncleanly.
 type MemoryBuffer struct {
 	entryID       uint64
 	db            database.Database
 	pluginID      string
-	buf           chan *entry.Entry
+	buf           chan memoryEntry
 	inFlight      map[uint64]*entry.Entry
 	inFlightMux   sync.Mutex
 	sem           *semaphore.Weighted
 	maxChunkDelay time.Duration
 	maxChunkSize  uint
+	maxChunkBytes int
 	reconfigMutex sync.RWMutex
+	codec         *recordCodec
+	logger        *zap.SugaredLogger
+
+	// pending is an entry that was taken from buf, but did not fit into the chunk
+	// that was being read. It is the first entry of the next chunk.
+	pending    *memoryEntry
+	pendingMux sync.Mutex
+
+	// checkpointInterval is the interval at which the changes to the buffer
+	// are saved to the database. Checkpointing is disabled if it is zero.
+	checkpointInterval time.Duration
+
+	// added holds the entries that were added since the last checkpoint, and removed
+	// holds the ids of the entries that were flushed or dropped since the last checkpoint.
+	// They are only tracked if checkpointing is enabled.
+	added          map[uint64]*entry.Entry
+	removed        map[uint64]struct{}
+	checkpointMux  sync.Mutex
+	stopCheckpoint context.CancelFunc
+	checkpointWg   sync.WaitGroup
+}
+
+// memoryEntry is an entry in a memory buffer together with its id
+type memoryEntry struct {
+	id    uint64
+	entry *entry.Entry
 }
 
 // Add inserts an entry into the memory database, blocking until there is space
@@ -77,31 +140,80 @@ func (m *MemoryBuffer) Add(ctx context.Context, e *entry.Entry) error {
 		return err
 	}
 
-	m.buf <- e
+	m.push(e)
 	return nil
 }
 
-// Read reads entries until either there are no entries left in the buffer
-// or the destination slice is full. The returned function must be called
-// once the entries are flushed to remove them from the memory buffer.
-func (m *MemoryBuffer) Read(dst []*entry.Entry) (Clearer, int, error) {
-	inFlight := make([]uint64, len(dst))
-	i := 0
-	for ; i < len(dst); i++ {
-		select {
-		case e := <-m.buf:
-			dst[i] = e
-			id := atomic.AddUint64(&m.entryID, 1)
-			m.inFlightMux.Lock()
-			m.inFlight[id] = e
-			m.inFlightMux.Unlock()
-			inFlight[i] = id
-		default:
-			return m.newClearer(inFlight[:i]), i, nil
+// tryAdd inserts an entry into the memory database if there is space for it
+func (m *MemoryBuffer) tryAdd(e *entry.Entry) (bool, error) {
+	if !m.sem.TryAcquire(1) {
+		return false, nil
+	}
+
+	m.push(e)
+	return true, nil
+}
+
+// replaceOldest drops the oldest unread entry and inserts e in its place. The space
+// of the dropped entry is reused, so inserting e never blocks.
+func (m *MemoryBuffer) replaceOldest(e *entry.Entry) bool {
+	m.pendingMux.Lock()
+	pending := m.pending
+	m.pending = nil
+	m.pendingMux.Unlock()
+	if pending != nil {
+		m.markRemoved([]uint64{pending.id})
+		m.push(e)
+		return true
+	}
+
+	select {
+	case oldest := <-m.buf:
+		m.markRemoved([]uint64{oldest.id})
+		m.push(e)
+		return true
+	default:
+		return false
+	}
+}
+
+// push assigns an id to an entry and inserts it into the buffer. Space for
+// the entry must have been acquired from the semaphore.
+func (m *MemoryBuffer) push(e *entry.Entry) {
+	id := atomic.AddUint64(&m.entryID, 1)
+	if m.checkpointInterval > 0 {
+		m.checkpointMux.Lock()
+		m.added[id] = e
+		m.checkpointMux.Unlock()
+	}
+	m.buf <- memoryEntry{id: id, entry: e}
+}
+
+// markRemoved records that entries were removed from the buffer, so that they are
+// removed from the database by the next checkpoint
+func (m *MemoryBuffer) markRemoved(ids []uint64) {
+	if m.checkpointInterval <= 0 {
+		return
+	}
+
+	m.checkpointMux.Lock()
+	defer m.checkpointMux.Unlock()
+	for _, id := range ids {
+		if _, ok := m.added[id]; ok {
+			// The entry was never saved, so there is nothing to remove
+			delete(m.added, id)
+			continue
 		}
+		m.removed[id] = struct{}{}
 	}
+}
 
-	return m.newClearer(inFlight[:i]), i, nil
+// Read reads entries until either there are no entries left in the buffer,
+// the destination slice is full, or the chunk has reached its maximum size.
+// The returned function must be called once the entries are flushed to remove
+// them from the memory buffer.
+func (m *MemoryBuffer) Read(dst []*entry.Entry) (Clearer, int, error) {
+	return m.read(nil, dst)
 }
 
 // ReadChunk is a thin wrapper around ReadWait that simplifies the call at the expense of an extra allocation
@@ -123,27 +235,88 @@ func (m *MemoryBuffer) ReadChunk(ctx context.Context) ([]*entry.Entry, Clearer,
 	}
 }
 
-// ReadWait reads entries until either the destination slice is full, or the context passed to it
-// is cancelled. The returned function must be called once the entries are flushed to remove them
-// from the memory buffer
+// ReadWait reads entries until either the destination slice is full, the chunk has reached its
+// maximum size, or the context passed to it is cancelled. The returned function must be called
+// once the entries are flushed to remove them from the memory buffer
 func (m *MemoryBuffer) ReadWait(ctx context.Context, dst []*entry.Entry) (Clearer, int, error) {
+	return m.read(ctx.Done(), dst)
+}
+
+// read reads entries into dst. If done is nil, it stops once there are no entries left.
+// Otherwise, it waits for new entries until done is closed.
+func (m *MemoryBuffer) read(done <-chan struct{}, dst []*entry.Entry) (Clearer, int, error) {
+	sizer := chunkSizer{maxBytes: m.MaxChunkBytes()}
 	inFlightIDs := make([]uint64, len(dst))
 	i := 0
-	for ; i < len(dst); i++ {
+	for ; i < len(dst) && !sizer.full(); i++ {
+		e, ok := m.next(done)
+		if !ok {
+			break
+		}
+		if !sizer.fits(e.entry) {
+			m.pendingMux.Lock()
+			m.pending = &e
+			m.pendingMux.Unlock()
+			break
+		}
+
+		dst[i] = e.entry
+		m.inFlightMux.Lock()
+		m.inFlight[e.id] = e.entry
+		m.inFlightMux.Unlock()
+		inFlightIDs[i] = e.id
+	}
+
+	return m.newClearer(inFlightIDs[:i]), i, nil
+}
+
+// next returns the pending entry, or the next entry in the buffer. If done is nil,
+// it returns false if there is no entry. Otherwise, it waits for an entry until
+// done is closed.
+func (m *MemoryBuffer) next(done <-chan struct{}) (memoryEntry, bool) {
+	m.pendingMux.Lock()
+	if pending := m.pending; pending != nil {
+		m.pending = nil
+		m.pendingMux.Unlock()
+		return *pending, true
+	}
+	m.pendingMux.Unlock()
+
+	if done == nil {
 		select {
 		case e := <-m.buf:
-			dst[i] = e
-			id := atomic.AddUint64(&m.entryID, 1)
-			m.inFlightMux.Lock()
-			m.inFlight[id] = e
-			m.inFlightMux.Unlock()
-			inFlightIDs[i] = id
-		case <-ctx.Done():
-			return m.newClearer(inFlightIDs[:i]), i, nil
+			return e, true
+		default:
+			return memoryEntry{}, false
 		}
 	}
 
-	return m.newClearer(inFlightIDs[:i]), i, nil
+	select {
+	case e := <-m.buf:
+		return e, true
+	case <-done:
+		return memoryEntry{}, false
+	}
+}
+
+// Unread returns the number of entries in the buffer that have not been read
+func (m *MemoryBuffer) Unread() int64 {
+	unread := int64(len(m.buf))
+	m.pendingMux.Lock()
+	if m.pending != nil {
+		unread++
+	}
+	m.pendingMux.Unlock()
+	return unread
+}
+
+// Usage returns the fraction of the max entries of the buffer that are held, including
+// the entries that were read but not flushed yet
+func (m *MemoryBuffer) Usage() float64 {
+	m.inFlightMux.Lock()
+	held := len(m.inFlight)
+	m.inFlightMux.Unlock()
+	return usage(int64(held)+m.Unread(), int64(cap(m.buf)))
 }
 
 func (m *MemoryBuffer) MaxChunkSize() uint {
@@ -158,6 +331,13 @@ func (m *MemoryBuffer) MaxChunkDelay() time.Duration {
 	return m.maxChunkDelay
 }
 
+// MaxChunkBytes returns the estimated size in bytes after which a chunk is closed
+func (m *MemoryBuffer) MaxChunkBytes() int {
+	m.reconfigMutex.RLock()
+	defer m.reconfigMutex.RUnlock()
+	return m.maxChunkBytes
+}
+
 func (m *MemoryBuffer) SetMaxChunkSize(size uint) {
 	m.reconfigMutex.Lock()
 	m.maxChunkSize = size
@@ -170,6 +350,13 @@ func (m *MemoryBuffer) SetMaxChunkDelay(delay time.Duration) {
 	m.reconfigMutex.Unlock()
 }
 
+// SetMaxChunkBytes sets the estimated size in bytes after which a chunk is closed
+func (m *MemoryBuffer) SetMaxChunkBytes(size int) {
+	m.reconfigMutex.Lock()
+	m.maxChunkBytes = size
+	m.reconfigMutex.Unlock()
+}
+
 type memoryClearer struct {
 	buffer *MemoryBuffer
 	ids    []uint64
@@ -181,6 +368,7 @@ func (mc *memoryClearer) MarkAllAsFlushed() error {
 		delete(mc.buffer.inFlight, id)
 	}
 	mc.buffer.inFlightMux.Unlock()
+	mc.buffer.markRemoved(mc.ids)
 	mc.buffer.sem.Release(int64(len(mc.ids)))
 	return nil
 }
@@ -195,6 +383,7 @@ func (mc *memoryClearer) MarkRangeAsFlushed(start, end uint) error {
 		delete(mc.buffer.inFlight, id)
 	}
 	mc.buffer.inFlightMux.Unlock()
+	mc.buffer.markRemoved(mc.ids[start:end])
 	mc.buffer.sem.Release(int64(end - start))
 	return nil
 }
@@ -210,6 +399,8 @@ func (m *MemoryBuffer) newClearer(ids []uint64) Clearer {
 // Close closes the memory buffer, saving all entries currently in the memory buffer to the
 // agent's database.
 func (m *MemoryBuffer) Close() error {
+	m.stopCheckpoints()
+
 	m.inFlightMux.Lock()
 	defer m.inFlightMux.Unlock()
 	return m.db.Update(func(tx *bbolt.Tx) error {
@@ -218,13 +409,30 @@ func (m *MemoryBuffer) Close() error {
 			return err
 		}
 
-		b, err := memBufBucket.CreateBucketIfNotExists([]byte(m.pluginID))
+		// Entries that were saved before are replaced, so that flushed entries are not loaded again
+		if memBufBucket.Bucket([]byte(m.pluginID)) != nil {
+			if err := memBufBucket.DeleteBucket([]byte(m.pluginID)); err != nil {
+				return err
+			}
+		}
+
+		b, err := memBufBucket.CreateBucket([]byte(m.pluginID))
 		if err != nil {
 			return err
 		}
 
 		for k, v := range m.inFlight {
-			if err := putKeyValue(b, k, v); err != nil {
+			if err := m.putKeyValue(b, k, v); err != nil {
+				return err
+			}
+		}
+
+		m.pendingMux.Lock()
+		pending := m.pending
+		m.pending = nil
+		m.pendingMux.Unlock()
+		if pending != nil {
+			if err := m.putKeyValue(b, pending.id, pending.entry); err != nil {
 				return err
 			}
 		}
@@ -232,8 +440,7 @@ func (m *MemoryBuffer) Close() error {
 		for {
 			select {
 			case e := <-m.buf:
-				m.entryID++
-				if err := putKeyValue(b, m.entryID, e); err != nil {
+				if err := m.putKeyValue(b, e.id, e.entry); err != nil {
 					return err
 				}
 			default:
@@ -243,22 +450,121 @@ func (m *MemoryBuffer) Close() error {
 	})
 }
 
-func putKeyValue(b *bbolt.Bucket, k uint64, v *entry.Entry) error {
-	var buf bytes.Buffer
-	enc := json.NewEncoder(&buf)
-	key := [8]byte{}
+// startCheckpoints starts saving the changes to the buffer to the database
+// at the checkpoint interval, if checkpointing is enabled
+func (m *MemoryBuffer) startCheckpoints() {
+	if m.checkpointInterval <= 0 {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	m.stopCheckpoint = cancel
+	m.checkpointWg.Add(1)
+	go func() {
+		defer m.checkpointWg.Done()
+		ticker := time.NewTicker(m.checkpointInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := m.checkpoint(); err != nil {
+					m.logger.Errorw("Failed to checkpoint memory buffer", zap.Error(err))
+				}
+			}
+		}
+	}()
+}
+
+// stopCheckpoints stops the checkpoints and waits for a running checkpoint to complete
+func (m *MemoryBuffer) stopCheckpoints() {
+	if m.stopCheckpoint == nil {
+		return
+	}
+	m.stopCheckpoint()
+	m.checkpointWg.Wait()
+}
+
+// checkpoint saves the entries that were added since the last checkpoint to the
+// database, and removes the entries that were flushed since the last checkpoint
+func (m *MemoryBuffer) checkpoint() error {
+	m.checkpointMux.Lock()
+	added, removed := m.added, m.removed
+	m.added, m.removed = make(map[uint64]*entry.Entry), make(map[uint64]struct{})
+	m.checkpointMux.Unlock()
+
+	if len(added) == 0 && len(removed) == 0 {
+		return nil
+	}
 
+	err := m.db.Update(func(tx *bbolt.Tx) error {
+		memBufBucket, err := tx.CreateBucketIfNotExists([]byte("memory_buffer"))
+		if err != nil {
+			return err
+		}
+
+		b, err := memBufBucket.CreateBucketIfNotExists([]byte(m.pluginID))
+		if err != nil {
+			return err
+		}
+
+		for k, v := range added {
+			if err := m.putKeyValue(b, k, v); err != nil {
+				return err
+			}
+		}
+
+		key := [8]byte{}
+		for k := range removed {
+			binary.LittleEndian.PutUint64(key[:], k)
+			if err := b.Delete(key[:]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		// Keep the changes for the next checkpoint. Entries that were removed in
+		// the meantime were never saved, so they are not saved now either.
+		m.checkpointMux.Lock()
+		for k, v := range added {
+			if _, ok := m.removed[k]; ok {
+				delete(m.removed, k)
+				continue
+			}
+			m.added[k] = v
+		}
+		for k := range removed {
+			m.removed[k] = struct{}{}
+		}
+		m.checkpointMux.Unlock()
+	}
+	return err
+}
+
+// putKeyValue saves an entry to the database, encoded with the codec of the buffer
+func (m *MemoryBuffer) putKeyValue(b *bbolt.Bucket, k uint64, v *entry.Entry) error {
+	key := [8]byte{}
 	binary.LittleEndian.PutUint64(key[:], k)
-	if err := enc.Encode(v); err != nil {
+
+	record, err := m.codec.encode(v)
+	if err != nil {
 		return err
 	}
-	return b.Put(key[:], buf.Bytes())
+	return b.Put(key[:], record)
 }
 
 // loadFromDB loads any entries saved to the database previously into the memory buffer,
-// allowing them to be flushed
+// allowing them to be flushed. The entries keep their ids, so that they can be removed
+// from the database by a checkpoint once they are flushed.
 func (m *MemoryBuffer) loadFromDB() error {
-	return m.db.Update(func(tx *bbolt.Tx) error {
+	if m.checkpointInterval > 0 {
+		m.added = make(map[uint64]*entry.Entry)
+		m.removed = make(map[uint64]struct{})
+	}
+
+	return m.db.View(func(tx *bbolt.Tx) error {
 		memBufBucket := tx.Bucket([]byte("memory_buffer"))
 		if memBufBucket == nil {
 			return nil
@@ -269,23 +575,36 @@ func (m *MemoryBuffer) loadFromDB() error {
 			return nil
 		}
 
-		return b.ForEach(func(k, v []byte) error {
-			if ok := m.sem.TryAcquire(1); !ok {
-				return fmt.Errorf("max_entries is smaller than the number of entries stored in the database")
+		var entries []memoryEntry
+		err := b.ForEach(func(k, v []byte) error {
+			e, err := decodeRecord(v)
+			if err != nil {
+				return err
 			}
+			entries = append(entries, memoryEntry{id: binary.LittleEndian.Uint64(k), entry: e})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
 
-			dec := json.NewDecoder(bytes.NewReader(v))
-			var e entry.Entry
-			if err := dec.Decode(&e); err != nil {
-				return err
+		// Keys are little endian, so they are not iterated in the order the entries were added
+		sort.Slice(entries, func(i, j int) bool { return entries[i].id < entries[j].id })
+		for _, e := range entries {
+			if ok := m.sem.TryAcquire(1); !ok {
+				return fmt.Errorf("max_entries is smaller than the number of entries stored in the database")
 			}
 
 			select {
-			case m.buf <- &e:
-				return nil
+			case m.buf <- e:
 			default:
 				return fmt.Errorf("max_entries is smaller than the number of entries stored in the database")
 			}
-		})
+
+			if e.id > m.entryID {
+				m.entryID = e.id
+			}
+		}
+		return nil
 	})
 }
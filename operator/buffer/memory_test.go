@@ -10,8 +10,11 @@ import (
 	"testing"
 
 	"github.com/observiq/stanza/entry"
+	"github.com/observiq/stanza/operator"
+	"github.com/observiq/stanza/operator/helper"
 	"github.com/observiq/stanza/testutil"
 	"github.com/stretchr/testify/require"
+	"go.etcd.io/bbolt"
 )
 
 func newMemoryBuffer(t testing.TB) *MemoryBuffer {
@@ -214,6 +217,38 @@ func TestMemoryBuffer(t *testing.T) {
 		})
 	})
 
+	t.Run("MaxChunkBytes", func(t *testing.T) {
+		t.Parallel()
+		cfg := NewMemoryBufferConfig()
+		cfg.MaxChunkDelay = helper.NewDuration(time.Minute)
+		cfg.MaxChunkBytes = helper.ByteSize(2*estimateSize(intEntry(0)) + 1)
+		buildContext := testutil.NewBuildContext(t)
+		b, err := cfg.Build(buildContext, "test")
+		require.NoError(t, err)
+
+		writeN(t, b, 5, 0)
+
+		// The chunk is closed by size before max_delay or max_chunk_size is hit
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		entries, clearer, err := b.ReadChunk(ctx)
+		require.NoError(t, err)
+		require.Equal(t, []*entry.Entry{intEntry(0), intEntry(1)}, entries)
+		require.NoError(t, clearer.MarkAllAsFlushed())
+
+		// The entry that did not fit into the chunk is the first of the next chunk
+		entries, _, err = b.ReadChunk(ctx)
+		require.NoError(t, err)
+		require.Equal(t, []*entry.Entry{intEntry(2), intEntry(3)}, entries)
+
+		// Entries that were read but not flushed, and the pending entry, are saved on close
+		require.NoError(t, b.Close())
+
+		b2, err := NewMemoryBufferConfig().Build(buildContext, "test")
+		require.NoError(t, err)
+		readN(t, b2, 3, 2)
+	})
+
 	t.Run("CloseReadUnflushed", func(t *testing.T) {
 		t.Parallel()
 		buildContext := testutil.NewBuildContext(t)
@@ -236,6 +271,136 @@ func TestMemoryBuffer(t *testing.T) {
 	})
 }
 
+func TestMemoryBufferCheckpoint(t *testing.T) {
+	newCheckpointBuffer := func(t *testing.T, bc operator.BuildContext, interval time.Duration) *MemoryBuffer {
+		cfg := NewMemoryBufferConfig()
+		cfg.CheckpointInterval = helper.NewDuration(interval)
+		b, err := cfg.Build(bc, "test")
+		require.NoError(t, err)
+		return b.(*MemoryBuffer)
+	}
+
+	// crash abandons a buffer without closing it, like an unclean shutdown would
+	crash := func(b *MemoryBuffer) {
+		b.stopCheckpoints()
+	}
+
+	t.Run("RecoverAfterCrash", func(t *testing.T) {
+		t.Parallel()
+		bc := testutil.NewBuildContext(t)
+		b := newCheckpointBuffer(t, bc, time.Hour)
+		writeN(t, b, 10, 0)
+		flushN(t, b, 3, 0)
+		readN(t, b, 2, 3)
+		require.NoError(t, b.checkpoint())
+		crash(b)
+
+		// Entries that were read but not flushed are recovered too
+		b2, err := NewMemoryBufferConfig().Build(bc, "test")
+		require.NoError(t, err)
+		readN(t, b2, 7, 3)
+		readN(t, b2, 0, 0)
+	})
+
+	t.Run("EntriesAddedAfterCheckpointAreLost", func(t *testing.T) {
+		t.Parallel()
+		bc := testutil.NewBuildContext(t)
+		b := newCheckpointBuffer(t, bc, time.Hour)
+		writeN(t, b, 5, 0)
+		require.NoError(t, b.checkpoint())
+		writeN(t, b, 5, 5)
+		crash(b)
+
+		b = newCheckpointBuffer(t, bc, time.Hour)
+		defer b.Close()
+		readN(t, b, 5, 0)
+		readN(t, b, 0, 0)
+	})
+
+	t.Run("EntriesFlushedAfterCheckpointAreReplayed", func(t *testing.T) {
+		t.Parallel()
+		bc := testutil.NewBuildContext(t)
+		b := newCheckpointBuffer(t, bc, time.Hour)
+		writeN(t, b, 5, 0)
+		require.NoError(t, b.checkpoint())
+		flushN(t, b, 5, 0)
+		crash(b)
+
+		b = newCheckpointBuffer(t, bc, time.Hour)
+		defer b.Close()
+		readN(t, b, 5, 0)
+	})
+
+	t.Run("RecoveredEntriesAreRemovedOnceFlushed", func(t *testing.T) {
+		t.Parallel()
+		bc := testutil.NewBuildContext(t)
+		b := newCheckpointBuffer(t, bc, time.Hour)
+		writeN(t, b, 10, 0)
+		require.NoError(t, b.checkpoint())
+		crash(b)
+
+		b = newCheckpointBuffer(t, bc, time.Hour)
+		flushN(t, b, 4, 0)
+		writeN(t, b, 2, 10)
+		require.NoError(t, b.checkpoint())
+		crash(b)
+
+		// New entries get ids after the recovered ones, so they are read last
+		b = newCheckpointBuffer(t, bc, time.Hour)
+		defer b.Close()
+		readN(t, b, 8, 4)
+		readN(t, b, 0, 0)
+	})
+
+	t.Run("Periodic", func(t *testing.T) {
+		t.Parallel()
+		bc := testutil.NewBuildContext(t)
+		b := newCheckpointBuffer(t, bc, 10*time.Millisecond)
+		writeN(t, b, 10, 0)
+		flushN(t, b, 4, 0)
+
+		require.Eventually(t, func() bool {
+			count := 0
+			err := bc.Database.View(func(tx *bbolt.Tx) error {
+				if bucket := tx.Bucket([]byte("memory_buffer")); bucket != nil && bucket.Bucket([]byte("test")) != nil {
+					count = bucket.Bucket([]byte("test")).Stats().KeyN
+				}
+				return nil
+			})
+			require.NoError(t, err)
+			return count == 6
+		}, 5*time.Second, 10*time.Millisecond)
+		crash(b)
+
+		b = newCheckpointBuffer(t, bc, time.Hour)
+		defer b.Close()
+		readN(t, b, 6, 4)
+	})
+
+	t.Run("CloseAfterCheckpoint", func(t *testing.T) {
+		t.Parallel()
+		bc := testutil.NewBuildContext(t)
+		b := newCheckpointBuffer(t, bc, time.Hour)
+		writeN(t, b, 10, 0)
+		require.NoError(t, b.checkpoint())
+		flushN(t, b, 5, 0)
+		require.NoError(t, b.Close())
+
+		b = newCheckpointBuffer(t, bc, time.Hour)
+		defer b.Close()
+		readN(t, b, 5, 5)
+		readN(t, b, 0, 0)
+	})
+
+	t.Run("NegativeInterval", func(t *testing.T) {
+		t.Parallel()
+		cfg := NewMemoryBufferConfig()
+		cfg.CheckpointInterval = helper.NewDuration(-time.Second)
+		_, err := cfg.Build(testutil.NewBuildContext(t), "test")
+		require.Error(t, err)
+	})
+}
+
 func BenchmarkMemoryBuffer(b *testing.B) {
 	buffer := newMemoryBuffer(b)
 	var wg sync.WaitGroup
@@ -0,0 +1,403 @@
+package buffer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/observiq/stanza/entry"
+	"github.com/observiq/stanza/operator"
+	"go.etcd.io/bbolt"
+)
+
+// offlineReadSize is the number of entries that are read from an offline buffer at once
+const offlineReadSize = 1000
+
+// Buffered is implemented by the configs of operators that store entries in a buffer
+type Buffered interface {
+	// ID returns the id of the operator, which identifies its buffer
+	ID() string
+
+	// Buffer returns the config of the buffer of the operator
+	Buffer() Config
+}
+
+// OfflineStats describes the entries stored in a buffer
+type OfflineStats struct {
+	// Type is the type of the buffer
+	Type string
+
+	// Spill is true if the buffer is the spill buffer of a memory buffer
+	Spill bool
+
+	// Lane is the name of the lane of a priority buffer that the buffer stores
+	Lane string
+
+	// Entries is the number of entries that were not flushed
+	Entries int
+
+	// Bytes is the size of the stored entries. It is the size of the entries in the
+	// database for memory buffers, and the size of the files on disk for other buffers.
+	Bytes int64
+
+	// Oldest is the earliest timestamp of the entries, or zero if there are none
+	Oldest time.Time
+
+	// DeadRangeBytes is the size of the dead range that an interrupted compaction
+	// left in the data file of a disk buffer
+	DeadRangeBytes int64
+}
+
+// Offline gives access to the entries stored by the buffer of an operator while the
+// agent is stopped. Entries are read without marking them as flushed, so they stay in
+// the buffer unless they are purged or migrated. The entries can only be read once.
+type Offline struct {
+	parts []*offlinePart
+	// router selects the lane of entries added to a priority buffer
+	router *laneRouter
+}
+
+// offlinePart is a buffer that was opened offline. A memory buffer that spills entries
+// has a part for the memory buffer, followed by a part for its spill buffer. A priority
+// buffer has the parts of every lane, in order of priority.
+type offlinePart struct {
+	buffer      Buffer
+	stats       OfflineStats
+	storedBytes func() (int64, error)
+	// storageID identifies where the buffer stores its entries
+	storageID string
+	// lane is the index of the lane of a priority buffer that the part stores
+	lane int
+}
+
+// OpenOffline opens the buffer of an operator while the agent is stopped. The overflow
+// policy of the buffer is not applied, and its spill buffer is opened separately. The
+// lanes of a priority buffer are opened separately as well.
+func OpenOffline(cfg Config, bc operator.BuildContext, pluginID string) (*Offline, error) {
+	cfg = cfg.inherit(bc, pluginID)
+	if cfg.Builder == nil {
+		return nil, fmt.Errorf("operator has no buffer")
+	}
+
+	p, ok := cfg.Builder.(*PriorityBufferConfig)
+	if !ok {
+		o := &Offline{}
+		if err := o.openWithSpill(cfg.Builder, bc, pluginID, 0, ""); err != nil {
+			_ = o.Close()
+			return nil, err
+		}
+		return o, nil
+	}
+
+	router, err := p.buildRouter(bc)
+	if err != nil {
+		return nil, err
+	}
+	o := &Offline{router: router}
+	for i, lc := range p.Lanes {
+		if err := o.openWithSpill(lc.buffer().Builder, bc, lc.pluginID(pluginID), i, lc.Name); err != nil {
+			_ = o.Close()
+			return nil, fmt.Errorf("lane '%s': %s", lc.Name, err)
+		}
+	}
+	return o, nil
+}
+
+// openWithSpill opens a buffer and its spill buffer, if it has one
+func (o *Offline) openWithSpill(builder Builder, bc operator.BuildContext, pluginID string, lane int, laneName string) error {
+	spill, err := o.open(builder, bc, pluginID, lane, laneName, false)
+	if err != nil {
+		return err
+	}
+	if spill != nil && spill.Builder != nil {
+		if _, err := o.open(spill.Builder, bc, pluginID, lane, laneName, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// open builds a buffer without its overflow policy and adds it to the parts. It returns
+// the config of the spill buffer of the buffer, if it has one.
+func (o *Offline) open(builder Builder, bc operator.BuildContext, pluginID string, lane int, laneName string, spill bool) (*Config, error) {
+	part := &offlinePart{stats: OfflineStats{Spill: spill, Lane: laneName}, lane: lane}
+
+	var spillConfig *Config
+	switch c := builder.(type) {
+	case *MemoryBufferConfig:
+		copied := *c
+		spillConfig, copied.OverflowConfig = c.Spill, OverflowConfig{}
+		builder = &copied
+		part.stats.Type = "memory"
+		part.storageID = "memory:" + pluginID
+		part.storedBytes = func() (int64, error) {
+			return memoryStoredBytes(bc, pluginID)
+		}
+	case *DiskBufferConfig:
+		copied := *c
+		copied.OverflowConfig = OverflowConfig{}
+		builder = &copied
+		part.stats.Type = "disk"
+		part.storageID = "disk:" + filepath.Clean(c.Path)
+		part.storedBytes = func() (int64, error) {
+			return filesSize(filepath.Join(c.Path, "data"))
+		}
+
+		// The dead range is removed when the buffer is opened
+		deadRange, err := readDeadRangeLength(filepath.Join(c.Path, "metadata"))
+		if err != nil {
+			return nil, fmt.Errorf("read disk buffer metadata: %s", err)
+		}
+		part.stats.DeadRangeBytes = deadRange
+	case *WALBufferConfig:
+		copied := *c
+		copied.OverflowConfig = OverflowConfig{}
+		builder = &copied
+		part.stats.Type = "wal"
+		part.storageID = "wal:" + filepath.Clean(c.Path)
+		part.storedBytes = func() (int64, error) {
+			return filesSize(filepath.Join(c.Path, "*"+walSegmentExt))
+		}
+	default:
+		return nil, fmt.Errorf("unsupported buffer config %T", builder)
+	}
+
+	b, err := builder.Build(bc, pluginID)
+	if err != nil {
+		return nil, err
+	}
+	part.buffer = b
+	o.parts = append(o.parts, part)
+	return spillConfig, nil
+}
+
+// read calls fn with every chunk of entries of every part. The entries of the
+// memory buffer are read before the entries of its spill buffer, and the entries
+// of lanes are read in order of priority.
+func (o *Offline) read(fn func(part *offlinePart, entries []*entry.Entry, clearer Clearer) error) error {
+	dst := make([]*entry.Entry, offlineReadSize)
+	for _, part := range o.parts {
+		for {
+			clearer, n, err := part.buffer.Read(dst)
+			if err != nil {
+				return fmt.Errorf("read %s buffer: %s", part.stats.Type, err)
+			}
+			if n == 0 {
+				break
+			}
+			if err := fn(part, dst[:n], clearer); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Stats returns the stats of the buffer, followed by the stats of its spill buffer if it has one.
+// A priority buffer returns the stats of every lane, in order of priority.
+func (o *Offline) Stats() ([]OfflineStats, error) {
+	err := o.read(func(part *offlinePart, entries []*entry.Entry, _ Clearer) error {
+		part.stats.Entries += len(entries)
+		for _, e := range entries {
+			if part.stats.Oldest.IsZero() || e.Timestamp.Before(part.stats.Oldest) {
+				part.stats.Oldest = e.Timestamp
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	stats := make([]OfflineStats, 0, len(o.parts))
+	for _, part := range o.parts {
+		bytes, err := part.storedBytes()
+		if err != nil {
+			return nil, err
+		}
+		part.stats.Bytes = bytes
+		stats = append(stats, part.stats)
+	}
+	return stats, nil
+}
+
+// ForEach calls fn with every entry in the buffer, in the order they would be flushed
+func (o *Offline) ForEach(fn func(*entry.Entry) error) error {
+	return o.read(func(_ *offlinePart, entries []*entry.Entry, _ Clearer) error {
+		for _, e := range entries {
+			if err := fn(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Purge removes every entry from the buffer. It returns the number of removed entries.
+func (o *Offline) Purge() (int, error) {
+	purged := 0
+	err := o.read(func(_ *offlinePart, entries []*entry.Entry, clearer Clearer) error {
+		if err := clearer.MarkAllAsFlushed(); err != nil {
+			return err
+		}
+		purged += len(entries)
+		return nil
+	})
+	if err != nil {
+		return purged, err
+	}
+	return purged, o.compact()
+}
+
+// MigrateTo moves every entry from the buffer to another buffer, which is closed once
+// the entries were added to it. The entries are only removed from this buffer once the
+// other buffer was closed successfully. It returns the number of moved entries.
+func (o *Offline) MigrateTo(dst *Offline) (int, error) {
+	for _, part := range o.parts {
+		for _, dstPart := range dst.parts {
+			if part.storageID == dstPart.storageID {
+				_ = dst.Close()
+				return 0, fmt.Errorf("the buffers store their entries in the same place")
+			}
+		}
+	}
+
+	var clearers []Clearer
+	migrated := 0
+	err := o.read(func(_ *offlinePart, entries []*entry.Entry, clearer Clearer) error {
+		for _, e := range entries {
+			if err := dst.add(e); err != nil {
+				return err
+			}
+		}
+		clearers = append(clearers, clearer)
+		migrated += len(entries)
+		return nil
+	})
+	if closeErr := dst.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("close destination buffer: %s", closeErr)
+	}
+	if err != nil {
+		// The entries that were added to the destination stay in this buffer as well
+		return 0, err
+	}
+
+	for _, clearer := range clearers {
+		if err := clearer.MarkAllAsFlushed(); err != nil {
+			return migrated, err
+		}
+	}
+	return migrated, o.compact()
+}
+
+// add adds an entry to the first part that has space for it. Nothing reads from an
+// offline buffer, so an entry is never added to a full buffer to wait for space.
+// Entries added to a priority buffer are only added to the parts of their lane.
+func (o *Offline) add(e *entry.Entry) error {
+	lane := 0
+	if o.router != nil {
+		lane = o.router.route(e)
+	}
+
+	for _, part := range o.parts {
+		if part.lane != lane {
+			continue
+		}
+		added, err := part.buffer.(overflowAdder).tryAdd(e)
+		if err != nil {
+			return err
+		}
+		if added {
+			return nil
+		}
+	}
+	return fmt.Errorf("destination buffer is full")
+}
+
+// compact removes flushed entries from disk buffers, which would otherwise
+// only be removed the next time they are opened
+func (o *Offline) compact() error {
+	for _, part := range o.parts {
+		if d, ok := part.buffer.(*DiskBuffer); ok {
+			if err := d.Compact(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Close closes every part of the buffer. Entries that were read but not purged or
+// migrated are kept.
+func (o *Offline) Close() error {
+	var firstErr error
+	for _, part := range o.parts {
+		if err := part.buffer.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// memoryStoredBytes returns the size of the entries that a memory buffer saved to the database
+func memoryStoredBytes(bc operator.BuildContext, pluginID string) (int64, error) {
+	var size int64
+	err := bc.Database.View(func(tx *bbolt.Tx) error {
+		memBufBucket := tx.Bucket([]byte("memory_buffer"))
+		if memBufBucket == nil {
+			return nil
+		}
+		b := memBufBucket.Bucket([]byte(pluginID))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(_, v []byte) error {
+			size += int64(len(v))
+			return nil
+		})
+	})
+	return size, err
+}
+
+// filesSize returns the total size of the files matching a pattern
+func filesSize(pattern string) (int64, error) {
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return 0, err
+	}
+
+	var size int64
+	for _, match := range matches {
+		info, err := os.Stat(match)
+		if err != nil {
+			return 0, err
+		}
+		size += info.Size()
+	}
+	return size, nil
+}
+
+// readDeadRangeLength reads the length of the dead range from the metadata file of a
+// disk buffer without opening it for writing. It returns 0 if there is no metadata file.
+func readDeadRangeLength(path string) (int64, error) {
+	file, err := os.Open(path) // #nosec - the disk buffer path is set in the config
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil || info.Size() == 0 {
+		return 0, err
+	}
+
+	m := &Metadata{}
+	if err := m.UnmarshalBinary(file); err != nil {
+		return 0, err
+	}
+	return m.deadRangeLength, nil
+}
@@ -0,0 +1,205 @@
+package buffer
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/observiq/stanza/entry"
+	"github.com/observiq/stanza/operator"
+	"github.com/observiq/stanza/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func newOfflineDiskConfig(t testing.TB) Config {
+	cfg := NewDiskBufferConfig()
+	cfg.Path = testutil.NewTempDir(t)
+	return Config{Builder: cfg}
+}
+
+// fillBuffer builds a buffer, adds n entries to it and closes it
+func fillBuffer(t testing.TB, cfg Config, bc operator.BuildContext, n int) {
+	b, err := cfg.Build(bc, "test")
+	require.NoError(t, err)
+	writeN(t, b, n, 0)
+	require.NoError(t, b.Close())
+}
+
+func openOffline(t testing.TB, cfg Config, bc operator.BuildContext) *Offline {
+	o, err := OpenOffline(cfg, bc, "test")
+	require.NoError(t, err)
+	return o
+}
+
+func offlineStats(t testing.TB, cfg Config, bc operator.BuildContext) []OfflineStats {
+	o := openOffline(t, cfg, bc)
+	stats, err := o.Stats()
+	require.NoError(t, err)
+	require.NoError(t, o.Close())
+	return stats
+}
+
+func TestOfflineStats(t *testing.T) {
+	t.Run("Memory", func(t *testing.T) {
+		bc := testutil.NewBuildContext(t)
+		cfg := NewConfig()
+		fillBuffer(t, cfg, bc, 10)
+
+		// Reading the stats keeps the entries
+		for i := 0; i < 2; i++ {
+			stats := offlineStats(t, cfg, bc)
+			require.Len(t, stats, 1)
+			require.Equal(t, "memory", stats[0].Type)
+			require.Equal(t, 10, stats[0].Entries)
+			require.Greater(t, stats[0].Bytes, int64(0))
+			require.Equal(t, intEntry(0).Timestamp, stats[0].Oldest)
+		}
+	})
+
+	t.Run("Spill", func(t *testing.T) {
+		bc := testutil.NewBuildContext(t)
+		memoryCfg := NewMemoryBufferConfig()
+		memoryCfg.MaxEntries = 5
+		memoryCfg.Overflow = OverflowSpill
+		memoryCfg.Spill = newSpillConfig(t)
+		cfg := Config{Builder: memoryCfg}
+		fillBuffer(t, cfg, bc, 20)
+
+		stats := offlineStats(t, cfg, bc)
+		require.Len(t, stats, 2)
+		require.Equal(t, "memory", stats[0].Type)
+		require.False(t, stats[0].Spill)
+		require.Equal(t, "disk", stats[1].Type)
+		require.True(t, stats[1].Spill)
+		require.Equal(t, 20, stats[0].Entries+stats[1].Entries)
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		stats := offlineStats(t, newOfflineDiskConfig(t), testutil.NewBuildContext(t))
+		require.Equal(t, []OfflineStats{{Type: "disk"}}, stats)
+	})
+
+	t.Run("NoBuffer", func(t *testing.T) {
+		_, err := OpenOffline(Config{}, testutil.NewBuildContext(t), "test")
+		require.EqualError(t, err, "operator has no buffer")
+	})
+}
+
+func TestOfflineForEach(t *testing.T) {
+	bc := testutil.NewBuildContext(t)
+	cfg := newOfflineDiskConfig(t)
+	fillBuffer(t, cfg, bc, 2500)
+
+	o := openOffline(t, cfg, bc)
+	var entries []*entry.Entry
+	require.NoError(t, o.ForEach(func(e *entry.Entry) error {
+		entries = append(entries, e)
+		return nil
+	}))
+	require.NoError(t, o.Close())
+
+	require.Len(t, entries, 2500)
+	for i, e := range entries {
+		require.Equal(t, intEntry(i), e)
+	}
+	require.Equal(t, 2500, offlineStats(t, cfg, bc)[0].Entries)
+}
+
+func TestOfflinePurge(t *testing.T) {
+	bc := testutil.NewBuildContext(t)
+	cfg := newOfflineDiskConfig(t)
+	fillBuffer(t, cfg, bc, 10)
+	before := offlineStats(t, cfg, bc)[0].Bytes
+
+	o := openOffline(t, cfg, bc)
+	purged, err := o.Purge()
+	require.NoError(t, err)
+	require.Equal(t, 10, purged)
+	require.NoError(t, o.Close())
+
+	stats := offlineStats(t, cfg, bc)
+	require.Equal(t, 0, stats[0].Entries)
+	require.Less(t, stats[0].Bytes, before)
+}
+
+func TestOfflineMigrateTo(t *testing.T) {
+	t.Run("MemoryToDisk", func(t *testing.T) {
+		bc := testutil.NewBuildContext(t)
+		src, dst := NewConfig(), newOfflineDiskConfig(t)
+		fillBuffer(t, src, bc, 10)
+
+		o := openOffline(t, src, bc)
+		migrated, err := o.MigrateTo(openOffline(t, dst, bc))
+		require.NoError(t, err)
+		require.NoError(t, o.Close())
+		require.Equal(t, 10, migrated)
+
+		require.Equal(t, 0, offlineStats(t, src, bc)[0].Entries)
+		b, err := dst.Build(bc, "test")
+		require.NoError(t, err)
+		defer b.Close()
+		readN(t, b, 10, 0)
+	})
+
+	t.Run("DestinationFull", func(t *testing.T) {
+		bc := testutil.NewBuildContext(t)
+		dstCfg := NewMemoryBufferConfig()
+		dstCfg.MaxEntries = 5
+		src, dst := newOfflineDiskConfig(t), Config{Builder: dstCfg}
+		fillBuffer(t, src, bc, 10)
+
+		o := openOffline(t, src, bc)
+		_, err := o.MigrateTo(openOffline(t, dst, bc))
+		require.EqualError(t, err, "destination buffer is full")
+		require.NoError(t, o.Close())
+
+		// The entries stay in the source buffer
+		require.Equal(t, 10, offlineStats(t, src, bc)[0].Entries)
+	})
+
+	t.Run("SameStorage", func(t *testing.T) {
+		bc := testutil.NewBuildContext(t)
+		cfg := newOfflineDiskConfig(t)
+		o := openOffline(t, cfg, bc)
+		defer o.Close()
+		_, err := o.MigrateTo(openOffline(t, cfg, bc))
+		require.EqualError(t, err, "the buffers store their entries in the same place")
+	})
+
+	t.Run("SpillToDisk", func(t *testing.T) {
+		bc := testutil.NewBuildContext(t)
+		srcCfg := NewMemoryBufferConfig()
+		srcCfg.MaxEntries = 5
+		srcCfg.Overflow = OverflowSpill
+		srcCfg.Spill = newSpillConfig(t)
+		src, dst := Config{Builder: srcCfg}, newOfflineDiskConfig(t)
+		fillBuffer(t, src, bc, 20)
+
+		o := openOffline(t, src, bc)
+		migrated, err := o.MigrateTo(openOffline(t, dst, bc))
+		require.NoError(t, err)
+		require.NoError(t, o.Close())
+		require.Equal(t, 20, migrated)
+
+		for _, s := range offlineStats(t, src, bc) {
+			require.Equal(t, 0, s.Entries)
+		}
+		require.Equal(t, 20, offlineStats(t, dst, bc)[0].Entries)
+	})
+}
+
+func TestReadDeadRangeLength(t *testing.T) {
+	dir := testutil.NewTempDir(t)
+	length, err := readDeadRangeLength(filepath.Join(dir, "metadata"))
+	require.NoError(t, err)
+	require.Equal(t, int64(0), length)
+
+	b := NewDiskBuffer(1 << 20)
+	require.NoError(t, b.Open(dir, false))
+	writeN(t, b, 10, 0)
+	flushN(t, b, 5, 0)
+	require.NoError(t, b.Close())
+
+	length, err = readDeadRangeLength(filepath.Join(dir, "metadata"))
+	require.NoError(t, err)
+	require.Equal(t, int64(0), length, "the dead range is only left by interrupted compactions")
+}
@@ -0,0 +1,338 @@
+package buffer
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/observiq/stanza/entry"
+	"github.com/observiq/stanza/operator"
+	"go.uber.org/zap"
+)
+
+// Overflow policies control what happens when an entry is added to a full buffer
+const (
+	// OverflowBlock waits until there is space for the entry
+	OverflowBlock = "block"
+	// OverflowDropNewest drops the entry that is being added
+	OverflowDropNewest = "drop_newest"
+	// OverflowDropOldest drops the oldest entry that has not been read yet
+	OverflowDropOldest = "drop_oldest"
+	// OverflowSpill adds the entry to a disk buffer until there is space again
+	OverflowSpill = "spill"
+)
+
+// overflowLogInterval is the minimum time between two logs about dropped or spilled entries
+const overflowLogInterval = 10 * time.Second
+
+// OverflowConfig configures what a buffer does when an entry is added while it is full
+type OverflowConfig struct {
+	// Overflow is the overflow policy. It defaults to block.
+	Overflow string `json:"overflow,omitempty" yaml:"overflow,omitempty"`
+
+	// Spill is the buffer that entries are spilled to when the overflow policy is spill
+	Spill *Config `json:"spill,omitempty" yaml:"spill,omitempty"`
+}
+
+// joinSpillPath returns a copy of the config whose spill buffer paths are joined with elem
+func (c OverflowConfig) joinSpillPath(elem string) OverflowConfig {
+	if c.Spill != nil {
+		spill := c.Spill.joinPath(elem)
+		c.Spill = &spill
+	}
+	return c
+}
+
+// DropCounter is implemented by buffers that drop entries when they are full
+type DropCounter interface {
+	// Dropped returns the number of entries that were dropped since the buffer was built
+	Dropped() uint64
+}
+
+// overflowAdder is implemented by buffers that can add an entry without waiting for space
+type overflowAdder interface {
+	// tryAdd adds an entry if there is space for it, and returns false otherwise
+	tryAdd(*entry.Entry) (bool, error)
+}
+
+// wrap applies the overflow policy to a buffer that was built from the config
+// that embeds the OverflowConfig. The buffer is closed if the policy is invalid.
+func (c OverflowConfig) wrap(context operator.BuildContext, pluginID string, b Buffer) (Buffer, error) {
+	wrapped, err := c.build(context, pluginID, b)
+	if err != nil {
+		_ = b.Close()
+		return nil, err
+	}
+	return wrapped, nil
+}
+
+func (c OverflowConfig) build(context operator.BuildContext, pluginID string, b Buffer) (Buffer, error) {
+	if c.Spill != nil && c.Overflow != OverflowSpill {
+		return nil, fmt.Errorf("'spill' can only be set if 'overflow' is '%s'", OverflowSpill)
+	}
+
+	logger := zap.NewNop().Sugar()
+	if context.Logger != nil {
+		logger = context.Logger.SugaredLogger
+	}
+
+	switch c.Overflow {
+	case "", OverflowBlock:
+		return b, nil
+	case OverflowDropNewest:
+		adder, ok := b.(overflowAdder)
+		if !ok {
+			return nil, fmt.Errorf("overflow '%s' is not supported by this buffer", c.Overflow)
+		}
+		return newDropBuffer(b, adder, nil, c.Overflow, logger), nil
+	case OverflowDropOldest:
+		mb, ok := b.(*MemoryBuffer)
+		if !ok {
+			return nil, fmt.Errorf("overflow '%s' is only supported by memory buffers", c.Overflow)
+		}
+		return newDropBuffer(b, mb, mb, c.Overflow, logger), nil
+	case OverflowSpill:
+		mb, ok := b.(*MemoryBuffer)
+		if !ok {
+			return nil, fmt.Errorf("overflow '%s' is only supported by memory buffers", c.Overflow)
+		}
+		return newSpillBuffer(context, pluginID, mb, c.Spill, logger)
+	default:
+		return nil, fmt.Errorf("invalid overflow '%s'", c.Overflow)
+	}
+}
+
+// overflowLogger logs the number of entries affected by an overflow policy,
+// at most once per overflowLogInterval
+type overflowLogger struct {
+	// count and lastLog are first in the struct to guarantee 64-bit alignment for atomic operations
+	count   uint64
+	lastLog int64
+	logger  *zap.SugaredLogger
+	message string
+	key     string
+}
+
+// add increments the count and logs it if nothing was logged recently
+func (l *overflowLogger) add(n uint64) {
+	count := atomic.AddUint64(&l.count, n)
+
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&l.lastLog)
+	if now-last < int64(overflowLogInterval) || !atomic.CompareAndSwapInt64(&l.lastLog, last, now) {
+		return
+	}
+	l.logger.Warnw(l.message, l.key, count)
+}
+
+// total returns the count
+func (l *overflowLogger) total() uint64 {
+	return atomic.LoadUint64(&l.count)
+}
+
+// oldestReplacer is implemented by buffers that can drop their oldest unread entry
+// to make space for a new one
+type oldestReplacer interface {
+	// replaceOldest drops the oldest unread entry and adds e in its place.
+	// It returns false if there are no unread entries.
+	replaceOldest(e *entry.Entry) bool
+}
+
+// dropBuffer is a buffer that drops entries instead of waiting when it is full
+type dropBuffer struct {
+	Buffer
+	adder    overflowAdder
+	replacer oldestReplacer
+	dropped  *overflowLogger
+}
+
+func newDropBuffer(b Buffer, adder overflowAdder, replacer oldestReplacer, policy string, logger *zap.SugaredLogger) *dropBuffer {
+	return &dropBuffer{
+		Buffer:   b,
+		adder:    adder,
+		replacer: replacer,
+		dropped: &overflowLogger{
+			logger:  logger.With("overflow", policy),
+			message: "Buffer is full. Dropping entries",
+			key:     "dropped_entries_total",
+		},
+	}
+}
+
+// Add adds an entry to the buffer. If the buffer is full, either the oldest unread
+// entry or the new entry is dropped. The new entry is also dropped if every entry
+// in the buffer is being flushed.
+func (b *dropBuffer) Add(ctx context.Context, e *entry.Entry) error {
+	ok, err := b.adder.tryAdd(e)
+	if err != nil || ok {
+		return err
+	}
+
+	if b.replacer != nil {
+		b.replacer.replaceOldest(e)
+	}
+	b.dropped.add(1)
+	return nil
+}
+
+// Dropped returns the number of entries that were dropped since the buffer was built
+func (b *dropBuffer) Dropped() uint64 {
+	return b.dropped.total()
+}
+
+// Unread returns the number of entries in the buffer that have not been read
+func (b *dropBuffer) Unread() int64 {
+	if counter, ok := b.Buffer.(UnreadCounter); ok {
+		return counter.Unread()
+	}
+	return 0
+}
+
+func (b *dropBuffer) Usage() float64 {
+	if reporter, ok := b.Buffer.(UsageReporter); ok {
+		return reporter.Usage()
+	}
+	return 0
+}
+
+// spillBuffer is a memory buffer that adds entries to a secondary buffer while it is full.
+// Entries are moved back from the secondary buffer as soon as there is space in memory,
+// so they are always read from the memory buffer.
+type spillBuffer struct {
+	// spilled is the number of entries in the secondary buffer. While it is not zero,
+	// entries are added to the secondary buffer so that they are read in order.
+	// It is first in the struct to guarantee 64-bit alignment for atomic operations.
+	spilled int64
+
+	*MemoryBuffer
+	secondary Buffer
+	logger    *overflowLogger
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func newSpillBuffer(bc operator.BuildContext, pluginID string, mb *MemoryBuffer, cfg *Config, logger *zap.SugaredLogger) (*spillBuffer, error) {
+	if cfg == nil || cfg.Builder == nil {
+		return nil, fmt.Errorf("missing required field 'spill'")
+	}
+
+	switch c := cfg.Builder.(type) {
+	case *MemoryBufferConfig:
+		return nil, fmt.Errorf("'spill' must be a disk or wal buffer")
+	case *DiskBufferConfig:
+		if c.Overflow != "" && c.Overflow != OverflowBlock {
+			return nil, fmt.Errorf("'spill' buffer must use overflow '%s'", OverflowBlock)
+		}
+	case *WALBufferConfig:
+		if c.Overflow != "" && c.Overflow != OverflowBlock {
+			return nil, fmt.Errorf("'spill' buffer must use overflow '%s'", OverflowBlock)
+		}
+	}
+
+	secondary, err := cfg.Builder.Build(bc, pluginID)
+	if err != nil {
+		return nil, fmt.Errorf("build spill buffer: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	b := &spillBuffer{
+		MemoryBuffer: mb,
+		secondary:    secondary,
+		cancel:       cancel,
+		logger: &overflowLogger{
+			logger:  logger.With("overflow", OverflowSpill),
+			message: "Memory buffer is full. Spilling entries",
+			key:     "spilled_entries_total",
+		},
+	}
+
+	// Entries that were spilled before the buffer was last closed are still in the secondary buffer
+	if counter, ok := secondary.(UnreadCounter); ok {
+		b.spilled = counter.Unread()
+	}
+
+	b.wg.Add(1)
+	go b.drain(ctx)
+
+	return b, nil
+}
+
+// Add adds an entry to the memory buffer, or to the secondary buffer if
+// the memory buffer is full or older entries are still spilled
+func (b *spillBuffer) Add(ctx context.Context, e *entry.Entry) error {
+	if atomic.LoadInt64(&b.spilled) == 0 {
+		ok, err := b.MemoryBuffer.tryAdd(e)
+		if err != nil || ok {
+			return err
+		}
+	}
+
+	atomic.AddInt64(&b.spilled, 1)
+	if err := b.secondary.Add(ctx, e); err != nil {
+		atomic.AddInt64(&b.spilled, -1)
+		return err
+	}
+	b.logger.add(1)
+	return nil
+}
+
+// drain moves entries from the secondary buffer to the memory buffer
+// until the context is cancelled
+func (b *spillBuffer) drain(ctx context.Context) {
+	defer b.wg.Done()
+	for {
+		// ReadChunk only fails once the context is cancelled
+		entries, clearer, err := b.secondary.ReadChunk(ctx)
+		if err != nil {
+			return
+		}
+
+		for i, e := range entries {
+			if err := b.MemoryBuffer.Add(ctx, e); err != nil {
+				// The entries that were not moved stay in the secondary buffer
+				_ = clearer.MarkRangeAsFlushed(0, uint(i))
+				return
+			}
+			atomic.AddInt64(&b.spilled, -1)
+		}
+
+		if err := clearer.MarkAllAsFlushed(); err != nil {
+			b.logger.logger.Errorw("Failed to mark spilled entries as moved", zap.Error(err))
+		}
+	}
+}
+
+// Spilled returns the number of entries that were added to the secondary buffer since the buffer was built
+func (b *spillBuffer) Spilled() uint64 {
+	return b.logger.total()
+}
+
+// Unread returns the number of entries in the memory buffer that have not been read,
+// and the number of entries in the secondary buffer
+func (b *spillBuffer) Unread() int64 {
+	return b.MemoryBuffer.Unread() + atomic.LoadInt64(&b.spilled)
+}
+
+// Usage returns the usage of the secondary buffer, because adding entries only blocks
+// once the secondary buffer is full
+func (b *spillBuffer) Usage() float64 {
+	if reporter, ok := b.secondary.(UsageReporter); ok {
+		return reporter.Usage()
+	}
+	return b.MemoryBuffer.Usage()
+}
+
+// Close stops moving entries from the secondary buffer and closes both buffers
+func (b *spillBuffer) Close() error {
+	b.cancel()
+	b.wg.Wait()
+
+	secondaryErr := b.secondary.Close()
+	if err := b.MemoryBuffer.Close(); err != nil {
+		return err
+	}
+	return secondaryErr
+}
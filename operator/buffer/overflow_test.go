@@ -0,0 +1,310 @@
+package buffer
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/observiq/stanza/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func newOverflowMemoryBuffer(t testing.TB, maxEntries int, overflow OverflowConfig) Buffer {
+	cfg := NewMemoryBufferConfig()
+	cfg.MaxEntries = maxEntries
+	cfg.MaxChunkDelay.Duration = 10 * time.Millisecond
+	cfg.OverflowConfig = overflow
+	b, err := cfg.Build(testutil.NewBuildContext(t), "test")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = b.Close() })
+	return b
+}
+
+func newSpillConfig(t testing.TB) *Config {
+	cfg := NewDiskBufferConfig()
+	cfg.Path = testutil.NewTempDir(t)
+	cfg.MaxChunkDelay.Duration = 10 * time.Millisecond
+	return &Config{Builder: cfg}
+}
+
+func TestOverflowBuild(t *testing.T) {
+	cases := []struct {
+		name     string
+		builder  func(t *testing.T) Builder
+		expected string
+	}{
+		{
+			"InvalidOverflow",
+			func(t *testing.T) Builder {
+				cfg := NewMemoryBufferConfig()
+				cfg.Overflow = "invalid"
+				return cfg
+			},
+			"invalid overflow 'invalid'",
+		},
+		{
+			"DropOldestDisk",
+			func(t *testing.T) Builder {
+				cfg := NewDiskBufferConfig()
+				cfg.Path = testutil.NewTempDir(t)
+				cfg.Overflow = OverflowDropOldest
+				return cfg
+			},
+			"overflow 'drop_oldest' is only supported by memory buffers",
+		},
+		{
+			"SpillWAL",
+			func(t *testing.T) Builder {
+				cfg := NewWALBufferConfig()
+				cfg.Path = testutil.NewTempDir(t)
+				cfg.Overflow = OverflowSpill
+				cfg.Spill = newSpillConfig(t)
+				return cfg
+			},
+			"overflow 'spill' is only supported by memory buffers",
+		},
+		{
+			"SpillMissing",
+			func(t *testing.T) Builder {
+				cfg := NewMemoryBufferConfig()
+				cfg.Overflow = OverflowSpill
+				return cfg
+			},
+			"missing required field 'spill'",
+		},
+		{
+			"SpillWithoutOverflow",
+			func(t *testing.T) Builder {
+				cfg := NewMemoryBufferConfig()
+				cfg.Spill = newSpillConfig(t)
+				return cfg
+			},
+			"'spill' can only be set if 'overflow' is 'spill'",
+		},
+		{
+			"SpillToMemory",
+			func(t *testing.T) Builder {
+				cfg := NewMemoryBufferConfig()
+				cfg.Overflow = OverflowSpill
+				cfg.Spill = &Config{Builder: NewMemoryBufferConfig()}
+				return cfg
+			},
+			"'spill' must be a disk or wal buffer",
+		},
+		{
+			"SpillWithDropPolicy",
+			func(t *testing.T) Builder {
+				spill := newSpillConfig(t)
+				spill.Builder.(*DiskBufferConfig).Overflow = OverflowDropNewest
+				cfg := NewMemoryBufferConfig()
+				cfg.Overflow = OverflowSpill
+				cfg.Spill = spill
+				return cfg
+			},
+			"'spill' buffer must use overflow 'block'",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := tc.builder(t).Build(testutil.NewBuildContext(t), "test")
+			require.Error(t, err)
+			require.Contains(t, err.Error(), tc.expected)
+		})
+	}
+}
+
+func TestOverflowDropNewest(t *testing.T) {
+	t.Run("Memory", func(t *testing.T) {
+		t.Parallel()
+		b := newOverflowMemoryBuffer(t, 2, OverflowConfig{Overflow: OverflowDropNewest})
+		writeN(t, b, 4, 0)
+		flushN(t, b, 2, 0)
+		require.Equal(t, uint64(2), b.(DropCounter).Dropped())
+
+		// Flushed entries make space again
+		writeN(t, b, 1, 2)
+		readN(t, b, 1, 2)
+		require.Equal(t, uint64(2), b.(DropCounter).Dropped())
+	})
+
+	t.Run("Disk", func(t *testing.T) {
+		t.Parallel()
+		cfg := NewDiskBufferConfig()
+		cfg.Path = testutil.NewTempDir(t)
+		cfg.MaxSize = 1000
+		cfg.Overflow = OverflowDropNewest
+		b, err := cfg.Build(testutil.NewBuildContext(t), "test")
+		require.NoError(t, err)
+		defer b.Close()
+
+		writeN(t, b, 20, 0)
+		dropped := b.(DropCounter).Dropped()
+		require.NotZero(t, dropped)
+		flushN(t, b, 20-int(dropped), 0)
+
+		// Flushed entries are compacted to make space
+		writeN(t, b, 1, 20-int(dropped))
+		readN(t, b, 1, 20-int(dropped))
+		require.Equal(t, dropped, b.(DropCounter).Dropped())
+	})
+
+	t.Run("WAL", func(t *testing.T) {
+		t.Parallel()
+		cfg := NewWALBufferConfig()
+		cfg.Path = testutil.NewTempDir(t)
+		cfg.MaxSize = 4 * 100
+		cfg.SegmentSize = 4 * 100
+		cfg.Overflow = OverflowDropNewest
+		b, err := cfg.Build(testutil.NewBuildContext(t), "test")
+		require.NoError(t, err)
+		defer b.Close()
+
+		writeN(t, b, 20, 0)
+		dropped := b.(DropCounter).Dropped()
+		require.NotZero(t, dropped)
+		flushN(t, b, 20-int(dropped), 0)
+
+		// The flushed active segment is reset to make space
+		writeN(t, b, 1, 20-int(dropped))
+		readN(t, b, 1, 20-int(dropped))
+		require.Equal(t, dropped, b.(DropCounter).Dropped())
+	})
+}
+
+func TestOverflowDropOldest(t *testing.T) {
+	t.Run("Simple", func(t *testing.T) {
+		t.Parallel()
+		b := newOverflowMemoryBuffer(t, 2, OverflowConfig{Overflow: OverflowDropOldest})
+		writeN(t, b, 5, 0)
+		flushN(t, b, 2, 3)
+		require.Equal(t, uint64(3), b.(DropCounter).Dropped())
+	})
+
+	t.Run("AllInFlight", func(t *testing.T) {
+		t.Parallel()
+		b := newOverflowMemoryBuffer(t, 2, OverflowConfig{Overflow: OverflowDropOldest})
+		writeN(t, b, 2, 0)
+		c := readN(t, b, 2, 0)
+
+		// Entries that are being flushed are not dropped, so the new entry is
+		writeN(t, b, 1, 2)
+		require.Equal(t, uint64(1), b.(DropCounter).Dropped())
+		require.NoError(t, c.MarkAllAsFlushed())
+		readN(t, b, 0, 0)
+	})
+}
+
+func TestOverflowSpill(t *testing.T) {
+	readAll := func(t *testing.T, b Buffer, n, start int) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		for read := 0; read < n; {
+			entries, c, err := b.ReadChunk(ctx)
+			require.NoError(t, err)
+			for i, e := range entries {
+				require.Equal(t, intEntry(start+read+i), e)
+			}
+			require.NoError(t, c.MarkAllAsFlushed())
+			read += len(entries)
+		}
+	}
+
+	t.Run("EntriesAreReadInOrder", func(t *testing.T) {
+		t.Parallel()
+		b := newOverflowMemoryBuffer(t, 5, OverflowConfig{Overflow: OverflowSpill, Spill: newSpillConfig(t)})
+		writeN(t, b, 50, 0)
+		require.GreaterOrEqual(t, b.(*spillBuffer).Spilled(), uint64(45))
+		readAll(t, b, 50, 0)
+	})
+
+	t.Run("EntriesAreAddedToMemoryAfterDraining", func(t *testing.T) {
+		t.Parallel()
+		b := newOverflowMemoryBuffer(t, 5, OverflowConfig{Overflow: OverflowSpill, Spill: newSpillConfig(t)})
+		writeN(t, b, 10, 0)
+		readAll(t, b, 10, 0)
+		require.Eventually(t, func() bool {
+			return atomic.LoadInt64(&b.(*spillBuffer).spilled) == 0
+		}, time.Second, time.Millisecond)
+
+		spilled := b.(*spillBuffer).Spilled()
+		writeN(t, b, 5, 10)
+		require.Equal(t, spilled, b.(*spillBuffer).Spilled())
+		readAll(t, b, 5, 10)
+	})
+
+	t.Run("SpilledEntriesArePersisted", func(t *testing.T) {
+		t.Parallel()
+		spill := newSpillConfig(t)
+		cfg := NewMemoryBufferConfig()
+		cfg.MaxEntries = 5
+		cfg.MaxChunkDelay.Duration = 10 * time.Millisecond
+		cfg.Overflow = OverflowSpill
+		cfg.Spill = spill
+		bc := testutil.NewBuildContext(t)
+
+		b, err := cfg.Build(bc, "test")
+		require.NoError(t, err)
+		writeN(t, b, 20, 0)
+		require.NoError(t, b.Close())
+
+		b, err = cfg.Build(bc, "test")
+		require.NoError(t, err)
+		defer b.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		seen := make(map[float64]bool)
+		for len(seen) < 20 {
+			entries, c, err := b.ReadChunk(ctx)
+			require.NoError(t, err)
+			for _, e := range entries {
+				seen[e.Record.(float64)] = true
+			}
+			require.NoError(t, c.MarkAllAsFlushed())
+		}
+	})
+	t.Run("SpilledEntriesAreCountedAfterRestart", func(t *testing.T) {
+		t.Parallel()
+		spill := newSpillConfig(t)
+		cfg := NewMemoryBufferConfig()
+		cfg.MaxEntries = 5
+		cfg.MaxChunkDelay.Duration = 10 * time.Millisecond
+		cfg.Overflow = OverflowSpill
+		cfg.Spill = spill
+		bc := testutil.NewBuildContext(t)
+
+		b, err := cfg.Build(bc, "test")
+		require.NoError(t, err)
+		writeN(t, b, 20, 0)
+		require.NoError(t, b.Close())
+
+		b, err = cfg.Build(bc, "test")
+		require.NoError(t, err)
+		defer b.Close()
+		sb := b.(*spillBuffer)
+		require.GreaterOrEqual(t, sb.Unread(), int64(20))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		for read := 0; read < 20; {
+			entries, c, err := b.ReadChunk(ctx)
+			require.NoError(t, err)
+			require.GreaterOrEqual(t, sb.Unread(), int64(0))
+			require.NoError(t, c.MarkAllAsFlushed())
+			read += len(entries)
+		}
+
+		// Once the backlog is drained, new entries are added to memory again
+		require.Eventually(t, func() bool {
+			return atomic.LoadInt64(&sb.spilled) == 0
+		}, time.Second, time.Millisecond)
+		require.Equal(t, int64(0), sb.Unread())
+		spilled := sb.Spilled()
+		writeN(t, b, 5, 20)
+		require.Equal(t, spilled, sb.Spilled())
+		readAll(t, b, 5, 20)
+	})
+}
@@ -0,0 +1,544 @@
+package buffer
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/antonmedv/expr"
+	"github.com/antonmedv/expr/vm"
+	"github.com/observiq/stanza/entry"
+	"github.com/observiq/stanza/operator"
+	"github.com/observiq/stanza/operator/helper"
+	"go.uber.org/zap"
+)
+
+// PriorityBufferConfig holds the configuration for a priority buffer
+type PriorityBufferConfig struct {
+	Type string `json:"type" yaml:"type"`
+
+	// Lanes are the lanes of the buffer, in order of priority, highest first
+	Lanes []LaneConfig `json:"lanes" yaml:"lanes"`
+}
+
+// LaneConfig is the configuration of a lane of a priority buffer
+type LaneConfig struct {
+	// Name identifies the lane. It is part of the id that the buffer of the lane is built with.
+	Name string `json:"name" yaml:"name"`
+
+	// Expr selects the entries that are added to the lane. The last lane receives
+	// the entries that match no other lane, so it has no expression.
+	Expr string `json:"expr,omitempty" yaml:"expr,omitempty"`
+
+	// Weight is the share of chunks that are read from the lane while other lanes have
+	// chunks ready as well. If no lane has a weight, chunks are read from the lane with the
+	// highest priority that has one ready. Otherwise it defaults to 1.
+	Weight int `json:"weight,omitempty" yaml:"weight,omitempty"`
+
+	// Buffer is the buffer that stores the entries of the lane. It defaults to a memory buffer.
+	Buffer *Config `json:"buffer,omitempty" yaml:"buffer,omitempty"`
+}
+
+// NewPriorityBufferConfig creates a new default PriorityBufferConfig
+func NewPriorityBufferConfig() *PriorityBufferConfig {
+	return &PriorityBufferConfig{
+		Type: "priority",
+	}
+}
+
+// buffer returns the config of the buffer of the lane
+func (c LaneConfig) buffer() Config {
+	if c.Buffer == nil || c.Buffer.Builder == nil {
+		return NewConfig()
+	}
+	return *c.Buffer
+}
+
+// pluginID returns the id that the buffer of the lane is built with
+func (c LaneConfig) pluginID(pluginID string) string {
+	return pluginID + "/" + c.Name
+}
+
+// weighted returns true if a lane has a weight, so that chunks are read by weighted round robin
+func (c PriorityBufferConfig) weighted() bool {
+	for _, lc := range c.Lanes {
+		if lc.Weight != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// weight returns the weight of the lane
+func (c LaneConfig) weight() int {
+	if c.Weight == 0 {
+		return 1
+	}
+	return c.Weight
+}
+
+func (c PriorityBufferConfig) joinPath(elem string) Builder {
+	lanes := make([]LaneConfig, 0, len(c.Lanes))
+	for _, lc := range c.Lanes {
+		if lc.Buffer != nil {
+			b := lc.Buffer.joinPath(elem)
+			lc.Buffer = &b
+		}
+		lanes = append(lanes, lc)
+	}
+	c.Lanes = lanes
+	return &c
+}
+
+// Build builds a PriorityBufferConfig into a Buffer, building the buffer of every lane
+func (c PriorityBufferConfig) Build(context operator.BuildContext, pluginID string) (Buffer, error) {
+	router, err := c.buildRouter(context)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &PriorityBuffer{
+		router:   router,
+		weighted: c.weighted(),
+		ready:    make(chan struct{}, 1),
+		added:    make(chan struct{}, 1),
+	}
+	for _, lc := range c.Lanes {
+		laneBuffer, err := lc.buffer().Builder.Build(context, lc.pluginID(pluginID))
+		if err != nil {
+			_ = b.Close()
+			return nil, fmt.Errorf("build buffer of lane '%s': %s", lc.Name, err)
+		}
+		b.lanes = append(b.lanes, &lane{
+			name:   lc.Name,
+			weight: lc.weight(),
+			buffer: laneBuffer,
+			chunks: make(chan laneChunk, 1),
+		})
+	}
+	return b, nil
+}
+
+// buildRouter validates the lanes and compiles their expressions
+func (c PriorityBufferConfig) buildRouter(context operator.BuildContext) (*laneRouter, error) {
+	if len(c.Lanes) < 2 {
+		return nil, fmt.Errorf("'lanes' must contain at least two lanes")
+	}
+
+	router := &laneRouter{logger: zap.NewNop().Sugar()}
+	if context.Logger != nil {
+		router.logger = context.Logger.SugaredLogger
+	}
+
+	names := make(map[string]bool, len(c.Lanes))
+	paths := make(map[string]string, len(c.Lanes))
+	for i, lc := range c.Lanes {
+		if lc.Name == "" {
+			return nil, fmt.Errorf("lane %d is missing required field 'name'", i)
+		}
+		if names[lc.Name] {
+			return nil, fmt.Errorf("lane name '%s' is used more than once", lc.Name)
+		}
+		names[lc.Name] = true
+
+		if lc.Weight < 0 {
+			return nil, fmt.Errorf("the 'weight' of lane '%s' cannot be negative", lc.Name)
+		}
+
+		var path string
+		switch b := lc.buffer().Builder.(type) {
+		case *PriorityBufferConfig:
+			return nil, fmt.Errorf("the buffer of lane '%s' cannot be a priority buffer", lc.Name)
+		case *DiskBufferConfig:
+			path = b.Path
+		case *WALBufferConfig:
+			path = b.Path
+		}
+		if path != "" {
+			path = filepath.Clean(path)
+			if other, ok := paths[path]; ok {
+				return nil, fmt.Errorf("lanes '%s' and '%s' use the same path", other, lc.Name)
+			}
+			paths[path] = lc.Name
+		}
+
+		if i == len(c.Lanes)-1 {
+			if lc.Expr != "" {
+				return nil, fmt.Errorf("the last lane receives the entries that match no other lane, so it cannot have an 'expr'")
+			}
+			continue
+		}
+		if lc.Expr == "" {
+			return nil, fmt.Errorf("lane '%s' is missing required field 'expr'", lc.Name)
+		}
+		program, err := expr.Compile(lc.Expr, expr.AsBool(), expr.AllowUndefinedVariables())
+		if err != nil {
+			return nil, fmt.Errorf("failed to compile expression of lane '%s': %s", lc.Name, err)
+		}
+		router.programs = append(router.programs, program)
+	}
+	return router, nil
+}
+
+// laneRouter selects the lane that an entry is added to
+type laneRouter struct {
+	// programs are the expressions of every lane except the last
+	programs []*vm.Program
+	logger   *zap.SugaredLogger
+}
+
+// route returns the index of the first lane whose expression matches an entry,
+// or of the last lane if none match
+func (r *laneRouter) route(e *entry.Entry) int {
+	env := helper.GetExprEnv(e)
+	defer helper.PutExprEnv(env)
+
+	for i, program := range r.programs {
+		matches, err := vm.Run(program, env)
+		if err != nil {
+			r.logger.Warnw("Running lane expression returned an error", zap.Error(err))
+			continue
+		}
+
+		// we compile the expression with "AsBool", so this should be safe
+		if matches.(bool) {
+			return i
+		}
+	}
+	return len(r.programs)
+}
+
+// PriorityBuffer is a buffer that adds entries to one of several lanes, which are each
+// stored in a buffer of their own. Chunks are read from the lane with the highest priority
+// that has one ready, unless the lanes have weights. Then chunks are read by weighted round
+// robin: while several lanes have chunks ready, each lane is read in proportion to its
+// weight, and ties go to the lane with the higher priority.
+type PriorityBuffer struct {
+	router   *laneRouter
+	lanes    []*lane
+	weighted bool
+
+	// mux guards the credits of the lanes and taking chunks from them
+	mux sync.Mutex
+	// ready is signalled when a lane has a chunk ready
+	ready chan struct{}
+	// added is signalled when an entry is added
+	added chan struct{}
+
+	// The readers are started by the first call to ReadChunk, so that
+	// Read and ReadWait see every entry if ReadChunk is never called
+	readersOnce   sync.Once
+	cancelReaders context.CancelFunc
+	wg            sync.WaitGroup
+}
+
+// lane is a lane of a priority buffer
+type lane struct {
+	name   string
+	weight int
+	buffer Buffer
+	// chunks holds the chunk that was read from the buffer of the lane, until ReadChunk takes it
+	chunks chan laneChunk
+	// credit is the weighted round robin credit of the lane
+	credit int
+}
+
+// laneChunk is a chunk read from the buffer of a lane
+type laneChunk struct {
+	entries []*entry.Entry
+	clearer Clearer
+	err     error
+}
+
+// Add adds an entry to the lane selected by the expressions of the lanes, blocking until there is space
+func (b *PriorityBuffer) Add(ctx context.Context, e *entry.Entry) error {
+	l := b.lanes[b.router.route(e)]
+	if err := l.buffer.Add(ctx, e); err != nil {
+		return err
+	}
+	signal(b.added)
+	return nil
+}
+
+// ReadChunk returns a chunk from the lane with the highest priority, or the lane picked by
+// weighted round robin if the lanes have weights, among the lanes that have a chunk ready, waiting until a chunk is ready or the context is cancelled
+func (b *PriorityBuffer) ReadChunk(ctx context.Context) ([]*entry.Entry, Clearer, error) {
+	b.startReaders()
+	for {
+		if chunk, ok := b.nextChunk(); ok {
+			return chunk.entries, chunk.clearer, chunk.err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-b.ready:
+		}
+	}
+}
+
+// nextChunk takes a chunk from the lane with the highest priority that has a chunk ready,
+// or if the lanes have weights, from the lane with the most credit among them. Every ready
+// lane earns its weight in credit, and the picked lane pays the total, so each lane is
+// picked in proportion to its weight.
+func (b *PriorityBuffer) nextChunk() (laneChunk, bool) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	if !b.weighted {
+		return b.nextPriorityChunk()
+	}
+
+	var picked *lane
+	total := 0
+	for _, l := range b.lanes {
+		if len(l.chunks) == 0 {
+			continue
+		}
+		l.credit += l.weight
+		total += l.weight
+		if picked == nil || l.credit > picked.credit {
+			picked = l
+		}
+	}
+	if picked == nil {
+		return laneChunk{}, false
+	}
+
+	picked.credit -= total
+	if total > picked.weight {
+		// Other lanes still have chunks ready for other readers
+		signal(b.ready)
+	}
+	return <-picked.chunks, true
+}
+
+// nextPriorityChunk takes a chunk from the lane with the highest priority that has a chunk ready
+func (b *PriorityBuffer) nextPriorityChunk() (laneChunk, bool) {
+	for i, l := range b.lanes {
+		if len(l.chunks) == 0 {
+			continue
+		}
+		for _, other := range b.lanes[i+1:] {
+			if len(other.chunks) != 0 {
+				// Other lanes still have chunks ready for other readers
+				signal(b.ready)
+				break
+			}
+		}
+		return <-l.chunks, true
+	}
+	return laneChunk{}, false
+}
+
+// startReaders starts reading chunks from the buffer of every lane
+func (b *PriorityBuffer) startReaders() {
+	b.readersOnce.Do(func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		b.cancelReaders = cancel
+		for _, l := range b.lanes {
+			b.wg.Add(1)
+			go b.readLane(ctx, l)
+		}
+	})
+}
+
+// readLane reads chunks from the buffer of a lane until the context is cancelled. Chunks
+// are read ahead so that each lane batches its entries with its own chunk settings.
+func (b *PriorityBuffer) readLane(ctx context.Context, l *lane) {
+	defer b.wg.Done()
+	for {
+		// ReadChunk only fails without entries once the context is cancelled
+		entries, clearer, err := l.buffer.ReadChunk(ctx)
+		if len(entries) == 0 && err != nil {
+			return
+		}
+
+		select {
+		case l.chunks <- laneChunk{entries: entries, clearer: clearer, err: err}:
+			signal(b.ready)
+		case <-ctx.Done():
+			// The entries of the chunk are kept by the buffer of the lane, because they were not flushed
+			return
+		}
+	}
+}
+
+// Read reads entries from the lanes in order of priority until dst is full or
+// every lane is empty. Entries in chunks that were read ahead for ReadChunk are
+// only returned by ReadChunk.
+func (b *PriorityBuffer) Read(dst []*entry.Entry) (Clearer, int, error) {
+	clearer := &laneClearer{}
+	n, err := b.read(dst, 0, clearer)
+	return clearer, n, err
+}
+
+// ReadWait reads entries from the lanes in order of priority until dst is full
+// or the context is cancelled
+func (b *PriorityBuffer) ReadWait(ctx context.Context, dst []*entry.Entry) (Clearer, int, error) {
+	clearer := &laneClearer{}
+	n := 0
+	for {
+		read, err := b.read(dst, n, clearer)
+		n += read
+		if err != nil || n == len(dst) {
+			return clearer, n, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return clearer, n, nil
+		case <-b.added:
+		}
+	}
+}
+
+// read reads entries from the lanes in order of priority into dst, starting at index
+// start, and adds the clearers of the lanes to the clearer. It returns the number of
+// entries read.
+func (b *PriorityBuffer) read(dst []*entry.Entry, start int, clearer *laneClearer) (int, error) {
+	n := start
+	for _, l := range b.lanes {
+		if n == len(dst) {
+			break
+		}
+		c, read, err := l.buffer.Read(dst[n:])
+		if read > 0 {
+			clearer.parts = append(clearer.parts, laneClearerPart{Clearer: c, start: uint(n), end: uint(n + read)})
+		}
+		n += read
+		if err != nil {
+			return n - start, fmt.Errorf("read lane '%s': %s", l.name, err)
+		}
+	}
+	return n - start, nil
+}
+
+// MaxChunkSize returns the max chunk size of the highest priority lane
+func (b *PriorityBuffer) MaxChunkSize() uint {
+	return b.lanes[0].buffer.MaxChunkSize()
+}
+
+// MaxChunkDelay returns the max chunk delay of the highest priority lane
+func (b *PriorityBuffer) MaxChunkDelay() time.Duration {
+	return b.lanes[0].buffer.MaxChunkDelay()
+}
+
+// SetMaxChunkSize sets the max chunk size of every lane
+func (b *PriorityBuffer) SetMaxChunkSize(size uint) {
+	for _, l := range b.lanes {
+		l.buffer.SetMaxChunkSize(size)
+	}
+}
+
+// SetMaxChunkDelay sets the max chunk delay of every lane
+func (b *PriorityBuffer) SetMaxChunkDelay(delay time.Duration) {
+	for _, l := range b.lanes {
+		l.buffer.SetMaxChunkDelay(delay)
+	}
+}
+
+// Unread returns the number of entries in the lanes that have not been read
+func (b *PriorityBuffer) Unread() int64 {
+	var unread int64
+	for _, l := range b.lanes {
+		if counter, ok := l.buffer.(UnreadCounter); ok {
+			unread += counter.Unread()
+		}
+	}
+	return unread
+}
+
+// Usage returns the highest usage of the lanes
+func (b *PriorityBuffer) Usage() float64 {
+	var highest float64
+	for _, l := range b.lanes {
+		if reporter, ok := l.buffer.(UsageReporter); ok && reporter.Usage() > highest {
+			highest = reporter.Usage()
+		}
+	}
+	return highest
+}
+
+// Dropped returns the number of entries that the lanes dropped since the buffer was built
+func (b *PriorityBuffer) Dropped() uint64 {
+	var dropped uint64
+	for _, l := range b.lanes {
+		if counter, ok := l.buffer.(DropCounter); ok {
+			dropped += counter.Dropped()
+		}
+	}
+	return dropped
+}
+
+// Close stops reading chunks from the lanes and closes the buffer of every lane.
+// Entries in chunks that were read ahead are kept by the buffers of the lanes.
+func (b *PriorityBuffer) Close() error {
+	// Prevent the readers from starting after the buffer is closed
+	b.readersOnce.Do(func() {})
+	if b.cancelReaders != nil {
+		b.cancelReaders()
+		b.wg.Wait()
+	}
+
+	var firstErr error
+	for _, l := range b.lanes {
+		if err := l.buffer.Close(); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("close lane '%s': %s", l.name, err)
+		}
+	}
+	return firstErr
+}
+
+// signal wakes up a reader waiting on ch, without blocking if one is already due to wake up
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// laneClearer marks the entries of a read that spans several lanes as flushed
+type laneClearer struct {
+	parts []laneClearerPart
+}
+
+// laneClearerPart is the clearer of the entries of a lane at [start, end) in a read
+type laneClearerPart struct {
+	Clearer
+	start, end uint
+}
+
+// MarkAllAsFlushed marks every entry of the read as flushed
+func (c *laneClearer) MarkAllAsFlushed() error {
+	var firstErr error
+	for _, part := range c.parts {
+		if err := part.MarkAllAsFlushed(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// MarkRangeAsFlushed marks the entries at [start, end) of the read as flushed
+func (c *laneClearer) MarkRangeAsFlushed(start, end uint) error {
+	var firstErr error
+	for _, part := range c.parts {
+		from, to := start, end
+		if from < part.start {
+			from = part.start
+		}
+		if to > part.end {
+			to = part.end
+		}
+		if from >= to {
+			continue
+		}
+		if err := part.MarkRangeAsFlushed(from-part.start, to-part.start); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
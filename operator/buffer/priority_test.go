@@ -0,0 +1,321 @@
+package buffer
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/observiq/stanza/entry"
+	"github.com/observiq/stanza/operator"
+	"github.com/observiq/stanza/operator/helper"
+	"github.com/observiq/stanza/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+// newPriorityConfig returns a config with a lane for entries with a negative record
+// and a lane for other entries. Both lanes are memory buffers with short chunk delays.
+func newPriorityConfig(maxEntries int) *PriorityBufferConfig {
+	lane := func() *Config {
+		cfg := NewMemoryBufferConfig()
+		cfg.MaxEntries = maxEntries
+		cfg.MaxChunkDelay = helper.NewDuration(10 * time.Millisecond)
+		cfg.MaxChunkSize = 10
+		return &Config{Builder: cfg}
+	}
+
+	cfg := NewPriorityBufferConfig()
+	cfg.Lanes = []LaneConfig{
+		{Name: "high", Expr: "$record < 0", Weight: 3, Buffer: lane()},
+		{Name: "low", Buffer: lane()},
+	}
+	return cfg
+}
+
+func newPriorityBuffer(t testing.TB, cfg *PriorityBufferConfig, bc operator.BuildContext) *PriorityBuffer {
+	b, err := cfg.Build(bc, "test")
+	require.NoError(t, err)
+	return b.(*PriorityBuffer)
+}
+
+func readPriorityChunk(t testing.TB, b Buffer) ([]*entry.Entry, Clearer) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	entries, clearer, err := b.ReadChunk(ctx)
+	require.NoError(t, err)
+	return entries, clearer
+}
+
+func TestPriorityBufferBuild(t *testing.T) {
+	cases := []struct {
+		name     string
+		modify   func(*PriorityBufferConfig)
+		expected string
+	}{
+		{"OneLane", func(c *PriorityBufferConfig) { c.Lanes = c.Lanes[:1] }, "'lanes' must contain at least two lanes"},
+		{"MissingName", func(c *PriorityBufferConfig) { c.Lanes[1].Name = "" }, "lane 1 is missing required field 'name'"},
+		{"DuplicateName", func(c *PriorityBufferConfig) { c.Lanes[1].Name = "high" }, "lane name 'high' is used more than once"},
+		{"NegativeWeight", func(c *PriorityBufferConfig) { c.Lanes[0].Weight = -1 }, "the 'weight' of lane 'high' cannot be negative"},
+		{"MissingExpr", func(c *PriorityBufferConfig) { c.Lanes[0].Expr = "" }, "lane 'high' is missing required field 'expr'"},
+		{"LastLaneExpr", func(c *PriorityBufferConfig) { c.Lanes[1].Expr = "true" }, "the last lane receives the entries that match no other lane, so it cannot have an 'expr'"},
+		{"NestedPriority", func(c *PriorityBufferConfig) { c.Lanes[1].Buffer = &Config{Builder: newPriorityConfig(10)} }, "the buffer of lane 'low' cannot be a priority buffer"},
+		{
+			"SamePath",
+			func(c *PriorityBufferConfig) {
+				for i := range c.Lanes {
+					cfg := NewDiskBufferConfig()
+					cfg.Path = "/tmp/buffer/"
+					c.Lanes[i].Buffer = &Config{Builder: cfg}
+				}
+			},
+			"lanes 'high' and 'low' use the same path",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := newPriorityConfig(10)
+			tc.modify(cfg)
+			_, err := cfg.Build(testutil.NewBuildContext(t), "test")
+			require.Error(t, err)
+			require.Contains(t, err.Error(), tc.expected)
+		})
+	}
+
+	t.Run("InvalidExpr", func(t *testing.T) {
+		cfg := newPriorityConfig(10)
+		cfg.Lanes[0].Expr = "$record <"
+		_, err := cfg.Build(testutil.NewBuildContext(t), "test")
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "failed to compile expression of lane 'high'")
+	})
+
+	t.Run("DefaultLaneBuffer", func(t *testing.T) {
+		cfg := newPriorityConfig(10)
+		cfg.Lanes[1].Buffer = nil
+		b := newPriorityBuffer(t, cfg, testutil.NewBuildContext(t))
+		defer b.Close()
+		require.IsType(t, &MemoryBuffer{}, b.lanes[1].buffer)
+		require.Equal(t, 1, b.lanes[1].weight)
+	})
+}
+
+func TestPriorityBuffer(t *testing.T) {
+	t.Run("EntriesAreRoutedToLanes", func(t *testing.T) {
+		b := newPriorityBuffer(t, newPriorityConfig(10), testutil.NewBuildContext(t))
+		defer b.Close()
+		writeN(t, b, 3, 0)
+		writeN(t, b, 2, -2)
+
+		dst := make([]*entry.Entry, 10)
+		_, n, err := b.lanes[0].buffer.Read(dst)
+		require.NoError(t, err)
+		require.Equal(t, []*entry.Entry{intEntry(-2), intEntry(-1)}, dst[:n])
+		_, n, err = b.lanes[1].buffer.Read(dst)
+		require.NoError(t, err)
+		require.Equal(t, []*entry.Entry{intEntry(0), intEntry(1), intEntry(2)}, dst[:n])
+	})
+
+	t.Run("ReadChunkPrefersHighPriority", func(t *testing.T) {
+		b := newPriorityBuffer(t, newPriorityConfig(100), testutil.NewBuildContext(t))
+		defer b.Close()
+		writeN(t, b, 40, 0)
+		writeN(t, b, 40, -40)
+
+		b.startReaders()
+		high, low := 0, 0
+		for i := 0; i < 4; i++ {
+			// Wait until both lanes have a chunk ready
+			require.Eventually(t, func() bool {
+				return len(b.lanes[0].chunks) == 1 && len(b.lanes[1].chunks) == 1
+			}, 10*time.Second, time.Millisecond)
+
+			entries, clearer := readPriorityChunk(t, b)
+			require.NoError(t, clearer.MarkAllAsFlushed())
+			if entries[0].Record.(float64) < 0 {
+				high++
+			} else {
+				low++
+			}
+			if i == 0 {
+				require.Equal(t, 1, high, "the first chunk is read from the high priority lane")
+			}
+		}
+		require.Equal(t, 3, high, "the high priority lane is read in proportion to its weight")
+		require.Equal(t, 1, low, "the low priority lane is not starved")
+	})
+
+	t.Run("ReadChunkWithoutWeightsIsStrict", func(t *testing.T) {
+		cfg := newPriorityConfig(100)
+		cfg.Lanes[0].Weight = 0
+		b := newPriorityBuffer(t, cfg, testutil.NewBuildContext(t))
+		defer b.Close()
+		writeN(t, b, 40, 0)
+		writeN(t, b, 40, -40)
+
+		b.startReaders()
+		for i := 0; i < 4; i++ {
+			// Wait until both lanes have a chunk ready
+			require.Eventually(t, func() bool {
+				return len(b.lanes[0].chunks) == 1 && len(b.lanes[1].chunks) == 1
+			}, 10*time.Second, time.Millisecond)
+
+			entries, clearer := readPriorityChunk(t, b)
+			require.NoError(t, clearer.MarkAllAsFlushed())
+			require.Less(t, entries[0].Record.(float64), float64(0), "the high priority lane is read before the backlog of the low priority lane")
+		}
+
+		entries, _ := readPriorityChunk(t, b)
+		require.Equal(t, intEntry(0), entries[0], "the low priority lane is read once the high priority lane is empty")
+	})
+
+	t.Run("ReadChunkWaitsForEntries", func(t *testing.T) {
+		b := newPriorityBuffer(t, newPriorityConfig(10), testutil.NewBuildContext(t))
+		defer b.Close()
+
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			_ = b.Add(context.Background(), intEntry(1))
+		}()
+		entries, _ := readPriorityChunk(t, b)
+		require.Equal(t, []*entry.Entry{intEntry(1)}, entries)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		_, _, err := b.ReadChunk(ctx)
+		require.Equal(t, context.DeadlineExceeded, err)
+	})
+
+	t.Run("ReadAcrossLanes", func(t *testing.T) {
+		bc := testutil.NewBuildContext(t)
+		b := newPriorityBuffer(t, newPriorityConfig(10), bc)
+		defer b.Close()
+		writeN(t, b, 2, 0)
+		writeN(t, b, 2, -2)
+
+		dst := make([]*entry.Entry, 3)
+		clearer, n, err := b.Read(dst)
+		require.NoError(t, err)
+		require.Equal(t, []*entry.Entry{intEntry(-2), intEntry(-1), intEntry(0)}, dst[:n])
+
+		// Flush the second high priority entry and the low priority entry
+		require.NoError(t, clearer.MarkRangeAsFlushed(1, 3))
+		require.NoError(t, b.Close())
+
+		b = newPriorityBuffer(t, newPriorityConfig(10), bc)
+		defer b.Close()
+		dst = make([]*entry.Entry, 10)
+		_, n, err = b.Read(dst)
+		require.NoError(t, err)
+		require.Equal(t, []*entry.Entry{intEntry(-2), intEntry(1)}, dst[:n])
+	})
+
+	t.Run("ReadWait", func(t *testing.T) {
+		b := newPriorityBuffer(t, newPriorityConfig(10), testutil.NewBuildContext(t))
+		defer b.Close()
+		writeN(t, b, 1, 0)
+
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			_ = b.Add(context.Background(), intEntry(-1))
+		}()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		dst := make([]*entry.Entry, 2)
+		_, n, err := b.ReadWait(ctx, dst)
+		require.NoError(t, err)
+		require.Equal(t, []*entry.Entry{intEntry(0), intEntry(-1)}, dst[:n])
+	})
+
+	t.Run("CloseKeepsReadAheadChunks", func(t *testing.T) {
+		bc := testutil.NewBuildContext(t)
+		b := newPriorityBuffer(t, newPriorityConfig(10), bc)
+		writeN(t, b, 3, 0)
+		writeN(t, b, 3, -3)
+
+		entries, clearer := readPriorityChunk(t, b)
+		require.Len(t, entries, 3)
+		require.NoError(t, clearer.MarkAllAsFlushed())
+		require.NoError(t, b.Close())
+
+		b = newPriorityBuffer(t, newPriorityConfig(10), bc)
+		defer b.Close()
+		dst := make([]*entry.Entry, 10)
+		_, n, err := b.Read(dst)
+		require.NoError(t, err)
+		require.Equal(t, 3, n, "only the flushed chunk is removed")
+	})
+
+	t.Run("LowPriorityEntriesAreDropped", func(t *testing.T) {
+		cfg := newPriorityConfig(5)
+		cfg.Lanes[1].Buffer.Builder.(*MemoryBufferConfig).Overflow = OverflowDropOldest
+		b := newPriorityBuffer(t, cfg, testutil.NewBuildContext(t))
+		defer b.Close()
+
+		writeN(t, b, 10, 0)
+		writeN(t, b, 5, -5)
+		require.Equal(t, uint64(5), b.Dropped())
+
+		dst := make([]*entry.Entry, 20)
+		_, n, err := b.Read(dst)
+		require.NoError(t, err)
+		require.Equal(t, 10, n)
+		require.Equal(t, intEntry(-5), dst[0])
+		require.Equal(t, intEntry(5), dst[5])
+	})
+}
+
+func TestLaneClearer(t *testing.T) {
+	bc := testutil.NewBuildContext(t)
+	first, err := NewMemoryBufferConfig().Build(bc, "first")
+	require.NoError(t, err)
+	second, err := NewMemoryBufferConfig().Build(bc, "second")
+	require.NoError(t, err)
+	writeN(t, first, 2, 0)
+	writeN(t, second, 2, 2)
+
+	firstClearer := readN(t, first, 2, 0)
+	secondClearer := readN(t, second, 2, 2)
+	clearer := &laneClearer{parts: []laneClearerPart{
+		{Clearer: firstClearer, start: 0, end: 2},
+		{Clearer: secondClearer, start: 2, end: 4},
+	}}
+	require.NoError(t, clearer.MarkRangeAsFlushed(1, 3))
+
+	// The unflushed entries are read again after the buffers are reopened
+	require.NoError(t, first.Close())
+	require.NoError(t, second.Close())
+	first, err = NewMemoryBufferConfig().Build(bc, "first")
+	require.NoError(t, err)
+	defer first.Close()
+	second, err = NewMemoryBufferConfig().Build(bc, "second")
+	require.NoError(t, err)
+	defer second.Close()
+	readN(t, first, 1, 0)
+	readN(t, second, 1, 3)
+}
+
+func TestOfflinePriority(t *testing.T) {
+	bc := testutil.NewBuildContext(t)
+	src, dst := NewConfig(), Config{Builder: newPriorityConfig(10)}
+	writeEntries := func(b Buffer) {
+		writeN(t, b, 2, 0)
+		writeN(t, b, 3, -3)
+	}
+	b, err := src.Build(bc, "test")
+	require.NoError(t, err)
+	writeEntries(b)
+	require.NoError(t, b.Close())
+
+	o := openOffline(t, src, bc)
+	migrated, err := o.MigrateTo(openOffline(t, dst, bc))
+	require.NoError(t, err)
+	require.NoError(t, o.Close())
+	require.Equal(t, 5, migrated)
+
+	stats := offlineStats(t, dst, bc)
+	require.Len(t, stats, 2)
+	require.Equal(t, "high", stats[0].Lane)
+	require.Equal(t, 3, stats[0].Entries)
+	require.Equal(t, "low", stats[1].Lane)
+	require.Equal(t, 2, stats[1].Entries)
+}
@@ -0,0 +1,654 @@
+package buffer
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/observiq/stanza/entry"
+	"github.com/observiq/stanza/operator"
+	"github.com/observiq/stanza/operator/helper"
+	"golang.org/x/sync/semaphore"
+)
+
+// WALBufferConfig is a configuration struct for a WALBuffer
+type WALBufferConfig struct {
+	Type string `json:"type" yaml:"type"`
+
+	// MaxSize is the maximum size in bytes of all segment files on disk
+	MaxSize helper.ByteSize `json:"max_size" yaml:"max_size"`
+
+	// SegmentSize is the size in bytes after which a new segment file is started
+	SegmentSize helper.ByteSize `json:"segment_size" yaml:"segment_size"`
+
+	// Path is a path to a directory which contains the segment files
+	Path string `json:"path" yaml:"path"`
+
+	// Sync indicates whether to open the files with O_SYNC. If this is set to false,
+	// in cases like power failures or unclean shutdowns, logs may be lost.
+	Sync bool `json:"sync" yaml:"sync"`
+
+	MaxChunkDelay helper.Duration `json:"max_delay"   yaml:"max_delay"`
+	MaxChunkSize  uint            `json:"max_chunk_size" yaml:"max_chunk_size"`
+
+	CodecConfig    `yaml:",inline"`
+	OverflowConfig `yaml:",inline"`
+}
+
+// NewWALBufferConfig creates a new default WAL buffer config
+func NewWALBufferConfig() *WALBufferConfig {
+	return &WALBufferConfig{
+		Type:          "wal",
+		MaxSize:       1 << 32, // 4GiB
+		SegmentSize:   1 << 26, // 64MiB
+		Sync:          true,
+		MaxChunkDelay: helper.NewDuration(time.Second),
+		MaxChunkSize:  1000,
+	}
+}
+
+func (c WALBufferConfig) joinPath(elem string) Builder {
+	c.Path = filepath.Join(c.Path, elem)
+	c.OverflowConfig = c.joinSpillPath(elem)
+	return &c
+}
+
+// Build creates a new Buffer from a WALBufferConfig
+func (c WALBufferConfig) Build(context operator.BuildContext, pluginID string) (Buffer, error) {
+	maxSize := c.MaxSize
+	if maxSize == 0 {
+		maxSize = 1 << 32
+	}
+
+	segmentSize := c.SegmentSize
+	if segmentSize == 0 {
+		segmentSize = 1 << 26
+	}
+
+	if segmentSize > maxSize {
+		return nil, fmt.Errorf("'segment_size' cannot be greater than 'max_size'")
+	}
+
+	if c.Path == "" {
+		return nil, fmt.Errorf("missing required field 'path'")
+	}
+	codec, err := c.CodecConfig.build()
+	if err != nil {
+		return nil, err
+	}
+
+	b := NewWALBuffer(int64(maxSize), int64(segmentSize))
+	b.codec = codec
+	if err := b.Open(c.Path, c.Sync); err != nil {
+		return nil, err
+	}
+	b.maxChunkSize = c.MaxChunkSize
+	b.maxChunkDelay = c.MaxChunkDelay.Raw()
+	return c.OverflowConfig.wrap(context, pluginID, b)
+}
+
+// WALBuffer is a buffer that appends entries to a write-ahead log of fixed size
+// segment files until they are flushed to their final destination. Flushed entries
+// are tracked per segment, and a segment is deleted as a whole once all of its
+// entries are flushed, so entries never have to be moved on disk.
+type WALBuffer struct {
+	dir   string
+	flags int
+
+	// segments are the segments on disk in ascending order. The last segment is
+	// the active segment that new entries are appended to.
+	segments []*walSegment
+	sync.Mutex
+
+	// readSegment, readOffset and readIndex are the position of the next
+	// record to read
+	readSegment *walSegment
+	readOffset  int64
+	readIndex   int
+
+	// readBuf is a pre-allocated byte slice that records are read into
+	readBuf []byte
+
+	// unreadCount is the number of entries that have not been read
+	unreadCount int64
+
+	// entryAdded is a channel that is notified on every time an entry is added.
+	// The integer sent down the channel is the new number of unread entries stored.
+	// Readers using ReadWait will listen on this channel, and wait to read until
+	// there are enough entries to fill its buffer.
+	entryAdded chan int64
+
+	maxBytes    int64
+	segmentSize int64
+
+	// waitingAdds is the number of entries that are waiting for space
+	waitingAdds int
+
+	// readerLock ensures that there is only ever one reader listening to the
+	// entryAdded channel at a time.
+	readerLock sync.Mutex
+
+	// diskSizeSemaphore is a semaphore that allows us to block once we've hit
+	// the max disk size.
+	diskSizeSemaphore *semaphore.Weighted
+
+	maxChunkDelay time.Duration
+	maxChunkSize  uint
+
+	// codec encodes new entries
+	codec *recordCodec
+
+	reconfigMutex sync.RWMutex
+}
+
+// NewWALBuffer creates a new WALBuffer
+func NewWALBuffer(maxDiskSize, segmentSize int64) *WALBuffer {
+	return &WALBuffer{
+		maxBytes:          maxDiskSize,
+		segmentSize:       segmentSize,
+		entryAdded:        make(chan int64, 1),
+		readBuf:           make([]byte, 1<<16),
+		diskSizeSemaphore: semaphore.NewWeighted(maxDiskSize),
+		codec:             defaultRecordCodec,
+	}
+}
+
+// Open opens the segment files in a directory, replaying every entry that was not flushed
+func (w *WALBuffer) Open(path string, sync bool) error {
+	w.dir = path
+	if sync {
+		w.flags = os.O_SYNC
+	}
+
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return err
+	}
+
+	ids, err := listWALSegments(path)
+	if err != nil {
+		return err
+	}
+
+	var size, unread int64
+	for i, id := range ids {
+		s, err := openWALSegment(path, id, w.flags)
+		if err != nil {
+			_ = w.closeSegments()
+			return err
+		}
+
+		active := i == len(ids)-1
+		switch {
+		case !active && s.done():
+			if err := s.remove(path); err != nil {
+				_ = w.closeSegments()
+				return err
+			}
+			continue
+		case active && s.done() && s.records() > 0:
+			if err := s.reset(); err != nil {
+				_ = s.close()
+				_ = w.closeSegments()
+				return err
+			}
+		}
+
+		s.sealed = !active
+		w.segments = append(w.segments, s)
+		size += s.size
+		unread += int64(s.records() - s.ackedCount)
+	}
+
+	if len(w.segments) == 0 {
+		s, err := createWALSegment(path, 1, w.flags)
+		if err != nil {
+			return err
+		}
+		w.segments = append(w.segments, s)
+	}
+
+	if ok := w.diskSizeSemaphore.TryAcquire(size); !ok {
+		_ = w.closeSegments()
+		return fmt.Errorf("current on-disk size is larger than max size")
+	}
+
+	w.readSegment = w.segments[0]
+	w.addUnreadCount(unread)
+	return nil
+}
+
+// Close closes the underlying segment files
+func (w *WALBuffer) Close() error {
+	w.Lock()
+	defer w.Unlock()
+
+	return w.closeSegments()
+}
+
+// closeSegments closes all segments, returning the first error
+func (w *WALBuffer) closeSegments() error {
+	var firstErr error
+	for _, s := range w.segments {
+		if err := s.close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Add adds an entry to the buffer, blocking until it is either added or the context
+// is cancelled.
+func (w *WALBuffer) Add(ctx context.Context, newEntry *entry.Entry) error {
+	record, err := w.encode(newEntry)
+	if err != nil {
+		return err
+	}
+
+	size := int64(len(record))
+	if !w.diskSizeSemaphore.TryAcquire(size) {
+		if err = w.waitForSpace(ctx, size); err != nil {
+			return err
+		}
+	}
+
+	return w.write(record)
+}
+
+// tryAdd adds an entry to the buffer if there is space for it. If there is not,
+// the active segment is reset first if all of its records are flushed.
+func (w *WALBuffer) tryAdd(newEntry *entry.Entry) (bool, error) {
+	record, err := w.encode(newEntry)
+	if err != nil {
+		return false, err
+	}
+
+	size := int64(len(record))
+	if !w.diskSizeSemaphore.TryAcquire(size) {
+		w.Lock()
+		err = w.resetActive()
+		w.Unlock()
+		if err != nil {
+			return false, err
+		}
+
+		if !w.diskSizeSemaphore.TryAcquire(size) {
+			return false, nil
+		}
+	}
+
+	return true, w.write(record)
+}
+
+// encode encodes an entry as a record, checking that it fits into the buffer
+func (w *WALBuffer) encode(newEntry *entry.Entry) ([]byte, error) {
+	payload, err := w.codec.encode(newEntry)
+	if err != nil {
+		return nil, err
+	}
+	record := encodeWALRecord(payload)
+
+	if int64(len(record)) > w.maxBytes {
+		return nil, fmt.Errorf("entry of %d bytes is larger than the max size of the buffer", len(record))
+	}
+	return record, nil
+}
+
+// write appends a record to the active segment, starting a new segment if it is full.
+// Space for the record must have been acquired from the disk size semaphore.
+func (w *WALBuffer) write(record []byte) error {
+	w.Lock()
+	defer w.Unlock()
+
+	size := int64(len(record))
+	active := w.activeSegment()
+	if active.size > 0 && active.size+size > w.segmentSize {
+		var err error
+		if active, err = w.rotate(); err != nil {
+			w.diskSizeSemaphore.Release(size)
+			return err
+		}
+	}
+
+	if err := active.append(record); err != nil {
+		w.diskSizeSemaphore.Release(size)
+		return err
+	}
+
+	w.addUnreadCount(1)
+
+	return nil
+}
+
+func (w *WALBuffer) waitForSpace(ctx context.Context, size int64) error {
+	w.Lock()
+	w.waitingAdds++
+	err := w.resetActive()
+	w.Unlock()
+
+	defer func() {
+		w.Lock()
+		w.waitingAdds--
+		w.Unlock()
+	}()
+
+	if err != nil {
+		return err
+	}
+	return w.diskSizeSemaphore.Acquire(ctx, size)
+}
+
+// activeSegment returns the segment that new entries are appended to.
+// The buffer lock must be held when calling this.
+func (w *WALBuffer) activeSegment() *walSegment {
+	return w.segments[len(w.segments)-1]
+}
+
+// rotate seals the active segment and starts a new one. The buffer lock
+// must be held when calling this.
+func (w *WALBuffer) rotate() (*walSegment, error) {
+	previous := w.activeSegment()
+	s, err := createWALSegment(w.dir, previous.id+1, w.flags)
+	if err != nil {
+		return nil, err
+	}
+
+	previous.sealed = true
+	w.segments = append(w.segments, s)
+
+	// The previous segment may have been flushed completely before it was sealed
+	return s, w.release(previous)
+}
+
+// removeSegment deletes a segment and frees its space. The buffer lock
+// must be held when calling this.
+func (w *WALBuffer) removeSegment(s *walSegment) error {
+	for i, segment := range w.segments {
+		if segment == s {
+			w.segments = append(w.segments[:i], w.segments[i+1:]...)
+			break
+		}
+	}
+
+	if err := s.remove(w.dir); err != nil {
+		return err
+	}
+	w.diskSizeSemaphore.Release(s.size)
+	return nil
+}
+
+// nextSegment returns the segment following s, even if s was removed.
+// The buffer lock must be held when calling this.
+func (w *WALBuffer) nextSegment(s *walSegment) *walSegment {
+	for _, segment := range w.segments {
+		if segment.id > s.id {
+			return segment
+		}
+	}
+	return nil
+}
+
+// addUnreadCount adds i to the unread count and notifies any callers of
+// ReadWait that an entry has been added. The buffer lock must be held when
+// calling this.
+func (w *WALBuffer) addUnreadCount(i int64) {
+	w.unreadCount += i
+
+	// Notify a reader that new entries have been added by either
+	// sending on the channel, or updating the value in the channel
+	select {
+	case <-w.entryAdded:
+		w.entryAdded <- w.unreadCount
+	case w.entryAdded <- w.unreadCount:
+	}
+}
+
+// ReadWait reads entries from the buffer, waiting until either there are enough entries in the
+// buffer to fill dst or the context is cancelled. This amortizes the cost of reading from the
+// disk. It returns a function that, when called, marks the read entries as flushed, the
+// number of entries read, and an error.
+func (w *WALBuffer) ReadWait(ctx context.Context, dst []*entry.Entry) (Clearer, int, error) {
+	w.readerLock.Lock()
+	defer w.readerLock.Unlock()
+
+	// Wait until the timeout is hit, or there are enough unread entries to fill the destination buffer
+LOOP:
+	for {
+		select {
+		case n := <-w.entryAdded:
+			if n >= int64(len(dst)) {
+				break LOOP
+			}
+		case <-ctx.Done():
+			break LOOP
+		}
+	}
+
+	return w.Read(dst)
+}
+
+// ReadChunk is a thin wrapper around ReadWait that simplifies the call at the expense of an extra allocation
+func (w *WALBuffer) ReadChunk(ctx context.Context) ([]*entry.Entry, Clearer, error) {
+	entries := make([]*entry.Entry, w.MaxChunkSize())
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		default:
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, w.MaxChunkDelay())
+		defer cancel()
+		flushFunc, n, err := w.ReadWait(ctx, entries)
+		if n > 0 {
+			return entries[:n], flushFunc, err
+		}
+	}
+}
+
+// Read copies entries from the disk into the destination buffer. It returns a function that,
+// when called, marks the entries as flushed, the number of entries read, and an error.
+// Entries that were flushed before the buffer was reopened are skipped.
+func (w *WALBuffer) Read(dst []*entry.Entry) (Clearer, int, error) {
+	w.Lock()
+	defer w.Unlock()
+
+	// Return fast if there are no unread entries
+	if w.unreadCount == 0 {
+		return w.newClearer(nil), 0, nil
+	}
+
+	// The position is only updated once every entry was decoded
+	segment, offset, index := w.readSegment, w.readOffset, w.readIndex
+	records := make([]walRecord, 0, min(len(dst), int(w.unreadCount)))
+	n := 0
+	for n < len(dst) && int64(n) < w.unreadCount {
+		if offset >= segment.size {
+			next := w.nextSegment(segment)
+			if next == nil {
+				break
+			}
+			segment, offset, index = next, 0, 0
+			continue
+		}
+
+		payloads, nextOffset, err := segment.readRecords(offset, w.readBuf, len(dst)-n)
+		if err != nil {
+			return nil, 0, fmt.Errorf("read segment %d: %s", segment.id, err)
+		}
+
+		for _, payload := range payloads {
+			i := index
+			index++
+			if segment.acked[i] {
+				continue
+			}
+
+			entry, err := decodeRecord(payload)
+			if err != nil {
+				return nil, 0, fmt.Errorf("decode: %s", err)
+			}
+			dst[n] = entry
+			n++
+			records = append(records, walRecord{
+				segment:    segment,
+				generation: segment.generation,
+				index:      i,
+			})
+		}
+		offset = nextOffset
+	}
+
+	w.readSegment, w.readOffset, w.readIndex = segment, offset, index
+	w.addUnreadCount(-int64(n))
+
+	return w.newClearer(records), n, nil
+}
+
+// Unread returns the number of entries in the buffer that have not been read
+func (w *WALBuffer) Unread() int64 {
+	w.Lock()
+	defer w.Unlock()
+	return w.unreadCount
+}
+
+// Usage returns the fraction of the max size of the buffer that the segment files take
+func (w *WALBuffer) Usage() float64 {
+	w.Lock()
+	defer w.Unlock()
+	var size int64
+	for _, s := range w.segments {
+		size += s.size
+	}
+	return usage(size, w.maxBytes)
+}
+
+func (w *WALBuffer) MaxChunkSize() uint {
+	w.reconfigMutex.RLock()
+	defer w.reconfigMutex.RUnlock()
+	return w.maxChunkSize
+}
+
+func (w *WALBuffer) MaxChunkDelay() time.Duration {
+	w.reconfigMutex.RLock()
+	defer w.reconfigMutex.RUnlock()
+	return w.maxChunkDelay
+}
+
+func (w *WALBuffer) SetMaxChunkSize(size uint) {
+	w.reconfigMutex.Lock()
+	w.maxChunkSize = size
+	w.reconfigMutex.Unlock()
+}
+
+func (w *WALBuffer) SetMaxChunkDelay(delay time.Duration) {
+	w.reconfigMutex.Lock()
+	w.maxChunkDelay = delay
+	w.reconfigMutex.Unlock()
+}
+
+// walRecord identifies a record that was read from a segment
+type walRecord struct {
+	segment    *walSegment
+	generation uint64
+	index      int
+}
+
+// newClearer returns a Clearer that marks read entries as flushed
+func (w *WALBuffer) newClearer(records []walRecord) Clearer {
+	return &walClearer{
+		buffer:  w,
+		records: records,
+	}
+}
+
+type walClearer struct {
+	buffer  *WALBuffer
+	records []walRecord
+}
+
+func (wc *walClearer) MarkAllAsFlushed() error {
+	return wc.buffer.ack(wc.records)
+}
+
+func (wc *walClearer) MarkRangeAsFlushed(start, end uint) error {
+	if int(end) > len(wc.records) || start > end {
+		return fmt.Errorf("invalid range")
+	}
+	return wc.buffer.ack(wc.records[start:end])
+}
+
+// ack persists the acknowledgements of flushed records segment by segment, then
+// deletes the segments whose records were all flushed
+func (w *WALBuffer) ack(records []walRecord) error {
+	w.Lock()
+	defer w.Unlock()
+
+	for start := 0; start < len(records); {
+		// Records are read in order, so the records of a segment are contiguous
+		s, generation := records[start].segment, records[start].generation
+		end := start
+		indexes := make([]int, 0, len(records)-start)
+		for ; end < len(records) && records[end].segment == s && records[end].generation == generation; end++ {
+			indexes = append(indexes, records[end].index)
+		}
+		start = end
+
+		// The records were already flushed if the segment was removed or reset since
+		if s.removed || s.generation != generation {
+			continue
+		}
+
+		if err := s.ack(indexes); err != nil {
+			return err
+		}
+		if err := w.release(s); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// release frees the space of a segment once all of its records were read and
+// flushed. Sealed segments are deleted. The active segment is reset once it is
+// half full, or as soon as an entry is waiting for space, so that its space can
+// be reused without waiting for it to fill up. The buffer lock must be held when
+// calling this.
+func (w *WALBuffer) release(s *walSegment) error {
+	if !s.done() {
+		return nil
+	}
+
+	if s.sealed {
+		if w.readSegment == s {
+			// Keep the reader in a valid position after the segment is removed
+			w.readSegment, w.readOffset, w.readIndex = w.nextSegment(s), 0, 0
+		}
+		return w.removeSegment(s)
+	}
+
+	if w.waitingAdds == 0 && 2*s.size < w.segmentSize {
+		return nil
+	}
+	return w.resetActive()
+}
+
+// resetActive resets the active segment if all of its records were read and
+// flushed. The buffer lock must be held when calling this.
+func (w *WALBuffer) resetActive() error {
+	s := w.activeSegment()
+	if s.records() == 0 || !s.done() || w.readSegment != s || w.readOffset != s.size {
+		return nil
+	}
+
+	size := s.size
+	if err := s.reset(); err != nil {
+		return err
+	}
+	w.readOffset, w.readIndex = 0, 0
+	w.diskSizeSemaphore.Release(size)
+	return nil
+}
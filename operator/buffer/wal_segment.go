@@ -0,0 +1,408 @@
+package buffer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A WALBuffer stores entries in segment files named after their sequence number,
+// such as 00000000000000000001.wal. The layout of each record in a segment is as follows:
+// - 4 byte Length of the payload as LittleEndian uint32
+// - 4 byte CRC-32 (Castagnoli) checksum of the payload as LittleEndian uint32
+// - Length byte Payload containing the entry, encoded by the recordCodec of the buffer
+//
+// Acknowledgements are appended to an ack file next to the segment, such as
+// 00000000000000000001.ack. The layout of the ack file is as follows:
+// - Repeated for every flushed record:
+//   - 4 byte Index of the record in the segment as LittleEndian uint32
+const (
+	walSegmentExt    = ".wal"
+	walAckExt        = ".ack"
+	walHeaderSize    = 8
+	walAckRecordSize = 4
+)
+
+var walChecksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+// walSegment is a segment file of a WALBuffer together with its acknowledgements
+type walSegment struct {
+	id   uint64
+	data *os.File
+	acks *os.File
+
+	// size is the number of bytes of complete records in the data file
+	size int64
+
+	// acked holds whether each record in the segment has been flushed
+	acked      []bool
+	ackedCount int
+
+	// sealed indicates that no more records are appended to the segment,
+	// so it can be deleted once every record is flushed
+	sealed bool
+
+	// generation is incremented every time the segment is reset, so that
+	// acknowledgements of records from before the reset are ignored
+	generation uint64
+
+	// removed indicates that the segment files were deleted
+	removed bool
+}
+
+// encodeWALRecord prefixes a payload with its record header
+func encodeWALRecord(payload []byte) []byte {
+	record := make([]byte, walHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(record[4:8], crc32.Checksum(payload, walChecksumTable))
+	copy(record[walHeaderSize:], payload)
+	return record
+}
+
+// walSegmentPath returns the path of a segment file with the given extension
+func walSegmentPath(dir string, id uint64, ext string) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", id, ext))
+}
+
+// listWALSegments returns the ids of the segments in a directory in ascending order,
+// and deletes ack files that were left behind by a segment that was deleted
+func listWALSegments(dir string) ([]uint64, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	segments := make(map[uint64]bool)
+	var acks []uint64
+	for _, file := range files {
+		name := file.Name()
+		ext := filepath.Ext(name)
+		if ext != walSegmentExt && ext != walAckExt {
+			continue
+		}
+
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, ext), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		if ext == walSegmentExt {
+			segments[id] = true
+		} else {
+			acks = append(acks, id)
+		}
+	}
+
+	for _, id := range acks {
+		if !segments[id] {
+			if err := os.Remove(walSegmentPath(dir, id, walAckExt)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	ids := make([]uint64, 0, len(segments))
+	for id := range segments {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+// createWALSegment creates the files of a new, empty segment
+func createWALSegment(dir string, id uint64, flags int) (*walSegment, error) {
+	s := &walSegment{id: id}
+
+	var err error
+	// #nosec - configs load based on user specified directory
+	if s.data, err = os.OpenFile(walSegmentPath(dir, id, walSegmentExt), flags|os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0600); err != nil {
+		return nil, err
+	}
+
+	// #nosec - configs load based on user specified directory
+	if s.acks, err = os.OpenFile(walSegmentPath(dir, id, walAckExt), flags|os.O_CREATE|os.O_TRUNC|os.O_RDWR|os.O_APPEND, 0600); err != nil {
+		_ = s.data.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// openWALSegment opens an existing segment, recovering its records and acknowledgements.
+// The segment is truncated after its last valid record, so that a record that was torn
+// by a crash is discarded together with anything written after it.
+func openWALSegment(dir string, id uint64, flags int) (*walSegment, error) {
+	s := &walSegment{id: id}
+
+	var err error
+	// #nosec - configs load based on user specified directory
+	if s.data, err = os.OpenFile(walSegmentPath(dir, id, walSegmentExt), flags|os.O_RDWR, 0600); err != nil {
+		return nil, err
+	}
+
+	// #nosec - configs load based on user specified directory
+	if s.acks, err = os.OpenFile(walSegmentPath(dir, id, walAckExt), flags|os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600); err != nil {
+		_ = s.data.Close()
+		return nil, err
+	}
+
+	if err = s.recoverRecords(); err != nil {
+		_ = s.close()
+		return nil, fmt.Errorf("recover segment %d: %s", id, err)
+	}
+
+	if err = s.recoverAcks(); err != nil {
+		_ = s.close()
+		return nil, fmt.Errorf("recover acknowledgements of segment %d: %s", id, err)
+	}
+
+	return s, nil
+}
+
+// recoverRecords counts the valid records of the data file and truncates anything after them
+func (s *walSegment) recoverRecords() error {
+	info, err := s.data.Stat()
+	if err != nil {
+		return err
+	}
+
+	rd := bufio.NewReader(io.NewSectionReader(s.data, 0, info.Size()))
+	header := make([]byte, walHeaderSize)
+	var payload []byte
+	for {
+		if _, err := io.ReadFull(rd, header); err != nil {
+			break
+		}
+
+		length := int64(binary.LittleEndian.Uint32(header[0:4]))
+		if s.size+walHeaderSize+length > info.Size() {
+			break
+		}
+
+		if int64(cap(payload)) < length {
+			payload = make([]byte, length)
+		}
+		payload = payload[:length]
+		if _, err := io.ReadFull(rd, payload); err != nil {
+			break
+		}
+
+		if crc32.Checksum(payload, walChecksumTable) != binary.LittleEndian.Uint32(header[4:8]) {
+			break
+		}
+
+		s.size += walHeaderSize + length
+		s.acked = append(s.acked, false)
+	}
+
+	if s.size < info.Size() {
+		return s.data.Truncate(s.size)
+	}
+	return nil
+}
+
+// recoverAcks marks the records listed in the ack file as flushed. Acknowledgements of
+// records that do not exist are left behind when a crash interrupts a reset, so the ack
+// file is rewritten without them. Otherwise they would apply to the next records.
+func (s *walSegment) recoverAcks() error {
+	info, err := s.acks.Stat()
+	if err != nil {
+		return err
+	}
+
+	// An acknowledgement that was torn by a crash is discarded, so its
+	// record is read again
+	complete := info.Size() - info.Size()%walAckRecordSize
+	if complete < info.Size() {
+		if err := s.acks.Truncate(complete); err != nil {
+			return err
+		}
+	}
+
+	rd := bufio.NewReader(io.NewSectionReader(s.acks, 0, complete))
+	buf := make([]byte, walAckRecordSize)
+	stale := false
+	for {
+		if _, err := io.ReadFull(rd, buf); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+
+		index := int(binary.LittleEndian.Uint32(buf))
+		switch {
+		case index >= len(s.acked):
+			stale = true
+		case !s.acked[index]:
+			s.acked[index] = true
+			s.ackedCount++
+		}
+	}
+
+	if !stale {
+		return nil
+	}
+	return s.rewriteAcks()
+}
+
+// rewriteAcks replaces the contents of the ack file with the records that are flushed
+func (s *walSegment) rewriteAcks() error {
+	if err := s.truncateAcks(); err != nil {
+		return err
+	}
+
+	indexes := make([]int, 0, s.ackedCount)
+	for index, acked := range s.acked {
+		if acked {
+			indexes = append(indexes, index)
+		}
+	}
+	buf := make([]byte, walAckRecordSize*len(indexes))
+	for i, index := range indexes {
+		binary.LittleEndian.PutUint32(buf[i*walAckRecordSize:], uint32(index))
+	}
+	if _, err := s.acks.Write(buf); err != nil {
+		return err
+	}
+	return s.acks.Sync()
+}
+
+// truncateAcks removes every acknowledgement from the ack file and syncs it
+func (s *walSegment) truncateAcks() error {
+	if err := s.acks.Truncate(0); err != nil {
+		return err
+	}
+	return s.acks.Sync()
+}
+
+// records returns the number of records in the segment
+func (s *walSegment) records() int {
+	return len(s.acked)
+}
+
+// done returns true if every record in the segment has been flushed
+func (s *walSegment) done() bool {
+	return s.ackedCount == len(s.acked)
+}
+
+// append writes a record to the end of the segment
+func (s *walSegment) append(record []byte) error {
+	if _, err := s.data.WriteAt(record, s.size); err != nil {
+		// Remove anything that was partially written, so the next record follows the last complete one
+		_ = s.data.Truncate(s.size)
+		return err
+	}
+
+	s.size += int64(len(record))
+	s.acked = append(s.acked, false)
+	return nil
+}
+
+// readRecords reads up to max complete records starting at offset. Records are read
+// into buf when they fit, so the payloads are only valid until buf is reused. It
+// returns the payloads and the offset following the last record.
+func (s *walSegment) readRecords(offset int64, buf []byte, max int) ([][]byte, int64, error) {
+	n := s.size - offset
+	if n > int64(len(buf)) {
+		n = int64(len(buf))
+	}
+	chunk := buf[:n]
+	if _, err := s.data.ReadAt(chunk, offset); err != nil {
+		return nil, offset, err
+	}
+
+	var payloads [][]byte
+	pos := 0
+	for len(payloads) < max && pos+walHeaderSize <= len(chunk) {
+		end := pos + walHeaderSize + int(binary.LittleEndian.Uint32(chunk[pos:pos+4]))
+		if end > len(chunk) {
+			break
+		}
+		payloads = append(payloads, chunk[pos+walHeaderSize:end])
+		pos = end
+	}
+
+	if len(payloads) == 0 && max > 0 && len(chunk) >= walHeaderSize {
+		// The next record is larger than buf, so it is read on its own
+		payload := make([]byte, binary.LittleEndian.Uint32(chunk[0:4]))
+		if _, err := s.data.ReadAt(payload, offset+walHeaderSize); err != nil {
+			return nil, offset, err
+		}
+		return [][]byte{payload}, offset + walHeaderSize + int64(len(payload)), nil
+	}
+
+	return payloads, offset + int64(pos), nil
+}
+
+// ack marks records as flushed and appends them to the ack file
+func (s *walSegment) ack(indexes []int) error {
+	buf := make([]byte, walAckRecordSize*len(indexes))
+	n := 0
+	for _, index := range indexes {
+		if index >= len(s.acked) || s.acked[index] {
+			continue
+		}
+		s.acked[index] = true
+		s.ackedCount++
+		binary.LittleEndian.PutUint32(buf[n:], uint32(index))
+		n += walAckRecordSize
+	}
+
+	if n == 0 {
+		return nil
+	}
+	_, err := s.acks.Write(buf[:n])
+	return err
+}
+
+// reset removes every record from the segment so that it can be reused
+func (s *walSegment) reset() error {
+	// The acknowledgements are removed first, so that a crash before the data is
+	// truncated replays the records rather than acknowledging the records that
+	// are written next
+	if err := s.truncateAcks(); err != nil {
+		return err
+	}
+	if err := s.data.Truncate(0); err != nil {
+		return err
+	}
+
+	s.size = 0
+	s.acked = s.acked[:0]
+	s.ackedCount = 0
+	s.generation++
+	return nil
+}
+
+// remove closes the segment and deletes its files
+func (s *walSegment) remove(dir string) error {
+	s.removed = true
+	if err := s.close(); err != nil {
+		return err
+	}
+
+	// The data file is deleted first, because ack files without
+	// a segment are deleted when the buffer is opened
+	if err := os.Remove(walSegmentPath(dir, s.id, walSegmentExt)); err != nil {
+		return err
+	}
+	return os.Remove(walSegmentPath(dir, s.id, walAckExt))
+}
+
+// close closes the files of the segment
+func (s *walSegment) close() error {
+	dataErr := s.data.Close()
+	acksErr := s.acks.Close()
+	if dataErr != nil {
+		return dataErr
+	}
+	return acksErr
+}
@@ -0,0 +1,569 @@
+package buffer
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/observiq/stanza/entry"
+	"github.com/observiq/stanza/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+// walRecordSize is the size of the records written by writeN for single digit numbers
+var walRecordSize = func() int64 {
+	payload, err := json.Marshal(intEntry(0))
+	panicOnErr(err)
+	return int64(walHeaderSize + len(payload))
+}()
+
+func openWALBuffer(t testing.TB, dir string, maxSize, segmentSize int64) *WALBuffer {
+	buffer := NewWALBuffer(maxSize, segmentSize)
+	err := buffer.Open(dir, false)
+	require.NoError(t, err)
+	t.Cleanup(func() { buffer.Close() })
+	return buffer
+}
+
+func walSegmentFiles(t testing.TB, dir string) []string {
+	matches, err := filepath.Glob(filepath.Join(dir, "*"+walSegmentExt))
+	require.NoError(t, err)
+	return matches
+}
+
+func TestWALBuffer(t *testing.T) {
+	t.Run("Simple", func(t *testing.T) {
+		t.Parallel()
+		b := openWALBuffer(t, testutil.NewTempDir(t), 1<<20, 1<<16)
+		writeN(t, b, 1, 0)
+		readN(t, b, 1, 0)
+	})
+
+	t.Run("Write20Read10Read10", func(t *testing.T) {
+		t.Parallel()
+		b := openWALBuffer(t, testutil.NewTempDir(t), 1<<20, 1<<16)
+		writeN(t, b, 20, 0)
+		readN(t, b, 10, 0)
+		readN(t, b, 10, 10)
+	})
+
+	t.Run("SingleReadWaitMultipleWrites", func(t *testing.T) {
+		t.Parallel()
+		b := openWALBuffer(t, testutil.NewTempDir(t), 1<<20, 1<<16)
+		writeN(t, b, 10, 0)
+		readyDone := make(chan struct{})
+		go func() {
+			readyDone <- struct{}{}
+			readWaitN(t, b, 20, 0)
+			readyDone <- struct{}{}
+		}()
+		<-readyDone
+		time.Sleep(100 * time.Millisecond)
+		writeN(t, b, 10, 10)
+		<-readyDone
+	})
+
+	t.Run("Write10Read10Read0", func(t *testing.T) {
+		t.Parallel()
+		b := openWALBuffer(t, testutil.NewTempDir(t), 1<<20, 1<<16)
+		writeN(t, b, 10, 0)
+		readN(t, b, 10, 0)
+		dst := make([]*entry.Entry, 10)
+		_, n, err := b.Read(dst)
+		require.NoError(t, err)
+		require.Equal(t, 0, n)
+	})
+
+	t.Run("ReadAcrossSegments", func(t *testing.T) {
+		t.Parallel()
+		dir := testutil.NewTempDir(t)
+		b := openWALBuffer(t, dir, 1<<20, 3*walRecordSize)
+		writeN(t, b, 10, 0)
+		require.Len(t, walSegmentFiles(t, dir), 4)
+		readN(t, b, 7, 0)
+		readN(t, b, 3, 7)
+	})
+
+	t.Run("ReadLargerThanReadBuffer", func(t *testing.T) {
+		t.Parallel()
+		b := openWALBuffer(t, testutil.NewTempDir(t), 1<<20, 1<<16)
+		b.readBuf = make([]byte, walRecordSize/2)
+		writeN(t, b, 3, 0)
+		readN(t, b, 3, 0)
+	})
+
+	t.Run("FlushedSegmentsAreDeleted", func(t *testing.T) {
+		t.Parallel()
+		dir := testutil.NewTempDir(t)
+		b := openWALBuffer(t, dir, 1<<20, 3*walRecordSize)
+		writeN(t, b, 10, 0)
+		require.Len(t, walSegmentFiles(t, dir), 4)
+
+		flushN(t, b, 4, 0)
+		require.Len(t, walSegmentFiles(t, dir), 3)
+
+		c := readN(t, b, 6, 4)
+		require.NoError(t, c.MarkRangeAsFlushed(0, 2))
+		require.Len(t, walSegmentFiles(t, dir), 2)
+
+		// The active segment is kept rather than deleted
+		require.NoError(t, c.MarkAllAsFlushed())
+		require.Len(t, walSegmentFiles(t, dir), 1)
+
+		writeN(t, b, 2, 10)
+		readN(t, b, 2, 10)
+	})
+
+	t.Run("ActiveSegmentIsResetWhenHalfFull", func(t *testing.T) {
+		t.Parallel()
+		b := openWALBuffer(t, testutil.NewTempDir(t), 1<<20, 4*walRecordSize)
+		writeN(t, b, 1, 0)
+		flushN(t, b, 1, 0)
+		require.Equal(t, walRecordSize, b.activeSegment().size)
+
+		writeN(t, b, 1, 1)
+		flushN(t, b, 1, 1)
+		require.Equal(t, int64(0), b.activeSegment().size)
+
+		writeN(t, b, 2, 2)
+		readN(t, b, 2, 2)
+	})
+
+	t.Run("ActiveSegmentIsResetForWaitingEntry", func(t *testing.T) {
+		t.Parallel()
+		b := openWALBuffer(t, testutil.NewTempDir(t), 3*walRecordSize, 3*walRecordSize)
+		large := entry.New()
+		large.Record = strings.Repeat("a", int(3*walRecordSize/2))
+
+		// The first entry is flushed while there is space, so the segment is kept
+		writeN(t, b, 1, 0)
+		flushN(t, b, 1, 0)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		require.NoError(t, b.Add(ctx, large))
+		dst := make([]*entry.Entry, 1)
+		c, n, err := b.Read(dst)
+		require.NoError(t, err)
+		require.Equal(t, 1, n)
+
+		// The next entry waits until the large entry is flushed
+		added := make(chan error, 1)
+		go func() {
+			added <- b.Add(ctx, large)
+		}()
+		select {
+		case <-added:
+			require.FailNow(t, "Entry should wait for space")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		require.NoError(t, c.MarkAllAsFlushed())
+		require.NoError(t, <-added)
+	})
+
+	t.Run("FlushOutOfOrder", func(t *testing.T) {
+		t.Parallel()
+		dir := testutil.NewTempDir(t)
+		b := openWALBuffer(t, dir, 1<<20, 3*walRecordSize)
+		writeN(t, b, 6, 0)
+		first := readN(t, b, 3, 0)
+		second := readN(t, b, 3, 3)
+
+		require.NoError(t, second.MarkAllAsFlushed())
+		require.Len(t, walSegmentFiles(t, dir), 2)
+		require.NoError(t, first.MarkAllAsFlushed())
+		require.Len(t, walSegmentFiles(t, dir), 1)
+	})
+
+	t.Run("ClearTwiceAfterReset", func(t *testing.T) {
+		t.Parallel()
+		b := openWALBuffer(t, testutil.NewTempDir(t), 1<<20, 4*walRecordSize)
+		writeN(t, b, 2, 0)
+		c := readN(t, b, 2, 0)
+		require.NoError(t, c.MarkAllAsFlushed())
+
+		// Clearing the same entries again must not flush the entries that reuse the segment
+		writeN(t, b, 2, 2)
+		require.NoError(t, c.MarkAllAsFlushed())
+		require.Equal(t, 0, b.activeSegment().ackedCount)
+		readN(t, b, 2, 2)
+	})
+
+	t.Run("InvalidRange", func(t *testing.T) {
+		t.Parallel()
+		b := openWALBuffer(t, testutil.NewTempDir(t), 1<<20, 1<<16)
+		writeN(t, b, 2, 0)
+		c := readN(t, b, 2, 0)
+		require.Error(t, c.MarkRangeAsFlushed(0, 3))
+		require.Error(t, c.MarkRangeAsFlushed(2, 1))
+	})
+
+	t.Run("ReadWaitTimesOut", func(t *testing.T) {
+		t.Parallel()
+		b := openWALBuffer(t, testutil.NewTempDir(t), 1<<20, 1<<16)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		dst := make([]*entry.Entry, 10)
+		_, n, err := b.ReadWait(ctx, dst)
+		require.NoError(t, err)
+		require.Equal(t, 0, n)
+	})
+
+	t.Run("AddTimesOut", func(t *testing.T) {
+		t.Parallel()
+		// Enough space for 2, but not 3 entries
+		b := openWALBuffer(t, testutil.NewTempDir(t), 2*walRecordSize+1, walRecordSize)
+		writeN(t, b, 2, 0)
+
+		// Third entry should block and be cancelled
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		err := b.Add(ctx, intEntry(2))
+		require.Error(t, err)
+		cancel()
+
+		// Flushing the first segment frees its space
+		flushN(t, b, 1, 0)
+		writeN(t, b, 1, 2)
+		readN(t, b, 2, 1)
+	})
+
+	t.Run("EntryLargerThanMaxSize", func(t *testing.T) {
+		t.Parallel()
+		b := openWALBuffer(t, testutil.NewTempDir(t), walRecordSize-1, walRecordSize-1)
+		err := b.Add(context.Background(), intEntry(0))
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "larger than the max size")
+	})
+}
+
+func TestWALBufferRecovery(t *testing.T) {
+	t.Run("Write20Read10CloseRead20", func(t *testing.T) {
+		t.Parallel()
+		dir := testutil.NewTempDir(t)
+		b := NewWALBuffer(1<<30, 3*walRecordSize)
+		require.NoError(t, b.Open(dir, false))
+		writeN(t, b, 20, 0)
+		readN(t, b, 10, 0)
+		require.NoError(t, b.Close())
+
+		b2 := openWALBuffer(t, dir, 1<<30, 3*walRecordSize)
+		readN(t, b2, 20, 0)
+	})
+
+	t.Run("FlushedEntriesAreNotReplayed", func(t *testing.T) {
+		t.Parallel()
+		dir := testutil.NewTempDir(t)
+		b := NewWALBuffer(1<<30, 4*walRecordSize)
+		require.NoError(t, b.Open(dir, false))
+		writeN(t, b, 8, 0)
+		c := readN(t, b, 6, 0)
+		require.NoError(t, c.MarkRangeAsFlushed(0, 2))
+		require.NoError(t, c.MarkRangeAsFlushed(3, 5))
+		require.NoError(t, b.Close())
+
+		b2 := openWALBuffer(t, dir, 1<<30, 4*walRecordSize)
+		dst := make([]*entry.Entry, 10)
+		_, n, err := b2.Read(dst)
+		require.NoError(t, err)
+		require.Equal(t, []*entry.Entry{intEntry(2), intEntry(5), intEntry(6), intEntry(7)}, dst[:n])
+	})
+
+	t.Run("FlushedSegmentsAreDeleted", func(t *testing.T) {
+		t.Parallel()
+		dir := testutil.NewTempDir(t)
+		b := NewWALBuffer(1<<30, 2*walRecordSize)
+		require.NoError(t, b.Open(dir, false))
+		writeN(t, b, 6, 0)
+		readN(t, b, 6, 0)
+
+		// Simulate a crash after acknowledging the first segment but before deleting it
+		require.NoError(t, b.segments[0].ack([]int{0, 1}))
+		require.NoError(t, b.Close())
+		require.Len(t, walSegmentFiles(t, dir), 3)
+
+		b2 := openWALBuffer(t, dir, 1<<30, 2*walRecordSize)
+		require.Len(t, walSegmentFiles(t, dir), 2)
+		readN(t, b2, 4, 2)
+	})
+
+	t.Run("TornFinalRecord", func(t *testing.T) {
+		t.Parallel()
+		dir := testutil.NewTempDir(t)
+		b := NewWALBuffer(1<<30, 1<<16)
+		require.NoError(t, b.Open(dir, false))
+		writeN(t, b, 3, 0)
+		require.NoError(t, b.Close())
+
+		// Simulate a crash in the middle of writing a record
+		path := walSegmentPath(dir, 1, walSegmentExt)
+		torn := encodeWALRecord([]byte(`{"record":3}`))
+		appendFile(t, path, torn[:len(torn)-4])
+
+		b2 := openWALBuffer(t, dir, 1<<30, 1<<16)
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		require.Equal(t, 3*walRecordSize, info.Size())
+
+		writeN(t, b2, 1, 3)
+		readN(t, b2, 4, 0)
+	})
+
+	t.Run("CorruptFinalRecord", func(t *testing.T) {
+		t.Parallel()
+		dir := testutil.NewTempDir(t)
+		b := NewWALBuffer(1<<30, 1<<16)
+		require.NoError(t, b.Open(dir, false))
+		writeN(t, b, 3, 0)
+		require.NoError(t, b.Close())
+
+		// Flip a byte of the last record, so its checksum does not match
+		path := walSegmentPath(dir, 1, walSegmentExt)
+		f, err := os.OpenFile(path, os.O_RDWR, 0600)
+		require.NoError(t, err)
+		_, err = f.WriteAt([]byte("X"), 3*walRecordSize-3)
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+
+		b2 := openWALBuffer(t, dir, 1<<30, 1<<16)
+		readN(t, b2, 2, 0)
+		dst := make([]*entry.Entry, 1)
+		_, n, err := b2.Read(dst)
+		require.NoError(t, err)
+		require.Equal(t, 0, n)
+	})
+
+	t.Run("TornAcknowledgement", func(t *testing.T) {
+		t.Parallel()
+		dir := testutil.NewTempDir(t)
+		b := NewWALBuffer(1<<30, 1<<16)
+		require.NoError(t, b.Open(dir, false))
+		writeN(t, b, 3, 0)
+		c := readN(t, b, 3, 0)
+		require.NoError(t, c.MarkRangeAsFlushed(0, 1))
+		require.NoError(t, b.Close())
+
+		// Simulate a crash in the middle of acknowledging the second record
+		appendFile(t, walSegmentPath(dir, 1, walAckExt), []byte{1, 0})
+
+		b2 := openWALBuffer(t, dir, 1<<30, 1<<16)
+		readN(t, b2, 2, 1)
+	})
+
+	t.Run("CrashAfterTruncatingAcks", func(t *testing.T) {
+		t.Parallel()
+		dir := testutil.NewTempDir(t)
+		b := NewWALBuffer(1<<30, 1<<16)
+		require.NoError(t, b.Open(dir, false))
+		writeN(t, b, 3, 0)
+		readN(t, b, 3, 0)
+
+		// Simulate a crash during a reset, after the acknowledgements were removed
+		// but before the data was truncated
+		require.NoError(t, b.segments[0].ack([]int{0, 1, 2}))
+		require.NoError(t, b.segments[0].truncateAcks())
+		require.NoError(t, b.Close())
+
+		// The flushed records are replayed rather than lost
+		b2 := openWALBuffer(t, dir, 1<<30, 1<<16)
+		readN(t, b2, 3, 0)
+	})
+
+	t.Run("CrashAfterTruncatingData", func(t *testing.T) {
+		t.Parallel()
+		dir := testutil.NewTempDir(t)
+		b := NewWALBuffer(1<<30, 1<<16)
+		require.NoError(t, b.Open(dir, false))
+		writeN(t, b, 3, 0)
+		readN(t, b, 3, 0)
+
+		// Simulate a crash during a reset that truncated the data but left the
+		// acknowledgements of its records behind
+		require.NoError(t, b.segments[0].ack([]int{0, 1, 2}))
+		require.NoError(t, b.segments[0].data.Truncate(0))
+		require.NoError(t, b.Close())
+
+		// The stale acknowledgements are removed when the segment is recovered,
+		// so they do not apply to the records written next
+		b2 := openWALBuffer(t, dir, 1<<30, 1<<16)
+		info, err := os.Stat(walSegmentPath(dir, 1, walAckExt))
+		require.NoError(t, err)
+		require.Equal(t, int64(0), info.Size())
+		writeN(t, b2, 2, 3)
+		require.NoError(t, b2.Close())
+
+		b3 := openWALBuffer(t, dir, 1<<30, 1<<16)
+		readN(t, b3, 2, 3)
+	})
+
+	t.Run("OrphanedAckFile", func(t *testing.T) {
+		t.Parallel()
+		dir := testutil.NewTempDir(t)
+		orphan := walSegmentPath(dir, 7, walAckExt)
+		require.NoError(t, ioutil.WriteFile(orphan, []byte{0, 0, 0, 0}, 0600))
+
+		openWALBuffer(t, dir, 1<<30, 1<<16)
+		_, err := os.Stat(orphan)
+		require.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("LargerThanMaxSize", func(t *testing.T) {
+		t.Parallel()
+		dir := testutil.NewTempDir(t)
+		b := NewWALBuffer(1<<30, 1<<16)
+		require.NoError(t, b.Open(dir, false))
+		writeN(t, b, 3, 0)
+		require.NoError(t, b.Close())
+
+		b2 := NewWALBuffer(walRecordSize, walRecordSize)
+		err := b2.Open(dir, false)
+		require.Error(t, err)
+	})
+}
+
+func TestWALBufferBuild(t *testing.T) {
+	t.Run("Default", func(t *testing.T) {
+		cfg := NewWALBufferConfig()
+		cfg.Path = testutil.NewTempDir(t)
+		b, err := cfg.Build(testutil.NewBuildContext(t), "test")
+		require.NoError(t, err)
+		defer func() {
+			if err := b.Close(); err != nil {
+				t.Error(err.Error())
+			}
+		}()
+		walBuffer := b.(*WALBuffer)
+		require.Equal(t, int64(1<<32), walBuffer.maxBytes)
+		require.Equal(t, int64(1<<26), walBuffer.segmentSize)
+		require.Len(t, walBuffer.segments, 1)
+		require.Equal(t, uint(1000), walBuffer.MaxChunkSize())
+		require.Equal(t, time.Second, walBuffer.MaxChunkDelay())
+	})
+
+	t.Run("MissingPath", func(t *testing.T) {
+		cfg := NewWALBufferConfig()
+		_, err := cfg.Build(testutil.NewBuildContext(t), "test")
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "missing required field 'path'")
+	})
+
+	t.Run("SegmentLargerThanMaxSize", func(t *testing.T) {
+		cfg := NewWALBufferConfig()
+		cfg.Path = testutil.NewTempDir(t)
+		cfg.MaxSize = 1 << 20
+		cfg.SegmentSize = 1 << 21
+		_, err := cfg.Build(testutil.NewBuildContext(t), "test")
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "'segment_size' cannot be greater than 'max_size'")
+	})
+}
+
+func appendFile(t testing.TB, path string, data []byte) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	require.NoError(t, err)
+	_, err = f.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+}
+
+// benchmarkBuffer adds b.N entries to a buffer while another goroutine reads and flushes them
+func benchmarkBuffer(b *testing.B, buffer Buffer) {
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		e := entry.New()
+		e.Record = "test log"
+		ctx := context.Background()
+		for i := 0; i < b.N; i++ {
+			panicOnErr(buffer.Add(ctx, e))
+		}
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		dst := make([]*entry.Entry, 1000)
+		ctx := context.Background()
+		for i := 0; i < b.N; {
+			ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+			c, n, err := buffer.ReadWait(ctx, dst)
+			cancel()
+			panicOnErr(err)
+			i += n
+			panicOnErr(c.MarkAllAsFlushed())
+		}
+	}()
+
+	wg.Wait()
+}
+
+// benchmarkBacklog adds b.N entries to a buffer while nothing is flushed, as if
+// the destination was down, then reads and flushes all of them
+func benchmarkBacklog(b *testing.B, buffer Buffer) {
+	e := entry.New()
+	e.Record = "test log"
+	ctx := context.Background()
+	for i := 0; i < b.N; i++ {
+		panicOnErr(buffer.Add(ctx, e))
+	}
+
+	dst := make([]*entry.Entry, 1000)
+	for i := 0; i < b.N; {
+		c, n, err := buffer.Read(dst)
+		panicOnErr(err)
+		i += n
+		panicOnErr(c.MarkAllAsFlushed())
+	}
+}
+
+func BenchmarkWALBuffer(b *testing.B) {
+	b.Run("NoSync", func(b *testing.B) {
+		buffer := openWALBuffer(b, testutil.NewTempDir(b), 1<<30, 1<<20)
+		benchmarkBuffer(b, buffer)
+	})
+
+	b.Run("Sync", func(b *testing.B) {
+		buffer := NewWALBuffer(1<<30, 1<<20)
+		err := buffer.Open(testutil.NewTempDir(b), true)
+		require.NoError(b, err)
+		b.Cleanup(func() { buffer.Close() })
+		benchmarkBuffer(b, buffer)
+	})
+}
+
+func BenchmarkDiskBuffers(b *testing.B) {
+	b.Run("Throughput", func(b *testing.B) {
+		b.Run("Disk", func(b *testing.B) {
+			buffer := NewDiskBuffer(1 << 30)
+			require.NoError(b, buffer.Open(testutil.NewTempDir(b), false))
+			b.Cleanup(func() { buffer.Close() })
+			benchmarkBuffer(b, buffer)
+		})
+
+		b.Run("WAL", func(b *testing.B) {
+			buffer := openWALBuffer(b, testutil.NewTempDir(b), 1<<30, 1<<20)
+			benchmarkBuffer(b, buffer)
+		})
+	})
+
+	b.Run("Backlog", func(b *testing.B) {
+		b.Run("Disk", func(b *testing.B) {
+			buffer := NewDiskBuffer(1 << 30)
+			require.NoError(b, buffer.Open(testutil.NewTempDir(b), false))
+			b.Cleanup(func() { buffer.Close() })
+			benchmarkBacklog(b, buffer)
+		})
+
+		b.Run("WAL", func(b *testing.B) {
+			buffer := openWALBuffer(b, testutil.NewTempDir(b), 1<<30, 1<<20)
+			benchmarkBacklog(b, buffer)
+		})
+	})
+}
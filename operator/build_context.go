@@ -6,6 +6,8 @@ import (
 
 	"github.com/observiq/stanza/database"
 	"github.com/observiq/stanza/logger"
+	"github.com/observiq/stanza/metrics"
+	"github.com/observiq/stanza/operator/deadletter"
 	"go.uber.org/zap"
 )
 
@@ -17,6 +19,19 @@ type BuildContext struct {
 	Namespace        string
 	DefaultOutputIDs []string
 	PluginDepth      int
+	DeadLetter       *deadletter.Queue
+	// Metrics records the metrics of the operators. They are not recorded if it is nil.
+	Metrics *metrics.Registry
+	// Labels and Resource are added to every entry that an input writes, unless the
+	// entry already has a label or resource key of the same name
+	Labels   map[string]string
+	Resource map[string]string
+	// Defaults holds the configs that the components of operators inherit unless they
+	// override them, by the name of the component, such as "buffer" or "flusher"
+	Defaults map[string]interface{}
+	// MemoryBuffers builds the buffers of outputs in memory regardless of their config, so
+	// that operators can be built without opening the buffers of a running agent
+	MemoryBuffers bool
 }
 
 // PrependNamespace adds the current namespace of the build context to the
@@ -60,6 +75,12 @@ func (bc BuildContext) Copy() BuildContext {
 		Namespace:        bc.Namespace,
 		DefaultOutputIDs: bc.DefaultOutputIDs,
 		PluginDepth:      bc.PluginDepth,
+		DeadLetter:       bc.DeadLetter,
+		Metrics:          bc.Metrics,
+		Labels:           bc.Labels,
+		Resource:         bc.Resource,
+		Defaults:         bc.Defaults,
+		MemoryBuffers:    bc.MemoryBuffers,
 	}
 }
 
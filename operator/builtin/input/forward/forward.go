@@ -101,7 +101,14 @@ func (f *ForwardInput) Stop() error {
 }
 
 func (f *ForwardInput) ServeHTTP(wr http.ResponseWriter, req *http.Request) {
-	dec := json.NewDecoder(req.Body)
+	body, err := helper.NewDecompressingReader(req.Header.Get("Content-Encoding"), req.Body)
+	if err != nil {
+		wr.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	defer body.Close()
+
+	dec := json.NewDecoder(body)
 
 	var entries []*entry.Entry
 	if err := dec.Decode(&entries); err != nil {
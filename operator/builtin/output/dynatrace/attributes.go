@@ -0,0 +1,191 @@
+package dynatrace
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/observiq/stanza/entry"
+)
+
+// Policies for labels and resource keys that are not mapped by a rule
+const (
+	unmappedPassthrough = "passthrough"
+	unmappedPrefix      = "prefix"
+	unmappedDrop        = "drop"
+)
+
+// dynatracePrefix is the prefix of keys that already are Dynatrace attributes.
+// These are never renamed or dropped by the unmapped policy.
+const dynatracePrefix = "dt."
+
+// defaultAttributeRules map the labels and resource keys produced by stanza
+// operators to Dynatrace semantic attributes
+var defaultAttributeRules = []AttributeRule{
+	// k8s_metadata_decorator and k8s_event_input
+	{From: entry.NewResourceField("k8s.cluster.name"), To: "k8s.cluster.name"},
+	{From: entry.NewResourceField("k8s.namespace.name"), To: "k8s.namespace.name"},
+	{From: entry.NewResourceField("k8s.pod.name"), To: "k8s.pod.name"},
+	{From: entry.NewResourceField("k8s.pod.uid"), To: "k8s.pod.uid"},
+	{From: entry.NewResourceField("k8s.container.name"), To: "k8s.container.name"},
+	{From: entry.NewResourceField("k8s.deployment.name"), To: "k8s.deployment.name"},
+	{From: entry.NewResourceField("k8s.daemonset.name"), To: "k8s.daemonset.name"},
+	{From: entry.NewResourceField("k8s.statefulset.name"), To: "k8s.statefulset.name"},
+	{From: entry.NewResourceField("k8s.replicaset.name"), To: "k8s.replicaset.name"},
+	{From: entry.NewResourceField("k8s.job.name"), To: "k8s.job.name"},
+	{From: entry.NewResourceField("k8s.cronjob.name"), To: "k8s.cronjob.name"},
+
+	// host_metadata
+	{From: entry.NewResourceField("host.name"), To: "host.name"},
+	{From: entry.NewResourceField("host.ip"), To: "host.ip"},
+
+	// file_input, preferring the full path over the file name
+	{From: entry.NewLabelField("file_path"), To: "log.source"},
+	{From: entry.NewLabelField("file_name"), To: "log.source"},
+}
+
+// AttributeRule maps a label or resource key to a Dynatrace attribute
+type AttributeRule struct {
+	From entry.Field `json:"from" yaml:"from"`
+	To   string      `json:"to"   yaml:"to"`
+}
+
+// AttributesConfig is the configuration of how labels and resource keys are
+// mapped to Dynatrace attributes
+type AttributesConfig struct {
+	// DefaultRules enables the rules for labels and resource keys produced by stanza operators
+	DefaultRules bool `json:"default_rules" yaml:"default_rules"`
+
+	// Rules are applied before the default rules, so they can override them
+	Rules []AttributeRule `json:"rules,omitempty" yaml:"rules,omitempty"`
+
+	// Unmapped is the policy for labels and resource keys that are not mapped by a rule
+	Unmapped string `json:"unmapped,omitempty" yaml:"unmapped,omitempty"`
+
+	// Prefix is prepended to unmapped keys when the policy is prefix
+	Prefix string `json:"prefix,omitempty" yaml:"prefix,omitempty"`
+}
+
+// NewAttributesConfig creates a new attributes config with default values
+func NewAttributesConfig() AttributesConfig {
+	return AttributesConfig{
+		DefaultRules: true,
+		Unmapped:     unmappedPassthrough,
+	}
+}
+
+// Build creates an attribute mapper from the configuration
+func (c AttributesConfig) Build() (*attributeMapper, error) {
+	switch c.Unmapped {
+	case unmappedPassthrough, unmappedDrop:
+	case unmappedPrefix:
+		if c.Prefix == "" {
+			return nil, fmt.Errorf("'prefix' is required when 'unmapped' is '%s'", unmappedPrefix)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported unmapped policy '%s'", c.Unmapped)
+	}
+
+	rules := make([]AttributeRule, 0, len(c.Rules)+len(defaultAttributeRules))
+	for i, rule := range c.Rules {
+		switch rule.From.FieldInterface.(type) {
+		case entry.LabelField, entry.ResourceField:
+		default:
+			return nil, fmt.Errorf("rule %d: 'from' must be a label or resource field", i)
+		}
+		if strings.TrimSpace(rule.To) == "" {
+			return nil, fmt.Errorf("rule %d: 'to' cannot be empty", i)
+		}
+		rules = append(rules, rule)
+	}
+	if c.DefaultRules {
+		rules = append(rules, defaultAttributeRules...)
+	}
+
+	return &attributeMapper{
+		rules:    rules,
+		unmapped: c.Unmapped,
+		prefix:   c.Prefix,
+	}, nil
+}
+
+// attributeMapper translates the labels and resource of an entry into Dynatrace attributes
+type attributeMapper struct {
+	rules    []AttributeRule
+	unmapped string
+	prefix   string
+}
+
+// apply adds the labels and resource of the entry to the message. Each label or
+// resource key is mapped by the first rule that matches it, and each attribute is
+// set by the first rule that produces it. Keys that are not mapped are handled
+// according to the unmapped policy. A nil mapper passes every key through.
+func (m *attributeMapper) apply(e *entry.Entry, logMessage LogMessage) {
+	if m == nil {
+		for key, value := range e.Labels {
+			logMessage[key] = value
+		}
+		for key, value := range e.Resource {
+			logMessage[key] = value
+		}
+		return
+	}
+
+	if len(e.Labels) == 0 && len(e.Resource) == 0 {
+		return
+	}
+
+	// Mapped keys are deleted from a copy so that the remaining keys are the unmapped ones
+	remaining := &entry.Entry{
+		Labels:   copyStringMap(e.Labels),
+		Resource: copyStringMap(e.Resource),
+	}
+
+	mapped := make(map[string]interface{})
+	for _, rule := range m.rules {
+		if _, ok := mapped[rule.To]; ok {
+			continue
+		}
+		if value, ok := rule.From.Delete(remaining); ok {
+			mapped[rule.To] = value
+		}
+	}
+
+	for key, value := range remaining.Labels {
+		m.addUnmapped(logMessage, key, value)
+	}
+	for key, value := range remaining.Resource {
+		m.addUnmapped(logMessage, key, value)
+	}
+
+	// Mapped attributes take precedence over unmapped keys with the same name
+	for key, value := range mapped {
+		logMessage[key] = value
+	}
+}
+
+// addUnmapped adds a key that is not mapped by a rule according to the unmapped policy
+func (m *attributeMapper) addUnmapped(logMessage LogMessage, key string, value string) {
+	if strings.HasPrefix(key, dynatracePrefix) {
+		logMessage[key] = value
+		return
+	}
+
+	switch m.unmapped {
+	case unmappedDrop:
+	case unmappedPrefix:
+		logMessage[m.prefix+key] = value
+	default:
+		logMessage[key] = value
+	}
+}
+
+func copyStringMap(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	copied := make(map[string]string, len(m))
+	for key, value := range m {
+		copied[key] = value
+	}
+	return copied
+}
@@ -0,0 +1,210 @@
+package dynatrace
+
+import (
+	"testing"
+
+	"github.com/observiq/stanza/entry"
+	"github.com/stretchr/testify/require"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestAttributesConfigBuild(t *testing.T) {
+	cases := []struct {
+		name        string
+		modify      func(*AttributesConfig)
+		expectedErr string
+	}{
+		{
+			"Default",
+			nil,
+			"",
+		},
+		{
+			"UnsupportedPolicy",
+			func(c *AttributesConfig) { c.Unmapped = "rename" },
+			"unsupported unmapped policy 'rename'",
+		},
+		{
+			"MissingPrefix",
+			func(c *AttributesConfig) { c.Unmapped = unmappedPrefix },
+			"'prefix' is required when 'unmapped' is 'prefix'",
+		},
+		{
+			"RecordRule",
+			func(c *AttributesConfig) {
+				c.Rules = []AttributeRule{{From: entry.NewRecordField("host"), To: "host.name"}}
+			},
+			"rule 0: 'from' must be a label or resource field",
+		},
+		{
+			"EmptyTarget",
+			func(c *AttributesConfig) {
+				c.Rules = []AttributeRule{{From: entry.NewLabelField("host"), To: ""}}
+			},
+			"rule 0: 'to' cannot be empty",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := NewAttributesConfig()
+			if tc.modify != nil {
+				tc.modify(&cfg)
+			}
+
+			_, err := cfg.Build()
+			if tc.expectedErr == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			require.Contains(t, err.Error(), tc.expectedErr)
+		})
+	}
+}
+
+func TestAttributesConfigUnmarshal(t *testing.T) {
+	raw := `
+default_rules: false
+rules:
+  - from: $labels.host_entity
+    to: dt.entity.host
+unmapped: prefix
+prefix: stanza.
+`
+	cfg := NewAttributesConfig()
+	require.NoError(t, yaml.UnmarshalStrict([]byte(raw), &cfg))
+
+	expected := AttributesConfig{
+		Rules:    []AttributeRule{{From: entry.NewLabelField("host_entity"), To: "dt.entity.host"}},
+		Unmapped: unmappedPrefix,
+		Prefix:   "stanza.",
+	}
+	require.Equal(t, expected, cfg)
+}
+
+func TestAttributeMapper(t *testing.T) {
+	cases := []struct {
+		name     string
+		modify   func(*AttributesConfig)
+		labels   map[string]string
+		resource map[string]string
+		expected LogMessage
+	}{
+		{
+			"DefaultRules",
+			nil,
+			map[string]string{
+				"file_name": "app.log",
+				"file_path": "/var/log/app.log",
+				"team":      "checkout",
+			},
+			map[string]string{
+				"k8s.namespace.name": "default",
+				"k8s.pod.name":       "app-1234",
+				"host.name":          "node-1",
+			},
+			LogMessage{
+				"log.source":         "/var/log/app.log",
+				"team":               "checkout",
+				"k8s.namespace.name": "default",
+				"k8s.pod.name":       "app-1234",
+				"host.name":          "node-1",
+				"file_name":          "app.log",
+			},
+		},
+		{
+			"FileNameOnly",
+			nil,
+			map[string]string{"file_name": "app.log"},
+			nil,
+			LogMessage{"log.source": "app.log"},
+		},
+		{
+			"UserRuleOverridesDefault",
+			func(c *AttributesConfig) {
+				c.Rules = []AttributeRule{
+					{From: entry.NewLabelField("file_name"), To: "log.source"},
+					{From: entry.NewResourceField("host.id"), To: "dt.entity.host"},
+				}
+			},
+			map[string]string{
+				"file_name": "app.log",
+				"file_path": "/var/log/app.log",
+			},
+			map[string]string{"host.id": "HOST-0123456789ABCDEF"},
+			LogMessage{
+				"log.source":     "app.log",
+				"file_path":      "/var/log/app.log",
+				"dt.entity.host": "HOST-0123456789ABCDEF",
+			},
+		},
+		{
+			"PrefixUnmapped",
+			func(c *AttributesConfig) {
+				c.Unmapped = unmappedPrefix
+				c.Prefix = "stanza."
+			},
+			map[string]string{"team": "checkout"},
+			map[string]string{
+				"host.name":               "node-1",
+				"dt.entity.process_group": "PROCESS_GROUP-1",
+			},
+			LogMessage{
+				"stanza.team":             "checkout",
+				"host.name":               "node-1",
+				"dt.entity.process_group": "PROCESS_GROUP-1",
+			},
+		},
+		{
+			"DropUnmapped",
+			func(c *AttributesConfig) { c.Unmapped = unmappedDrop },
+			map[string]string{"team": "checkout", "file_path": "/var/log/app.log"},
+			map[string]string{"dt.entity.host": "HOST-1"},
+			LogMessage{
+				"log.source":     "/var/log/app.log",
+				"dt.entity.host": "HOST-1",
+			},
+		},
+		{
+			"NoDefaultRules",
+			func(c *AttributesConfig) { c.DefaultRules = false },
+			map[string]string{"file_path": "/var/log/app.log"},
+			nil,
+			LogMessage{"file_path": "/var/log/app.log"},
+		},
+		{
+			"MappedTakesPrecedence",
+			nil,
+			map[string]string{
+				"log.source": "unmapped",
+				"file_path":  "/var/log/app.log",
+			},
+			nil,
+			LogMessage{"log.source": "/var/log/app.log"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := NewAttributesConfig()
+			if tc.modify != nil {
+				tc.modify(&cfg)
+			}
+			mapper, err := cfg.Build()
+			require.NoError(t, err)
+
+			e := entry.New()
+			e.Labels = tc.labels
+			e.Resource = tc.resource
+
+			logMessage := make(LogMessage)
+			mapper.apply(e, logMessage)
+			require.Equal(t, tc.expected, logMessage)
+
+			// The entry is not modified
+			require.Equal(t, tc.labels, e.Labels)
+			require.Equal(t, tc.resource, e.Resource)
+		})
+	}
+}
@@ -0,0 +1,211 @@
+package dynatrace
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	stderrors "errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/observiq/stanza/errors"
+	"github.com/observiq/stanza/operator"
+	"go.uber.org/zap"
+)
+
+// Modes of the connection check that runs when an output starts
+const (
+	connectionCheckOff  = "off"
+	connectionCheckWarn = "warn"
+	connectionCheckFail = "fail"
+)
+
+// saasHostSuffix is the domain of Dynatrace SaaS environments, which are
+// addressed by their host rather than by an /e/{environment-id} path
+const saasHostSuffix = ".live.dynatrace.com"
+
+// validateConnectionCheck returns an error if the connection check mode is not supported
+func validateConnectionCheck(mode string) error {
+	switch mode {
+	case connectionCheckOff, connectionCheckWarn, connectionCheckFail:
+		return nil
+	default:
+		return fmt.Errorf("'connection_check' must be one of '%s', '%s' or '%s'",
+			connectionCheckOff, connectionCheckWarn, connectionCheckFail)
+	}
+}
+
+// startupCheck runs the connection check of an output according to its mode.
+// Failures are logged in warn mode, and prevent the output from starting in fail mode.
+func startupCheck(ctx context.Context, mode string, checker operator.Checker, logger *zap.SugaredLogger) error {
+	if mode == connectionCheckOff {
+		return nil
+	}
+
+	err := checker.Check(ctx)
+	if err == nil {
+		logger.Debug("Connection check succeeded")
+		return nil
+	}
+
+	if mode == connectionCheckWarn {
+		logger.Warnw("Connection check failed", zap.Any("error", err))
+		return nil
+	}
+	return errors.Wrap(err, "connection check")
+}
+
+// ingestAPI describes a Dynatrace ingest API and the token scope it requires
+type ingestAPI struct {
+	path  string
+	scope string
+}
+
+var (
+	logsIngestAPI    = ingestAPI{path: "/api/v2/logs/ingest", scope: "logs.ingest"}
+	metricsIngestAPI = ingestAPI{path: "/api/v2/metrics/ingest", scope: "metrics.ingest"}
+)
+
+// checkEndpoint validates the URL of an endpoint and sends a lightweight
+// authenticated request to it, using newRequest to create the request
+func (api ingestAPI) checkEndpoint(ctx context.Context, client *http.Client, u *url.URL, timeout time.Duration, newRequest func(context.Context) (*http.Request, error)) error {
+	if err := api.validateURL(u); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := newRequest(ctx)
+	if err != nil {
+		return err
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return requestError(err)
+	}
+
+	return api.checkResponse(res)
+}
+
+// validateURL checks that a URL is the environment URL of the API, such as
+// https://{environment-id}.live.dynatrace.com/api/v2/logs/ingest, or the URL of the
+// API on an ActiveGate or Managed cluster, such as https://{host}/e/{environment-id}/api/v2/logs/ingest
+func (api ingestAPI) validateURL(u *url.URL) error {
+	path := strings.TrimSuffix(u.Path, "/")
+	saas := strings.HasSuffix(u.Hostname(), saasHostSuffix)
+
+	if path == api.path {
+		return nil
+	}
+
+	if env := strings.TrimSuffix(path, api.path); env != path && isEnvironmentPath(env) {
+		if saas {
+			return errors.NewError(
+				fmt.Sprintf("the URL of a SaaS environment must not contain the environment path '%s'", env),
+				fmt.Sprintf("use https://{environment-id}%s%s", saasHostSuffix, api.path),
+			)
+		}
+		return nil
+	}
+
+	suggestion := fmt.Sprintf("use https://{environment-id}%s%s, or https://{activegate}/e/{environment-id}%s for an ActiveGate",
+		saasHostSuffix, api.path, api.path)
+	if saas {
+		suggestion = fmt.Sprintf("use https://{environment-id}%s%s", saasHostSuffix, api.path)
+	}
+	return errors.NewError(fmt.Sprintf("the path of the URL must end with '%s'", api.path), suggestion)
+}
+
+// isEnvironmentPath returns true if a path has the form /e/{environment-id}
+func isEnvironmentPath(path string) bool {
+	id := strings.TrimPrefix(path, "/e/")
+	return id != path && id != "" && !strings.Contains(id, "/")
+}
+
+// checkResponse describes why the response to a connection check was not successful.
+// A bad request is expected, because the check does not send any data.
+func (api ingestAPI) checkResponse(res *http.Response) error {
+	body, err := ioutil.ReadAll(res.Body)
+	_ = res.Body.Close()
+	if err != nil {
+		body = nil
+	}
+
+	switch {
+	case res.StatusCode >= 200 && res.StatusCode < 300, res.StatusCode == http.StatusBadRequest:
+		return nil
+	case res.StatusCode == http.StatusUnauthorized:
+		return errors.NewError(
+			"the API token was rejected",
+			"check that the API token is valid and has not expired or been revoked",
+		)
+	case res.StatusCode == http.StatusForbidden:
+		return errors.NewError(
+			fmt.Sprintf("the API token does not have the '%s' scope", api.scope),
+			fmt.Sprintf("create an API token with the '%s' scope", api.scope),
+		)
+	case res.StatusCode == http.StatusNotFound:
+		return errors.NewError(
+			fmt.Sprintf("the endpoint does not serve '%s'", api.path),
+			"check the path of the URL and, for an ActiveGate, its environment id",
+		)
+	default:
+		return errors.NewError(newStatusError(res, body).Error(), "")
+	}
+}
+
+// requestError describes why a connection check request could not be sent
+func requestError(err error) error {
+	if isTLSError(err) {
+		return errors.NewError(
+			fmt.Sprintf("TLS verification failed: %s", err),
+			"check that the endpoint serves a trusted certificate for its host, or configure 'tls.ca_file'",
+		)
+	}
+	return errors.NewError(
+		fmt.Sprintf("the endpoint is unreachable: %s", err),
+		"check the host of the URL, and that the network allows connections to it",
+	)
+}
+
+// isTLSError returns true if the error was caused by the TLS handshake
+func isTLSError(err error) bool {
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	var header tls.RecordHeaderError
+	return stderrors.As(err, &unknownAuthority) ||
+		stderrors.As(err, &hostname) ||
+		stderrors.As(err, &invalid) ||
+		stderrors.As(err, &header)
+}
+
+// endpointErrors collects the connection check failures of several endpoints
+type endpointErrors []error
+
+// Error returns the failures of every endpoint
+func (e endpointErrors) Error() string {
+	messages := make([]string, 0, len(e))
+	for _, err := range e {
+		messages = append(messages, err.Error())
+	}
+	return strings.Join(messages, "; ")
+}
+
+// err returns nil if no endpoint failed, the error of a single endpoint, or all errors
+func (e endpointErrors) err() error {
+	switch len(e) {
+	case 0:
+		return nil
+	case 1:
+		return e[0]
+	default:
+		return e
+	}
+}
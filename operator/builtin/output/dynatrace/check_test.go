@@ -0,0 +1,203 @@
+package dynatrace
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/observiq/stanza/errors"
+	"github.com/observiq/stanza/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateURL(t *testing.T) {
+	cases := []struct {
+		name        string
+		uri         string
+		expectedErr string
+	}{
+		{"SaaS", "https://abc12345.live.dynatrace.com/api/v2/logs/ingest", ""},
+		{"TrailingSlash", "https://abc12345.live.dynatrace.com/api/v2/logs/ingest/", ""},
+		{"ActiveGate", "https://activegate:9999/e/abc12345/api/v2/logs/ingest", ""},
+		{"Managed", "https://dynatrace.example.com/e/abc12345/api/v2/logs/ingest", ""},
+		{"MissingPath", "https://abc12345.live.dynatrace.com", "the path of the URL must end with '/api/v2/logs/ingest'"},
+		{"WrongAPI", "https://activegate:9999/e/abc12345/api/v2/metrics/ingest", "the path of the URL must end with '/api/v2/logs/ingest'"},
+		{"MissingEnvironmentID", "https://activegate:9999/e//api/v2/logs/ingest", "the path of the URL must end with '/api/v2/logs/ingest'"},
+		{"SaaSWithEnvironmentPath", "https://abc12345.live.dynatrace.com/e/abc12345/api/v2/logs/ingest", "the URL of a SaaS environment must not contain the environment path '/e/abc12345'"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			u, err := url.Parse(tc.uri)
+			require.NoError(t, err)
+
+			err = logsIngestAPI.validateURL(u)
+			if tc.expectedErr == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			require.Equal(t, tc.expectedErr, err.Error())
+		})
+	}
+}
+
+func TestDynatraceOutputCheck(t *testing.T) {
+	cases := []struct {
+		name        string
+		status      int
+		expectedErr string
+	}{
+		{"Accepted", http.StatusNoContent, ""},
+		{"EmptyPayload", http.StatusBadRequest, ""},
+		{"InvalidToken", http.StatusUnauthorized, "the API token was rejected"},
+		{"MissingScope", http.StatusForbidden, "the API token does not have the 'logs.ingest' scope"},
+		{"NotFound", http.StatusNotFound, "the endpoint does not serve '/api/v2/logs/ingest'"},
+		{"Unavailable", http.StatusServiceUnavailable, "unexpected status code: 503 Service Unavailable"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				require.Equal(t, "Api-Token testkey", req.Header.Get("Authorization"))
+				rw.WriteHeader(tc.status)
+			}))
+			defer srv.Close()
+
+			op := newUnstartedTestOutput(t, srv.URL+"/e/abc12345/api/v2/logs/ingest", nil)
+			err := op.Check(context.Background())
+			if tc.expectedErr == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			require.Contains(t, err.Error(), tc.expectedErr)
+			require.Contains(t, err.Error(), srv.URL)
+		})
+	}
+
+	t.Run("Unreachable", func(t *testing.T) {
+		srv := httptest.NewServer(http.NotFoundHandler())
+		uri := srv.URL + "/e/abc12345/api/v2/logs/ingest"
+		srv.Close()
+
+		op := newUnstartedTestOutput(t, uri, nil)
+		err := op.Check(context.Background())
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "the endpoint is unreachable")
+	})
+
+	t.Run("UntrustedCertificate", func(t *testing.T) {
+		srv := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.WriteHeader(http.StatusNoContent)
+		}))
+		defer srv.Close()
+
+		op := newUnstartedTestOutput(t, srv.URL+"/e/abc12345/api/v2/logs/ingest", nil)
+		err := op.Check(context.Background())
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "TLS verification failed")
+
+		agentErr, ok := err.(errors.AgentError)
+		require.True(t, ok)
+		require.Contains(t, agentErr.Suggestion, "tls.ca_file")
+	})
+
+	t.Run("EveryEndpoint", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.WriteHeader(http.StatusForbidden)
+		}))
+		defer srv.Close()
+
+		op := newUnstartedTestOutput(t, srv.URL+"/e/abc12345/api/v2/logs/ingest", func(cfg *DynatraceOutputConfig) {
+			cfg.Endpoints = []string{srv.URL + "/api/v1/logs"}
+		})
+		err := op.Check(context.Background())
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "the API token does not have the 'logs.ingest' scope")
+		require.Contains(t, err.Error(), "the path of the URL must end with '/api/v2/logs/ingest'")
+	})
+}
+
+func TestDynatraceOutputConnectionCheckMode(t *testing.T) {
+	requests := make(chan struct{}, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		requests <- struct{}{}
+		rw.WriteHeader(http.StatusForbidden)
+	}))
+	defer srv.Close()
+	uri := srv.URL + "/e/abc12345/api/v2/logs/ingest"
+
+	t.Run("Off", func(t *testing.T) {
+		op := newUnstartedTestOutput(t, uri, nil)
+		require.NoError(t, op.Start())
+		require.NoError(t, op.Stop())
+		require.Len(t, requests, 0)
+	})
+
+	t.Run("Warn", func(t *testing.T) {
+		op := newUnstartedTestOutput(t, uri, func(cfg *DynatraceOutputConfig) {
+			cfg.ConnectionCheck = connectionCheckWarn
+		})
+		require.NoError(t, op.Start())
+		require.NoError(t, op.Stop())
+		require.Len(t, requests, 1)
+		<-requests
+	})
+
+	t.Run("Fail", func(t *testing.T) {
+		op := newUnstartedTestOutput(t, uri, func(cfg *DynatraceOutputConfig) {
+			cfg.ConnectionCheck = connectionCheckFail
+		})
+		err := op.Start()
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "connection check")
+		require.Contains(t, err.Error(), "the API token does not have the 'logs.ingest' scope")
+		require.NoError(t, op.Stop())
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		cfg := NewDynatraceOutputConfig("test")
+		cfg.BaseURI = uri
+		cfg.APIKey = "testkey"
+		cfg.ConnectionCheck = "sometimes"
+		_, err := cfg.Build(testutil.NewBuildContext(t))
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "'connection_check' must be one of")
+	})
+}
+
+func TestDynatraceMetricsOutputCheck(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		require.Equal(t, "Api-Token testkey", req.Header.Get("Authorization"))
+		rw.WriteHeader(http.StatusForbidden)
+	}))
+	defer srv.Close()
+
+	cfg := NewDynatraceMetricsOutputConfig("test")
+	cfg.BaseURI = srv.URL + "/e/abc12345/api/v2/metrics/ingest"
+	cfg.APIKey = "testkey"
+	cfg.MetricKey = "http.requests"
+	ops, err := cfg.Build(testutil.NewBuildContext(t))
+	require.NoError(t, err)
+
+	err = ops[0].(*DynatraceMetricsOutput).Check(context.Background())
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "the API token does not have the 'metrics.ingest' scope")
+}
+
+// newUnstartedTestOutput builds a DynatraceOutput that sends to the given URL without starting it
+func newUnstartedTestOutput(t *testing.T, uri string, cfgMod func(*DynatraceOutputConfig)) *DynatraceOutput {
+	cfg := NewDynatraceOutputConfig("test")
+	cfg.BaseURI = uri
+	cfg.APIKey = "testkey"
+	if cfgMod != nil {
+		cfgMod(cfg)
+	}
+
+	ops, err := cfg.Build(testutil.NewBuildContext(t))
+	require.NoError(t, err)
+	return ops[0].(*DynatraceOutput)
+}
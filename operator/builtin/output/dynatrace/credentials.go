@@ -0,0 +1,96 @@
+package dynatrace
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenSource provides the API token used to authenticate requests
+type tokenSource interface {
+	Token() (string, error)
+}
+
+// newTokenSource creates a token source from exactly one of a static token,
+// an environment variable or a file
+func newTokenSource(apiKey, apiKeyEnv, apiKeyFile string) (tokenSource, error) {
+	configured := 0
+	for _, source := range []string{apiKey, apiKeyEnv, apiKeyFile} {
+		if strings.TrimSpace(source) != "" {
+			configured++
+		}
+	}
+	if configured != 1 {
+		return nil, fmt.Errorf("exactly one of 'api_key', 'api_key_env' or 'api_key_file' is required")
+	}
+
+	switch {
+	case strings.TrimSpace(apiKey) != "":
+		return staticToken(strings.TrimSpace(apiKey)), nil
+	case strings.TrimSpace(apiKeyEnv) != "":
+		token := strings.TrimSpace(os.Getenv(apiKeyEnv))
+		if token == "" {
+			return nil, fmt.Errorf("environment variable '%s' set by 'api_key_env' is empty", apiKeyEnv)
+		}
+		return staticToken(token), nil
+	default:
+		source := &fileToken{path: apiKeyFile}
+		if _, err := source.Token(); err != nil {
+			return nil, err
+		}
+		return source, nil
+	}
+}
+
+// staticToken is a token that never changes
+type staticToken string
+
+// Token returns the token
+func (s staticToken) Token() (string, error) {
+	return string(s), nil
+}
+
+// fileToken is a token read from a file, such as a mounted Kubernetes secret.
+// The file is read again whenever it is modified so that rotated tokens are used
+// without restarting the agent.
+type fileToken struct {
+	path string
+
+	mutex   sync.Mutex
+	modTime time.Time
+	size    int64
+	token   string
+}
+
+// Token returns the current content of the token file
+func (f *fileToken) Token() (string, error) {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return "", fmt.Errorf("read 'api_key_file': %s", err)
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.token != "" && info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return f.token, nil
+	}
+
+	contents, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return "", fmt.Errorf("read 'api_key_file': %s", err)
+	}
+
+	token := strings.TrimSpace(string(contents))
+	if token == "" {
+		return "", fmt.Errorf("'api_key_file' %s is empty", f.path)
+	}
+
+	f.token = token
+	f.modTime = info.ModTime()
+	f.size = info.Size()
+	return f.token, nil
+}
@@ -0,0 +1,82 @@
+package dynatrace
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/observiq/stanza/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewTokenSource(t *testing.T) {
+	t.Run("None", func(t *testing.T) {
+		_, err := newTokenSource("", "", "")
+		require.EqualError(t, err, "exactly one of 'api_key', 'api_key_env' or 'api_key_file' is required")
+	})
+
+	t.Run("Multiple", func(t *testing.T) {
+		_, err := newTokenSource("token", "ENV", "")
+		require.EqualError(t, err, "exactly one of 'api_key', 'api_key_env' or 'api_key_file' is required")
+	})
+
+	t.Run("Static", func(t *testing.T) {
+		source, err := newTokenSource(" token ", "", "")
+		require.NoError(t, err)
+		token, err := source.Token()
+		require.NoError(t, err)
+		require.Equal(t, "token", token)
+	})
+
+	t.Run("Env", func(t *testing.T) {
+		os.Setenv("STANZA_TEST_DT_TOKEN", "envtoken")
+		defer os.Unsetenv("STANZA_TEST_DT_TOKEN")
+
+		source, err := newTokenSource("", "STANZA_TEST_DT_TOKEN", "")
+		require.NoError(t, err)
+		token, err := source.Token()
+		require.NoError(t, err)
+		require.Equal(t, "envtoken", token)
+	})
+
+	t.Run("EmptyEnv", func(t *testing.T) {
+		_, err := newTokenSource("", "STANZA_TEST_DT_TOKEN_MISSING", "")
+		require.EqualError(t, err, "environment variable 'STANZA_TEST_DT_TOKEN_MISSING' set by 'api_key_env' is empty")
+	})
+
+	t.Run("MissingFile", func(t *testing.T) {
+		_, err := newTokenSource("", "", filepath.Join(testutil.NewTempDir(t), "missing"))
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "read 'api_key_file'")
+	})
+
+	t.Run("EmptyFile", func(t *testing.T) {
+		path := filepath.Join(testutil.NewTempDir(t), "token")
+		require.NoError(t, ioutil.WriteFile(path, []byte("\n"), 0600))
+		_, err := newTokenSource("", "", path)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "is empty")
+	})
+}
+
+func TestFileTokenRotation(t *testing.T) {
+	path := filepath.Join(testutil.NewTempDir(t), "token")
+	require.NoError(t, ioutil.WriteFile(path, []byte("first\n"), 0600))
+
+	source, err := newTokenSource("", "", path)
+	require.NoError(t, err)
+	token, err := source.Token()
+	require.NoError(t, err)
+	require.Equal(t, "first", token)
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("second\n"), 0600))
+	// Make sure the modification time changes on file systems with a coarse resolution
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(path, later, later))
+
+	token, err = source.Token()
+	require.NoError(t, err)
+	require.Equal(t, "second", token)
+}
@@ -2,17 +2,14 @@ package dynatrace
 
 import (
 	"bytes"
-//	"compress/gzip"
 	"context"
-	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
-    "crypto/tls"
 	"net/url"
 	"sync"
 	"time"
-    "strings"
+
 	"github.com/observiq/stanza/entry"
 	"github.com/observiq/stanza/errors"
 	"github.com/observiq/stanza/operator"
@@ -20,13 +17,17 @@ import (
 	"github.com/observiq/stanza/operator/flusher"
 	"github.com/observiq/stanza/operator/helper"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
-const  (
-        defaultssl=  false
-		defaulttimestamp= false
-		defaultclusterid=""
+const (
+	defaultssl       = true
+	defaulttimestamp = false
+	defaultclusterid = ""
+	defaultflatten   = true
+	defaultseparator = "."
 )
+
 func init() {
 	operator.Register("dynatrace_output", func() operator.Builder { return NewDynatraceOutputConfig("") })
 }
@@ -34,29 +35,54 @@ func init() {
 // DynatraceOutputConfig creates a dynatrace output config with default values
 func NewDynatraceOutputConfig(operatorID string) *DynatraceOutputConfig {
 	return &DynatraceOutputConfig{
-		OutputConfig:  helper.NewOutputConfig(operatorID, "dynatrace_output"),
-		BufferConfig:  buffer.NewConfig(),
-		FlusherConfig: flusher.NewConfig(),
-		SslVerify: defaultssl,
-		ClusterID : defaultclusterid,
-		Injecttimestamp: defaulttimestamp,
-		Timeout:       helper.NewDuration(10 * time.Second),
-		MessageField:  entry.NewRecordField(),
+		OutputConfig:      helper.NewOutputConfig(operatorID, "dynatrace_output"),
+		BufferConfig:      buffer.NewConfig(),
+		FlusherConfig:     flusher.NewConfig(),
+		SslVerify:         defaultssl,
+		ClusterID:         defaultclusterid,
+		Injecttimestamp:   defaulttimestamp,
+		Timeout:           helper.NewDuration(10 * time.Second),
+		MessageField:      entry.NewRecordField(),
+		FlattenNested:     defaultflatten,
+		FlattenSeparator:  defaultseparator,
+		Limits:            NewLimitsConfig(),
+		LoadBalancing:     NewLoadBalancingConfig(),
+		Attributes:        NewAttributesConfig(),
+		Severity:          NewSeverityConfig(),
+		ConnectionCheck:   connectionCheckOff,
+		CompressionConfig: helper.NewCompressionConfig(helper.CompressionNone),
 	}
 }
 
 // DynatraceOutputConfig is the configuration of a DynatraceOutput operator
 type DynatraceOutputConfig struct {
-	helper.OutputConfig `yaml:",inline"`
-	BufferConfig        buffer.Config  `json:"buffer" yaml:"buffer"`
-	FlusherConfig       flusher.Config `json:"flusher" yaml:"flusher"`
-	APIKey       string         `json:"api_key,omitempty"       yaml:"api_key,omitempty"`
-    BaseURI      string        `json:"base_uri,omitempty"      yaml:"base_uri,omitempty"`
-    ClusterID    string        `json:"cluster_id,omitempty"      yaml:"cluster_id,omitempty"`
-	SslVerify    bool             `json:"sslverify,omitempty"      yaml:"sslverify,omitempty"`
-	Injecttimestamp bool     `json:"injectTimestamp,omitempty"      yaml:"injectTimestamp,omitempty"`
-	Timeout      helper.Duration `json:"timeout,omitempty"       yaml:"timeout,omitempty"`
-	MessageField entry.Field     `json:"message_field,omitempty" yaml:"message_field,omitempty"`
+	helper.OutputConfig      `yaml:",inline"`
+	helper.CompressionConfig `yaml:",inline"`
+	BufferConfig             buffer.Config       `json:"buffer" yaml:"buffer"`
+	FlusherConfig            flusher.Config      `json:"flusher" yaml:"flusher"`
+	APIKey                   string              `json:"api_key,omitempty"       yaml:"api_key,omitempty"`
+	APIKeyEnv                string              `json:"api_key_env,omitempty"   yaml:"api_key_env,omitempty"`
+	APIKeyFile               string              `json:"api_key_file,omitempty"  yaml:"api_key_file,omitempty"`
+	BaseURI                  string              `json:"base_uri,omitempty"      yaml:"base_uri,omitempty"`
+	Endpoints                []string            `json:"endpoints,omitempty"     yaml:"endpoints,omitempty"`
+	LoadBalancing            LoadBalancingConfig `json:"load_balancing"      yaml:"load_balancing"`
+	ClusterID                string              `json:"cluster_id,omitempty"      yaml:"cluster_id,omitempty"`
+	SslVerify                bool                `json:"sslverify"               yaml:"sslverify"`
+	TLS                      TLSConfig           `json:"tls,omitempty"           yaml:"tls,omitempty"`
+	Injecttimestamp          bool                `json:"injectTimestamp,omitempty"      yaml:"injectTimestamp,omitempty"`
+	Timeout                  helper.Duration     `json:"timeout,omitempty"       yaml:"timeout,omitempty"`
+	MessageField             entry.Field         `json:"message_field,omitempty" yaml:"message_field,omitempty"`
+	FlattenNested            bool                `json:"flatten_nested"              yaml:"flatten_nested"`
+	FlattenSeparator         string              `json:"flatten_separator,omitempty" yaml:"flatten_separator,omitempty"`
+	Limits                   LimitsConfig        `json:"limits"                      yaml:"limits"`
+	Attributes               AttributesConfig    `json:"attributes"                  yaml:"attributes"`
+	Severity                 SeverityConfig      `json:"severity"                    yaml:"severity"`
+	ConnectionCheck          string              `json:"connection_check,omitempty"  yaml:"connection_check,omitempty"`
+}
+
+// Buffer returns the config of the buffer of the output
+func (c DynatraceOutputConfig) Buffer() buffer.Config {
+	return c.BufferConfig
 }
 
 // Build will build a new NewRelicOutput
@@ -66,89 +92,140 @@ func (c DynatraceOutputConfig) Build(bc operator.BuildContext) ([]operator.Opera
 		return nil, err
 	}
 
+	tokens, err := newTokenSource(c.APIKey, c.APIKeyEnv, c.APIKeyFile)
+	if err != nil {
+		return nil, err
+	}
 
+	headers := c.getHeaders()
 
-    if strings.TrimSpace(c.APIKey) == "" {
-		return nil, errors.Wrap(err, "'api_key' cannot be empty")
-	} else {
-	    fmt.Println("API key : "+c.APIKey)
+	buffer, err := c.BufferConfig.Build(bc, c.ID())
+	if err != nil {
+		return nil, err
 	}
 
-	headers, err := c.getHeaders()
+	endpoints, err := c.LoadBalancing.Build(c.endpointURIs(), bc.Logger.SugaredLogger)
 	if err != nil {
 		return nil, err
 	}
 
-	buffer, err := c.BufferConfig.Build(bc, c.ID())
+	if c.FlattenSeparator == "" {
+		return nil, fmt.Errorf("'flatten_separator' cannot be empty")
+	}
+
+	if err := validateConnectionCheck(c.ConnectionCheck); err != nil {
+		return nil, err
+	}
+
+	limiter, err := c.Limits.Build()
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid 'limits'")
+	}
+
+	attributes, err := c.Attributes.Build()
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid 'attributes'")
+	}
+
+	severity, err := c.Severity.Build()
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid 'severity'")
+	}
+
+	compressor, err := c.CompressionConfig.Build()
 	if err != nil {
 		return nil, err
 	}
+	if encoding := compressor.ContentEncoding(); encoding != "" {
+		headers.Set("Content-Encoding", encoding)
+	}
 
-	url, err := url.Parse(c.BaseURI)
+	// sslverify is kept for compatibility with existing configurations
+	tlsConfig := c.TLS
+	tlsConfig.InsecureSkipVerify = tlsConfig.InsecureSkipVerify || !c.SslVerify
+	clientTLS, err := tlsConfig.Build()
 	if err != nil {
-		return nil, errors.Wrap(err, "'base_uri' is not a valid URL")
+		return nil, errors.Wrap(err, "invalid 'tls'")
 	}
 
-	flusher := c.FlusherConfig.Build(bc.Logger.SugaredLogger)
+	flusher, err := c.FlusherConfig.Build(bc, outputOperator.ID())
+	if err != nil {
+		return nil, err
+	}
 	ctx, cancel := context.WithCancel(context.Background())
-    tr := &http.Transport{
-                    TLSClientConfig: &tls.Config{InsecureSkipVerify: !c.SslVerify},
-                }
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.TLSClientConfig = clientTLS
 	nro := &DynatraceOutput{
 		OutputOperator: outputOperator,
 		buffer:         buffer,
 		flusher:        flusher,
-		client:         &http.Client{Transport:tr},
+		client:         &http.Client{Transport: tr},
 		headers:        headers,
-		url:            url,
+		tokens:         tokens,
+		endpoints:      endpoints,
 		timeout:        c.Timeout.Raw(),
-		messageField:   c.MessageField,
-		ctx:            ctx,
-		cluster_id:     c.ClusterID,
-		cancel:         cancel,
+		payloadBuilder: &payloadBuilder{
+			messageField:     c.MessageField,
+			clusterID:        c.ClusterID,
+			flattenNested:    c.FlattenNested,
+			flattenSeparator: c.FlattenSeparator,
+			attributes:       attributes,
+			severity:         severity,
+		},
+		limiter:         limiter,
+		compressor:      compressor,
+		connectionCheck: c.ConnectionCheck,
+		ctx:             ctx,
+		cancel:          cancel,
 	}
+	outputOperator.Metrics().SetEndpoints(endpoints.stats)
 
 	return []operator.Operator{nro}, nil
 }
 
-func (c DynatraceOutputConfig) getHeaders() (http.Header, error) {
-	headers := http.Header{
-				"accept": []string{"application/json; charset=utf-8"},
-				"Content-Type": []string{"application/json; charset=utf-8"},
+// endpointURIs returns the URIs of the endpoints in priority order. The base_uri
+// is kept for compatibility with existing configurations and comes first.
+func (c DynatraceOutputConfig) endpointURIs() []string {
+	uris := make([]string, 0, len(c.Endpoints)+1)
+	if c.BaseURI != "" {
+		uris = append(uris, c.BaseURI)
 	}
+	return append(uris, c.Endpoints...)
+}
 
-	if c.APIKey == ""  {
-		return nil, fmt.Errorf("api_key'  is required")
-	} else if c.APIKey != "" {
-	    var token string
-	    token="Api-Token "+c.APIKey
-		headers["Authorization"] = []string{token}
+// getHeaders returns the headers sent with every request. The Authorization
+// header is added to each request because the token can be rotated.
+func (c DynatraceOutputConfig) getHeaders() http.Header {
+	return http.Header{
+		"Accept":       []string{"application/json; charset=utf-8"},
+		"Content-Type": []string{"application/json; charset=utf-8"},
 	}
-
-	return headers, nil
 }
 
 // DynatraceOutput is an operator that sends entries to the Dynatrace Logs platform
 type DynatraceOutput struct {
 	helper.OutputOperator
-	buffer  buffer.Buffer
-	flusher *flusher.Flusher
-	client       *http.Client
-	url          *url.URL
-	cluster_id   string
-	headers      http.Header
-	timeout      time.Duration
-    messageField entry.Field
-	ctx    context.Context
-	cancel context.CancelFunc
-	wg     sync.WaitGroup
+	buffer          buffer.Buffer
+	flusher         *flusher.Flusher
+	client          *http.Client
+	endpoints       *endpointPool
+	headers         http.Header
+	tokens          tokenSource
+	timeout         time.Duration
+	payloadBuilder  *payloadBuilder
+	limiter         *limiter
+	compressor      *helper.Compressor
+	connectionCheck string
+	ctx             context.Context
+	cancel          context.CancelFunc
+	wg              sync.WaitGroup
 }
 
-// Start tests the connection to Dynatrace and begins flushing entries
+// Start checks the connection to Dynatrace if configured and begins flushing entries
 func (nro *DynatraceOutput) Start() error {
-	//if err := nro.testConnection(); err != nil {
-	//	return fmt.Errorf("test connection: %s", err)
-//	}
+	if err := startupCheck(nro.ctx, nro.connectionCheck, nro, nro.SugaredLogger); err != nil {
+		return err
+	}
 
 	nro.wg.Add(1)
 	go func() {
@@ -167,26 +244,36 @@ func (nro *DynatraceOutput) Stop() error {
 	return nro.buffer.Close()
 }
 
+// Close releases the buffer of an output that was never started
+func (nro *DynatraceOutput) Close() error {
+	nro.flusher.Stop()
+	return nro.buffer.Close()
+}
+
+// Health returns how long the output has been retrying to flush and how full its buffer is
+func (nro *DynatraceOutput) Health() operator.Health {
+	return nro.flusher.Health(nro.buffer)
+}
+
 // Process adds an entry to the output's buffer
 func (nro *DynatraceOutput) Process(ctx context.Context, entry *entry.Entry) error {
 	return nro.buffer.Add(ctx, entry)
 }
 
-func (nro *DynatraceOutput) testConnection() error {
-	ctx, cancel := context.WithTimeout(context.Background(), nro.timeout)
-	defer cancel()
-
-	req, err := nro.newRequest(ctx, nil)
-	if err != nil {
-		return err
-	}
-
-	res, err := nro.client.Do(req)
-	if err != nil {
-		return err
+// Check verifies that the URL of every endpoint has the shape of the Logs Ingest
+// API, and that each endpoint accepts the API token
+func (nro *DynatraceOutput) Check(ctx context.Context) error {
+	var errs endpointErrors
+	for _, e := range nro.endpoints.endpoints {
+		u := e.url
+		err := logsIngestAPI.checkEndpoint(ctx, nro.client, u, nro.timeout, func(ctx context.Context) (*http.Request, error) {
+			return nro.newRequest(ctx, u, []byte("[]"))
+		})
+		if err != nil {
+			errs = append(errs, errors.Wrap(err, u.String()))
+		}
 	}
-
-	return nro.handleResponse(res)
+	return errs.err()
 }
 
 func (nro *DynatraceOutput) feedFlusher(ctx context.Context) {
@@ -199,71 +286,218 @@ func (nro *DynatraceOutput) feedFlusher(ctx context.Context) {
 			continue
 		}
 
-		nro.flusher.Do(func(ctx context.Context) error {
-			req, err := nro.newRequest(ctx, entries)
+		nro.flusher.DoChunk(entries, clearer, nro.newFlushFunc(entries, clearer))
+	}
+}
+
+// newFlushFunc creates the function that flushes a chunk of entries. The batches that
+// have not been sent successfully are kept between retries so that requests that
+// succeeded are not sent again. Entries that Dynatrace will never accept are
+// dead-lettered if a dead-letter queue is configured, and dropped otherwise, and a
+// *flusher.RejectedError reports them to the flusher.
+func (nro *DynatraceOutput) newFlushFunc(entries []*entry.Entry, clearer buffer.Clearer) flusher.FlushFunc {
+	var batches []batch
+	encoded := false
+	// Batches contain one log per entry, in the order of the entries. done is the number
+	// of entries at the start of the chunk whose batches were sent or rejected.
+	done := 0
+	// rejected counts the entries that were dropped or dead-lettered, and holds the
+	// error of the last rejection
+	var rejected flusher.RejectedError
+
+	return func(ctx context.Context) error {
+		if !encoded {
+			var err error
+			batches, err = nro.limiter.batches(nro.payloadBuilder.LogPayloadFromEntries(entries))
 			if err != nil {
-				nro.Errorw("Failed to create request from payload", zap.Error(err))
-				// drop these logs because we couldn't creat a request and a retry won't help
+				// a retry won't help because the logs cannot be encoded
+				nro.Errorw(nro.reject(ctx, &rejected, entries, err)+" chunk that could not be encoded", zap.Error(err))
 				if err := clearer.MarkAllAsFlushed(); err != nil {
-					nro.Errorf("Failed to mark entries as flushed after failing to create a request", zap.Error(err))
+					nro.Errorw("Failed to mark entries as flushed after failing to encode payload", zap.Error(err))
 				}
-				return nil
+				return &rejected
 			}
+			encoded = true
+		}
 
-
-			res, err := nro.client.Do(req)
-			if err != nil {
-				return err
+		for len(batches) > 0 {
+			err := nro.send(ctx, batches[0])
+			if err == nil {
+				done += len(batches[0])
+				batches = batches[1:]
+				continue
 			}
 
-			if err := nro.handleResponse(res); err != nil {
+			statusErr, ok := err.(*statusError)
+			if !ok {
 				return err
 			}
 
-			if err = clearer.MarkAllAsFlushed(); err != nil {
-				nro.Errorw("Failed to mark entries as flushed", zap.Error(err))
+			switch statusErr.class() {
+			case tooLarge:
+				if len(batches[0]) > 1 {
+					first, second := batches[0].split()
+					batches = append([]batch{first, second}, batches[1:]...)
+					nro.Debugw("Splitting request that was too large", "logs", len(first)+len(second))
+					continue
+				}
+				action := nro.reject(ctx, &rejected, entries[done:done+1], err)
+				nro.Errorw(action+" log that is too large to be accepted by Dynatrace", zap.Error(err))
+				done++
+				batches = batches[1:]
+			case permanent:
+				logs := len(entries) - done
+				action := nro.reject(ctx, &rejected, entries[done:], err)
+				nro.Errorw(action+" chunk because Dynatrace rejected the request with a permanent error",
+					zap.Error(err), "status_code", statusErr.statusCode, "logs", logs)
+				batches = nil
+			default:
+				return statusErr.retryError()
 			}
-			return nil
-		})
+		}
+
+		if err := clearer.MarkAllAsFlushed(); err != nil {
+			nro.Errorw("Failed to mark entries as flushed", zap.Error(err))
+		}
+		if rejected.Err != nil {
+			return &rejected
+		}
+		return nil
+	}
+}
+
+// reject dead-letters entries that Dynatrace will never accept, or drops them if they
+// cannot be dead-lettered, and counts them in rejected. It returns a description of
+// what happened to the entries.
+func (nro *DynatraceOutput) reject(ctx context.Context, rejected *flusher.RejectedError, entries []*entry.Entry, err error) string {
+	rejected.Err = err
+	deadLettered := nro.flusher.DeadLetter(ctx, entries, err)
+	if deadLettered {
+		rejected.DeadLettered += len(entries)
+	} else {
+		rejected.Dropped += len(entries)
+	}
+	return rejectAction(deadLettered)
+}
+
+// rejectAction describes what happened to entries that Dynatrace will never accept
+func rejectAction(deadLettered bool) string {
+	if deadLettered {
+		return "Dead-lettering"
 	}
+	return "Dropping"
 }
 
-// newRequest creates a new http.Request with the given context and entries
-func (nro *DynatraceOutput) newRequest(ctx context.Context, entries []*entry.Entry) (*http.Request, error) {
-	payload := LogPayloadFromEntries(entries, nro.messageField,nro.cluster_id)
+// send posts a single batch to Dynatrace. If an endpoint is unreachable or
+// responds with a retryable error, the batch is sent to the next endpoint chosen
+// by the load balancing strategy. The error of the last endpoint is returned if
+// every endpoint failed.
+func (nro *DynatraceOutput) send(ctx context.Context, b batch) error {
+	body := b.body()
+	tried := make(map[*endpoint]bool)
 
-	var buf bytes.Buffer
-	//wr := gzip.NewWriter(&buf)
-	enc := json.NewEncoder(&buf)
+	var lastErr error
+	for {
+		e := nro.endpoints.pick(tried)
+		if e == nil {
+			return lastErr
+		}
+		tried[e] = true
 
-	if err := enc.Encode(payload); err != nil {
-		return nil, errors.Wrap(err, "encode payload")
+		err := nro.sendTo(ctx, e, body)
+		if err == nil || !isEndpointFailure(err) || ctx.Err() != nil {
+			return err
+		}
+
+		lastErr = err
+		nro.Debugw("Request to endpoint failed", zap.Error(err), "endpoint", e.url.String())
 	}
-	//if err := wr.Close(); err != nil {
-	//	return nil, err
-	//}
+}
 
-      fmt.Println("opayload =",buf.String())
-	req, err := http.NewRequestWithContext(ctx, "POST", nro.url.String(), &buf)
+// sendTo posts an encoded batch to a single endpoint and records the result
+func (nro *DynatraceOutput) sendTo(ctx context.Context, e *endpoint, body []byte) error {
+	req, err := nro.newRequest(ctx, e.url, body)
+	if err != nil {
+		return err
+	}
+
+	nro.endpoints.begin(e)
+	res, err := nro.client.Do(req)
+	if err == nil {
+		err = nro.handleResponse(res)
+	}
+
+	if isEndpointFailure(err) {
+		nro.endpoints.failed(e, err)
+	} else {
+		nro.endpoints.succeeded(e)
+	}
+	return err
+}
+
+// isEndpointFailure returns true if the error is caused by the endpoint
+// rather than by the request, so that another endpoint may succeed
+func isEndpointFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	if statusErr, ok := err.(*statusError); ok {
+		return statusErr.class() == retryable
+	}
+	return true
+}
+
+// newRequest creates a new http.Request with the given context and encoded payload
+func (nro *DynatraceOutput) newRequest(ctx context.Context, u *url.URL, body []byte) (*http.Request, error) {
+	if ce := nro.Desugar().Check(zapcore.DebugLevel, "Sending request"); ce != nil {
+		ce.Write(zap.String("url", u.String()), zap.ByteString("payload", body))
+	}
+
+	token, err := nro.tokens.Token()
+	if err != nil {
+		return nil, errors.Wrap(err, "load api token")
+	}
+
+	compressed, err := nro.compressor.Compress(body)
+	if err != nil {
+		return nil, errors.Wrap(err, "compress payload")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", u.String(), bytes.NewReader(compressed))
 	if err != nil {
 		return nil, err
 	}
-	req.Header = nro.headers
+	req.Header = nro.headers.Clone()
+	req.Header.Set("Authorization", "Api-Token "+token)
 
 	return req, nil
 }
 
+// handleResponse returns a *statusError if the request was not successful,
+// and reports logs that Dynatrace rejected in a partially successful request
 func (nro *DynatraceOutput) handleResponse(res *http.Response) error {
+	body, err := ioutil.ReadAll(res.Body)
+	if closeErr := res.Body.Close(); closeErr != nil {
+		nro.Errorw("Failed to close response body", zap.Error(closeErr))
+	}
+
 	if !(res.StatusCode >= 200 && res.StatusCode < 300) {
-		body, err := ioutil.ReadAll(res.Body)
 		if err != nil {
-			return errors.NewError("unexpected status code", "", "status", res.Status)
-		} else {
-			if err := res.Body.Close(); err != nil {
-				nro.Errorf(err.Error())
-			}
-			return errors.NewError("unexpected status code", "", "status", res.Status, "body", string(body))
+			body = nil
 		}
+		return newStatusError(res, body)
 	}
-	return res.Body.Close()
+
+	if err != nil {
+		return errors.Wrap(err, "read response body")
+	}
+
+	if res.StatusCode == http.StatusOK {
+		if reason, ok := parsePartialSuccess(body); ok {
+			nro.Metrics().AddPartialRequest()
+			nro.Warnw("Dynatrace rejected some of the logs in a request", "reason", reason)
+		}
+	}
+
+	return nil
 }
@@ -1,23 +1,32 @@
 package dynatrace
 
 import (
-	"compress/gzip"
 	"context"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/observiq/stanza/entry"
+	"github.com/observiq/stanza/metrics"
 	"github.com/observiq/stanza/operator/buffer"
+	"github.com/observiq/stanza/operator/deadletter"
 	"github.com/observiq/stanza/operator/helper"
 	"github.com/observiq/stanza/testutil"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
-
 func TestDynatraceConfigBuild(t *testing.T) {
 	t.Run("OutputConfigError", func(t *testing.T) {
 		cfg := NewDynatraceOutputConfig("test")
@@ -31,23 +40,33 @@ func TestDynatraceConfigBuild(t *testing.T) {
 		cfg := NewDynatraceOutputConfig("test")
 		_, err := cfg.Build(testutil.NewBuildContext(t))
 		require.Error(t, err)
-		require.Equal(t, err.Error(), "one of 'api_key' is required")
+		require.Equal(t, err.Error(), "exactly one of 'api_key', 'api_key_env' or 'api_key_file' is required")
 	})
 
 	t.Run("InvalidURL", func(t *testing.T) {
 		cfg := NewDynatraceOutputConfig("test")
-		cfg.LicenseKey = "testkey"
+		cfg.APIKey = "testkey"
 		cfg.BaseURI = `%^&*($@)`
 		_, err := cfg.Build(testutil.NewBuildContext(t))
 		require.Error(t, err)
 		require.Contains(t, err.Error(), "is not a valid URL")
 	})
+
+	t.Run("EmptySeparator", func(t *testing.T) {
+		cfg := NewDynatraceOutputConfig("test")
+		cfg.APIKey = "testkey"
+		cfg.BaseURI = "http://localhost/api/v2/logs/ingest"
+		cfg.FlattenSeparator = ""
+		_, err := cfg.Build(testutil.NewBuildContext(t))
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "'flatten_separator' cannot be empty")
+	})
 }
 
 func TestDynatraceOutput(t *testing.T) {
 	cases := []struct {
 		name     string
-		cfgMod   func(*NewDynatraceOutputConfig)
+		cfgMod   func(*DynatraceOutputConfig)
 		input    []*entry.Entry
 		expected string
 	}{
@@ -58,7 +77,7 @@ func TestDynatraceOutput(t *testing.T) {
 				Timestamp: time.Date(2016, 10, 10, 8, 58, 52, 0, time.UTC),
 				Record:    "test",
 			}},
-			`[{"common":{"attributes":{"plugin":{"type":"stanza","version":"unknown"}}},"logs":[{"timestamp":1476089932000,"attributes":{"labels":null,"record":"test","resource":null,"severity":"default"},"message":"test"}]}]` + "\n",
+			`[{"content":"test","severity":"NONE","timestamp":"1476089932000"}]`,
 		},
 		{
 			"Multi",
@@ -70,11 +89,11 @@ func TestDynatraceOutput(t *testing.T) {
 				Timestamp: time.Date(2016, 10, 10, 8, 58, 52, 0, time.UTC),
 				Record:    "test2",
 			}},
-			`[{"common":{"attributes":{"plugin":{"type":"stanza","version":"unknown"}}},"logs":[{"timestamp":1476089932000,"attributes":{"labels":null,"record":"test1","resource":null,"severity":"default"},"message":"test1"},{"timestamp":1476089932000,"attributes":{"labels":null,"record":"test2","resource":null,"severity":"default"},"message":"test2"}]}]` + "\n",
+			`[{"content":"test1","severity":"NONE","timestamp":"1476089932000"},{"content":"test2","severity":"NONE","timestamp":"1476089932000"}]`,
 		},
 		{
 			"CustomMessage",
-			func(cfg *NewDynatraceOutputConfig) {
+			func(cfg *DynatraceOutputConfig) {
 				cfg.MessageField = entry.NewRecordField("log")
 			},
 			[]*entry.Entry{{
@@ -82,9 +101,10 @@ func TestDynatraceOutput(t *testing.T) {
 				Record: map[string]interface{}{
 					"log":     "testlog",
 					"message": "testmessage",
+					"status":  200,
 				},
 			}},
-			`[{"common":{"attributes":{"plugin":{"type":"stanza","version":"unknown"}}},"logs":[{"timestamp":1476089932000,"attributes":{"labels":null,"record":{"log":"testlog","message":"testmessage"},"resource":null,"severity":"default"},"message":"testlog"}]}]` + "\n",
+			`[{"content":"testlog","message":"testmessage","severity":"NONE","status":200,"timestamp":"1476089932000"}]`,
 		},
 	}
 
@@ -103,7 +123,7 @@ func TestDynatraceOutput(t *testing.T) {
 					return cfg
 				}(),
 			}
-			cfg.BaseURI = fmt.Sprintf("http://%s/log/v1", addr)
+			cfg.BaseURI = fmt.Sprintf("http://%s/api/v2/logs/ingest", addr)
 			cfg.APIKey = "testkey"
 			if tc.cfgMod != nil {
 				tc.cfgMod(cfg)
@@ -118,27 +138,476 @@ func TestDynatraceOutput(t *testing.T) {
 			}
 			defer op.Stop()
 
-			expectTestConnection(t, ln)
 			expectRequestBody(t, ln, tc.expected)
 		})
 	}
+}
+
+func TestDynatraceOutputAuthorization(t *testing.T) {
+	received := make(chan string, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusNoContent)
+		received <- req.Header.Get("Authorization")
+	}))
+	defer srv.Close()
+
+	path := filepath.Join(testutil.NewTempDir(t), "token")
+	require.NoError(t, ioutil.WriteFile(path, []byte("first\n"), 0600))
+
+	op := newTestOutput(t, srv.URL, func(cfg *DynatraceOutputConfig) {
+		cfg.APIKey = ""
+		cfg.APIKeyFile = path
+	})
+
+	expectAuthorization := func(expected string) {
+		select {
+		case auth := <-received:
+			require.Equal(t, expected, auth)
+		case <-time.After(time.Second):
+			require.FailNow(t, "Timed out waiting for request")
+		}
+	}
 
-	t.Run("FailedTestConnection", func(t *testing.T) {
-		cfg := NewDynatraceOutputConfig("test")
-		cfg.BaseURI = "http://localhost/log/v1"
-		cfg.APIKey = "testkey"
+	require.NoError(t, op.Process(context.Background(), entry.New()))
+	expectAuthorization("Api-Token first")
+
+	// A rotated token is used for the following requests
+	require.NoError(t, ioutil.WriteFile(path, []byte("second\n"), 0600))
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(path, later, later))
+
+	require.NoError(t, op.Process(context.Background(), entry.New()))
+	expectAuthorization("Api-Token second")
+}
+
+func TestDynatraceOutputTLS(t *testing.T) {
+	received := make(chan struct{}, 10)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusNoContent)
+		received <- struct{}{}
+	}))
+	defer srv.Close()
+
+	caFile := filepath.Join(testutil.NewTempDir(t), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	require.NoError(t, ioutil.WriteFile(caFile, caPEM, 0600))
+
+	t.Run("TrustedCA", func(t *testing.T) {
+		op := newTestOutput(t, srv.URL, func(cfg *DynatraceOutputConfig) {
+			cfg.TLS.CAFile = caFile
+		})
+		require.NoError(t, op.Process(context.Background(), entry.New()))
+
+		select {
+		case <-received:
+		case <-time.After(time.Second):
+			require.FailNow(t, "Timed out waiting for request")
+		}
+	})
+
+	t.Run("UntrustedCA", func(t *testing.T) {
+		op := newTestOutput(t, srv.URL, nil)
+		require.NoError(t, op.Process(context.Background(), entry.New()))
+
+		select {
+		case <-received:
+			require.FailNow(t, "Request with an untrusted certificate should fail")
+		case <-time.After(200 * time.Millisecond):
+		}
+	})
+}
+
+func TestDynatraceOutputCompression(t *testing.T) {
+	for _, compression := range []string{"gzip", "deflate"} {
+		t.Run(compression, func(t *testing.T) {
+			received := make(chan []byte, 1)
+			srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				assert.Equal(t, compression, req.Header.Get("Content-Encoding"))
+				rd, err := helper.NewDecompressingReader(req.Header.Get("Content-Encoding"), req.Body)
+				assert.NoError(t, err)
+				body, err := ioutil.ReadAll(rd)
+				assert.NoError(t, err)
+				rw.WriteHeader(http.StatusNoContent)
+				received <- body
+			}))
+			defer srv.Close()
+
+			op := newTestOutput(t, srv.URL, func(cfg *DynatraceOutputConfig) {
+				cfg.Compression = compression
+			})
+			require.NoError(t, op.Process(context.Background(), &entry.Entry{
+				Timestamp: time.Date(2016, 10, 10, 8, 58, 52, 0, time.UTC),
+				Record:    "test",
+			}))
+
+			select {
+			case body := <-received:
+				require.Equal(t, `[{"content":"test","severity":"NONE","timestamp":"1476089932000"}]`, string(body))
+			case <-time.After(time.Second):
+				require.FailNow(t, "Timed out waiting for request")
+			}
+		})
+	}
+}
+
+func TestDynatraceOutputSplitsOversizedChunks(t *testing.T) {
+	const maxBodySize = 1024
+	const entryCount = 200
+
+	var mux sync.Mutex
+	received := map[string]bool{}
+	rejected := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, err := ioutil.ReadAll(req.Body)
+		assert.NoError(t, err)
+
+		mux.Lock()
+		defer mux.Unlock()
+		if len(body) > maxBodySize {
+			rejected++
+			rw.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		var records []map[string]interface{}
+		assert.NoError(t, json.Unmarshal(body, &records))
+		for _, record := range records {
+			received[record["content"].(string)] = true
+		}
+		rw.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	cfg := NewDynatraceOutputConfig("test")
+	cfg.BufferConfig = buffer.Config{
+		Builder: func() buffer.Builder {
+			cfg := buffer.NewMemoryBufferConfig()
+			cfg.MaxChunkDelay = helper.NewDuration(50 * time.Millisecond)
+			cfg.MaxChunkSize = entryCount
+			return cfg
+		}(),
+	}
+	cfg.BaseURI = srv.URL
+	cfg.APIKey = "testkey"
+	cfg.Limits.MaxRequestSize = maxBodySize
+
+	ops, err := cfg.Build(testutil.NewBuildContext(t))
+	require.NoError(t, err)
+	op := ops[0]
+	require.NoError(t, op.Start())
+	defer op.Stop()
+
+	for i := 0; i < entryCount; i++ {
+		e := entry.New()
+		e.Record = fmt.Sprintf("log message number %d", i)
+		require.NoError(t, op.Process(context.Background(), e))
+	}
+
+	require.Eventually(t, func() bool {
+		mux.Lock()
+		defer mux.Unlock()
+		return len(received) == entryCount
+	}, 5*time.Second, 10*time.Millisecond)
+
+	mux.Lock()
+	defer mux.Unlock()
+	require.Equal(t, 0, rejected)
+}
+
+func TestDynatraceOutputResponseHandling(t *testing.T) {
+	t.Run("PermanentErrorDropsChunk", func(t *testing.T) {
+		var requests int64
+		srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			atomic.AddInt64(&requests, 1)
+			rw.WriteHeader(http.StatusUnauthorized)
+		}))
+		defer srv.Close()
+
+		op, registry := newTestOutputWithMetrics(t, srv.URL, nil)
+		require.NoError(t, op.Process(context.Background(), entry.New()))
+
+		requireMetric(t, registry, `stanza_flush_chunks_total{`+testLabels+`,result="dropped"} 1`)
+		body := testutil.ScrapeMetrics(t, registry)
+		require.Contains(t, body, `stanza_flush_chunks_total{`+testLabels+`,result="flushed"} 0`)
+		require.Contains(t, body, `stanza_flush_undelivered_entries_total{`+testLabels+`,result="dropped"} 1`)
+		require.Contains(t, body, `stanza_operator_entries_out_total{`+testLabels+`} 0`)
+
+		// The chunk must not be retried
+		time.Sleep(200 * time.Millisecond)
+		require.Equal(t, int64(1), atomic.LoadInt64(&requests))
+	})
+
+	t.Run("PermanentErrorDeadLettersUnsentEntries", func(t *testing.T) {
+		const entryCount = 5
+
+		var requests int64
+		srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			if atomic.AddInt64(&requests, 1) == 1 {
+				rw.WriteHeader(http.StatusNoContent)
+				return
+			}
+			rw.WriteHeader(http.StatusBadRequest)
+		}))
+		defer srv.Close()
+
+		path := filepath.Join(testutil.NewTempDir(t), "dead_letter.jsonl")
+		op, registry := newTestOutputWithMetrics(t, srv.URL, func(cfg *DynatraceOutputConfig) {
+			cfg.BufferConfig = buffer.Config{
+				Builder: func() buffer.Builder {
+					cfg := buffer.NewMemoryBufferConfig()
+					cfg.MaxChunkDelay = helper.NewDuration(50 * time.Millisecond)
+					cfg.MaxChunkSize = entryCount
+					return cfg
+				}(),
+			}
+			cfg.Limits.MaxLogRecords = 2
+			cfg.FlusherConfig.DeadLetter.Path = path
+		})
+		for i := 0; i < entryCount; i++ {
+			e := entry.New()
+			e.Record = fmt.Sprintf("log message number %d", i)
+			require.NoError(t, op.Process(context.Background(), e))
+		}
+
+		requireMetric(t, registry, `stanza_flush_chunks_total{`+testLabels+`,result="dead_lettered"} 1`)
+		body := testutil.ScrapeMetrics(t, registry)
+		require.Contains(t, body, `stanza_flush_undelivered_entries_total{`+testLabels+`,result="dead_lettered"} 3`)
+		require.Contains(t, body, `stanza_operator_entries_out_total{`+testLabels+`} 2`)
 
-		ops, err := cfg.Build(testutil.NewBuildContext(t))
+		// The entries of the first request were accepted
+		file, err := os.Open(path)
 		require.NoError(t, err)
-		op := ops[0]
-		err = op.Start()
-		require.Error(t, err)
+		defer file.Close()
+		decoder := json.NewDecoder(file)
+		for i := 2; i < entryCount; i++ {
+			var record deadletter.Record
+			require.NoError(t, decoder.Decode(&record))
+			require.Equal(t, fmt.Sprintf("log message number %d", i), record.Entry.Record)
+			require.Equal(t, http.StatusBadRequest, record.Status)
+			require.Equal(t, op.ID(), record.Operator)
+		}
+		require.False(t, decoder.More())
+	})
+
+	t.Run("TooLargeSplitsRequest", func(t *testing.T) {
+		const entryCount = 10
+
+		var mux sync.Mutex
+		received := 0
+		srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			var records []map[string]interface{}
+			assert.NoError(t, json.NewDecoder(req.Body).Decode(&records))
+			if len(records) > 3 {
+				rw.WriteHeader(http.StatusRequestEntityTooLarge)
+				return
+			}
+
+			mux.Lock()
+			received += len(records)
+			mux.Unlock()
+			rw.WriteHeader(http.StatusNoContent)
+		}))
+		defer srv.Close()
+
+		op, registry := newTestOutputWithMetrics(t, srv.URL, func(cfg *DynatraceOutputConfig) {
+			cfg.BufferConfig = buffer.Config{
+				Builder: func() buffer.Builder {
+					cfg := buffer.NewMemoryBufferConfig()
+					cfg.MaxChunkDelay = helper.NewDuration(50 * time.Millisecond)
+					cfg.MaxChunkSize = entryCount
+					return cfg
+				}(),
+			}
+		})
+		for i := 0; i < entryCount; i++ {
+			require.NoError(t, op.Process(context.Background(), entry.New()))
+		}
+
+		require.Eventually(t, func() bool {
+			mux.Lock()
+			defer mux.Unlock()
+			return received == entryCount
+		}, 5*time.Second, 10*time.Millisecond)
+		requireMetric(t, registry, `stanza_flush_chunks_total{`+testLabels+`,result="flushed"} 1`)
+		require.Contains(t, testutil.ScrapeMetrics(t, registry), `stanza_flush_undelivered_entries_total{`+testLabels+`,result="dropped"} 0`)
+	})
+
+	t.Run("RetryAfter", func(t *testing.T) {
+		var mux sync.Mutex
+		var attempts []time.Time
+		srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			mux.Lock()
+			defer mux.Unlock()
+			attempts = append(attempts, time.Now())
+			if len(attempts) == 1 {
+				rw.Header().Set("Retry-After", "1")
+				rw.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			rw.WriteHeader(http.StatusNoContent)
+		}))
+		defer srv.Close()
+
+		op := newTestOutput(t, srv.URL, nil)
+		require.NoError(t, op.Process(context.Background(), entry.New()))
+
+		require.Eventually(t, func() bool {
+			mux.Lock()
+			defer mux.Unlock()
+			return len(attempts) == 2
+		}, 5*time.Second, 10*time.Millisecond)
+
+		mux.Lock()
+		defer mux.Unlock()
+		require.GreaterOrEqual(t, int64(attempts[1].Sub(attempts[0])), int64(time.Second))
+	})
+
+	t.Run("PartialSuccess", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.WriteHeader(http.StatusOK)
+			rw.Write([]byte(`{"error":{"code":200,"message":"1 events were not ingested because of invalid content"}}`))
+		}))
+		defer srv.Close()
+
+		op, registry := newTestOutputWithMetrics(t, srv.URL, nil)
+		require.NoError(t, op.Process(context.Background(), entry.New()))
+
+		requireMetric(t, registry, `stanza_flush_partial_requests_total{`+testLabels+`} 1`)
+	})
+}
+
+func TestDynatraceOutputEndpoints(t *testing.T) {
+	t.Run("FailoverToNextEndpoint", func(t *testing.T) {
+		var failed int64
+		down := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			atomic.AddInt64(&failed, 1)
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer down.Close()
+
+		ln := newListener()
+		addr, err := ln.start()
+		require.NoError(t, err)
+		defer ln.stop()
+
+		up := fmt.Sprintf("http://%s/api/v2/logs/ingest", addr)
+		op, registry := newTestOutputWithMetrics(t, "", func(cfg *DynatraceOutputConfig) {
+			cfg.Endpoints = []string{down.URL, up}
+			cfg.LoadBalancing.MaxFailures = 1
+		})
+
+		e := entry.New()
+		e.Timestamp = time.Date(2016, 10, 10, 8, 58, 52, 0, time.UTC)
+		e.Record = "test"
+		require.NoError(t, op.Process(context.Background(), e))
+		expectRequestBody(t, ln, `[{"content":"test","severity":"NONE","timestamp":"1476089932000"}]`)
+
+		// The failed endpoint is ejected and not used for the next request
+		require.NoError(t, op.Process(context.Background(), e))
+		expectRequestBody(t, ln, `[{"content":"test","severity":"NONE","timestamp":"1476089932000"}]`)
+		require.Equal(t, int64(1), atomic.LoadInt64(&failed))
+
+		stats := op.endpoints.stats()
+		require.False(t, stats[0].Healthy)
+		require.Equal(t, uint64(1), stats[0].Failures)
+		require.True(t, stats[1].Healthy)
+		require.Equal(t, uint64(2), stats[1].Requests)
+
+		// The state of the endpoints is reported through the metrics of the output
+		body := testutil.ScrapeMetrics(t, registry)
+		require.Contains(t, body, `stanza_endpoint_failures_total{endpoint="`+down.URL+`",`+testLabels+`} 1`)
+		require.Contains(t, body, `stanza_endpoint_healthy{endpoint="`+down.URL+`",`+testLabels+`} 0`)
+		require.Contains(t, body, `stanza_endpoint_requests_total{endpoint="`+up+`",`+testLabels+`} 2`)
+		require.Contains(t, body, `stanza_endpoint_healthy{endpoint="`+up+`",`+testLabels+`} 1`)
+	})
+
+	t.Run("RoundRobin", func(t *testing.T) {
+		lnA, lnB := newListener(), newListener()
+		addrA, err := lnA.start()
+		require.NoError(t, err)
+		defer lnA.stop()
+		addrB, err := lnB.start()
+		require.NoError(t, err)
+		defer lnB.stop()
+
+		op := newTestOutput(t, fmt.Sprintf("http://%s/api/v2/logs/ingest", addrA), func(cfg *DynatraceOutputConfig) {
+			cfg.Endpoints = []string{fmt.Sprintf("http://%s/api/v2/logs/ingest", addrB)}
+			cfg.LoadBalancing.Strategy = strategyRoundRobin
+		})
+
+		for i := 0; i < 2; i++ {
+			e := entry.New()
+			e.Timestamp = time.Date(2016, 10, 10, 8, 58, 52, 0, time.UTC)
+			e.Record = "test"
+			require.NoError(t, op.Process(context.Background(), e))
+			ln := lnA
+			if i%2 == 1 {
+				ln = lnB
+			}
+			expectRequestBody(t, ln, `[{"content":"test","severity":"NONE","timestamp":"1476089932000"}]`)
+		}
+	})
+
+	t.Run("PermanentErrorDoesNotFailover", func(t *testing.T) {
+		var requests int64
+		srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			atomic.AddInt64(&requests, 1)
+			rw.WriteHeader(http.StatusUnauthorized)
+		}))
+		defer srv.Close()
+
+		op, registry := newTestOutputWithMetrics(t, srv.URL, func(cfg *DynatraceOutputConfig) {
+			cfg.Endpoints = []string{srv.URL}
+		})
+		require.NoError(t, op.Process(context.Background(), entry.New()))
+
+		requireMetric(t, registry, `stanza_flush_chunks_total{`+testLabels+`,result="dropped"} 1`)
+		require.Equal(t, int64(1), atomic.LoadInt64(&requests))
+		require.True(t, op.endpoints.stats()[0].Healthy)
 	})
 }
 
-func expectTestConnection(t *testing.T, ln *listener) {
-	testConnection := `[{"common":{"attributes":{"plugin":{"type":"stanza","version":"unknown"}}},"logs":[]}]` + "\n"
-	expectRequestBody(t, ln, testConnection)
+// testLabels are the labels of the metrics of a test output
+const testLabels = `operator_id="$.test",operator_type="dynatrace_output"`
+
+// requireMetric waits until the metrics of a registry contain a line
+func requireMetric(t *testing.T, registry *metrics.Registry, line string) {
+	require.Eventually(t, func() bool {
+		return strings.Contains(testutil.ScrapeMetrics(t, registry), line+"\n")
+	}, 5*time.Second, 10*time.Millisecond, line)
+}
+
+// newTestOutput builds and starts a DynatraceOutput that sends to the given URL
+func newTestOutput(t *testing.T, uri string, cfgMod func(*DynatraceOutputConfig)) *DynatraceOutput {
+	op, _ := newTestOutputWithMetrics(t, uri, cfgMod)
+	return op
+}
+
+// newTestOutputWithMetrics builds and starts a DynatraceOutput that sends to the given URL,
+// and returns the registry of its metrics
+func newTestOutputWithMetrics(t *testing.T, uri string, cfgMod func(*DynatraceOutputConfig)) (*DynatraceOutput, *metrics.Registry) {
+	cfg := NewDynatraceOutputConfig("test")
+	cfg.BufferConfig = buffer.Config{
+		Builder: func() buffer.Builder {
+			cfg := buffer.NewMemoryBufferConfig()
+			cfg.MaxChunkDelay = helper.NewDuration(50 * time.Millisecond)
+			return cfg
+		}(),
+	}
+	cfg.BaseURI = uri
+	cfg.APIKey = "testkey"
+	if cfgMod != nil {
+		cfgMod(cfg)
+	}
+
+	bc := testutil.NewBuildContext(t)
+	bc.Metrics = metrics.NewRegistry()
+	ops, err := cfg.Build(bc)
+	require.NoError(t, err)
+	op := ops[0].(*DynatraceOutput)
+	require.NoError(t, op.Start())
+	t.Cleanup(func() { op.Stop() })
+	return op, bc.Metrics
 }
 
 func expectRequestBody(t *testing.T, ln *listener, expected string) {
@@ -146,7 +615,7 @@ func expectRequestBody(t *testing.T, ln *listener, expected string) {
 	case body := <-ln.requestBodies:
 		require.Equal(t, expected, string(body))
 	case <-time.After(time.Second):
-		require.FailNow(t, "Timed out waiting for test connection")
+		require.FailNow(t, "Timed out waiting for request")
 	}
 }
 
@@ -188,19 +657,13 @@ func (l *listener) stop() {
 
 func handle(ch chan []byte) func(rw http.ResponseWriter, req *http.Request) {
 	return func(rw http.ResponseWriter, req *http.Request) {
-		rw.WriteHeader(200)
-		rw.Write([]byte(`{}`))
-
-		rd, err := gzip.NewReader(req.Body)
-		if err != nil {
-			panic(err)
-		}
-		body, err := ioutil.ReadAll(rd)
+		body, err := ioutil.ReadAll(req.Body)
 		if err != nil {
 			panic(err)
 		}
 		req.Body.Close()
 
+		rw.WriteHeader(204)
 		ch <- body
 	}
 }
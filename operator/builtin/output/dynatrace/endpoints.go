@@ -0,0 +1,230 @@
+package dynatrace
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/observiq/stanza/metrics"
+	"github.com/observiq/stanza/operator/helper"
+	"go.uber.org/zap"
+)
+
+// Load balancing strategies
+const (
+	strategyFailover      = "failover"
+	strategyRoundRobin    = "round_robin"
+	strategyLeastInflight = "least_inflight"
+)
+
+// LoadBalancingConfig is the configuration of how requests are spread over endpoints
+type LoadBalancingConfig struct {
+	// Strategy selects the endpoint used for a request
+	Strategy string `json:"strategy,omitempty" yaml:"strategy,omitempty"`
+
+	// MaxFailures is the number of consecutive failures after which an endpoint is ejected
+	MaxFailures int `json:"max_failures,omitempty" yaml:"max_failures,omitempty"`
+
+	// EjectionDuration is how long an endpoint is ejected before it is probed again
+	EjectionDuration helper.Duration `json:"ejection_duration,omitempty" yaml:"ejection_duration,omitempty"`
+}
+
+// NewLoadBalancingConfig creates a new load balancing config with default values
+func NewLoadBalancingConfig() LoadBalancingConfig {
+	return LoadBalancingConfig{
+		Strategy:         strategyFailover,
+		MaxFailures:      3,
+		EjectionDuration: helper.NewDuration(30 * time.Second),
+	}
+}
+
+// Build creates an endpoint pool for the given endpoint URIs
+func (c LoadBalancingConfig) Build(uris []string, logger *zap.SugaredLogger) (*endpointPool, error) {
+	switch c.Strategy {
+	case strategyFailover, strategyRoundRobin, strategyLeastInflight:
+	default:
+		return nil, fmt.Errorf("unsupported strategy '%s'", c.Strategy)
+	}
+
+	if c.MaxFailures <= 0 {
+		return nil, fmt.Errorf("'max_failures' must be greater than 0")
+	}
+
+	if c.EjectionDuration.Raw() <= 0 {
+		return nil, fmt.Errorf("'ejection_duration' must be greater than 0")
+	}
+
+	if len(uris) == 0 {
+		return nil, fmt.Errorf("one of 'base_uri' or 'endpoints' is required")
+	}
+
+	// An endpoint that is listed more than once is only used at its first position
+	endpoints := make([]*endpoint, 0, len(uris))
+	listed := make(map[string]bool, len(uris))
+	for _, uri := range uris {
+		parsed, err := url.Parse(strings.TrimSpace(uri))
+		if err != nil {
+			return nil, fmt.Errorf("'%s' is not a valid URL: %s", uri, err)
+		}
+		if listed[parsed.String()] {
+			continue
+		}
+		listed[parsed.String()] = true
+		endpoints = append(endpoints, &endpoint{url: parsed})
+	}
+
+	return &endpointPool{
+		SugaredLogger:    logger,
+		strategy:         c.Strategy,
+		maxFailures:      c.MaxFailures,
+		ejectionDuration: c.EjectionDuration.Raw(),
+		endpoints:        endpoints,
+		now:              time.Now,
+	}, nil
+}
+
+// endpoint is a single Dynatrace endpoint, such as an ActiveGate
+type endpoint struct {
+	// counters are first in the struct to guarantee 64-bit alignment for atomic operations
+	requests uint64
+	failures uint64
+	ejects   uint64
+	inflight int64
+
+	url *url.URL
+
+	mutex               sync.Mutex
+	consecutiveFailures int
+	ejectedUntil        time.Time
+}
+
+// endpointPool selects endpoints according to a load balancing strategy and
+// passively tracks their health. An endpoint that fails max_failures times in a
+// row is ejected for ejection_duration. After that, it receives requests again,
+// and is ejected again on the next failure.
+type endpointPool struct {
+	roundRobin uint64
+
+	*zap.SugaredLogger
+	strategy         string
+	maxFailures      int
+	ejectionDuration time.Duration
+	endpoints        []*endpoint
+	now              func() time.Time
+}
+
+// pick returns the endpoint that should be used for the next request, ignoring
+// the excluded endpoints. Ejected endpoints are only used if every other
+// endpoint is ejected too. It returns nil if every endpoint is excluded.
+func (p *endpointPool) pick(exclude map[*endpoint]bool) *endpoint {
+	now := p.now()
+
+	candidates := make([]*endpoint, 0, len(p.endpoints))
+	var soonest *endpoint
+	var soonestTime time.Time
+	for _, e := range p.endpoints {
+		if exclude[e] {
+			continue
+		}
+
+		ejectedUntil := e.ejectionTime()
+		if now.Before(ejectedUntil) {
+			if soonest == nil || ejectedUntil.Before(soonestTime) {
+				soonest, soonestTime = e, ejectedUntil
+			}
+			continue
+		}
+		candidates = append(candidates, e)
+	}
+
+	if len(candidates) == 0 {
+		return soonest
+	}
+
+	switch p.strategy {
+	case strategyRoundRobin:
+		next := atomic.AddUint64(&p.roundRobin, 1) - 1
+		return candidates[next%uint64(len(candidates))]
+	case strategyLeastInflight:
+		least := candidates[0]
+		for _, e := range candidates[1:] {
+			if atomic.LoadInt64(&e.inflight) < atomic.LoadInt64(&least.inflight) {
+				least = e
+			}
+		}
+		return least
+	default:
+		return candidates[0]
+	}
+}
+
+// begin records the start of a request to the endpoint
+func (p *endpointPool) begin(e *endpoint) {
+	atomic.AddUint64(&e.requests, 1)
+	atomic.AddInt64(&e.inflight, 1)
+}
+
+// succeeded records a successful request to the endpoint
+func (p *endpointPool) succeeded(e *endpoint) {
+	atomic.AddInt64(&e.inflight, -1)
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if !e.ejectedUntil.IsZero() {
+		p.Infow("Dynatrace endpoint recovered", "endpoint", e.url.String())
+	}
+	e.consecutiveFailures = 0
+	e.ejectedUntil = time.Time{}
+}
+
+// failed records a failed request to the endpoint, ejecting it if it failed too many times in a row
+func (p *endpointPool) failed(e *endpoint, err error) {
+	atomic.AddInt64(&e.inflight, -1)
+	atomic.AddUint64(&e.failures, 1)
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.consecutiveFailures++
+
+	// An endpoint that was ejected before is ejected again as soon as its probe fails
+	if e.consecutiveFailures < p.maxFailures && e.ejectedUntil.IsZero() {
+		return
+	}
+
+	e.ejectedUntil = p.now().Add(p.ejectionDuration)
+	atomic.AddUint64(&e.ejects, 1)
+	p.Warnw("Ejecting Dynatrace endpoint after consecutive failures",
+		"endpoint", e.url.String(),
+		"consecutive_failures", e.consecutiveFailures,
+		"retry_after", p.ejectionDuration,
+		zap.Error(err),
+	)
+}
+
+// stats returns a snapshot of the metrics of every endpoint. It is reported through the
+// metrics of the output.
+func (p *endpointPool) stats() []metrics.Endpoint {
+	now := p.now()
+	stats := make([]metrics.Endpoint, 0, len(p.endpoints))
+	for _, e := range p.endpoints {
+		stats = append(stats, metrics.Endpoint{
+			URL:      e.url.String(),
+			Requests: atomic.LoadUint64(&e.requests),
+			Failures: atomic.LoadUint64(&e.failures),
+			Ejects:   atomic.LoadUint64(&e.ejects),
+			Inflight: atomic.LoadInt64(&e.inflight),
+			Healthy:  !now.Before(e.ejectionTime()),
+		})
+	}
+	return stats
+}
+
+// ejectionTime returns the time until which the endpoint is ejected
+func (e *endpoint) ejectionTime() time.Time {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.ejectedUntil
+}
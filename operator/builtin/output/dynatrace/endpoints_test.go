@@ -0,0 +1,217 @@
+package dynatrace
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/observiq/stanza/operator/helper"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestLoadBalancingConfigBuild(t *testing.T) {
+	cases := []struct {
+		name        string
+		modify      func(*LoadBalancingConfig)
+		uris        []string
+		expectedErr string
+	}{
+		{
+			"Default",
+			nil,
+			[]string{"http://localhost"},
+			"",
+		},
+		{
+			"UnsupportedStrategy",
+			func(c *LoadBalancingConfig) { c.Strategy = "random" },
+			[]string{"http://localhost"},
+			"unsupported strategy 'random'",
+		},
+		{
+			"ZeroMaxFailures",
+			func(c *LoadBalancingConfig) { c.MaxFailures = 0 },
+			[]string{"http://localhost"},
+			"'max_failures' must be greater than 0",
+		},
+		{
+			"ZeroEjectionDuration",
+			func(c *LoadBalancingConfig) { c.EjectionDuration = helper.NewDuration(0) },
+			[]string{"http://localhost"},
+			"'ejection_duration' must be greater than 0",
+		},
+		{
+			"NoEndpoints",
+			nil,
+			nil,
+			"one of 'base_uri' or 'endpoints' is required",
+		},
+		{
+			"InvalidEndpoint",
+			nil,
+			[]string{"http://localhost", `%^&*($@)`},
+			"is not a valid URL",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := NewLoadBalancingConfig()
+			if tc.modify != nil {
+				tc.modify(&cfg)
+			}
+
+			pool, err := cfg.Build(tc.uris, zap.NewNop().Sugar())
+			if tc.expectedErr != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tc.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, pool.endpoints, len(tc.uris))
+		})
+	}
+
+	t.Run("DuplicateEndpoints", func(t *testing.T) {
+		pool, err := NewLoadBalancingConfig().Build([]string{"http://a", "http://b", " http://a"}, zap.NewNop().Sugar())
+		require.NoError(t, err)
+		require.Len(t, pool.endpoints, 2)
+		require.Equal(t, "http://a", pool.endpoints[0].url.String())
+		require.Equal(t, "http://b", pool.endpoints[1].url.String())
+	})
+}
+
+func TestEndpointPoolPick(t *testing.T) {
+	t.Run("Failover", func(t *testing.T) {
+		pool := newTestPool(t, strategyFailover, 3)
+		for i := 0; i < 3; i++ {
+			require.Equal(t, pool.endpoints[0], pool.pick(nil))
+		}
+		require.Equal(t, pool.endpoints[1], pool.pick(map[*endpoint]bool{pool.endpoints[0]: true}))
+	})
+
+	t.Run("RoundRobin", func(t *testing.T) {
+		pool := newTestPool(t, strategyRoundRobin, 3)
+		for i := 0; i < 6; i++ {
+			require.Equal(t, pool.endpoints[i%3], pool.pick(nil))
+		}
+	})
+
+	t.Run("LeastInflight", func(t *testing.T) {
+		pool := newTestPool(t, strategyLeastInflight, 3)
+		pool.begin(pool.endpoints[0])
+		pool.begin(pool.endpoints[1])
+		require.Equal(t, pool.endpoints[2], pool.pick(nil))
+
+		pool.begin(pool.endpoints[2])
+		pool.begin(pool.endpoints[2])
+		pool.succeeded(pool.endpoints[1])
+		require.Equal(t, pool.endpoints[1], pool.pick(nil))
+	})
+
+	t.Run("AllExcluded", func(t *testing.T) {
+		pool := newTestPool(t, strategyFailover, 2)
+		exclude := map[*endpoint]bool{pool.endpoints[0]: true, pool.endpoints[1]: true}
+		require.Nil(t, pool.pick(exclude))
+	})
+}
+
+func TestEndpointPoolHealth(t *testing.T) {
+	t.Run("EjectAfterConsecutiveFailures", func(t *testing.T) {
+		pool := newTestPool(t, strategyFailover, 2)
+		first := pool.endpoints[0]
+
+		for i := 0; i < 2; i++ {
+			pool.begin(first)
+			pool.failed(first, fmt.Errorf("unreachable"))
+			require.Equal(t, first, pool.pick(nil))
+		}
+
+		pool.begin(first)
+		pool.failed(first, fmt.Errorf("unreachable"))
+		require.Equal(t, pool.endpoints[1], pool.pick(nil))
+
+		stats := pool.stats()
+		require.Equal(t, uint64(3), stats[0].Requests)
+		require.Equal(t, uint64(3), stats[0].Failures)
+		require.Equal(t, uint64(1), stats[0].Ejects)
+		require.Equal(t, int64(0), stats[0].Inflight)
+		require.False(t, stats[0].Healthy)
+		require.True(t, stats[1].Healthy)
+	})
+
+	t.Run("SuccessResetsFailures", func(t *testing.T) {
+		pool := newTestPool(t, strategyFailover, 2)
+		first := pool.endpoints[0]
+
+		for i := 0; i < 5; i++ {
+			pool.begin(first)
+			pool.failed(first, fmt.Errorf("unreachable"))
+			pool.begin(first)
+			pool.succeeded(first)
+		}
+		require.Equal(t, first, pool.pick(nil))
+		require.Equal(t, uint64(0), pool.stats()[0].Ejects)
+	})
+
+	t.Run("ReprobeAfterEjection", func(t *testing.T) {
+		pool := newTestPool(t, strategyFailover, 2)
+		now := time.Now()
+		pool.now = func() time.Time { return now }
+		first := pool.endpoints[0]
+
+		ejectEndpoint(pool, first)
+		require.Equal(t, pool.endpoints[1], pool.pick(nil))
+
+		// A failed probe ejects the endpoint again immediately
+		now = now.Add(time.Minute)
+		require.Equal(t, first, pool.pick(nil))
+		pool.begin(first)
+		pool.failed(first, fmt.Errorf("unreachable"))
+		require.Equal(t, pool.endpoints[1], pool.pick(nil))
+		require.Equal(t, uint64(2), pool.stats()[0].Ejects)
+
+		// A successful probe restores the endpoint
+		now = now.Add(time.Minute)
+		pool.begin(first)
+		pool.succeeded(first)
+		require.Equal(t, first, pool.pick(nil))
+		require.True(t, pool.stats()[0].Healthy)
+	})
+
+	t.Run("AllEjected", func(t *testing.T) {
+		pool := newTestPool(t, strategyFailover, 2)
+		now := time.Now()
+		pool.now = func() time.Time { return now }
+
+		ejectEndpoint(pool, pool.endpoints[0])
+		now = now.Add(time.Second)
+		ejectEndpoint(pool, pool.endpoints[1])
+
+		// The endpoint that is probed again first is used
+		require.Equal(t, pool.endpoints[0], pool.pick(nil))
+		require.Equal(t, pool.endpoints[1], pool.pick(map[*endpoint]bool{pool.endpoints[0]: true}))
+	})
+}
+
+func newTestPool(t *testing.T, strategy string, endpoints int) *endpointPool {
+	cfg := NewLoadBalancingConfig()
+	cfg.Strategy = strategy
+
+	uris := make([]string, 0, endpoints)
+	for i := 0; i < endpoints; i++ {
+		uris = append(uris, fmt.Sprintf("http://activegate-%d:9999/e/env/api/v2/logs/ingest", i))
+	}
+
+	pool, err := cfg.Build(uris, zap.NewNop().Sugar())
+	require.NoError(t, err)
+	return pool
+}
+
+func ejectEndpoint(pool *endpointPool, e *endpoint) {
+	for i := 0; i < pool.maxFailures; i++ {
+		pool.begin(e)
+		pool.failed(e, fmt.Errorf("unreachable"))
+	}
+}
@@ -0,0 +1,201 @@
+package dynatrace
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"unicode/utf8"
+
+	"github.com/observiq/stanza/operator/helper"
+)
+
+// Default limits of the Dynatrace Log Ingest API
+const (
+	defaultMaxRequestSize          = 5 * 1024 * 1024
+	defaultMaxLogRecords           = 50000
+	defaultMaxAttributes           = 50
+	defaultMaxAttributeValueLength = 250
+	defaultMaxContentLength        = 65536
+)
+
+// truncationMarker is appended to values that were truncated to fit the limits
+const truncationMarker = "[TRUNCATED]"
+
+// LimitsConfig is the configuration of the limits enforced by the Dynatrace Log Ingest API
+type LimitsConfig struct {
+	MaxRequestSize          helper.ByteSize `json:"max_request_size,omitempty"           yaml:"max_request_size,omitempty"`
+	MaxLogRecords           int             `json:"max_log_records,omitempty"            yaml:"max_log_records,omitempty"`
+	MaxAttributes           int             `json:"max_attributes,omitempty"             yaml:"max_attributes,omitempty"`
+	MaxAttributeValueLength int             `json:"max_attribute_value_length,omitempty" yaml:"max_attribute_value_length,omitempty"`
+	MaxContentLength        int             `json:"max_content_length,omitempty"         yaml:"max_content_length,omitempty"`
+}
+
+// NewLimitsConfig creates a new limits config with the Dynatrace defaults
+func NewLimitsConfig() LimitsConfig {
+	return LimitsConfig{
+		MaxRequestSize:          defaultMaxRequestSize,
+		MaxLogRecords:           defaultMaxLogRecords,
+		MaxAttributes:           defaultMaxAttributes,
+		MaxAttributeValueLength: defaultMaxAttributeValueLength,
+		MaxContentLength:        defaultMaxContentLength,
+	}
+}
+
+// Build validates the limits config and creates a limiter
+func (c LimitsConfig) Build() (*limiter, error) {
+	if c.MaxRequestSize <= 2 {
+		return nil, fmt.Errorf("'max_request_size' must be greater than 2 bytes")
+	}
+	if c.MaxLogRecords <= 0 {
+		return nil, fmt.Errorf("'max_log_records' must be greater than 0")
+	}
+	if c.MaxAttributes <= 0 {
+		return nil, fmt.Errorf("'max_attributes' must be greater than 0")
+	}
+	if c.MaxAttributeValueLength <= len(truncationMarker) {
+		return nil, fmt.Errorf("'max_attribute_value_length' must be greater than %d", len(truncationMarker))
+	}
+	if c.MaxContentLength <= len(truncationMarker) {
+		return nil, fmt.Errorf("'max_content_length' must be greater than %d", len(truncationMarker))
+	}
+
+	return &limiter{
+		maxRequestSize:          int(c.MaxRequestSize),
+		maxLogRecords:           c.MaxLogRecords,
+		maxAttributes:           c.MaxAttributes,
+		maxAttributeValueLength: c.MaxAttributeValueLength,
+		maxContentLength:        c.MaxContentLength,
+	}, nil
+}
+
+// limiter makes log messages and requests fit the limits of the Dynatrace Log Ingest API
+type limiter struct {
+	maxRequestSize          int
+	maxLogRecords           int
+	maxAttributes           int
+	maxAttributeValueLength int
+	maxContentLength        int
+}
+
+// apply truncates the content and attribute values of a log message and drops
+// attributes over the limit. Attributes are kept in a deterministic order: the
+// severity and cluster id first, followed by the remaining keys in sorted order.
+func (l *limiter) apply(msg LogMessage) {
+	if content, ok := msg[contentKey].(string); ok {
+		msg[contentKey] = truncate(content, l.maxContentLength)
+	}
+
+	keys := make([]string, 0, len(msg))
+	for key, value := range msg {
+		if key == contentKey || key == timestampKey {
+			continue
+		}
+		if s, ok := value.(string); ok {
+			msg[key] = truncate(s, l.maxAttributeValueLength)
+		}
+		keys = append(keys, key)
+	}
+
+	if len(keys) <= l.maxAttributes {
+		return
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		iPriority, jPriority := attributePriority(keys[i]), attributePriority(keys[j])
+		if iPriority != jPriority {
+			return iPriority < jPriority
+		}
+		return keys[i] < keys[j]
+	})
+
+	for _, key := range keys[l.maxAttributes:] {
+		delete(msg, key)
+	}
+}
+
+// attributePriority returns the order in which attributes are kept when over the limit
+func attributePriority(key string) int {
+	switch key {
+	case severityKey:
+		return 0
+	case clusterIDKey:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// batch is a list of encoded log messages that are sent in a single request
+type batch []json.RawMessage
+
+// body returns the request body of the batch
+func (b batch) body() []byte {
+	var buf bytes.Buffer
+	buf.WriteByte('[')
+	for i, msg := range b {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.Write(msg)
+	}
+	buf.WriteByte(']')
+	return buf.Bytes()
+}
+
+// split divides the batch into two halves
+func (b batch) split() (batch, batch) {
+	half := len(b) / 2
+	return b[:half], b[half:]
+}
+
+// batches encodes log messages into batches that fit the request size and
+// record count limits. A message that does not fit into a request on its own is
+// sent in a request by itself.
+func (l *limiter) batches(payload LogPayload) ([]batch, error) {
+	batches := []batch{}
+
+	var current batch
+	// size of the current batch, including the brackets and separators
+	size := 0
+	for _, msg := range payload {
+		l.apply(msg)
+		encoded, err := json.Marshal(msg)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(current) > 0 && (size+len(encoded)+1 > l.maxRequestSize || len(current) >= l.maxLogRecords) {
+			batches = append(batches, current)
+			current = nil
+		}
+
+		if len(current) == 0 {
+			size = 2
+		} else {
+			size++
+		}
+		current = append(current, encoded)
+		size += len(encoded)
+	}
+
+	if len(current) > 0 {
+		batches = append(batches, current)
+	}
+
+	return batches, nil
+}
+
+// truncate shortens s to at most max bytes, including the truncation marker,
+// without splitting a multi-byte character
+func truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+
+	end := max - len(truncationMarker)
+	for end > 0 && !utf8.RuneStart(s[end]) {
+		end--
+	}
+	return s[:end] + truncationMarker
+}
@@ -0,0 +1,197 @@
+package dynatrace
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimitsConfigBuild(t *testing.T) {
+	cases := []struct {
+		name        string
+		modify      func(*LimitsConfig)
+		expectedErr string
+	}{
+		{
+			"Default",
+			func(*LimitsConfig) {},
+			"",
+		},
+		{
+			"ZeroRequestSize",
+			func(c *LimitsConfig) { c.MaxRequestSize = 0 },
+			"'max_request_size' must be greater than 2 bytes",
+		},
+		{
+			"ZeroLogRecords",
+			func(c *LimitsConfig) { c.MaxLogRecords = 0 },
+			"'max_log_records' must be greater than 0",
+		},
+		{
+			"ZeroAttributes",
+			func(c *LimitsConfig) { c.MaxAttributes = 0 },
+			"'max_attributes' must be greater than 0",
+		},
+		{
+			"AttributeLengthShorterThanMarker",
+			func(c *LimitsConfig) { c.MaxAttributeValueLength = 5 },
+			"'max_attribute_value_length' must be greater than 11",
+		},
+		{
+			"ContentLengthShorterThanMarker",
+			func(c *LimitsConfig) { c.MaxContentLength = 5 },
+			"'max_content_length' must be greater than 11",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := NewLimitsConfig()
+			tc.modify(&cfg)
+			_, err := cfg.Build()
+			if tc.expectedErr == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.EqualError(t, err, tc.expectedErr)
+		})
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	require.Equal(t, "short", truncate("short", 20))
+	require.Equal(t, "exactly", truncate("exactly", 7))
+	require.Equal(t, "abcde"+truncationMarker, truncate(strings.Repeat("abcdefghij", 5), 16))
+
+	// A multi-byte character is not split
+	truncated := truncate(strings.Repeat("é", 20), 14)
+	require.Equal(t, "é"+truncationMarker, truncated)
+	require.LessOrEqual(t, len(truncated), 14)
+}
+
+func TestLimiterApply(t *testing.T) {
+	t.Run("TruncateContent", func(t *testing.T) {
+		l := newTestLimiter(t, func(c *LimitsConfig) { c.MaxContentLength = 20 })
+		msg := LogMessage{contentKey: strings.Repeat("a", 30)}
+		l.apply(msg)
+		require.Equal(t, strings.Repeat("a", 9)+truncationMarker, msg[contentKey])
+	})
+
+	t.Run("TruncateAttributes", func(t *testing.T) {
+		l := newTestLimiter(t, func(c *LimitsConfig) { c.MaxAttributeValueLength = 15 })
+		msg := LogMessage{
+			contentKey: strings.Repeat("a", 30),
+			"long":     strings.Repeat("b", 30),
+			"number":   12345678901234567,
+		}
+		l.apply(msg)
+		require.Equal(t, strings.Repeat("a", 30), msg[contentKey])
+		require.Equal(t, "bbbb"+truncationMarker, msg["long"])
+		require.Equal(t, 12345678901234567, msg["number"])
+	})
+
+	t.Run("DropAttributes", func(t *testing.T) {
+		l := newTestLimiter(t, func(c *LimitsConfig) { c.MaxAttributes = 3 })
+		msg := LogMessage{
+			contentKey:   "content",
+			timestampKey: "1476089932000",
+			severityKey:  "error",
+			clusterIDKey: "cluster",
+			"d":          "d",
+			"a":          "a",
+			"c":          "c",
+			"b":          "b",
+		}
+		l.apply(msg)
+		require.Equal(t, LogMessage{
+			contentKey:   "content",
+			timestampKey: "1476089932000",
+			severityKey:  "error",
+			clusterIDKey: "cluster",
+			"a":          "a",
+		}, msg)
+	})
+}
+
+func TestLimiterBatches(t *testing.T) {
+	payload := func(n int) LogPayload {
+		p := make(LogPayload, 0, n)
+		for i := 0; i < n; i++ {
+			p = append(p, LogMessage{contentKey: fmt.Sprintf("message %d", i)})
+		}
+		return p
+	}
+
+	t.Run("Empty", func(t *testing.T) {
+		l := newTestLimiter(t, nil)
+		batches, err := l.batches(payload(0))
+		require.NoError(t, err)
+		require.Len(t, batches, 0)
+	})
+
+	t.Run("Single", func(t *testing.T) {
+		l := newTestLimiter(t, nil)
+		batches, err := l.batches(payload(3))
+		require.NoError(t, err)
+		require.Len(t, batches, 1)
+		require.Equal(t, `[{"content":"message 0"},{"content":"message 1"},{"content":"message 2"}]`, string(batches[0].body()))
+	})
+
+	t.Run("MaxLogRecords", func(t *testing.T) {
+		l := newTestLimiter(t, func(c *LimitsConfig) { c.MaxLogRecords = 2 })
+		batches, err := l.batches(payload(5))
+		require.NoError(t, err)
+		require.Len(t, batches, 3)
+		require.Equal(t, 5, countRecords(t, batches))
+	})
+
+	t.Run("MaxRequestSize", func(t *testing.T) {
+		// Each message is 23 bytes, so two messages, the separator and the brackets fill a request exactly
+		l := newTestLimiter(t, func(c *LimitsConfig) { c.MaxRequestSize = 49 })
+		batches, err := l.batches(payload(5))
+		require.NoError(t, err)
+		require.Len(t, batches, 3)
+		for _, batch := range batches {
+			require.LessOrEqual(t, len(batch.body()), 49)
+		}
+		require.Equal(t, 5, countRecords(t, batches))
+	})
+
+	t.Run("OversizedMessage", func(t *testing.T) {
+		l := newTestLimiter(t, func(c *LimitsConfig) { c.MaxRequestSize = 10 })
+		batches, err := l.batches(payload(2))
+		require.NoError(t, err)
+		require.Len(t, batches, 2)
+		require.Equal(t, 2, countRecords(t, batches))
+	})
+}
+
+func newTestLimiter(t *testing.T, modify func(*LimitsConfig)) *limiter {
+	cfg := NewLimitsConfig()
+	if modify != nil {
+		modify(&cfg)
+	}
+	l, err := cfg.Build()
+	require.NoError(t, err)
+	return l
+}
+
+func TestBatchSplit(t *testing.T) {
+	b := batch{json.RawMessage(`1`), json.RawMessage(`2`), json.RawMessage(`3`)}
+	first, second := b.split()
+	require.Equal(t, "[1]", string(first.body()))
+	require.Equal(t, "[2,3]", string(second.body()))
+}
+
+func countRecords(t *testing.T, batches []batch) int {
+	count := 0
+	for _, batch := range batches {
+		var records []map[string]interface{}
+		require.NoError(t, json.Unmarshal(batch.body(), &records))
+		count += len(records)
+	}
+	return count
+}
@@ -0,0 +1,597 @@
+package dynatrace
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/observiq/stanza/entry"
+	"github.com/observiq/stanza/errors"
+	"github.com/observiq/stanza/operator"
+	"github.com/observiq/stanza/operator/buffer"
+	"github.com/observiq/stanza/operator/flusher"
+	"github.com/observiq/stanza/operator/helper"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+func init() {
+	operator.Register("dynatrace_metrics_output", func() operator.Builder { return NewDynatraceMetricsOutputConfig("") })
+}
+
+// NewDynatraceMetricsOutputConfig creates a dynatrace metrics output config with default values
+func NewDynatraceMetricsOutputConfig(operatorID string) *DynatraceMetricsOutputConfig {
+	return &DynatraceMetricsOutputConfig{
+		OutputConfig:       helper.NewOutputConfig(operatorID, "dynatrace_metrics_output"),
+		BufferConfig:       buffer.NewConfig(),
+		FlusherConfig:      flusher.NewConfig(),
+		Timeout:            helper.NewDuration(10 * time.Second),
+		FlushInterval:      helper.NewDuration(time.Minute),
+		MaxLinesPerRequest: 1000,
+		ConnectionCheck:    connectionCheckOff,
+	}
+}
+
+// DynatraceMetricsOutputConfig is the configuration of a DynatraceMetricsOutput operator
+type DynatraceMetricsOutputConfig struct {
+	helper.OutputConfig `yaml:",inline"`
+	BufferConfig        buffer.Config          `json:"buffer"                          yaml:"buffer"`
+	FlusherConfig       flusher.Config         `json:"flusher"                         yaml:"flusher"`
+	APIKey              string                 `json:"api_key,omitempty"               yaml:"api_key,omitempty"`
+	APIKeyEnv           string                 `json:"api_key_env,omitempty"           yaml:"api_key_env,omitempty"`
+	APIKeyFile          string                 `json:"api_key_file,omitempty"          yaml:"api_key_file,omitempty"`
+	BaseURI             string                 `json:"base_uri,omitempty"              yaml:"base_uri,omitempty"`
+	TLS                 TLSConfig              `json:"tls,omitempty"                   yaml:"tls,omitempty"`
+	Timeout             helper.Duration        `json:"timeout,omitempty"               yaml:"timeout,omitempty"`
+	MetricKey           string                 `json:"metric_key,omitempty"            yaml:"metric_key,omitempty"`
+	MetricKeyField      *entry.Field           `json:"metric_key_field,omitempty"      yaml:"metric_key_field,omitempty"`
+	Prefix              string                 `json:"prefix,omitempty"                yaml:"prefix,omitempty"`
+	ValueField          *entry.Field           `json:"value_field,omitempty"           yaml:"value_field,omitempty"`
+	Dimensions          map[string]entry.Field `json:"dimensions,omitempty"            yaml:"dimensions,omitempty"`
+	DefaultDimensions   map[string]string      `json:"default_dimensions,omitempty"    yaml:"default_dimensions,omitempty"`
+	FlushInterval       helper.Duration        `json:"flush_interval,omitempty"        yaml:"flush_interval,omitempty"`
+	MaxLinesPerRequest  int                    `json:"max_lines_per_request,omitempty" yaml:"max_lines_per_request,omitempty"`
+	ConnectionCheck     string                 `json:"connection_check,omitempty"      yaml:"connection_check,omitempty"`
+}
+
+// Buffer returns the config of the buffer of the output
+func (c DynatraceMetricsOutputConfig) Buffer() buffer.Config {
+	return c.BufferConfig
+}
+
+// Build will build a new DynatraceMetricsOutput
+func (c DynatraceMetricsOutputConfig) Build(bc operator.BuildContext) ([]operator.Operator, error) {
+	outputOperator, err := c.OutputConfig.Build(bc)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens, err := newTokenSource(c.APIKey, c.APIKeyEnv, c.APIKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.BaseURI == "" {
+		return nil, fmt.Errorf("missing required parameter 'base_uri'")
+	}
+	url, err := url.Parse(c.BaseURI)
+	if err != nil {
+		return nil, fmt.Errorf("'base_uri' is not a valid URL: %s", err)
+	}
+
+	if (c.MetricKey == "") == (c.MetricKeyField == nil) {
+		return nil, fmt.Errorf("exactly one of 'metric_key' or 'metric_key_field' is required")
+	}
+	if c.MetricKey != "" {
+		if _, ok := normalizeMetricKey(c.Prefix + c.MetricKey); !ok {
+			return nil, fmt.Errorf("'metric_key' must start with a letter")
+		}
+	}
+
+	if c.FlushInterval.Raw() <= 0 {
+		return nil, fmt.Errorf("'flush_interval' must be greater than 0")
+	}
+
+	if c.MaxLinesPerRequest <= 0 {
+		return nil, fmt.Errorf("'max_lines_per_request' must be greater than 0")
+	}
+
+	if err := validateConnectionCheck(c.ConnectionCheck); err != nil {
+		return nil, err
+	}
+
+	dimensions := make([]dimensionField, 0, len(c.Dimensions))
+	for key, field := range c.Dimensions {
+		normalized, ok := normalizeDimensionKey(key)
+		if !ok {
+			return nil, fmt.Errorf("dimension '%s' must start with a letter", key)
+		}
+		dimensions = append(dimensions, dimensionField{key: normalized, field: field})
+	}
+
+	defaultDimensions := make(map[string]string, len(c.DefaultDimensions))
+	for key, value := range c.DefaultDimensions {
+		normalized, ok := normalizeDimensionKey(key)
+		if !ok {
+			return nil, fmt.Errorf("default dimension '%s' must start with a letter", key)
+		}
+		defaultDimensions[normalized] = value
+	}
+
+	// Lines are aggregated from many entries, so there are no entries to dead-letter
+	if c.FlusherConfig.Retry.OnExhausted == flusher.OnExhaustedDeadLetter {
+		return nil, fmt.Errorf("'on_exhausted' '%s' is not supported", flusher.OnExhaustedDeadLetter)
+	}
+
+	flusher, err := c.FlusherConfig.Build(bc, outputOperator.ID())
+	if err != nil {
+		return nil, err
+	}
+
+	buffer, err := c.BufferConfig.Build(bc, c.ID())
+	if err != nil {
+		return nil, err
+	}
+
+	clientTLS, err := c.TLS.Build()
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid 'tls'")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.TLSClientConfig = clientTLS
+	output := &DynatraceMetricsOutput{
+		OutputOperator: outputOperator,
+		buffer:         buffer,
+		flusher:        flusher,
+		client:         &http.Client{Transport: tr},
+		url:            url,
+		tokens:         tokens,
+		timeout:        c.Timeout.Raw(),
+		converter: &metricConverter{
+			metricKey:         c.MetricKey,
+			metricKeyField:    c.MetricKeyField,
+			prefix:            c.Prefix,
+			valueField:        c.ValueField,
+			dimensions:        dimensions,
+			defaultDimensions: defaultDimensions,
+		},
+		aggregator:      newMetricsAggregator(),
+		flushInterval:   c.FlushInterval.Raw(),
+		maxLines:        c.MaxLinesPerRequest,
+		connectionCheck: c.ConnectionCheck,
+		now:             time.Now,
+		ctx:             ctx,
+		cancel:          cancel,
+	}
+
+	return []operator.Operator{output}, nil
+}
+
+// DynatraceMetricsOutput is an operator that converts entries into metrics and
+// sends them to the Dynatrace Metrics Ingest API
+type DynatraceMetricsOutput struct {
+	// counters of entries and lines that were not ingested by Dynatrace. These are
+	// first in the struct to guarantee 64-bit alignment for atomic operations.
+	skippedEntries uint64
+	droppedLines   uint64
+	invalidLines   uint64
+
+	helper.OutputOperator
+	buffer          buffer.Buffer
+	flusher         *flusher.Flusher
+	client          *http.Client
+	url             *url.URL
+	tokens          tokenSource
+	timeout         time.Duration
+	converter       *metricConverter
+	aggregator      *metricsAggregator
+	flushInterval   time.Duration
+	maxLines        int
+	connectionCheck string
+	now             func() time.Time
+	ctx             context.Context
+	cancel          context.CancelFunc
+	wg              sync.WaitGroup
+}
+
+// Start checks the connection to Dynatrace if configured and begins aggregating
+// entries and flushing metrics
+func (o *DynatraceMetricsOutput) Start() error {
+	if err := startupCheck(o.ctx, o.connectionCheck, o, o.SugaredLogger); err != nil {
+		return err
+	}
+
+	o.wg.Add(2)
+	go func() {
+		defer o.wg.Done()
+		o.feedAggregator(o.ctx)
+	}()
+	go func() {
+		defer o.wg.Done()
+		o.flushOnInterval(o.ctx)
+	}()
+
+	return nil
+}
+
+// Stop tells the DynatraceMetricsOutput to stop gracefully. Aggregates that were
+// not sent yet are discarded. Their entries were not marked as flushed, so
+// buffers that persist entries aggregate them again after a restart.
+func (o *DynatraceMetricsOutput) Stop() error {
+	o.cancel()
+	o.wg.Wait()
+	o.flusher.Stop()
+	return o.buffer.Close()
+}
+
+// Close releases the buffer of an output that was never started
+func (o *DynatraceMetricsOutput) Close() error {
+	o.flusher.Stop()
+	return o.buffer.Close()
+}
+
+// Health returns how long the output has been retrying to flush and how full its buffer is
+func (o *DynatraceMetricsOutput) Health() operator.Health {
+	return o.flusher.Health(o.buffer)
+}
+
+// Process adds an entry to the output's buffer
+func (o *DynatraceMetricsOutput) Process(ctx context.Context, entry *entry.Entry) error {
+	return o.buffer.Add(ctx, entry)
+}
+
+// feedAggregator reads chunks from the buffer and aggregates their entries
+func (o *DynatraceMetricsOutput) feedAggregator(ctx context.Context) {
+	for {
+		entries, clearer, err := o.buffer.ReadChunk(ctx)
+		if err != nil && err == context.Canceled {
+			return
+		} else if err != nil {
+			o.Errorw("Failed to read chunk", zap.Error(err))
+			continue
+		}
+
+		samples := make([]sample, 0, len(entries))
+		for _, e := range entries {
+			smp, err := o.converter.convert(e)
+			if err != nil {
+				skipped := atomic.AddUint64(&o.skippedEntries, 1)
+				o.Debugw("Skipping entry that cannot be converted to a metric", zap.Error(err), "skipped_entries_total", skipped)
+				continue
+			}
+			samples = append(samples, smp)
+		}
+		o.aggregator.addChunk(samples, clearer)
+	}
+}
+
+// flushOnInterval flushes the aggregated metrics every flush interval
+func (o *DynatraceMetricsOutput) flushOnInterval(ctx context.Context) {
+	ticker := time.NewTicker(o.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			o.flush()
+		}
+	}
+}
+
+// flush hands the aggregated metrics to the flusher
+func (o *DynatraceMetricsOutput) flush() {
+	aggregated, clearers := o.aggregator.take()
+	if len(clearers) == 0 {
+		return
+	}
+
+	timestamp := o.now()
+	lines := make([]string, 0, len(aggregated))
+	for _, s := range aggregated {
+		lines = append(lines, s.line(timestamp))
+	}
+
+	o.flusher.Do(o.newFlushFunc(lines, clearers))
+}
+
+// newFlushFunc creates the function that sends metric lines in requests of at most
+// max_lines_per_request lines. The requests that have not been sent successfully
+// are kept between retries so that lines are not sent twice.
+func (o *DynatraceMetricsOutput) newFlushFunc(lines []string, clearers []buffer.Clearer) flusher.FlushFunc {
+	var requests [][]string
+	for len(lines) > 0 {
+		n := o.maxLines
+		if n > len(lines) {
+			n = len(lines)
+		}
+		requests = append(requests, lines[:n])
+		lines = lines[n:]
+	}
+
+	return func(ctx context.Context) error {
+		for len(requests) > 0 {
+			err := o.send(ctx, requests[0])
+			if err == nil {
+				requests = requests[1:]
+				continue
+			}
+
+			statusErr, ok := err.(*statusError)
+			if !ok {
+				return err
+			}
+
+			switch statusErr.class() {
+			case tooLarge:
+				if len(requests[0]) > 1 {
+					half := len(requests[0]) / 2
+					requests = append([][]string{requests[0][:half], requests[0][half:]}, requests[1:]...)
+					continue
+				}
+				fallthrough
+			case permanent:
+				dropped := atomic.AddUint64(&o.droppedLines, uint64(len(requests[0])))
+				o.Errorw("Dropping metric lines because Dynatrace rejected the request with a permanent error",
+					zap.Error(err), "status_code", statusErr.statusCode, "lines", len(requests[0]), "dropped_lines_total", dropped)
+				requests = requests[1:]
+			default:
+				return statusErr.retryError()
+			}
+		}
+
+		for _, clearer := range clearers {
+			if err := clearer.MarkAllAsFlushed(); err != nil {
+				o.Errorw("Failed to mark entries as flushed", zap.Error(err))
+			}
+		}
+		return nil
+	}
+}
+
+// Check verifies that the URL has the shape of the Metrics Ingest API, and that
+// the endpoint accepts the API token
+func (o *DynatraceMetricsOutput) Check(ctx context.Context) error {
+	err := metricsIngestAPI.checkEndpoint(ctx, o.client, o.url, o.timeout, func(ctx context.Context) (*http.Request, error) {
+		return o.newRequest(ctx, nil)
+	})
+	if err != nil {
+		return errors.Wrap(err, o.url.String())
+	}
+	return nil
+}
+
+// send posts metric lines to Dynatrace
+func (o *DynatraceMetricsOutput) send(ctx context.Context, lines []string) error {
+	ctx, cancel := context.WithTimeout(ctx, o.timeout)
+	defer cancel()
+
+	req, err := o.newRequest(ctx, []byte(strings.Join(lines, "\n")))
+	if err != nil {
+		return err
+	}
+
+	res, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	return o.handleResponse(res)
+}
+
+// newRequest creates a request that posts metric lines to Dynatrace
+func (o *DynatraceMetricsOutput) newRequest(ctx context.Context, body []byte) (*http.Request, error) {
+	if ce := o.Desugar().Check(zapcore.DebugLevel, "Sending request"); ce != nil {
+		ce.Write(zap.String("url", o.url.String()), zap.ByteString("payload", body))
+	}
+
+	token, err := o.tokens.Token()
+	if err != nil {
+		return nil, errors.Wrap(err, "load api token")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", o.url.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	req.Header.Set("Accept", "application/json; charset=utf-8")
+	req.Header.Set("Authorization", "Api-Token "+token)
+
+	return req, nil
+}
+
+// handleResponse returns a *statusError if the request was not successful,
+// and reports lines that Dynatrace rejected in an accepted request
+func (o *DynatraceMetricsOutput) handleResponse(res *http.Response) error {
+	body, err := ioutil.ReadAll(res.Body)
+	if closeErr := res.Body.Close(); closeErr != nil {
+		o.Errorw("Failed to close response body", zap.Error(closeErr))
+	}
+
+	if !(res.StatusCode >= 200 && res.StatusCode < 300) {
+		if err != nil {
+			body = nil
+		}
+		return newStatusError(res, body)
+	}
+
+	if err != nil {
+		return errors.Wrap(err, "read response body")
+	}
+
+	if invalid, reason, ok := parseMetricsResponse(body); ok {
+		total := atomic.AddUint64(&o.invalidLines, uint64(invalid))
+		o.Warnw("Dynatrace rejected some of the metric lines in a request",
+			"invalid_lines", invalid, "reason", reason, "invalid_lines_total", total)
+	}
+
+	return nil
+}
+
+// metricsResponse is the body of a response of the Metrics Ingest API
+type metricsResponse struct {
+	LinesOk      int `json:"linesOk"`
+	LinesInvalid int `json:"linesInvalid"`
+	Error        *struct {
+		Message      string          `json:"message"`
+		InvalidLines json.RawMessage `json:"invalidLines,omitempty"`
+	} `json:"error"`
+}
+
+// parseMetricsResponse returns the number of invalid lines reported in the body
+// of an accepted request and the reason. It returns false if every line was valid.
+func parseMetricsResponse(body []byte) (int, string, bool) {
+	var res metricsResponse
+	if err := json.Unmarshal(body, &res); err != nil || res.LinesInvalid == 0 {
+		return 0, "", false
+	}
+
+	if res.Error == nil {
+		return res.LinesInvalid, "", true
+	}
+	if len(res.Error.InvalidLines) == 0 {
+		return res.LinesInvalid, res.Error.Message, true
+	}
+	return res.LinesInvalid, fmt.Sprintf("%s: %s", res.Error.Message, string(res.Error.InvalidLines)), true
+}
+
+// dimensionField is a dimension whose value is read from a field of each entry
+type dimensionField struct {
+	key   string
+	field entry.Field
+}
+
+// metricConverter converts entries into the metric key, dimensions and value of a metric
+type metricConverter struct {
+	metricKey         string
+	metricKeyField    *entry.Field
+	prefix            string
+	valueField        *entry.Field
+	dimensions        []dimensionField
+	defaultDimensions map[string]string
+}
+
+// convert returns the sample of an entry, with sorted dimensions. Entries are
+// counted with a value of 1 if no value field is configured.
+func (c *metricConverter) convert(e *entry.Entry) (sample, error) {
+	key := c.metricKey
+	if c.metricKeyField != nil {
+		raw, ok := e.Get(*c.metricKeyField)
+		if !ok {
+			return sample{}, fmt.Errorf("missing metric key field %s", c.metricKeyField.String())
+		}
+		key = stringValue(raw)
+	}
+
+	metricKey, ok := normalizeMetricKey(c.prefix + key)
+	if !ok {
+		return sample{}, fmt.Errorf("metric key '%s' must start with a letter", c.prefix+key)
+	}
+
+	value := 1.0
+	if c.valueField != nil {
+		raw, ok := e.Get(*c.valueField)
+		if !ok {
+			return sample{}, fmt.Errorf("missing value field %s", c.valueField.String())
+		}
+		parsed, err := numericValue(raw)
+		if err != nil {
+			return sample{}, err
+		}
+		if math.IsNaN(parsed) || math.IsInf(parsed, 0) {
+			return sample{}, fmt.Errorf("value %v is not a finite number", parsed)
+		}
+		value = parsed
+	}
+
+	values := make(map[string]string, len(c.defaultDimensions)+len(c.dimensions))
+	for key, value := range c.defaultDimensions {
+		values[key] = value
+	}
+	for _, d := range c.dimensions {
+		if raw, ok := e.Get(d.field); ok {
+			values[d.key] = stringValue(raw)
+		}
+	}
+
+	dimensions := make([]dimension, 0, len(values))
+	for key, value := range values {
+		dimensions = append(dimensions, dimension{key: key, value: value})
+	}
+	sort.Slice(dimensions, func(i, j int) bool { return dimensions[i].key < dimensions[j].key })
+
+	return sample{
+		metricKey:  metricKey,
+		dimensions: dimensions,
+		value:      value,
+		counter:    c.valueField == nil,
+	}, nil
+}
+
+// numericValue converts a field value into a number. Strings are parsed, because
+// values extracted by parsers such as regex_parser are strings.
+func numericValue(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case float64:
+		return v, nil
+	case float32:
+		return float64(v), nil
+	case int:
+		return float64(v), nil
+	case int8:
+		return float64(v), nil
+	case int16:
+		return float64(v), nil
+	case int32:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	case uint:
+		return float64(v), nil
+	case uint8:
+		return float64(v), nil
+	case uint16:
+		return float64(v), nil
+	case uint32:
+		return float64(v), nil
+	case uint64:
+		return float64(v), nil
+	case json.Number:
+		return v.Float64()
+	case string:
+		parsed, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return 0, fmt.Errorf("value '%s' is not a number", v)
+		}
+		return parsed, nil
+	default:
+		return 0, fmt.Errorf("value of type %T is not a number", value)
+	}
+}
+
+// stringValue converts a field value into a string
+func stringValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
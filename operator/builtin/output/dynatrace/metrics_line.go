@@ -0,0 +1,245 @@
+package dynatrace
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/observiq/stanza/operator/buffer"
+)
+
+// Limits of the Dynatrace metrics ingest line protocol
+const (
+	maxMetricKeyLength      = 250
+	maxDimensionKeyLength   = 100
+	maxDimensionValueLength = 250
+)
+
+// dimension is a normalized dimension of a metric line
+type dimension struct {
+	key   string
+	value string
+}
+
+// series is the aggregate of the values of a metric key and set of dimensions
+type series struct {
+	metricKey  string
+	dimensions []dimension
+	counter    bool
+	count      uint64
+	sum        float64
+	min        float64
+	max        float64
+}
+
+// line returns the series in the Dynatrace metrics ingest line protocol.
+// Counters are sent as a delta of the number of entries, and gauges as a summary
+// of the values of the entries.
+func (s *series) line(timestamp time.Time) string {
+	var b strings.Builder
+	b.WriteString(s.metricKey)
+	for _, d := range s.dimensions {
+		b.WriteByte(',')
+		b.WriteString(d.key)
+		b.WriteString(`="`)
+		b.WriteString(escapeDimensionValue(d.value))
+		b.WriteByte('"')
+	}
+
+	if s.counter {
+		b.WriteString(" count,delta=")
+		b.WriteString(strconv.FormatUint(s.count, 10))
+	} else {
+		fmt.Fprintf(&b, " gauge,min=%s,max=%s,sum=%s,count=%d",
+			formatValue(s.min), formatValue(s.max), formatValue(s.sum), s.count)
+	}
+
+	b.WriteByte(' ')
+	b.WriteString(strconv.FormatInt(timestamp.UnixNano()/int64(time.Millisecond), 10))
+	return b.String()
+}
+
+// metricsAggregator pre-aggregates the values of entries until they are flushed.
+// It keeps the clearers of the chunks that were aggregated, so the entries are
+// only marked as flushed once the aggregates containing them were sent.
+type metricsAggregator struct {
+	mutex    sync.Mutex
+	series   map[string]*series
+	clearers []buffer.Clearer
+}
+
+// newMetricsAggregator creates an empty aggregator
+func newMetricsAggregator() *metricsAggregator {
+	return &metricsAggregator{
+		series: make(map[string]*series),
+	}
+}
+
+// sample is a value of a metric key and set of sorted dimensions
+type sample struct {
+	metricKey  string
+	dimensions []dimension
+	value      float64
+	counter    bool
+}
+
+// addChunk adds the samples of a chunk of entries, and keeps the clearer of the
+// chunk until the next flush. The whole chunk is added at once, so that its
+// clearer is never taken without its samples.
+func (a *metricsAggregator) addChunk(samples []sample, clearer buffer.Clearer) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	for _, smp := range samples {
+		a.add(smp)
+	}
+	a.clearers = append(a.clearers, clearer)
+}
+
+// add adds a sample to its series. The caller must hold the mutex.
+func (a *metricsAggregator) add(smp sample) {
+	id := seriesID(smp.metricKey, smp.dimensions, smp.counter)
+
+	s, ok := a.series[id]
+	if !ok {
+		a.series[id] = &series{
+			metricKey:  smp.metricKey,
+			dimensions: smp.dimensions,
+			counter:    smp.counter,
+			count:      1,
+			sum:        smp.value,
+			min:        smp.value,
+			max:        smp.value,
+		}
+		return
+	}
+
+	s.count++
+	s.sum += smp.value
+	if smp.value < s.min {
+		s.min = smp.value
+	}
+	if smp.value > s.max {
+		s.max = smp.value
+	}
+}
+
+// take returns the aggregated series sorted by their lines, together with the
+// clearers of the aggregated chunks, and resets the aggregator
+func (a *metricsAggregator) take() ([]*series, []buffer.Clearer) {
+	a.mutex.Lock()
+	ids := make([]string, 0, len(a.series))
+	for id := range a.series {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	taken := make([]*series, 0, len(ids))
+	for _, id := range ids {
+		taken = append(taken, a.series[id])
+	}
+	clearers := a.clearers
+
+	a.series = make(map[string]*series)
+	a.clearers = nil
+	a.mutex.Unlock()
+
+	return taken, clearers
+}
+
+// seriesID returns the identifier of a series
+func seriesID(metricKey string, dimensions []dimension, counter bool) string {
+	var b strings.Builder
+	b.WriteString(metricKey)
+	for _, d := range dimensions {
+		b.WriteByte(0)
+		b.WriteString(d.key)
+		b.WriteByte(0)
+		b.WriteString(d.value)
+	}
+	if counter {
+		b.WriteString("\x00count")
+	}
+	return b.String()
+}
+
+// normalizeMetricKey replaces characters that are not allowed in a metric key with
+// underscores. It returns false if the key does not start with a letter.
+func normalizeMetricKey(key string) (string, bool) {
+	key = truncateBytes(key, maxMetricKeyLength)
+	if key == "" || !isLetter(key[0]) {
+		return "", false
+	}
+
+	b := []byte(key)
+	for i, c := range b {
+		if !(isLetter(c) || isDigit(c) || c == '.' || c == '_' || c == '-') {
+			b[i] = '_'
+		}
+	}
+	return string(b), true
+}
+
+// normalizeDimensionKey lower cases a dimension key and replaces characters that
+// are not allowed with underscores. It returns false if the key does not start with a letter.
+func normalizeDimensionKey(key string) (string, bool) {
+	key = strings.ToLower(truncateBytes(key, maxDimensionKeyLength))
+	if key == "" || !isLetter(key[0]) {
+		return "", false
+	}
+
+	b := []byte(key)
+	for i, c := range b {
+		if !(isLetter(c) || isDigit(c) || c == '.' || c == '_' || c == '-' || c == ':') {
+			b[i] = '_'
+		}
+	}
+	return string(b), true
+}
+
+// escapeDimensionValue escapes a quoted dimension value
+func escapeDimensionValue(value string) string {
+	value = truncate(value, maxDimensionValueLength)
+	if !strings.ContainsAny(value, "\"\\\n") {
+		return value
+	}
+
+	var b bytes.Buffer
+	for _, r := range value {
+		switch r {
+		case '"', '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case '\n':
+			b.WriteString(`\n`)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// formatValue formats a value without an exponent, as required by the line protocol
+func formatValue(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// truncateBytes truncates an ASCII string to a maximum number of bytes
+func truncateBytes(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	return s[:max]
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
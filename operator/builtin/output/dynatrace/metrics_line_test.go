@@ -0,0 +1,142 @@
+package dynatrace
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSeriesLine(t *testing.T) {
+	ts := time.Date(2016, 10, 10, 8, 58, 52, 0, time.UTC)
+
+	cases := []struct {
+		name     string
+		series   series
+		expected string
+	}{
+		{
+			"Gauge",
+			series{metricKey: "http.latency", count: 3, sum: 4.5, min: 0.5, max: 2.5},
+			"http.latency gauge,min=0.5,max=2.5,sum=4.5,count=3 1476089932000",
+		},
+		{
+			"Counter",
+			series{metricKey: "http.requests", counter: true, count: 42, sum: 42, min: 1, max: 1},
+			"http.requests count,delta=42 1476089932000",
+		},
+		{
+			"Dimensions",
+			series{
+				metricKey:  "http.requests",
+				dimensions: []dimension{{"k8s.namespace.name", "default"}, {"status", "200"}},
+				counter:    true,
+				count:      1,
+			},
+			`http.requests,k8s.namespace.name="default",status="200" count,delta=1 1476089932000`,
+		},
+		{
+			"EscapedDimension",
+			series{
+				metricKey:  "app.errors",
+				dimensions: []dimension{{"message", `say "hi" \ bye`}},
+				counter:    true,
+				count:      1,
+			},
+			`app.errors,message="say \"hi\" \\ bye" count,delta=1 1476089932000`,
+		},
+		{
+			"LargeValue",
+			series{metricKey: "bytes", count: 1, sum: 1e21, min: 1e21, max: 1e21},
+			"bytes gauge,min=1000000000000000000000,max=1000000000000000000000,sum=1000000000000000000000,count=1 1476089932000",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.expected, tc.series.line(ts))
+		})
+	}
+}
+
+func TestNormalizeMetricKey(t *testing.T) {
+	cases := []struct {
+		key      string
+		expected string
+		ok       bool
+	}{
+		{"http.requests", "http.requests", true},
+		{"http requests/total", "http_requests_total", true},
+		{"Custom-Key_1", "Custom-Key_1", true},
+		{"1requests", "", false},
+		{"", "", false},
+		{strings.Repeat("a", 300), strings.Repeat("a", maxMetricKeyLength), true},
+	}
+
+	for _, tc := range cases {
+		key, ok := normalizeMetricKey(tc.key)
+		require.Equal(t, tc.ok, ok, tc.key)
+		require.Equal(t, tc.expected, key)
+	}
+}
+
+func TestNormalizeDimensionKey(t *testing.T) {
+	cases := []struct {
+		key      string
+		expected string
+		ok       bool
+	}{
+		{"status", "status", true},
+		{"K8s.Namespace.Name", "k8s.namespace.name", true},
+		{"dt.entity:host", "dt.entity:host", true},
+		{"http status", "http_status", true},
+		{"_status", "", false},
+	}
+
+	for _, tc := range cases {
+		key, ok := normalizeDimensionKey(tc.key)
+		require.Equal(t, tc.ok, ok, tc.key)
+		require.Equal(t, tc.expected, key)
+	}
+}
+
+func TestMetricsAggregator(t *testing.T) {
+	a := newMetricsAggregator()
+	ok := []dimension{{"status", "200"}}
+	failed := []dimension{{"status", "500"}}
+
+	a.addChunk([]sample{
+		{metricKey: "http.latency", dimensions: ok, value: 1},
+		{metricKey: "http.latency", dimensions: ok, value: 3},
+		{metricKey: "http.latency", dimensions: failed, value: 10},
+	}, &testClearer{})
+	a.addChunk([]sample{
+		{metricKey: "http.latency", dimensions: ok, value: 2},
+	}, &testClearer{})
+
+	aggregated, clearers := a.take()
+	require.Len(t, clearers, 2)
+	require.Equal(t, []*series{
+		{metricKey: "http.latency", dimensions: ok, count: 3, sum: 6, min: 1, max: 3},
+		{metricKey: "http.latency", dimensions: failed, count: 1, sum: 10, min: 10, max: 10},
+	}, aggregated)
+
+	// The aggregator is reset after each flush
+	aggregated, clearers = a.take()
+	require.Empty(t, aggregated)
+	require.Empty(t, clearers)
+}
+
+type testClearer struct {
+	flushed bool
+}
+
+func (c *testClearer) MarkAllAsFlushed() error {
+	c.flushed = true
+	return nil
+}
+
+func (c *testClearer) MarkRangeAsFlushed(uint, uint) error {
+	return nil
+}
@@ -0,0 +1,342 @@
+package dynatrace
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/observiq/stanza/entry"
+	"github.com/observiq/stanza/operator/buffer"
+	"github.com/observiq/stanza/operator/helper"
+	"github.com/observiq/stanza/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestDynatraceMetricsConfigBuild(t *testing.T) {
+	cases := []struct {
+		name        string
+		modify      func(*DynatraceMetricsOutputConfig)
+		expectedErr string
+	}{
+		{
+			"Valid",
+			nil,
+			"",
+		},
+		{
+			"MissingBaseURI",
+			func(c *DynatraceMetricsOutputConfig) { c.BaseURI = "" },
+			"missing required parameter 'base_uri'",
+		},
+		{
+			"MissingMetricKey",
+			func(c *DynatraceMetricsOutputConfig) { c.MetricKey = "" },
+			"exactly one of 'metric_key' or 'metric_key_field' is required",
+		},
+		{
+			"MetricKeyAndField",
+			func(c *DynatraceMetricsOutputConfig) {
+				field := entry.NewRecordField("metric")
+				c.MetricKeyField = &field
+			},
+			"exactly one of 'metric_key' or 'metric_key_field' is required",
+		},
+		{
+			"InvalidMetricKey",
+			func(c *DynatraceMetricsOutputConfig) { c.MetricKey = "1requests" },
+			"'metric_key' must start with a letter",
+		},
+		{
+			"InvalidDimension",
+			func(c *DynatraceMetricsOutputConfig) {
+				c.Dimensions = map[string]entry.Field{"_status": entry.NewRecordField("status")}
+			},
+			"dimension '_status' must start with a letter",
+		},
+		{
+			"ZeroFlushInterval",
+			func(c *DynatraceMetricsOutputConfig) { c.FlushInterval = helper.NewDuration(0) },
+			"'flush_interval' must be greater than 0",
+		},
+		{
+			"ZeroMaxLines",
+			func(c *DynatraceMetricsOutputConfig) { c.MaxLinesPerRequest = 0 },
+			"'max_lines_per_request' must be greater than 0",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := NewDynatraceMetricsOutputConfig("test")
+			cfg.APIKey = "testkey"
+			cfg.BaseURI = "http://localhost/api/v2/metrics/ingest"
+			cfg.MetricKey = "http.requests"
+			if tc.modify != nil {
+				tc.modify(cfg)
+			}
+
+			_, err := cfg.Build(testutil.NewBuildContext(t))
+			if tc.expectedErr == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			require.Contains(t, err.Error(), tc.expectedErr)
+		})
+	}
+}
+
+func TestDynatraceMetricsConfigUnmarshal(t *testing.T) {
+	raw := `
+type: dynatrace_metrics_output
+api_key: testkey
+base_uri: http://localhost/api/v2/metrics/ingest
+metric_key: http.latency
+prefix: stanza.
+value_field: $record.duration
+dimensions:
+  status: $record.status
+  namespace: $resource['k8s.namespace.name']
+default_dimensions:
+  env: prod
+flush_interval: 30s
+`
+	cfg := NewDynatraceMetricsOutputConfig("")
+	require.NoError(t, yaml.UnmarshalStrict([]byte(raw), cfg))
+
+	valueField := entry.NewRecordField("duration")
+	require.Equal(t, "http.latency", cfg.MetricKey)
+	require.Equal(t, "stanza.", cfg.Prefix)
+	require.Equal(t, &valueField, cfg.ValueField)
+	require.Equal(t, map[string]entry.Field{
+		"status":    entry.NewRecordField("status"),
+		"namespace": entry.NewResourceField("k8s.namespace.name"),
+	}, cfg.Dimensions)
+	require.Equal(t, map[string]string{"env": "prod"}, cfg.DefaultDimensions)
+	require.Equal(t, helper.NewDuration(30*time.Second), cfg.FlushInterval)
+}
+
+func TestDynatraceMetricsOutput(t *testing.T) {
+	t.Run("Counter", func(t *testing.T) {
+		srv, bodies := newMetricsServer(t, http.StatusAccepted, `{"linesOk":2,"linesInvalid":0,"error":null}`)
+		op := newTestMetricsOutput(t, srv.URL, func(cfg *DynatraceMetricsOutputConfig) {
+			cfg.Dimensions = map[string]entry.Field{"status": entry.NewRecordField("status")}
+			cfg.DefaultDimensions = map[string]string{"env": "prod"}
+		})
+
+		for _, status := range []interface{}{"200", 200, "500"} {
+			e := entry.New()
+			e.Record = map[string]interface{}{"status": status}
+			require.NoError(t, op.Process(context.Background(), e))
+		}
+		flushMetrics(t, op, 3)
+
+		expectMetricLines(t, bodies,
+			`http.requests,env="prod",status="200" count,delta=2 1476089932000`,
+			`http.requests,env="prod",status="500" count,delta=1 1476089932000`,
+		)
+	})
+
+	t.Run("Gauge", func(t *testing.T) {
+		srv, bodies := newMetricsServer(t, http.StatusAccepted, "")
+		op := newTestMetricsOutput(t, srv.URL, func(cfg *DynatraceMetricsOutputConfig) {
+			valueField := entry.NewRecordField("duration")
+			cfg.ValueField = &valueField
+			cfg.MetricKey = "http.latency"
+			cfg.Dimensions = map[string]entry.Field{"namespace": entry.NewResourceField("k8s.namespace.name")}
+		})
+
+		for _, duration := range []interface{}{"0.5", 2.5, 1, "not a number"} {
+			e := entry.New()
+			e.Record = map[string]interface{}{"duration": duration}
+			e.Resource = map[string]string{"k8s.namespace.name": "default"}
+			require.NoError(t, op.Process(context.Background(), e))
+		}
+		flushMetrics(t, op, 4)
+
+		expectMetricLines(t, bodies,
+			`http.latency,namespace="default" gauge,min=0.5,max=2.5,sum=4,count=3 1476089932000`,
+		)
+		require.Equal(t, uint64(1), atomic.LoadUint64(&op.skippedEntries))
+	})
+
+	t.Run("MetricKeyField", func(t *testing.T) {
+		srv, bodies := newMetricsServer(t, http.StatusAccepted, "")
+		op := newTestMetricsOutput(t, srv.URL, func(cfg *DynatraceMetricsOutputConfig) {
+			field := entry.NewLabelField("metric")
+			cfg.MetricKey = ""
+			cfg.MetricKeyField = &field
+			cfg.Prefix = "logs."
+		})
+
+		for _, metric := range []string{"errors", "warnings", "errors"} {
+			e := entry.New()
+			e.Labels = map[string]string{"metric": metric}
+			require.NoError(t, op.Process(context.Background(), e))
+		}
+		flushMetrics(t, op, 3)
+
+		expectMetricLines(t, bodies,
+			"logs.errors count,delta=2 1476089932000",
+			"logs.warnings count,delta=1 1476089932000",
+		)
+	})
+
+	t.Run("MaxLinesPerRequest", func(t *testing.T) {
+		srv, bodies := newMetricsServer(t, http.StatusAccepted, "")
+		op := newTestMetricsOutput(t, srv.URL, func(cfg *DynatraceMetricsOutputConfig) {
+			cfg.MaxLinesPerRequest = 1
+			cfg.Dimensions = map[string]entry.Field{"status": entry.NewRecordField("status")}
+		})
+
+		for _, status := range []string{"200", "500"} {
+			e := entry.New()
+			e.Record = map[string]interface{}{"status": status}
+			require.NoError(t, op.Process(context.Background(), e))
+		}
+		flushMetrics(t, op, 2)
+
+		expectMetricLines(t, bodies, `http.requests,status="200" count,delta=1 1476089932000`)
+		expectMetricLines(t, bodies, `http.requests,status="500" count,delta=1 1476089932000`)
+	})
+}
+
+func TestDynatraceMetricsOutputResponseHandling(t *testing.T) {
+	t.Run("RetryableError", func(t *testing.T) {
+		var requests int64
+		bodies := make(chan string, 10)
+		srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			body, err := ioutil.ReadAll(req.Body)
+			assert.NoError(t, err)
+			if atomic.AddInt64(&requests, 1) == 1 {
+				rw.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			rw.WriteHeader(http.StatusAccepted)
+			bodies <- string(body)
+		}))
+		defer srv.Close()
+
+		op := newTestMetricsOutput(t, srv.URL, nil)
+		require.NoError(t, op.Process(context.Background(), entry.New()))
+		flushMetrics(t, op, 1)
+
+		expectMetricLines(t, bodies, "http.requests count,delta=1 1476089932000")
+		require.Equal(t, int64(2), atomic.LoadInt64(&requests))
+	})
+
+	t.Run("PermanentError", func(t *testing.T) {
+		srv, _ := newMetricsServer(t, http.StatusBadRequest, `{"linesOk":0,"linesInvalid":1,"error":{"code":400,"message":"1 invalid line"}}`)
+		op := newTestMetricsOutput(t, srv.URL, nil)
+		require.NoError(t, op.Process(context.Background(), entry.New()))
+		flushMetrics(t, op, 1)
+
+		require.Eventually(t, func() bool {
+			return atomic.LoadUint64(&op.droppedLines) == 1
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("InvalidLines", func(t *testing.T) {
+		srv, _ := newMetricsServer(t, http.StatusAccepted,
+			`{"linesOk":1,"linesInvalid":1,"error":{"code":400,"message":"1 invalid line","invalidLines":[{"line":2,"error":"invalid dimension"}]}}`)
+		op := newTestMetricsOutput(t, srv.URL, nil)
+		require.NoError(t, op.Process(context.Background(), entry.New()))
+		flushMetrics(t, op, 1)
+
+		require.Eventually(t, func() bool {
+			return atomic.LoadUint64(&op.invalidLines) == 1
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+}
+
+func TestParseMetricsResponse(t *testing.T) {
+	invalid, reason, ok := parseMetricsResponse([]byte(`{"linesOk":3,"linesInvalid":0,"error":null}`))
+	require.False(t, ok)
+
+	invalid, reason, ok = parseMetricsResponse([]byte(`{"linesOk":1,"linesInvalid":2,"error":{"code":400,"message":"2 invalid lines"}}`))
+	require.True(t, ok)
+	require.Equal(t, 2, invalid)
+	require.Equal(t, "2 invalid lines", reason)
+
+	_, _, ok = parseMetricsResponse([]byte("not json"))
+	require.False(t, ok)
+}
+
+// newMetricsServer creates a server that responds with the given status code and body, and
+// sends the bodies of requests authenticated with the test key to the returned channel
+func newMetricsServer(t *testing.T, statusCode int, response string) (*httptest.Server, chan string) {
+	bodies := make(chan string, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "Api-Token testkey", req.Header.Get("Authorization"))
+		assert.Equal(t, "text/plain; charset=utf-8", req.Header.Get("Content-Type"))
+		body, err := ioutil.ReadAll(req.Body)
+		assert.NoError(t, err)
+		rw.WriteHeader(statusCode)
+		rw.Write([]byte(response))
+		bodies <- string(body)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, bodies
+}
+
+// newTestMetricsOutput builds and starts a DynatraceMetricsOutput that sends to the given URL
+func newTestMetricsOutput(t *testing.T, uri string, cfgMod func(*DynatraceMetricsOutputConfig)) *DynatraceMetricsOutput {
+	cfg := NewDynatraceMetricsOutputConfig("test")
+	cfg.BufferConfig = buffer.Config{
+		Builder: func() buffer.Builder {
+			cfg := buffer.NewMemoryBufferConfig()
+			cfg.MaxChunkDelay = helper.NewDuration(10 * time.Millisecond)
+			return cfg
+		}(),
+	}
+	cfg.BaseURI = uri
+	cfg.APIKey = "testkey"
+	cfg.MetricKey = "http.requests"
+	// Tests flush with flushMetrics, so that entries are never split between flushes
+	cfg.FlushInterval = helper.NewDuration(time.Hour)
+	if cfgMod != nil {
+		cfgMod(cfg)
+	}
+
+	ops, err := cfg.Build(testutil.NewBuildContext(t))
+	require.NoError(t, err)
+	op := ops[0].(*DynatraceMetricsOutput)
+	op.now = func() time.Time { return time.Date(2016, 10, 10, 8, 58, 52, 0, time.UTC) }
+	require.NoError(t, op.Start())
+	t.Cleanup(func() { op.Stop() })
+	return op
+}
+
+// flushMetrics waits until the given number of entries was aggregated or skipped, and flushes them
+func flushMetrics(t *testing.T, op *DynatraceMetricsOutput, entries int) {
+	require.Eventually(t, func() bool {
+		op.aggregator.mutex.Lock()
+		defer op.aggregator.mutex.Unlock()
+
+		total := atomic.LoadUint64(&op.skippedEntries)
+		for _, s := range op.aggregator.series {
+			total += s.count
+		}
+		return total == uint64(entries)
+	}, 5*time.Second, 10*time.Millisecond)
+	op.flush()
+}
+
+func expectMetricLines(t *testing.T, bodies chan string, expected ...string) {
+	select {
+	case body := <-bodies:
+		lines := strings.Split(body, "\n")
+		sort.Strings(lines)
+		require.Equal(t, expected, lines)
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "Timed out waiting for request")
+	}
+}
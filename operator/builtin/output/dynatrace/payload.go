@@ -1,74 +1,182 @@
 package dynatrace
 
 import (
-	"github.com/observiq/stanza/entry"
+	"encoding/json"
+	"fmt"
+	"math"
 	"strconv"
+	"time"
+
+	"github.com/observiq/stanza/entry"
 )
 
-// LogPayloadFromEntries creates a new []*LogPayload from an array of entries
-func LogPayloadFromEntries(entries []*entry.Entry, messageField entry.Field,clusterid string) []map[string]string {
-	logs := make([]map[string]string, 0, len(entries))
-	for _, entry := range entries {
-		logs = append(logs, LogMessageFromEntry(entry, messageField, clusterid))
-	}
+const (
+	contentKey   = "content"
+	timestampKey = "timestamp"
+	severityKey  = "severity"
+	clusterIDKey = "dt.kubernetes.cluster.id"
+)
 
+// LogPayload represents a single payload delivered to the Dynatrace Log Ingest API
+type LogPayload []LogMessage
 
+// LogMessage represents a single log entry that will be marshalled
+// in the format expected by the Dynatrace Log Ingest API. Values are kept
+// typed so that numbers and booleans are sent as JSON numbers and booleans.
+type LogMessage map[string]interface{}
+
+// payloadBuilder converts entries into Dynatrace log messages
+type payloadBuilder struct {
+	messageField     entry.Field
+	clusterID        string
+	flattenNested    bool
+	flattenSeparator string
+	attributes       *attributeMapper
+	severity         *severityMapper
+}
 
+// LogPayloadFromEntries creates a new LogPayload from an array of entries
+func (p *payloadBuilder) LogPayloadFromEntries(entries []*entry.Entry) LogPayload {
+	logs := make(LogPayload, 0, len(entries))
+	for _, entry := range entries {
+		logs = append(logs, p.LogMessageFromEntry(entry))
+	}
 	return logs
 }
 
-// LogPayload represents a single payload delivered to the New Relic Log API
-type LogPayload []struct {
-	Logs   []*LogMessage
-}
+// LogMessageFromEntry creates a new LogMessage from a given entry.Entry.
+//
+// The value found at the message field becomes the content of the message. If the
+// message field points inside a map record, the remaining record fields are kept
+// as typed attributes.
+func (p *payloadBuilder) LogMessageFromEntry(e *entry.Entry) LogMessage {
+	logMessage := make(LogMessage)
+
+	if rec, ok := p.remainingRecord(e); ok {
+		for key, value := range rec {
+			p.addAttribute(logMessage, key, value)
+		}
+	}
+
+	p.attributes.apply(e, logMessage)
 
+	if p.clusterID != "" {
+		logMessage[clusterIDKey] = p.clusterID
+	}
+
+	if value, ok := e.Get(p.messageField); ok {
+		logMessage[contentKey] = contentString(value)
+	}
+	logMessage[timestampKey] = strconv.FormatInt(e.Timestamp.UnixNano()/1000/1000, 10)
+	p.severity.apply(e, logMessage)
 
+	return logMessage
+}
 
-// LogMessageFromEntry creates a new LogMessage from a given entry.Entry
-func LogMessageFromEntry(entry *entry.Entry, messageField entry.Field, clusterid string) map[string]string {
-	logMessage :=make(map[string]string)
+// remainingRecord returns the record fields that are not promoted to the content
+// of the message. It returns false if the record does not have any remaining fields.
+func (p *payloadBuilder) remainingRecord(e *entry.Entry) (map[string]interface{}, bool) {
+	recordField, ok := p.messageField.FieldInterface.(entry.RecordField)
+	if !ok {
+		rec, ok := e.Record.(map[string]interface{})
+		return rec, ok
+	}
 
-    if clusterid != "" {
-        logMessage["dt.kubernetes.cluster.id"]=clusterid
-    }
+	// The whole record is used as the content
+	if len(recordField.Keys) == 0 {
+		return nil, false
+	}
 
-    logMessage["timestamp"] = strconv.FormatInt(entry.Timestamp.UnixNano() / 1000 / 1000,10)
+	rec, ok := e.Record.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	return withoutKeys(rec, recordField.Keys), true
+}
 
-	var message string
-	err := entry.Read(messageField, &message)
-    if err == nil {
-        logMessage["content"] = message
-    } else {
-        if rec, ok := entry.Record.(map[string]interface{}); ok {
-            for key, value:= range rec {
-                logMessage["content"]+=","
-                logMessage["content"]+=key
-                logMessage["content"]+=":"
-                v, ok:=value.(string)
-                if ok {
-                    logMessage["content"]+=v
-                }
+// withoutKeys returns a copy of a record without the value at the nested keys. Only the maps
+// along the keys are copied, so that the other values keep their types and are not modified.
+func withoutKeys(rec map[string]interface{}, keys []string) map[string]interface{} {
+	copied := make(map[string]interface{}, len(rec))
+	for key, value := range rec {
+		copied[key] = value
+	}
 
-            }
-        }
-    }
+	if len(keys) == 1 {
+		delete(copied, keys[0])
+	} else if nested, ok := rec[keys[0]].(map[string]interface{}); ok {
+		copied[keys[0]] = withoutKeys(nested, keys[1:])
+	}
+	return copied
+}
 
-    logMessage["severity"] = entry.Severity.String()
-    for key, value := range entry.Labels  {
-        logMessage[key] = value
-    }
-    for key, value := range entry.Resource {
-        logMessage[key] = value
-    }
+// addAttribute adds a record value to the message, flattening nested maps if configured
+func (p *payloadBuilder) addAttribute(logMessage LogMessage, key string, value interface{}) {
+	nested, ok := value.(map[string]interface{})
+	if !ok || !p.flattenNested {
+		logMessage[key] = attributeValue(value)
+		return
+	}
 
+	for childKey, childValue := range nested {
+		p.addAttribute(logMessage, key+p.flattenSeparator+childKey, childValue)
+	}
+}
 
+// attributeValue converts a record value into a value that keeps its JSON type. NaN and
+// infinite floats cannot be encoded as JSON numbers, so they are sent as strings.
+func attributeValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case nil, string, bool,
+		int, int8, int16, int32, int64,
+		uint, uint8, uint16, uint32, uint64,
+		json.Number:
+		return v
+	case float32:
+		return floatValue(v, float64(v))
+	case float64:
+		return floatValue(v, v)
+	case []byte:
+		return string(v)
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case map[string]interface{}:
+		converted := make(map[string]interface{}, len(v))
+		for key, child := range v {
+			converted[key] = attributeValue(child)
+		}
+		return converted
+	case []interface{}:
+		converted := make([]interface{}, 0, len(v))
+		for _, child := range v {
+			converted = append(converted, attributeValue(child))
+		}
+		return converted
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
 
-	return logMessage
+// floatValue returns a float as it is, or its string form if it is NaN or infinite
+func floatValue(value interface{}, f float64) interface{} {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	}
+	return value
 }
 
-// LogMessage represents a single log entry that will be marshalled
-// in the format expected by the New Relic Log API
-type LogMessage struct {
-	// Milliseconds or seconds since epoch
-	Log map[string]string
+// contentString converts the value found at the message field into the content string
+func contentString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	default:
+		bytes, err := json.Marshal(attributeValue(v))
+		if err != nil {
+			return fmt.Sprintf("%v", v)
+		}
+		return string(bytes)
+	}
 }
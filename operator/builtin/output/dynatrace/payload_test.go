@@ -0,0 +1,247 @@
+package dynatrace
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/observiq/stanza/entry"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogMessageFromEntry(t *testing.T) {
+	ts := time.Date(2016, 10, 10, 8, 58, 52, 0, time.UTC)
+
+	cases := []struct {
+		name     string
+		builder  payloadBuilder
+		input    *entry.Entry
+		expected LogMessage
+	}{
+		{
+			"StringRecord",
+			payloadBuilder{messageField: entry.NewRecordField(), flattenNested: true, flattenSeparator: "."},
+			&entry.Entry{
+				Timestamp: ts,
+				Record:    "test",
+			},
+			LogMessage{
+				"content":   "test",
+				"severity":  "NONE",
+				"timestamp": "1476089932000",
+			},
+		},
+		{
+			"MapRecordAsContent",
+			payloadBuilder{messageField: entry.NewRecordField(), flattenNested: true, flattenSeparator: "."},
+			&entry.Entry{
+				Timestamp: ts,
+				Record: map[string]interface{}{
+					"message": "test",
+					"count":   3,
+				},
+			},
+			LogMessage{
+				"content":   `{"count":3,"message":"test"}`,
+				"severity":  "NONE",
+				"timestamp": "1476089932000",
+			},
+		},
+		{
+			"TypedAttributes",
+			payloadBuilder{messageField: entry.NewRecordField("message"), flattenNested: true, flattenSeparator: "."},
+			&entry.Entry{
+				Timestamp: ts,
+				Record: map[string]interface{}{
+					"message":  "test",
+					"status":   200,
+					"duration": 1.5,
+					"success":  true,
+					"tags":     []interface{}{"a", 1},
+					"raw":      []byte("bytes"),
+				},
+			},
+			LogMessage{
+				"content":   "test",
+				"status":    200,
+				"duration":  1.5,
+				"success":   true,
+				"tags":      []interface{}{"a", 1},
+				"raw":       "bytes",
+				"severity":  "NONE",
+				"timestamp": "1476089932000",
+			},
+		},
+		{
+			"FlattenNested",
+			payloadBuilder{messageField: entry.NewRecordField("message"), flattenNested: true, flattenSeparator: "."},
+			&entry.Entry{
+				Timestamp: ts,
+				Record: map[string]interface{}{
+					"message": "test",
+					"http": map[string]interface{}{
+						"status": 404,
+						"request": map[string]interface{}{
+							"method": "GET",
+						},
+					},
+				},
+			},
+			LogMessage{
+				"content":             "test",
+				"http.status":         404,
+				"http.request.method": "GET",
+				"severity":            "NONE",
+				"timestamp":           "1476089932000",
+			},
+		},
+		{
+			"FlattenCustomSeparator",
+			payloadBuilder{messageField: entry.NewRecordField("message"), flattenNested: true, flattenSeparator: "_"},
+			&entry.Entry{
+				Timestamp: ts,
+				Record: map[string]interface{}{
+					"message": "test",
+					"http": map[string]interface{}{
+						"status": 404,
+					},
+				},
+			},
+			LogMessage{
+				"content":     "test",
+				"http_status": 404,
+				"severity":    "NONE",
+				"timestamp":   "1476089932000",
+			},
+		},
+		{
+			"NoFlatten",
+			payloadBuilder{messageField: entry.NewRecordField("message"), flattenNested: false, flattenSeparator: "."},
+			&entry.Entry{
+				Timestamp: ts,
+				Record: map[string]interface{}{
+					"message": "test",
+					"http": map[string]interface{}{
+						"status": 404,
+					},
+				},
+			},
+			LogMessage{
+				"content": "test",
+				"http": map[string]interface{}{
+					"status": 404,
+				},
+				"severity":  "NONE",
+				"timestamp": "1476089932000",
+			},
+		},
+		{
+			"NestedMessageField",
+			payloadBuilder{messageField: entry.NewRecordField("log", "message"), flattenNested: true, flattenSeparator: "."},
+			&entry.Entry{
+				Timestamp: ts,
+				Record: map[string]interface{}{
+					"log": map[string]interface{}{
+						"message": "test",
+						"file":    "app.log",
+					},
+				},
+			},
+			LogMessage{
+				"content":   "test",
+				"log.file":  "app.log",
+				"severity":  "NONE",
+				"timestamp": "1476089932000",
+			},
+		},
+		{
+			"MissingMessageField",
+			payloadBuilder{messageField: entry.NewRecordField("message"), flattenNested: true, flattenSeparator: "."},
+			&entry.Entry{
+				Timestamp: ts,
+				Record: map[string]interface{}{
+					"other": "value",
+				},
+			},
+			LogMessage{
+				"other":     "value",
+				"severity":  "NONE",
+				"timestamp": "1476089932000",
+			},
+		},
+		{
+			"LabelsResourceAndClusterID",
+			payloadBuilder{messageField: entry.NewRecordField(), clusterID: "cluster", flattenNested: true, flattenSeparator: "."},
+			&entry.Entry{
+				Timestamp: ts,
+				Severity:  entry.Error,
+				Labels:    map[string]string{"label": "value"},
+				Resource:  map[string]string{"resource": "value"},
+				Record:    "test",
+			},
+			LogMessage{
+				"content":                  "test",
+				"label":                    "value",
+				"resource":                 "value",
+				"dt.kubernetes.cluster.id": "cluster",
+				"severity":                 "ERROR",
+				"timestamp":                "1476089932000",
+			},
+		},
+		{
+			"ReservedKeysNotOverwritten",
+			payloadBuilder{messageField: entry.NewRecordField("message"), flattenNested: true, flattenSeparator: "."},
+			&entry.Entry{
+				Timestamp: ts,
+				Record: map[string]interface{}{
+					"message":   "test",
+					"timestamp": "other",
+					"content":   "other",
+				},
+			},
+			LogMessage{
+				"content":   "test",
+				"severity":  "NONE",
+				"timestamp": "1476089932000",
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			original := tc.input.Copy().Record
+			msg := tc.builder.LogMessageFromEntry(tc.input)
+			require.Equal(t, tc.expected, msg)
+			require.Equal(t, original, tc.input.Record, "record must not be modified")
+		})
+	}
+}
+
+func TestLogMessageFromEntryNonFiniteFloats(t *testing.T) {
+	builder := payloadBuilder{messageField: entry.NewRecordField("message"), flattenNested: true, flattenSeparator: "."}
+	e := &entry.Entry{
+		Timestamp: time.Date(2016, 10, 10, 8, 58, 52, 0, time.UTC),
+		Record: map[string]interface{}{
+			"message": map[string]interface{}{"ratio": math.NaN()},
+			"nan":     math.NaN(),
+			"inf":     math.Inf(1),
+			"neg_inf": float32(math.Inf(-1)),
+			"nested":  map[string]interface{}{"values": []interface{}{math.Inf(1), 1.5}},
+		},
+	}
+
+	msg := builder.LogMessageFromEntry(e)
+	require.Equal(t, LogMessage{
+		"content":       `{"ratio":"NaN"}`,
+		"nan":           "NaN",
+		"inf":           "+Inf",
+		"neg_inf":       "-Inf",
+		"nested.values": []interface{}{"+Inf", 1.5},
+		"severity":      "NONE",
+		"timestamp":     "1476089932000",
+	}, msg)
+
+	_, err := json.Marshal(LogPayload{msg})
+	require.NoError(t, err)
+}
@@ -0,0 +1,140 @@
+package dynatrace
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/observiq/stanza/operator/flusher"
+)
+
+// responseClass describes how a failed request should be handled
+type responseClass int
+
+const (
+	// retryable requests are retried with exponential backoff
+	retryable responseClass = iota
+
+	// permanent requests will never succeed and are dropped
+	permanent
+
+	// tooLarge requests are split into smaller requests
+	tooLarge
+)
+
+// statusError is returned when Dynatrace responds with a status code that is not successful
+type statusError struct {
+	statusCode int
+	status     string
+	body       string
+	retryAfter time.Duration
+}
+
+// Error returns a description of the response
+func (e *statusError) Error() string {
+	if e.body == "" {
+		return fmt.Sprintf("unexpected status code: %s", e.status)
+	}
+	return fmt.Sprintf("unexpected status code: %s: %s", e.status, e.body)
+}
+
+// StatusCode returns the status code of the response
+func (e *statusError) StatusCode() int {
+	return e.statusCode
+}
+
+// class returns how a request that failed with this error should be handled
+func (e *statusError) class() responseClass {
+	switch e.statusCode {
+	case http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+		return permanent
+	case http.StatusRequestEntityTooLarge:
+		return tooLarge
+	default:
+		return retryable
+	}
+}
+
+// retryError returns the error that is handed to the flusher. Responses that
+// carry a Retry-After header ask the flusher to wait the requested duration.
+func (e *statusError) retryError() error {
+	if e.retryAfter > 0 {
+		return flusher.NewRetryAfterError(e, e.retryAfter)
+	}
+	return e
+}
+
+// newStatusError creates a statusError from a response and its body
+func newStatusError(res *http.Response, body []byte) *statusError {
+	err := &statusError{
+		statusCode: res.StatusCode,
+		status:     res.Status,
+		body:       string(body),
+	}
+
+	switch res.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		if after, ok := parseRetryAfter(res.Header.Get("Retry-After"), time.Now()); ok {
+			err.retryAfter = after
+		}
+	}
+
+	return err
+}
+
+// parseRetryAfter parses the value of a Retry-After header, which is either
+// a number of seconds or an HTTP date
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+
+	after := date.Sub(now)
+	if after < 0 {
+		return 0, true
+	}
+	return after, true
+}
+
+// partialSuccess is the body of a 200 response, which Dynatrace returns when
+// only some of the logs in a request were ingested
+type partialSuccess struct {
+	Error *struct {
+		Code    int             `json:"code"`
+		Message string          `json:"message"`
+		Details json.RawMessage `json:"details,omitempty"`
+	} `json:"error"`
+}
+
+// parsePartialSuccess returns a description of the rejected logs reported in
+// the body of a 200 response. It returns false if the body does not report
+// rejected logs.
+func parsePartialSuccess(body []byte) (string, bool) {
+	if len(body) == 0 {
+		return "", false
+	}
+
+	var res partialSuccess
+	if err := json.Unmarshal(body, &res); err != nil || res.Error == nil {
+		return "", false
+	}
+
+	if len(res.Error.Details) == 0 {
+		return res.Error.Message, true
+	}
+	return fmt.Sprintf("%s: %s", res.Error.Message, string(res.Error.Details)), true
+}
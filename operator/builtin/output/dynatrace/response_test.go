@@ -0,0 +1,124 @@
+package dynatrace
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/observiq/stanza/operator/flusher"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatusErrorClass(t *testing.T) {
+	cases := []struct {
+		statusCode int
+		expected   responseClass
+	}{
+		{http.StatusBadRequest, permanent},
+		{http.StatusUnauthorized, permanent},
+		{http.StatusForbidden, permanent},
+		{http.StatusNotFound, permanent},
+		{http.StatusRequestEntityTooLarge, tooLarge},
+		{http.StatusTooManyRequests, retryable},
+		{http.StatusInternalServerError, retryable},
+		{http.StatusBadGateway, retryable},
+		{http.StatusServiceUnavailable, retryable},
+	}
+
+	for _, tc := range cases {
+		t.Run(http.StatusText(tc.statusCode), func(t *testing.T) {
+			err := &statusError{statusCode: tc.statusCode}
+			require.Equal(t, tc.expected, err.class())
+		})
+	}
+}
+
+func TestNewStatusError(t *testing.T) {
+	t.Run("RetryAfter", func(t *testing.T) {
+		for _, statusCode := range []int{http.StatusTooManyRequests, http.StatusServiceUnavailable} {
+			res := &http.Response{
+				StatusCode: statusCode,
+				Status:     http.StatusText(statusCode),
+				Header:     http.Header{"Retry-After": []string{"3"}},
+			}
+			err := newStatusError(res, []byte("slow down"))
+			require.Equal(t, 3*time.Second, err.retryAfter)
+
+			var retryAfter *flusher.RetryAfterError
+			require.True(t, errors.As(err.retryError(), &retryAfter))
+			require.Equal(t, 3*time.Second, retryAfter.After)
+		}
+	})
+
+	t.Run("RetryAfterIgnoredForOtherStatus", func(t *testing.T) {
+		res := &http.Response{
+			StatusCode: http.StatusInternalServerError,
+			Status:     "500 Internal Server Error",
+			Header:     http.Header{"Retry-After": []string{"3"}},
+		}
+		err := newStatusError(res, nil)
+		require.Equal(t, time.Duration(0), err.retryAfter)
+		require.Equal(t, err, err.retryError())
+		require.Equal(t, "unexpected status code: 500 Internal Server Error", err.Error())
+	})
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2021, 11, 12, 10, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		name       string
+		value      string
+		expected   time.Duration
+		expectedOk bool
+	}{
+		{"Empty", "", 0, false},
+		{"Seconds", "120", 2 * time.Minute, true},
+		{"NegativeSeconds", "-1", 0, false},
+		{"Date", "Fri, 12 Nov 2021 10:00:30 GMT", 30 * time.Second, true},
+		{"PastDate", "Fri, 12 Nov 2021 09:00:00 GMT", 0, true},
+		{"Invalid", "soon", 0, false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			after, ok := parseRetryAfter(tc.value, now)
+			require.Equal(t, tc.expectedOk, ok)
+			require.Equal(t, tc.expected, after)
+		})
+	}
+}
+
+func TestParsePartialSuccess(t *testing.T) {
+	cases := []struct {
+		name       string
+		body       string
+		expected   string
+		expectedOk bool
+	}{
+		{"Empty", "", "", false},
+		{"NotJSON", "ok", "", false},
+		{"NoError", "{}", "", false},
+		{
+			"Message",
+			`{"error":{"code":200,"message":"1 events were not ingested because of invalid content"}}`,
+			"1 events were not ingested because of invalid content",
+			true,
+		},
+		{
+			"Details",
+			`{"error":{"code":200,"message":"1 events were not ingested","details":{"invalidEventIndexes":[2]}}}`,
+			`1 events were not ingested: {"invalidEventIndexes":[2]}`,
+			true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			reason, ok := parsePartialSuccess([]byte(tc.body))
+			require.Equal(t, tc.expectedOk, ok)
+			require.Equal(t, tc.expected, reason)
+		})
+	}
+}
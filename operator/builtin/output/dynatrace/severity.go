@@ -0,0 +1,160 @@
+package dynatrace
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/observiq/stanza/entry"
+)
+
+// Dynatrace log levels
+const (
+	levelNone      = "NONE"
+	levelTrace     = "TRACE"
+	levelDebug     = "DEBUG"
+	levelInfo      = "INFO"
+	levelNotice    = "NOTICE"
+	levelWarn      = "WARN"
+	levelError     = "ERROR"
+	levelCritical  = "CRITICAL"
+	levelAlert     = "ALERT"
+	levelEmergency = "EMERGENCY"
+)
+
+const defaultSeverityTextAttribute = "severity_text"
+
+// defaultSeverityRules map each range of stanza severities to a Dynatrace log level
+var defaultSeverityRules = []severityRule{
+	{level: levelNone, hasRange: true, min: entry.Default, max: entry.Default},
+	{level: levelTrace, hasRange: true, min: entry.Default + 1, max: entry.Debug - 1},
+	{level: levelDebug, hasRange: true, min: entry.Debug, max: entry.Info - 1},
+	{level: levelInfo, hasRange: true, min: entry.Info, max: entry.Notice - 1},
+	{level: levelNotice, hasRange: true, min: entry.Notice, max: entry.Warning - 1},
+	{level: levelWarn, hasRange: true, min: entry.Warning, max: entry.Error - 1},
+	{level: levelError, hasRange: true, min: entry.Error, max: entry.Critical - 1},
+	{level: levelCritical, hasRange: true, min: entry.Critical, max: entry.Alert - 1},
+	{level: levelAlert, hasRange: true, min: entry.Alert, max: entry.Emergency - 1},
+	{level: levelEmergency, hasRange: true, min: entry.Emergency, max: entry.Catastrophe},
+}
+
+// SeverityRule maps a range of severities or severity texts to a Dynatrace log level
+type SeverityRule struct {
+	Level string   `json:"level"          yaml:"level"`
+	Min   *int     `json:"min,omitempty"  yaml:"min,omitempty"`
+	Max   *int     `json:"max,omitempty"  yaml:"max,omitempty"`
+	Text  []string `json:"text,omitempty" yaml:"text,omitempty"`
+}
+
+// SeverityConfig is the configuration of how severities are mapped to Dynatrace log levels
+type SeverityConfig struct {
+	// Mapping is applied before the default mapping, so it can override it
+	Mapping []SeverityRule `json:"mapping,omitempty" yaml:"mapping,omitempty"`
+
+	// TextAttribute is the attribute that preserves the severity text when it differs from the log level
+	TextAttribute string `json:"text_attribute" yaml:"text_attribute"`
+}
+
+// NewSeverityConfig creates a new severity config with default values
+func NewSeverityConfig() SeverityConfig {
+	return SeverityConfig{
+		TextAttribute: defaultSeverityTextAttribute,
+	}
+}
+
+// Build creates a severity mapper from the configuration
+func (c SeverityConfig) Build() (*severityMapper, error) {
+	rules := make([]severityRule, 0, len(c.Mapping)+len(defaultSeverityRules))
+	for i, r := range c.Mapping {
+		rule, err := r.build()
+		if err != nil {
+			return nil, fmt.Errorf("mapping %d: %s", i, err)
+		}
+		rules = append(rules, rule)
+	}
+
+	return &severityMapper{
+		rules:         append(rules, defaultSeverityRules...),
+		textAttribute: c.TextAttribute,
+	}, nil
+}
+
+func (r SeverityRule) build() (severityRule, error) {
+	if strings.TrimSpace(r.Level) == "" {
+		return severityRule{}, fmt.Errorf("'level' cannot be empty")
+	}
+
+	if (r.Min == nil) != (r.Max == nil) {
+		return severityRule{}, fmt.Errorf("'min' and 'max' must be set together")
+	}
+
+	if r.Min == nil && len(r.Text) == 0 {
+		return severityRule{}, fmt.Errorf("one of 'min' and 'max' or 'text' is required")
+	}
+
+	rule := severityRule{
+		level:    r.Level,
+		hasRange: r.Min != nil,
+	}
+
+	if rule.hasRange {
+		if *r.Min > *r.Max {
+			return severityRule{}, fmt.Errorf("'min' cannot be greater than 'max'")
+		}
+		rule.min, rule.max = entry.Severity(*r.Min), entry.Severity(*r.Max)
+	}
+
+	if len(r.Text) > 0 {
+		rule.text = make(map[string]bool, len(r.Text))
+		for _, text := range r.Text {
+			rule.text[strings.ToLower(text)] = true
+		}
+	}
+
+	return rule, nil
+}
+
+// severityRule matches a range of severities or any of a set of lower case severity texts
+type severityRule struct {
+	level    string
+	hasRange bool
+	min      entry.Severity
+	max      entry.Severity
+	text     map[string]bool
+}
+
+// matches returns true if the severity or severity text of the entry matches the rule
+func (r severityRule) matches(e *entry.Entry) bool {
+	if r.text[strings.ToLower(e.SeverityText)] {
+		return true
+	}
+	return r.hasRange && e.Severity >= r.min && e.Severity <= r.max
+}
+
+// severityMapper maps the severity of entries to Dynatrace log levels
+type severityMapper struct {
+	rules         []severityRule
+	textAttribute string
+}
+
+// apply sets the log level of the message from the first rule that matches the
+// entry. The severity text is kept as an attribute if it differs from the log level.
+// A nil mapper uses the default rules.
+func (m *severityMapper) apply(e *entry.Entry, logMessage LogMessage) {
+	rules, textAttribute := defaultSeverityRules, defaultSeverityTextAttribute
+	if m != nil {
+		rules, textAttribute = m.rules, m.textAttribute
+	}
+
+	level := levelNone
+	for _, rule := range rules {
+		if rule.matches(e) {
+			level = rule.level
+			break
+		}
+	}
+	logMessage[severityKey] = level
+
+	if textAttribute != "" && e.SeverityText != "" && !strings.EqualFold(e.SeverityText, level) {
+		logMessage[textAttribute] = e.SeverityText
+	}
+}
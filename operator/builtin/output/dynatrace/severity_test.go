@@ -0,0 +1,164 @@
+package dynatrace
+
+import (
+	"testing"
+
+	"github.com/observiq/stanza/entry"
+	"github.com/stretchr/testify/require"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestSeverityConfigBuild(t *testing.T) {
+	intPtr := func(i int) *int { return &i }
+
+	cases := []struct {
+		name        string
+		rule        SeverityRule
+		expectedErr string
+	}{
+		{
+			"Range",
+			SeverityRule{Level: "SEVERE", Min: intPtr(62), Max: intPtr(69)},
+			"",
+		},
+		{
+			"Text",
+			SeverityRule{Level: "ERROR", Text: []string{"oops"}},
+			"",
+		},
+		{
+			"MissingLevel",
+			SeverityRule{Text: []string{"oops"}},
+			"mapping 0: 'level' cannot be empty",
+		},
+		{
+			"MissingMax",
+			SeverityRule{Level: "ERROR", Min: intPtr(60)},
+			"mapping 0: 'min' and 'max' must be set together",
+		},
+		{
+			"NothingToMatch",
+			SeverityRule{Level: "ERROR"},
+			"mapping 0: one of 'min' and 'max' or 'text' is required",
+		},
+		{
+			"InvertedRange",
+			SeverityRule{Level: "ERROR", Min: intPtr(69), Max: intPtr(60)},
+			"mapping 0: 'min' cannot be greater than 'max'",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := NewSeverityConfig()
+			cfg.Mapping = []SeverityRule{tc.rule}
+
+			_, err := cfg.Build()
+			if tc.expectedErr == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			require.Equal(t, tc.expectedErr, err.Error())
+		})
+	}
+}
+
+func TestSeverityMapperDefaults(t *testing.T) {
+	cases := []struct {
+		severity entry.Severity
+		expected string
+	}{
+		{entry.Default, levelNone},
+		{entry.Trace, levelTrace},
+		{entry.Trace4, levelTrace},
+		{entry.Debug, levelDebug},
+		{entry.Debug2, levelDebug},
+		{entry.Info, levelInfo},
+		{35, levelInfo},
+		{entry.Notice, levelNotice},
+		{entry.Warning, levelWarn},
+		{entry.Warning3, levelWarn},
+		{entry.Error, levelError},
+		{entry.Error2, levelError},
+		{entry.Critical, levelCritical},
+		{entry.Alert, levelAlert},
+		{entry.Emergency, levelEmergency},
+		{entry.Emergency4, levelEmergency},
+		{entry.Catastrophe, levelEmergency},
+		{101, levelNone},
+	}
+
+	mapper, err := NewSeverityConfig().Build()
+	require.NoError(t, err)
+
+	for _, tc := range cases {
+		t.Run(tc.severity.String(), func(t *testing.T) {
+			msg := make(LogMessage)
+			mapper.apply(&entry.Entry{Severity: tc.severity}, msg)
+			require.Equal(t, LogMessage{severityKey: tc.expected}, msg)
+		})
+	}
+}
+
+func TestSeverityMapper(t *testing.T) {
+	raw := `
+mapping:
+  - level: SEVERE
+    min: 62
+    max: 69
+  - level: WARN
+    text: [Degraded]
+text_attribute: level_text
+`
+	cfg := NewSeverityConfig()
+	require.NoError(t, yaml.UnmarshalStrict([]byte(raw), &cfg))
+	mapper, err := cfg.Build()
+	require.NoError(t, err)
+
+	cases := []struct {
+		name     string
+		entry    *entry.Entry
+		expected LogMessage
+	}{
+		{
+			"CustomRange",
+			&entry.Entry{Severity: entry.Error2, SeverityText: "E2"},
+			LogMessage{severityKey: "SEVERE", "level_text": "E2"},
+		},
+		{
+			"DefaultRange",
+			&entry.Entry{Severity: entry.Error, SeverityText: "error"},
+			LogMessage{severityKey: levelError},
+		},
+		{
+			"Text",
+			&entry.Entry{Severity: entry.Info, SeverityText: "degraded"},
+			LogMessage{severityKey: levelWarn, "level_text": "degraded"},
+		},
+		{
+			"NoText",
+			&entry.Entry{Severity: entry.Info},
+			LogMessage{severityKey: levelInfo},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			msg := make(LogMessage)
+			mapper.apply(tc.entry, msg)
+			require.Equal(t, tc.expected, msg)
+		})
+	}
+
+	t.Run("TextAttributeDisabled", func(t *testing.T) {
+		cfg := NewSeverityConfig()
+		cfg.TextAttribute = ""
+		mapper, err := cfg.Build()
+		require.NoError(t, err)
+
+		msg := make(LogMessage)
+		mapper.apply(&entry.Entry{Severity: entry.Error2, SeverityText: "E2"}, msg)
+		require.Equal(t, LogMessage{severityKey: levelError}, msg)
+	})
+}
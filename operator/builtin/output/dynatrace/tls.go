@@ -0,0 +1,81 @@
+package dynatrace
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// TLSConfig is the configuration of the TLS connection to Dynatrace
+type TLSConfig struct {
+	// InsecureSkipVerify disables the verification of the server certificate
+	InsecureSkipVerify bool `json:"insecure_skip_verify,omitempty" yaml:"insecure_skip_verify,omitempty"`
+
+	// CAFile is the file path for a CA bundle used to verify the server certificate.
+	// The system roots are used if it is not set.
+	CAFile string `json:"ca_file,omitempty" yaml:"ca_file,omitempty"`
+
+	// Certificate is the file path for the client certificate used for mutual TLS
+	Certificate string `json:"certificate,omitempty" yaml:"certificate,omitempty"`
+
+	// PrivateKey is the file path for the private key of the client certificate
+	PrivateKey string `json:"private_key,omitempty" yaml:"private_key,omitempty"`
+
+	// ServerName overrides the name used to verify the server certificate
+	ServerName string `json:"server_name,omitempty" yaml:"server_name,omitempty"`
+
+	// MinVersion is the minimum tls version
+	MinVersion float32 `json:"min_version,omitempty" yaml:"min_version,omitempty"`
+}
+
+// Build creates a tls.Config from the configuration
+func (c TLSConfig) Build() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: c.InsecureSkipVerify,
+		ServerName:         c.ServerName,
+	}
+
+	switch c.MinVersion {
+	case 0, 1.2:
+		tlsConfig.MinVersion = tls.VersionTLS12
+	case 1.0:
+		tlsConfig.MinVersion = tls.VersionTLS10
+	case 1.1:
+		tlsConfig.MinVersion = tls.VersionTLS11
+	case 1.3:
+		tlsConfig.MinVersion = tls.VersionTLS13
+	default:
+		return nil, fmt.Errorf("unsupported tls version: %f", c.MinVersion)
+	}
+
+	if c.CAFile != "" {
+		ca, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ca_file: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("failed to parse any certificates from ca_file %s", c.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if c.Certificate != "" || c.PrivateKey != "" {
+		if c.Certificate == "" {
+			return nil, fmt.Errorf("missing required parameter 'certificate', required when 'private_key' is set")
+		}
+		if c.PrivateKey == "" {
+			return nil, fmt.Errorf("missing required parameter 'private_key', required when 'certificate' is set")
+		}
+
+		cert, err := tls.LoadX509KeyPair(c.Certificate, c.PrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load tls certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
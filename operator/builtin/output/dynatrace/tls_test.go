@@ -0,0 +1,64 @@
+package dynatrace
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/observiq/stanza/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTLSConfigBuild(t *testing.T) {
+	t.Run("Default", func(t *testing.T) {
+		cfg, err := TLSConfig{}.Build()
+		require.NoError(t, err)
+		require.False(t, cfg.InsecureSkipVerify)
+		require.Equal(t, uint16(tls.VersionTLS12), cfg.MinVersion)
+		require.Nil(t, cfg.RootCAs)
+		require.Empty(t, cfg.Certificates)
+	})
+
+	t.Run("MinVersion", func(t *testing.T) {
+		cfg, err := TLSConfig{MinVersion: 1.3}.Build()
+		require.NoError(t, err)
+		require.Equal(t, uint16(tls.VersionTLS13), cfg.MinVersion)
+	})
+
+	t.Run("InvalidMinVersion", func(t *testing.T) {
+		_, err := TLSConfig{MinVersion: 1.5}.Build()
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "unsupported tls version")
+	})
+
+	t.Run("ServerName", func(t *testing.T) {
+		cfg, err := TLSConfig{ServerName: "activegate.example.com"}.Build()
+		require.NoError(t, err)
+		require.Equal(t, "activegate.example.com", cfg.ServerName)
+	})
+
+	t.Run("MissingCAFile", func(t *testing.T) {
+		_, err := TLSConfig{CAFile: filepath.Join(testutil.NewTempDir(t), "missing")}.Build()
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "failed to read ca_file")
+	})
+
+	t.Run("InvalidCAFile", func(t *testing.T) {
+		path := filepath.Join(testutil.NewTempDir(t), "ca.pem")
+		require.NoError(t, ioutil.WriteFile(path, []byte("not a certificate"), 0600))
+		_, err := TLSConfig{CAFile: path}.Build()
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "failed to parse any certificates")
+	})
+
+	t.Run("CertificateWithoutKey", func(t *testing.T) {
+		_, err := TLSConfig{Certificate: "cert.pem"}.Build()
+		require.EqualError(t, err, "missing required parameter 'private_key', required when 'certificate' is set")
+	})
+
+	t.Run("KeyWithoutCertificate", func(t *testing.T) {
+		_, err := TLSConfig{PrivateKey: "key.pem"}.Build()
+		require.EqualError(t, err, "missing required parameter 'certificate', required when 'private_key' is set")
+	})
+}
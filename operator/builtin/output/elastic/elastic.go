@@ -47,6 +47,11 @@ type ElasticOutputConfig struct {
 	IDField    *entry.Field `json:"id_field,omitempty"    yaml:"id_field,omitempty"`
 }
 
+// Buffer returns the config of the buffer of the output
+func (c ElasticOutputConfig) Buffer() buffer.Config {
+	return c.BufferConfig
+}
+
 // Build will build an elasticsearch output operator.
 func (c ElasticOutputConfig) Build(bc operator.BuildContext) ([]operator.Operator, error) {
 	outputOperator, err := c.OutputConfig.Build(bc)
@@ -76,7 +81,10 @@ func (c ElasticOutputConfig) Build(bc operator.BuildContext) ([]operator.Operato
 		return nil, err
 	}
 
-	flusher := c.FlusherConfig.Build(bc.Logger.SugaredLogger)
+	flusher, err := c.FlusherConfig.Build(bc, outputOperator.ID())
+	if err != nil {
+		return nil, err
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 
@@ -128,6 +136,17 @@ func (e *ElasticOutput) Stop() error {
 	return e.buffer.Close()
 }
 
+// Close releases the buffer of an output that was never started
+func (e *ElasticOutput) Close() error {
+	e.flusher.Stop()
+	return e.buffer.Close()
+}
+
+// Health returns how long the output has been retrying to flush and how full its buffer is
+func (e *ElasticOutput) Health() operator.Health {
+	return e.flusher.Health(e.buffer)
+}
+
 // Process adds an entry to the outputs buffer
 func (e *ElasticOutput) Process(ctx context.Context, entry *entry.Entry) error {
 	return e.buffer.Add(ctx, entry)
@@ -196,7 +215,7 @@ func (e *ElasticOutput) feedFlusher(ctx context.Context) {
 			continue
 		}
 
-		e.flusher.Do(func(ctx context.Context) error {
+		e.flusher.DoChunk(entries, clearer, func(ctx context.Context) error {
 			req := e.createRequest(entries)
 			res, err := req.Do(ctx, e.client)
 			if err != nil {
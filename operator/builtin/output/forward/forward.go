@@ -24,18 +24,25 @@ func init() {
 // NewForwardOutputConfig creates a new forward output config with default values
 func NewForwardOutputConfig(operatorID string) *ForwardOutputConfig {
 	return &ForwardOutputConfig{
-		OutputConfig:  helper.NewOutputConfig(operatorID, "forward_output"),
-		BufferConfig:  buffer.NewConfig(),
-		FlusherConfig: flusher.NewConfig(),
+		OutputConfig:      helper.NewOutputConfig(operatorID, "forward_output"),
+		BufferConfig:      buffer.NewConfig(),
+		FlusherConfig:     flusher.NewConfig(),
+		CompressionConfig: helper.NewCompressionConfig(helper.CompressionNone),
 	}
 }
 
 // ForwardOutputConfig is the configuration of a forward output operator.
 type ForwardOutputConfig struct {
-	helper.OutputConfig `yaml:",inline"`
-	BufferConfig        buffer.Config  `json:"buffer"  yaml:"buffer"`
-	FlusherConfig       flusher.Config `json:"flusher" yaml:"flusher"`
-	Address             string         `json:"address" yaml:"address"`
+	helper.OutputConfig      `yaml:",inline"`
+	helper.CompressionConfig `yaml:",inline"`
+	BufferConfig             buffer.Config  `json:"buffer"  yaml:"buffer"`
+	FlusherConfig            flusher.Config `json:"flusher" yaml:"flusher"`
+	Address                  string         `json:"address" yaml:"address"`
+}
+
+// Buffer returns the config of the buffer of the output
+func (c ForwardOutputConfig) Buffer() buffer.Config {
+	return c.BufferConfig
 }
 
 // Build will build an forward output operator.
@@ -54,7 +61,15 @@ func (c ForwardOutputConfig) Build(bc operator.BuildContext) ([]operator.Operato
 		return nil, errors.NewError("missing required parameter 'address'", "")
 	}
 
-	flusher := c.FlusherConfig.Build(bc.Logger.SugaredLogger)
+	compressor, err := c.CompressionConfig.Build()
+	if err != nil {
+		return nil, err
+	}
+
+	flusher, err := c.FlusherConfig.Build(bc, outputOperator.ID())
+	if err != nil {
+		return nil, err
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 
@@ -66,6 +81,7 @@ func (c ForwardOutputConfig) Build(bc operator.BuildContext) ([]operator.Operato
 		cancel:         cancel,
 		client:         &http.Client{},
 		address:        c.Address,
+		compressor:     compressor,
 	}
 
 	return []operator.Operator{forwardOutput}, nil
@@ -77,8 +93,9 @@ type ForwardOutput struct {
 	buffer  buffer.Buffer
 	flusher *flusher.Flusher
 
-	client  *http.Client
-	address string
+	client     *http.Client
+	address    string
+	compressor *helper.Compressor
 
 	ctx    context.Context
 	cancel context.CancelFunc
@@ -104,6 +121,17 @@ func (f *ForwardOutput) Stop() error {
 	return f.buffer.Close()
 }
 
+// Close releases the buffer of an output that was never started
+func (f *ForwardOutput) Close() error {
+	f.flusher.Stop()
+	return f.buffer.Close()
+}
+
+// Health returns how long the output has been retrying to flush and how full its buffer is
+func (f *ForwardOutput) Health() operator.Health {
+	return f.flusher.Health(f.buffer)
+}
+
 // Process adds an entry to the outputs buffer
 func (f *ForwardOutput) Process(ctx context.Context, entry *entry.Entry) error {
 	return f.buffer.Add(ctx, entry)
@@ -112,13 +140,28 @@ func (f *ForwardOutput) Process(ctx context.Context, entry *entry.Entry) error {
 // ProcessMulti will send entries to elasticsearch.
 func (f *ForwardOutput) createRequest(ctx context.Context, entries []*entry.Entry) (*http.Request, error) {
 	var b bytes.Buffer
-	enc := json.NewEncoder(&b)
-	err := enc.Encode(entries)
+	wr, err := f.compressor.NewWriter(&b)
+	if err != nil {
+		return nil, err
+	}
+
+	enc := json.NewEncoder(wr)
+	if err := enc.Encode(entries); err != nil {
+		return nil, err
+	}
+	if err := wr.Close(); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", f.address, &b)
 	if err != nil {
 		return nil, err
 	}
+	if encoding := f.compressor.ContentEncoding(); encoding != "" {
+		req.Header.Set("Content-Encoding", encoding)
+	}
 
-	return http.NewRequestWithContext(ctx, "POST", f.address, &b)
+	return req, nil
 }
 
 func (f *ForwardOutput) feedFlusher(ctx context.Context) {
@@ -131,7 +174,7 @@ func (f *ForwardOutput) feedFlusher(ctx context.Context) {
 			continue
 		}
 
-		f.flusher.Do(func(ctx context.Context) error {
+		f.flusher.DoChunk(entries, clearer, func(ctx context.Context) error {
 			req, err := f.createRequest(ctx, entries)
 			if err != nil {
 				f.Errorf("Failed to create request", zap.Error(err))
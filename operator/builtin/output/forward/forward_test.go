@@ -58,3 +58,58 @@ func TestForwardOutput(t *testing.T) {
 		require.Equal(t, newEntry.Resource, e.Resource)
 	}
 }
+
+func TestForwardOutputCompression(t *testing.T) {
+	for _, compression := range []string{"gzip", "deflate"} {
+		t.Run(compression, func(t *testing.T) {
+			received := make(chan []byte, 1)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				require.Equal(t, compression, req.Header.Get("Content-Encoding"))
+				rd, err := helper.NewDecompressingReader(req.Header.Get("Content-Encoding"), req.Body)
+				require.NoError(t, err)
+				body, _ := ioutil.ReadAll(rd)
+				received <- body
+			}))
+			defer srv.Close()
+
+			cfg := NewForwardOutputConfig("test")
+			memoryCfg := buffer.NewMemoryBufferConfig()
+			memoryCfg.MaxChunkDelay = helper.NewDuration(50 * time.Millisecond)
+			cfg.BufferConfig = buffer.Config{
+				Builder: memoryCfg,
+			}
+			cfg.Address = srv.URL
+			cfg.Compression = compression
+
+			ops, err := cfg.Build(testutil.NewBuildContext(t))
+			require.NoError(t, err)
+			forwardOutput := ops[0].(*ForwardOutput)
+
+			newEntry := entry.New()
+			newEntry.Record = "test"
+			require.NoError(t, forwardOutput.Start())
+			defer forwardOutput.Stop()
+			require.NoError(t, forwardOutput.Process(context.Background(), newEntry))
+
+			select {
+			case <-time.After(time.Second):
+				require.FailNow(t, "Timed out waiting for server to receive entry")
+			case body := <-received:
+				var entries []*entry.Entry
+				require.NoError(t, json.Unmarshal(body, &entries))
+				require.Len(t, entries, 1)
+				require.Equal(t, newEntry.Record, entries[0].Record)
+			}
+		})
+	}
+}
+
+func TestForwardOutputInvalidCompression(t *testing.T) {
+	cfg := NewForwardOutputConfig("test")
+	cfg.Address = "http://localhost"
+	cfg.Compression = "zstd"
+
+	_, err := cfg.Build(testutil.NewBuildContext(t))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "unsupported compression")
+}
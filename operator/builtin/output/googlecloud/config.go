@@ -65,6 +65,11 @@ type GoogleCloudOutputConfig struct {
 	MaxRequestSize      helper.ByteSize `json:"max_request_size"           yaml:"max_request_size"`
 }
 
+// Buffer returns the config of the buffer of the output
+func (c GoogleCloudOutputConfig) Buffer() buffer.Config {
+	return c.BufferConfig
+}
+
 // Build will build a google cloud output operator.
 func (c GoogleCloudOutputConfig) Build(bc operator.BuildContext) ([]operator.Operator, error) {
 	outputOperator, err := c.OutputConfig.Build(bc)
@@ -92,7 +97,10 @@ func (c GoogleCloudOutputConfig) Build(bc operator.BuildContext) ([]operator.Ope
 		return nil, errors.New("failed to get project id from config or credentials")
 	}
 
-	newFlusher := c.FlusherConfig.Build(bc.Logger.SugaredLogger)
+	newFlusher, err := c.FlusherConfig.Build(bc, outputOperator.ID())
+	if err != nil {
+		return nil, fmt.Errorf("failed to build flusher: %w", err)
+	}
 	clientOptions := c.createClientOptions(credentials, c.UseCompression)
 	ctx, cancel := context.WithCancel(context.Background())
 
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/observiq/stanza/entry"
+	"github.com/observiq/stanza/operator"
 	"github.com/observiq/stanza/operator/buffer"
 	"github.com/observiq/stanza/operator/flusher"
 	"github.com/observiq/stanza/operator/helper"
@@ -90,6 +91,17 @@ func (g *GoogleCloudOutput) Stop() error {
 	return nil
 }
 
+// Close releases the buffer of an output that was never started
+func (g *GoogleCloudOutput) Close() error {
+	g.flusher.Stop()
+	return g.buffer.Close()
+}
+
+// Health returns how long the output has been retrying to flush and how full its buffer is
+func (g *GoogleCloudOutput) Health() operator.Health {
+	return g.flusher.Health(g.buffer)
+}
+
 // Process adds an incoming entry to the buffer
 func (g *GoogleCloudOutput) Process(ctx context.Context, e *entry.Entry) error {
 	return g.buffer.Add(ctx, e)
@@ -174,7 +186,7 @@ func (g *GoogleCloudOutput) flushChunk(ctx context.Context) error {
 		return clearer.MarkAllAsFlushed()
 	}
 
-	g.flusher.Do(flushFunc)
+	g.flusher.DoChunk(entries, clearer, flushFunc)
 	g.Debugw("Submitted requests to the flusher", "requests", len(requests))
 
 	return nil
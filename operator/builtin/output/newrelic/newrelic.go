@@ -2,7 +2,6 @@ package newrelic
 
 import (
 	"bytes"
-	"compress/gzip"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -28,20 +27,22 @@ func init() {
 // NewNewRelicOutputConfig creates a new relic output config with default values
 func NewNewRelicOutputConfig(operatorID string) *NewRelicOutputConfig {
 	return &NewRelicOutputConfig{
-		OutputConfig:  helper.NewOutputConfig(operatorID, "newrelic_output"),
-		BufferConfig:  buffer.NewConfig(),
-		FlusherConfig: flusher.NewConfig(),
-		BaseURI:       "https://log-api.newrelic.com/log/v1",
-		Timeout:       helper.NewDuration(10 * time.Second),
-		MessageField:  entry.NewRecordField(),
+		OutputConfig:      helper.NewOutputConfig(operatorID, "newrelic_output"),
+		BufferConfig:      buffer.NewConfig(),
+		FlusherConfig:     flusher.NewConfig(),
+		BaseURI:           "https://log-api.newrelic.com/log/v1",
+		Timeout:           helper.NewDuration(10 * time.Second),
+		MessageField:      entry.NewRecordField(),
+		CompressionConfig: helper.NewCompressionConfig(helper.CompressionGzip),
 	}
 }
 
 // NewRelicOutputConfig is the configuration of a NewRelicOutput operator
 type NewRelicOutputConfig struct {
-	helper.OutputConfig `yaml:",inline"`
-	BufferConfig        buffer.Config  `json:"buffer" yaml:"buffer"`
-	FlusherConfig       flusher.Config `json:"flusher" yaml:"flusher"`
+	helper.OutputConfig      `yaml:",inline"`
+	helper.CompressionConfig `yaml:",inline"`
+	BufferConfig             buffer.Config  `json:"buffer" yaml:"buffer"`
+	FlusherConfig            flusher.Config `json:"flusher" yaml:"flusher"`
 
 	APIKey       string          `json:"api_key,omitempty"       yaml:"api_key,omitempty"`
 	BaseURI      string          `json:"base_uri,omitempty"      yaml:"base_uri,omitempty"`
@@ -50,6 +51,11 @@ type NewRelicOutputConfig struct {
 	MessageField entry.Field     `json:"message_field,omitempty" yaml:"message_field,omitempty"`
 }
 
+// Buffer returns the config of the buffer of the output
+func (c NewRelicOutputConfig) Buffer() buffer.Config {
+	return c.BufferConfig
+}
+
 // Build will build a new NewRelicOutput
 func (c NewRelicOutputConfig) Build(bc operator.BuildContext) ([]operator.Operator, error) {
 	outputOperator, err := c.OutputConfig.Build(bc)
@@ -62,6 +68,14 @@ func (c NewRelicOutputConfig) Build(bc operator.BuildContext) ([]operator.Operat
 		return nil, err
 	}
 
+	compressor, err := c.CompressionConfig.Build()
+	if err != nil {
+		return nil, err
+	}
+	if encoding := compressor.ContentEncoding(); encoding != "" {
+		headers.Set("Content-Encoding", encoding)
+	}
+
 	buffer, err := c.BufferConfig.Build(bc, c.ID())
 	if err != nil {
 		return nil, err
@@ -72,7 +86,10 @@ func (c NewRelicOutputConfig) Build(bc operator.BuildContext) ([]operator.Operat
 		return nil, errors.Wrap(err, "'base_uri' is not a valid URL")
 	}
 
-	flusher := c.FlusherConfig.Build(bc.Logger.SugaredLogger)
+	flusher, err := c.FlusherConfig.Build(bc, outputOperator.ID())
+	if err != nil {
+		return nil, err
+	}
 	ctx, cancel := context.WithCancel(context.Background())
 
 	nro := &NewRelicOutput{
@@ -84,6 +101,7 @@ func (c NewRelicOutputConfig) Build(bc operator.BuildContext) ([]operator.Operat
 		url:            url,
 		timeout:        c.Timeout.Raw(),
 		messageField:   c.MessageField,
+		compressor:     compressor,
 		ctx:            ctx,
 		cancel:         cancel,
 	}
@@ -93,8 +111,7 @@ func (c NewRelicOutputConfig) Build(bc operator.BuildContext) ([]operator.Operat
 
 func (c NewRelicOutputConfig) getHeaders() (http.Header, error) {
 	headers := http.Header{
-		"X-Event-Source":   []string{"logs"},
-		"Content-Encoding": []string{"gzip"},
+		"X-Event-Source": []string{"logs"},
 	}
 
 	if c.APIKey == "" && c.LicenseKey == "" {
@@ -119,6 +136,7 @@ type NewRelicOutput struct {
 	headers      http.Header
 	timeout      time.Duration
 	messageField entry.Field
+	compressor   *helper.Compressor
 
 	ctx    context.Context
 	cancel context.CancelFunc
@@ -148,6 +166,17 @@ func (nro *NewRelicOutput) Stop() error {
 	return nro.buffer.Close()
 }
 
+// Close releases the buffer of an output that was never started
+func (nro *NewRelicOutput) Close() error {
+	nro.flusher.Stop()
+	return nro.buffer.Close()
+}
+
+// Health returns how long the output has been retrying to flush and how full its buffer is
+func (nro *NewRelicOutput) Health() operator.Health {
+	return nro.flusher.Health(nro.buffer)
+}
+
 // Process adds an entry to the output's buffer
 func (nro *NewRelicOutput) Process(ctx context.Context, entry *entry.Entry) error {
 	return nro.buffer.Add(ctx, entry)
@@ -180,7 +209,7 @@ func (nro *NewRelicOutput) feedFlusher(ctx context.Context) {
 			continue
 		}
 
-		nro.flusher.Do(func(ctx context.Context) error {
+		nro.flusher.DoChunk(entries, clearer, func(ctx context.Context) error {
 			req, err := nro.newRequest(ctx, entries)
 			if err != nil {
 				nro.Errorw("Failed to create request from payload", zap.Error(err))
@@ -213,7 +242,10 @@ func (nro *NewRelicOutput) newRequest(ctx context.Context, entries []*entry.Entr
 	payload := LogPayloadFromEntries(entries, nro.messageField)
 
 	var buf bytes.Buffer
-	wr := gzip.NewWriter(&buf)
+	wr, err := nro.compressor.NewWriter(&buf)
+	if err != nil {
+		return nil, err
+	}
 	enc := json.NewEncoder(wr)
 	if err := enc.Encode(payload); err != nil {
 		return nil, errors.Wrap(err, "encode payload")
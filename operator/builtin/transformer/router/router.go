@@ -3,10 +3,12 @@ package router
 import (
 	"context"
 	"fmt"
+	"sync"
 
 	"github.com/antonmedv/expr"
 	"github.com/antonmedv/expr/vm"
 	"github.com/observiq/stanza/entry"
+	"github.com/observiq/stanza/metrics"
 	"github.com/observiq/stanza/operator"
 	"github.com/observiq/stanza/operator/helper"
 	"go.uber.org/zap"
@@ -84,6 +86,10 @@ func (c RouterOperatorConfig) Build(bc operator.BuildContext) ([]operator.Operat
 type RouterOperator struct {
 	helper.BasicOperator
 	routes []*RouterOperatorRoute
+
+	// outputsMux guards the outputs of the routes, so that a reload can connect
+	// the router to new outputs while it is running
+	outputsMux sync.RWMutex
 }
 
 // RouterOperatorRoute is a route on a router operator
@@ -92,6 +98,9 @@ type RouterOperatorRoute struct {
 	Expression      *vm.Program
 	OutputIDs       helper.OutputIDs
 	OutputOperators []operator.Operator
+
+	// outputMetrics are the metrics of the output operators of the route
+	outputMetrics []*metrics.Operator
 }
 
 // CanProcess will always return true for a router operator
@@ -104,6 +113,9 @@ func (p *RouterOperator) Process(ctx context.Context, entry *entry.Entry) error
 	env := helper.GetExprEnv(entry)
 	defer helper.PutExprEnv(env)
 
+	p.outputsMux.RLock()
+	defer p.outputsMux.RUnlock()
+
 	for _, route := range p.routes {
 		matches, err := vm.Run(route.Expression, env)
 		if err != nil {
@@ -118,6 +130,10 @@ func (p *RouterOperator) Process(ctx context.Context, entry *entry.Entry) error
 				return err
 			}
 
+			p.Metrics().AddEntriesOut(1)
+			for _, m := range route.outputMetrics {
+				m.AddEntriesIn(1)
+			}
 			for _, output := range route.OutputOperators {
 				_ = output.Process(ctx, entry)
 			}
@@ -135,6 +151,9 @@ func (p *RouterOperator) CanOutput() bool {
 
 // Outputs will return all connected operators.
 func (p *RouterOperator) Outputs() []operator.Operator {
+	p.outputsMux.RLock()
+	defer p.outputsMux.RUnlock()
+
 	outputs := make([]operator.Operator, 0, len(p.routes))
 	for _, route := range p.routes {
 		outputs = append(outputs, route.OutputOperators...)
@@ -144,14 +163,21 @@ func (p *RouterOperator) Outputs() []operator.Operator {
 
 // SetOutputs will set the outputs of the router operator.
 func (p *RouterOperator) SetOutputs(operators []operator.Operator) error {
+	routeOutputs := make([][]operator.Operator, 0, len(p.routes))
 	for _, route := range p.routes {
 		outputOperators, err := p.findOperators(operators, route.OutputIDs)
 		if err != nil {
 			return fmt.Errorf("failed to set outputs on route: %s", err)
 		}
-		route.OutputOperators = outputOperators
+		routeOutputs = append(routeOutputs, outputOperators)
 	}
 
+	p.outputsMux.Lock()
+	defer p.outputsMux.Unlock()
+	for i, route := range p.routes {
+		route.OutputOperators = routeOutputs[i]
+		route.outputMetrics = helper.OutputMetrics(routeOutputs[i])
+	}
 	return nil
 }
 
@@ -0,0 +1,10 @@
+package operator
+
+import "context"
+
+// Checker is implemented by operators that can verify their connection to an
+// external system without being started.
+type Checker interface {
+	// Check verifies that the operator is able to connect to the external system.
+	Check(ctx context.Context) error
+}
@@ -0,0 +1,9 @@
+package operator
+
+// Closer is implemented by operators that hold resources from the time they are
+// built, such as the buffers of outputs.
+type Closer interface {
+	// Close releases the resources of an operator that was built but never started.
+	// Operators that were started release them when they are stopped.
+	Close() error
+}
@@ -0,0 +1,202 @@
+package deadletter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/observiq/stanza/entry"
+)
+
+// Labels that are added to entries that are sent to a dead-letter output
+const (
+	OperatorLabel = "dead_letter_operator"
+	ReasonLabel   = "dead_letter_reason"
+	StatusLabel   = "dead_letter_status"
+)
+
+// Config configures the dead-letter queue of a pipeline. Exactly one of Path or Output must be set.
+type Config struct {
+	// Path is the file that dead-lettered entries are appended to as JSON lines
+	Path string `json:"path,omitempty" yaml:"path,omitempty"`
+
+	// Output is the id of the operator that dead-lettered entries are sent to
+	Output string `json:"output,omitempty" yaml:"output,omitempty"`
+}
+
+// Build creates the queue of the config
+func (c Config) Build() (*Queue, error) {
+	switch {
+	case c.Path != "" && c.Output != "":
+		return nil, fmt.Errorf("only one of 'path' or 'output' can be set")
+	case c.Path != "":
+		return NewFileQueue(c.Path), nil
+	case c.Output != "":
+		return &Queue{outputID: c.Output}, nil
+	default:
+		return nil, fmt.Errorf("one of 'path' or 'output' is required")
+	}
+}
+
+// Record is an entry that an output failed to deliver, as it is written to a dead-letter file
+type Record struct {
+	// Time is the time the entry was dead-lettered
+	Time time.Time `json:"time"`
+
+	// Operator is the id of the output that failed to deliver the entry
+	Operator string `json:"operator"`
+
+	// Reason is the error of the last attempt to deliver the entry
+	Reason string `json:"reason"`
+
+	// Status is the status code of the response to the last attempt, if there was one
+	Status int `json:"status,omitempty"`
+
+	// Entry is the entry that was not delivered
+	Entry *entry.Entry `json:"entry"`
+}
+
+// StatusCoder is implemented by errors that are caused by a response with a status code
+type StatusCoder interface {
+	StatusCode() int
+}
+
+// statusCode returns the status code of the first error in the chain of err that has one
+func statusCode(err error) int {
+	var coder StatusCoder
+	if errors.As(err, &coder) {
+		return coder.StatusCode()
+	}
+	return 0
+}
+
+// Processor is an operator that dead-lettered entries can be sent to
+type Processor interface {
+	ID() string
+	Process(context.Context, *entry.Entry) error
+}
+
+// Queue receives entries that outputs failed to deliver. It appends them to a file,
+// or sends them to an output once it is connected to one.
+type Queue struct {
+	path     string
+	file     *os.File
+	outputID string
+	output   Processor
+	mux      sync.Mutex
+}
+
+// NewFileQueue creates a queue that appends entries to a file as JSON lines.
+// The file is opened when the first entries are added.
+func NewFileQueue(path string) *Queue {
+	return &Queue{path: path}
+}
+
+// OutputID returns the id of the output that entries are sent to, or an empty string
+// if entries are written to a file
+func (q *Queue) OutputID() string {
+	return q.outputID
+}
+
+// Connect sets the output that entries are sent to
+func (q *Queue) Connect(output Processor) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	q.output = output
+}
+
+// Add adds entries that an output failed to deliver to the queue. The reason is the
+// error of the last attempt to deliver them.
+func (q *Queue) Add(ctx context.Context, operatorID string, entries []*entry.Entry, reason error) error {
+	if q.outputID != "" {
+		return q.send(ctx, operatorID, entries, reason)
+	}
+	return q.write(operatorID, entries, reason)
+}
+
+// write appends a record for every entry to the file
+func (q *Queue) write(operatorID string, entries []*entry.Entry, reason error) error {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	if q.file == nil {
+		file, err := os.OpenFile(q.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return fmt.Errorf("open dead-letter file: %s", err)
+		}
+		q.file = file
+	}
+
+	now := time.Now()
+	status := statusCode(reason)
+	var buf []byte
+	for _, e := range entries {
+		line, err := json.Marshal(Record{
+			Time:     now,
+			Operator: operatorID,
+			Reason:   reason.Error(),
+			Status:   status,
+			Entry:    e,
+		})
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+
+	// The lines of a chunk are written with a single write
+	if _, err := q.file.Write(buf); err != nil {
+		return fmt.Errorf("write dead-letter file: %s", err)
+	}
+	return nil
+}
+
+// send sends a copy of every entry with labels describing the failure to the output
+func (q *Queue) send(ctx context.Context, operatorID string, entries []*entry.Entry, reason error) error {
+	q.mux.Lock()
+	output := q.output
+	q.mux.Unlock()
+
+	if output == nil {
+		return fmt.Errorf("dead-letter output '%s' is not connected", q.outputID)
+	}
+	if output.ID() == operatorID {
+		return fmt.Errorf("entries of the dead-letter output cannot be dead-lettered")
+	}
+
+	status := statusCode(reason)
+	for _, e := range entries {
+		dead := e.Copy()
+		if dead.Labels == nil {
+			dead.Labels = make(map[string]string, 3)
+		}
+		dead.Labels[OperatorLabel] = operatorID
+		dead.Labels[ReasonLabel] = reason.Error()
+		if status != 0 {
+			dead.Labels[StatusLabel] = strconv.Itoa(status)
+		}
+
+		if err := output.Process(ctx, dead); err != nil {
+			return fmt.Errorf("send to dead-letter output: %s", err)
+		}
+	}
+	return nil
+}
+
+// Close closes the file of the queue
+func (q *Queue) Close() error {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	if q.file == nil {
+		return nil
+	}
+	err := q.file.Close()
+	q.file = nil
+	return err
+}
@@ -0,0 +1,174 @@
+package deadletter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/observiq/stanza/entry"
+	"github.com/stretchr/testify/require"
+)
+
+type statusErr struct {
+	code int
+}
+
+func (e statusErr) Error() string   { return fmt.Sprintf("status %d", e.code) }
+func (e statusErr) StatusCode() int { return e.code }
+
+// fakeProcessor records the entries it processes
+type fakeProcessor struct {
+	id       string
+	received []*entry.Entry
+}
+
+func (p *fakeProcessor) ID() string { return p.id }
+
+func (p *fakeProcessor) Process(_ context.Context, e *entry.Entry) error {
+	p.received = append(p.received, e)
+	return nil
+}
+
+func testEntries() []*entry.Entry {
+	first, second := entry.New(), entry.New()
+	first.Timestamp = time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	second.Timestamp = first.Timestamp.Add(time.Second)
+	first.Record = "first"
+	second.Record = "second"
+	second.Labels = map[string]string{"key": "value"}
+	return []*entry.Entry{first, second}
+}
+
+func readAll(t *testing.T, path string) []*entry.Entry {
+	var entries []*entry.Entry
+	require.NoError(t, ReadFile(path, func(e *entry.Entry) error {
+		entries = append(entries, e)
+		return nil
+	}))
+	return entries
+}
+
+func TestConfigBuild(t *testing.T) {
+	cases := []struct {
+		name        string
+		config      Config
+		expectedErr string
+	}{
+		{"Path", Config{Path: "/dead_letter.jsonl"}, ""},
+		{"Output", Config{Output: "dead_letter_output"}, ""},
+		{"Both", Config{Path: "/dead_letter.jsonl", Output: "dead_letter_output"}, "only one of 'path' or 'output' can be set"},
+		{"Neither", Config{}, "one of 'path' or 'output' is required"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			queue, err := tc.config.Build()
+			if tc.expectedErr != "" {
+				require.EqualError(t, err, tc.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.config.Output, queue.OutputID())
+		})
+	}
+}
+
+func TestFileQueue(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dead_letter.jsonl")
+	queue := NewFileQueue(path)
+	defer queue.Close()
+
+	entries := testEntries()
+	require.NoError(t, queue.Add(context.Background(), "$.output", entries[:1], fmt.Errorf("wrapped: %w", statusErr{400})))
+	require.NoError(t, queue.Add(context.Background(), "$.output", entries[1:], fmt.Errorf("timeout")))
+
+	contents, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(contents)), "\n")
+	require.Len(t, lines, 2)
+
+	var record Record
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &record))
+	require.Equal(t, "$.output", record.Operator)
+	require.Equal(t, "wrapped: status 400", record.Reason)
+	require.Equal(t, 400, record.Status)
+	require.NotContains(t, lines[1], `"status"`, "the status is omitted if the error has none")
+
+	require.Equal(t, entries, readAll(t, path))
+}
+
+func TestOutputQueue(t *testing.T) {
+	queue, err := Config{Output: "$.fake"}.Build()
+	require.NoError(t, err)
+
+	err = queue.Add(context.Background(), "$.output", testEntries(), fmt.Errorf("rejected"))
+	require.EqualError(t, err, "dead-letter output '$.fake' is not connected")
+
+	output := &fakeProcessor{id: "$.fake"}
+	queue.Connect(output)
+	require.NoError(t, queue.Add(context.Background(), "$.output", testEntries(), statusErr{503}))
+
+	require.Len(t, output.received, 2)
+	for i, expected := range testEntries() {
+		received := output.received[i]
+		require.Equal(t, "$.output", received.Labels[OperatorLabel])
+		require.Equal(t, "status 503", received.Labels[ReasonLabel])
+		require.Equal(t, "503", received.Labels[StatusLabel])
+		require.Equal(t, expected.Record, received.Record)
+		require.Equal(t, expected.Labels["key"], received.Labels["key"])
+	}
+
+	err = queue.Add(context.Background(), output.ID(), testEntries(), fmt.Errorf("rejected"))
+	require.EqualError(t, err, "entries of the dead-letter output cannot be dead-lettered")
+}
+
+func TestReadFile(t *testing.T) {
+	t.Run("OutputEntries", func(t *testing.T) {
+		// Entries written by a file_output that the queue sent entries to
+		path := filepath.Join(t.TempDir(), "output.jsonl")
+		var lines []string
+		for _, e := range testEntries() {
+			dead := e.Copy()
+			if dead.Labels == nil {
+				dead.Labels = map[string]string{}
+			}
+			dead.Labels[OperatorLabel] = "$.output"
+			dead.Labels[ReasonLabel] = "rejected"
+			line, err := json.Marshal(dead)
+			require.NoError(t, err)
+			lines = append(lines, string(line))
+		}
+		require.NoError(t, ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")), 0600))
+
+		require.Equal(t, testEntries(), readAll(t, path))
+	})
+
+	t.Run("InvalidLine", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "invalid.jsonl")
+		require.NoError(t, ioutil.WriteFile(path, []byte("{}\n\nnot json\n"), 0600))
+
+		err := ReadFile(path, func(*entry.Entry) error { return nil })
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "line 3:")
+	})
+
+	t.Run("EntriesAddedWhileReading", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "dead_letter.jsonl")
+		queue := NewFileQueue(path)
+		defer queue.Close()
+		require.NoError(t, queue.Add(context.Background(), "$.output", testEntries(), fmt.Errorf("rejected")))
+
+		read := 0
+		require.NoError(t, ReadFile(path, func(e *entry.Entry) error {
+			read++
+			return queue.Add(context.Background(), "$.output", []*entry.Entry{e}, fmt.Errorf("rejected again"))
+		}))
+		require.Equal(t, 2, read)
+		require.Len(t, readAll(t, path), 4)
+	})
+}
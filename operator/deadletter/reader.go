@@ -0,0 +1,81 @@
+package deadletter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/observiq/stanza/entry"
+)
+
+// ReadFile calls fn with every entry in a file. The file is either a dead-letter file,
+// or a file of entries as JSON lines that were sent to a dead-letter output, such as
+// a file_output. The labels describing the failure are removed from the entries.
+// Only the lines that are in the file when it is opened are read, so entries that are
+// dead-lettered to the same file while it is read are not read again.
+func ReadFile(path string, fn func(*entry.Entry) error) error {
+	file, err := os.Open(path) // #nosec - the dead-letter file is chosen by the user
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	return read(io.LimitReader(file, info.Size()), fn)
+}
+
+func read(r io.Reader, fn func(*entry.Entry) error) error {
+	reader := bufio.NewReader(r)
+	for lineNumber := 1; ; lineNumber++ {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		if trimmed := bytes.TrimSpace(line); len(trimmed) > 0 {
+			e, decodeErr := decodeLine(trimmed)
+			if decodeErr != nil {
+				return fmt.Errorf("line %d: %s", lineNumber, decodeErr)
+			}
+			if fnErr := fn(e); fnErr != nil {
+				return fnErr
+			}
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+// decodeLine decodes a record, or an entry that was sent to a dead-letter output
+func decodeLine(line []byte) (*entry.Entry, error) {
+	var record struct {
+		Entry json.RawMessage `json:"entry"`
+	}
+	if err := json.Unmarshal(line, &record); err != nil {
+		return nil, err
+	}
+	if record.Entry != nil {
+		line = record.Entry
+	}
+
+	var e entry.Entry
+	if err := json.Unmarshal(line, &e); err != nil {
+		return nil, err
+	}
+
+	delete(e.Labels, OperatorLabel)
+	delete(e.Labels, ReasonLabel)
+	delete(e.Labels, StatusLabel)
+	if len(e.Labels) == 0 {
+		e.Labels = nil
+	}
+	return &e, nil
+}
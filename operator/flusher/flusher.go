@@ -2,50 +2,233 @@ package flusher
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	backoff "github.com/cenkalti/backoff/v4"
+	"github.com/observiq/stanza/entry"
+	"github.com/observiq/stanza/metrics"
+	"github.com/observiq/stanza/operator"
+	"github.com/observiq/stanza/operator/buffer"
+	"github.com/observiq/stanza/operator/deadletter"
 	"go.uber.org/zap"
-	"golang.org/x/sync/semaphore"
 )
 
-// These are vars so they can be overridden in tests
-var maxRetryInterval = time.Minute
-var maxElapsedTime = time.Hour
-
 // Config holds the configuration to build a new flusher
 type Config struct {
 	// MaxConcurrent is the maximum number of goroutines flushing entries concurrently.
 	// Defaults to 16.
 	MaxConcurrent int `json:"max_concurrent" yaml:"max_concurrent"`
 
-	// TODO configurable retry
+	// Adaptive configures adaptive concurrency, which adjusts the number of goroutines
+	// flushing entries concurrently to how the destination behaves
+	Adaptive AdaptiveConfig `json:"adaptive" yaml:"adaptive"`
+
+	// Retry configures how failed flushes are retried
+	Retry RetryConfig `json:"retry" yaml:"retry"`
+
+	// DeadLetter configures where entries are written if they are dead-lettered.
+	// It defaults to the dead-letter queue of the pipeline.
+	DeadLetter DeadLetterConfig `json:"dead_letter,omitempty" yaml:"dead_letter,omitempty"`
+
+	// set holds the keys of the settings that the config was unmarshalled with, by their path.
+	// A key is true if its value is not a mapping. It is nil if the config was not unmarshalled.
+	set map[string]bool
+}
+
+// DeadLetterConfig configures the dead-letter file of a flusher
+type DeadLetterConfig struct {
+	// Path is the file that dead-lettered entries are appended to as JSON lines
+	Path string `json:"path,omitempty" yaml:"path,omitempty"`
 }
 
 // NewConfig creates a new default flusher config
 func NewConfig() Config {
 	return Config{
 		MaxConcurrent: 16,
+		Adaptive:      NewAdaptiveConfig(),
+		Retry:         NewRetryConfig(),
+	}
+}
+
+// DefaultsKey is the key of the flusher config that outputs inherit in the defaults of a build context
+const DefaultsKey = "flusher"
+
+// inherit returns the config with each setting that is not set taken from the flusher config
+// in the defaults of a build context. A setting is not set if the config was unmarshalled without
+// its key, or if the config was not unmarshalled and the setting is left at its default.
+func (c Config) inherit(bc operator.BuildContext) Config {
+	parent, ok := bc.Defaults[DefaultsKey].(Config)
+	if !ok {
+		return c
+	}
+	inheritFields(reflect.ValueOf(&c).Elem(), reflect.ValueOf(NewConfig()), reflect.ValueOf(parent), "", c.set)
+	return c
+}
+
+// inheritFields sets each field of a struct that is not set to the field of the parent struct.
+// The fields of nested structs are inherited one by one, unless a value that is not a mapping
+// was set for the struct.
+func inheritFields(field, def, parent reflect.Value, path string, set map[string]bool) {
+	if set != nil && set[path] {
+		return
+	}
+
+	if field.Kind() == reflect.Struct {
+		for i := 0; i < field.NumField(); i++ {
+			if field.Field(i).CanSet() {
+				inheritFields(field.Field(i), def.Field(i), parent.Field(i), fieldPath(path, field.Type().Field(i)), set)
+			}
+		}
+		return
+	}
+
+	if set != nil || reflect.DeepEqual(field.Interface(), def.Interface()) {
+		field.Set(parent)
+	}
+}
+
+// fieldPath returns the path of the key of a struct field within the struct at path
+func fieldPath(path string, field reflect.StructField) string {
+	name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+	if name == "" {
+		name = field.Name
+	}
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// UnmarshalYAML unmarshals a config, and records which settings it sets so that only
+// the others are inherited from the defaults
+func (c *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawConfig Config
+	raw := rawConfig(*c)
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	keys := map[string]interface{}{}
+	if err := unmarshal(&keys); err != nil {
+		return err
+	}
+
+	*c = Config(raw)
+	c.set = map[string]bool{}
+	setKeys(c.set, "", keys)
+	return nil
+}
+
+// UnmarshalJSON unmarshals a config, and records which settings it sets so that only
+// the others are inherited from the defaults
+func (c *Config) UnmarshalJSON(data []byte) error {
+	type rawConfig Config
+	raw := rawConfig(*c)
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	keys := map[string]interface{}{}
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return err
+	}
+
+	*c = Config(raw)
+	c.set = map[string]bool{}
+	setKeys(c.set, "", keys)
+	return nil
+}
+
+// setKeys records the paths of the keys of an unmarshalled mapping, and of the keys of its nested mappings
+func setKeys(set map[string]bool, path string, mapping interface{}) {
+	add := func(key string, value interface{}) {
+		if path != "" {
+			key = path + "." + key
+		}
+		switch value.(type) {
+		case map[string]interface{}, map[interface{}]interface{}:
+			set[key] = false
+			setKeys(set, key, value)
+		default:
+			set[key] = true
+		}
+	}
+
+	switch m := mapping.(type) {
+	case map[string]interface{}:
+		for key, value := range m {
+			add(key, value)
+		}
+	case map[interface{}]interface{}:
+		for key, value := range m {
+			add(fmt.Sprint(key), value)
+		}
 	}
 }
 
-// Build uses a Config to build a new Flusher
-func (c *Config) Build(logger *zap.SugaredLogger) *Flusher {
+// Build uses a Config to build a new Flusher for the operator with the given id
+func (c *Config) Build(bc operator.BuildContext, operatorID string) (*Flusher, error) {
+	cfg := c.inherit(bc)
+	c = &cfg
 	maxConcurrent := c.MaxConcurrent
 	if maxConcurrent == 0 {
 		maxConcurrent = 16
 	}
 
+	adaptive := c.Adaptive
+	if adaptive == (AdaptiveConfig{}) {
+		adaptive = NewAdaptiveConfig()
+	}
+	if err := adaptive.validate(maxConcurrent); err != nil {
+		return nil, fmt.Errorf("invalid 'adaptive': %s", err)
+	}
+	limiter := newFixedLimiter(maxConcurrent)
+	if adaptive.Enabled {
+		limiter = newAdaptiveLimiter(adaptive, maxConcurrent)
+	}
+
+	retry := c.Retry
+	if retry == (RetryConfig{}) {
+		retry = NewRetryConfig()
+	}
+	if err := retry.validate(); err != nil {
+		return nil, fmt.Errorf("invalid 'retry': %s", err)
+	}
+
+	deadLetter, ownDeadLetter := bc.DeadLetter, false
+	if c.DeadLetter.Path != "" {
+		deadLetter, ownDeadLetter = deadletter.NewFileQueue(c.DeadLetter.Path), true
+	}
+	if retry.OnExhausted == OnExhaustedDeadLetter && deadLetter == nil {
+		return nil, fmt.Errorf("'on_exhausted' is '%s', but neither the flusher nor the pipeline has a 'dead_letter' queue", OnExhaustedDeadLetter)
+	}
+
+	logger := zap.NewNop().Sugar()
+	if bc.Logger != nil {
+		logger = bc.Logger.SugaredLogger
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 
-	return &Flusher{
+	f := &Flusher{
 		ctx:           ctx,
 		cancel:        cancel,
-		sem:           semaphore.NewWeighted(int64(maxConcurrent)),
+		limiter:       limiter,
+		retry:         retry,
+		operatorID:    operatorID,
+		deadLetter:    deadLetter,
+		ownDeadLetter: ownDeadLetter,
+		metrics:       bc.Metrics.Operator(operatorID),
 		SugaredLogger: logger,
 	}
+	f.metrics.SetFlusher(f.ConcurrencyLimit)
+	return f, nil
 }
 
 // Flusher is used to flush entries from a buffer concurrently. It handles max concurrency,
@@ -54,18 +237,114 @@ type Flusher struct {
 	chunkIDCounter uint64
 	ctx            context.Context
 	cancel         context.CancelFunc
-	sem            *semaphore.Weighted
+	limiter        *limiter
 	wg             sync.WaitGroup
+	retry          RetryConfig
+	operatorID     string
+	deadLetter     *deadletter.Queue
+	ownDeadLetter  bool
+	metrics        *metrics.Operator
+
+	// paused is the number of chunks that exhausted their retries with the
+	// pause action and are not flushed yet. resumed is closed once it is zero.
+	pauseMux sync.Mutex
+	paused   int
+	resumed  chan struct{}
+
+	// failing holds the time of the first failed attempt of each chunk that is retried
+	failingMux sync.Mutex
+	failing    map[uint64]time.Time
+
 	*zap.SugaredLogger
 }
 
 // FlushFunc is any function that flushes
 type FlushFunc func(context.Context) error
 
+// RetryAfterError can be returned by a FlushFunc to request that the next
+// attempt is made after a specific duration instead of the backoff interval.
+// This is used to honour rate limiting responses from a destination.
+type RetryAfterError struct {
+	Err   error
+	After time.Duration
+}
+
+// NewRetryAfterError creates a new RetryAfterError
+func NewRetryAfterError(err error, after time.Duration) *RetryAfterError {
+	return &RetryAfterError{
+		Err:   err,
+		After: after,
+	}
+}
+
+// Error returns the message of the wrapped error
+func (e *RetryAfterError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the wrapped error
+func (e *RetryAfterError) Unwrap() error {
+	return e.Err
+}
+
+// RejectedError can be returned by a FlushFunc if the destination will never accept some
+// of the entries of a chunk, so that they were dropped or dead-lettered by the FlushFunc
+// instead of flushed. The chunk is not retried. It counts as dropped if any of its entries
+// were dropped, as dead-lettered if any were dead-lettered, and as flushed otherwise.
+type RejectedError struct {
+	Err          error
+	Dropped      int
+	DeadLettered int
+}
+
+// NewRejectedError creates a new RejectedError
+func NewRejectedError(err error, dropped, deadLettered int) *RejectedError {
+	return &RejectedError{
+		Err:          err,
+		Dropped:      dropped,
+		DeadLettered: deadLettered,
+	}
+}
+
+// Error returns the message of the wrapped error
+func (e *RejectedError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the wrapped error
+func (e *RejectedError) Unwrap() error {
+	return e.Err
+}
+
+// chunk is a chunk of entries that is flushed by a FlushFunc. The entries
+// and clearer are nil if the chunk was not read from a buffer.
+type chunk struct {
+	entries []*entry.Entry
+	clearer buffer.Clearer
+	flush   FlushFunc
+}
+
 // Do executes the flusher function in a goroutine
 func (f *Flusher) Do(flush FlushFunc) {
+	f.do(chunk{flush: flush})
+}
+
+// DoChunk executes the flusher function of a chunk of entries read from a buffer in
+// a goroutine. If the retries are exhausted, the entries are dropped or dead-lettered
+// and marked as flushed.
+func (f *Flusher) DoChunk(entries []*entry.Entry, clearer buffer.Clearer, flush FlushFunc) {
+	f.do(chunk{entries: entries, clearer: clearer, flush: flush})
+}
+
+func (f *Flusher) do(c chunk) {
+	// Wait while flushes are paused
+	if err := f.waitUntilResumed(); err != nil {
+		// Context cancelled
+		return
+	}
+
 	// Wait until we have free flusher goroutines
-	if err := f.sem.Acquire(f.ctx, 1); err != nil {
+	if err := f.limiter.acquire(f.ctx); err != nil {
 		// Context cancelled
 		return
 	}
@@ -74,8 +353,8 @@ func (f *Flusher) Do(flush FlushFunc) {
 	f.wg.Add(1)
 	go func() {
 		defer f.wg.Done()
-		defer f.sem.Release(1)
-		f.flushWithRetry(f.ctx, flush)
+		defer f.limiter.release()
+		f.flushWithRetry(f.ctx, c)
 	}()
 }
 
@@ -83,27 +362,72 @@ func (f *Flusher) Do(flush FlushFunc) {
 func (f *Flusher) Stop() {
 	f.cancel()
 	f.wg.Wait()
+	// The dead-letter queue of the pipeline is closed by the agent
+	if f.ownDeadLetter {
+		if err := f.deadLetter.Close(); err != nil {
+			f.Errorw("Failed to close dead-letter queue", zap.Error(err))
+		}
+	}
 }
 
-// flushWithRetry will continue trying to call flushFunc with the entries passed
-// in until either flushFunc returns no error or the context is cancelled. It will only
-// return an error in the case that the context was cancelled. If no error was returned,
-// it is safe to mark the entries in the buffer as flushed.
-func (f *Flusher) flushWithRetry(ctx context.Context, flush FlushFunc) {
+// flushWithRetry will continue trying to call the flush function of the chunk until either
+// it returns no error, the retries are exhausted, or the context is cancelled. If the retries
+// are exhausted, the chunk is handled according to the on_exhausted action.
+func (f *Flusher) flushWithRetry(ctx context.Context, c chunk) {
 	chunkID := f.nextChunkID()
-	b := newExponentialBackoff()
-	for {
-		err := flush(ctx)
+	b := f.retry.newBackoff()
+	paused := false
+	defer func() {
+		if paused {
+			f.resume()
+		}
+	}()
+
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		err := c.flush(ctx)
+		f.metrics.ObserveFlush(time.Since(start))
+		f.adjustConcurrency(start, err)
 		if err == nil {
+			f.metrics.AddChunk(metrics.ChunkFlushed)
+			f.metrics.AddEntriesOut(len(c.entries))
+			if paused {
+				f.Infow("Flushed chunk that exhausted its retries. Resuming flushes", "chunk_id", chunkID)
+			}
 			return
 		}
 
-		waitTime := b.NextBackOff()
-		if waitTime == b.Stop {
-			f.Errorw("Reached max backoff time during chunk flush retry. Dropping logs in chunk", "chunk_id", chunkID)
+		var rejected *RejectedError
+		if errors.As(err, &rejected) {
+			f.rejected(chunkID, c, rejected)
 			return
 		}
 
+		if attempt == 1 {
+			f.markFailing(chunkID, start)
+			defer f.clearFailing(chunkID)
+		}
+
+		waitTime := b.NextBackOff()
+		exhausted := waitTime == b.Stop || (f.retry.MaxAttempts > 0 && attempt >= f.retry.MaxAttempts)
+		if exhausted && !paused {
+			if f.retry.OnExhausted != OnExhaustedPause {
+				f.exhausted(chunkID, c, err)
+				return
+			}
+			paused = true
+			f.pause()
+			f.Errorw("Reached max retries during chunk flush. Pausing flushes until the chunk is flushed", "chunk_id", chunkID, "error", err)
+		}
+		if paused {
+			waitTime = f.retry.MaxInterval.Raw()
+		}
+
+		var retryAfter *RetryAfterError
+		if errors.As(err, &retryAfter) && retryAfter.After > 0 {
+			waitTime = retryAfter.After
+		}
+
 		// Only log the error if the context hasn't been canceled
 		// This protects from flooding the logs with "context canceled" messages on clean shutdown
 		select {
@@ -118,24 +442,173 @@ func (f *Flusher) flushWithRetry(ctx context.Context, flush FlushFunc) {
 			return
 		case <-time.After(waitTime):
 		}
+		f.metrics.AddFlushRetry()
 	}
 }
 
-func (f *Flusher) nextChunkID() uint64 {
-	return atomic.AddUint64(&f.chunkIDCounter, 1)
+// markFailing records that the first attempt to flush a chunk failed
+func (f *Flusher) markFailing(chunkID uint64, start time.Time) {
+	f.failingMux.Lock()
+	defer f.failingMux.Unlock()
+	if f.failing == nil {
+		f.failing = make(map[uint64]time.Time)
+	}
+	f.failing[chunkID] = start
+}
+
+// clearFailing records that a chunk is not retried anymore
+func (f *Flusher) clearFailing(chunkID uint64) {
+	f.failingMux.Lock()
+	defer f.failingMux.Unlock()
+	delete(f.failing, chunkID)
 }
 
-// newExponentialBackoff returns a default ExponentialBackOff
-func newExponentialBackoff() *backoff.ExponentialBackOff {
-	b := &backoff.ExponentialBackOff{
-		InitialInterval:     50 * time.Millisecond,
-		RandomizationFactor: backoff.DefaultRandomizationFactor,
-		Multiplier:          backoff.DefaultMultiplier,
-		MaxInterval:         maxRetryInterval,
-		MaxElapsedTime:      maxElapsedTime,
-		Stop:                backoff.Stop,
-		Clock:               backoff.SystemClock,
+// RetryingFor returns how long the flusher has been retrying the chunk that failed first,
+// or zero if no chunk is being retried
+func (f *Flusher) RetryingFor() time.Duration {
+	f.failingMux.Lock()
+	defer f.failingMux.Unlock()
+	var longest time.Duration
+	for _, start := range f.failing {
+		if retrying := time.Since(start); retrying > longest {
+			longest = retrying
+		}
+	}
+	return longest
+}
+
+// Health returns the health of an output that flushes the chunks of a buffer
+func (f *Flusher) Health(b buffer.Buffer) operator.Health {
+	health := operator.Health{RetryingFor: f.RetryingFor()}
+	if reporter, ok := b.(buffer.UsageReporter); ok {
+		health.BufferUsage = reporter.Usage()
+	}
+	return health
+}
+
+// adjustConcurrency adjusts the concurrency limit with the result of a flush attempt
+func (f *Flusher) adjustConcurrency(start time.Time, err error) {
+	limit, changed := f.limiter.observe(start, err)
+	if !changed {
+		return
+	}
+	if err == nil {
+		f.Debugw("Raised flush concurrency", "concurrency_limit", limit)
+	} else {
+		f.Warnw("Cut flush concurrency because the destination is overloaded", "concurrency_limit", limit, "error", err)
 	}
-	b.Reset()
-	return b
+}
+
+// ConcurrencyLimit returns the maximum number of chunks that are currently flushed
+// concurrently. It only changes if adaptive concurrency is enabled.
+func (f *Flusher) ConcurrencyLimit() int {
+	return f.limiter.current()
+}
+
+// exhausted drops or dead-letters a chunk that exhausted its retries. The entries are
+// marked as flushed, unless they could not be written to the dead-letter sink.
+func (f *Flusher) exhausted(chunkID uint64, c chunk, err error) {
+	if f.retry.OnExhausted == OnExhaustedDeadLetter && c.entries != nil {
+		if !f.DeadLetter(f.ctx, c.entries, err) {
+			f.Errorw("Reached max retries during chunk flush, and failed to dead-letter the chunk. Leaving logs in buffer", "chunk_id", chunkID, "error", err)
+			return
+		}
+		f.Errorw("Reached max retries during chunk flush. Dead-lettered logs in chunk", "chunk_id", chunkID, "error", err, "entries", len(c.entries))
+		f.metrics.AddChunk(metrics.ChunkDeadLettered)
+		f.metrics.AddUndelivered(metrics.ChunkDeadLettered, len(c.entries))
+	} else {
+		f.Errorw("Reached max retries during chunk flush. Dropping logs in chunk", "chunk_id", chunkID, "error", err)
+		f.metrics.AddChunk(metrics.ChunkDropped)
+		f.metrics.AddUndelivered(metrics.ChunkDropped, len(c.entries))
+	}
+
+	if c.clearer != nil {
+		if err := c.clearer.MarkAllAsFlushed(); err != nil {
+			f.Errorw("Failed to mark entries as flushed", zap.Error(err))
+		}
+	}
+}
+
+// rejected counts a chunk whose FlushFunc dropped or dead-lettered entries that the
+// destination will never accept. The FlushFunc marks the entries as flushed.
+func (f *Flusher) rejected(chunkID uint64, c chunk, rejected *RejectedError) {
+	result := metrics.ChunkFlushed
+	switch {
+	case rejected.Dropped > 0:
+		result = metrics.ChunkDropped
+	case rejected.DeadLettered > 0:
+		result = metrics.ChunkDeadLettered
+	}
+	f.Debugw("Flushed chunk whose destination rejected entries", "chunk_id", chunkID, "error", rejected.Err,
+		"dropped", rejected.Dropped, "dead_lettered", rejected.DeadLettered)
+
+	f.metrics.AddChunk(result)
+	f.metrics.AddUndelivered(metrics.ChunkDropped, rejected.Dropped)
+	f.metrics.AddUndelivered(metrics.ChunkDeadLettered, rejected.DeadLettered)
+	if flushed := len(c.entries) - rejected.Dropped - rejected.DeadLettered; flushed > 0 {
+		f.metrics.AddEntriesOut(flushed)
+	}
+}
+
+// DeadLetter adds entries that were not delivered to the dead-letter queue of the flusher,
+// or of the pipeline. It returns false if there is no queue or the entries could not be added.
+func (f *Flusher) DeadLetter(ctx context.Context, entries []*entry.Entry, reason error) bool {
+	if f.deadLetter == nil {
+		return false
+	}
+	if err := f.deadLetter.Add(ctx, f.operatorID, entries, reason); err != nil {
+		f.Errorw("Failed to dead-letter entries", zap.Error(err), "entries", len(entries))
+		return false
+	}
+	return true
+}
+
+// pause stops new chunks from being flushed until resume is called
+func (f *Flusher) pause() {
+	f.pauseMux.Lock()
+	defer f.pauseMux.Unlock()
+
+	if f.paused == 0 {
+		f.resumed = make(chan struct{})
+	}
+	f.paused++
+}
+
+// resume undoes a call to pause
+func (f *Flusher) resume() {
+	f.pauseMux.Lock()
+	defer f.pauseMux.Unlock()
+
+	f.paused--
+	if f.paused == 0 {
+		close(f.resumed)
+	}
+}
+
+// Paused returns true if flushes are paused because a chunk exhausted its retries
+func (f *Flusher) Paused() bool {
+	f.pauseMux.Lock()
+	defer f.pauseMux.Unlock()
+	return f.paused > 0
+}
+
+// waitUntilResumed blocks while flushes are paused. It returns an error if the flusher is stopped.
+func (f *Flusher) waitUntilResumed() error {
+	f.pauseMux.Lock()
+	paused, resumed := f.paused > 0, f.resumed
+	f.pauseMux.Unlock()
+
+	if !paused {
+		return nil
+	}
+	select {
+	case <-f.ctx.Done():
+		return f.ctx.Err()
+	case <-resumed:
+		return nil
+	}
+}
+
+func (f *Flusher) nextChunkID() uint64 {
+	return atomic.AddUint64(&f.chunkIDCounter, 1)
 }
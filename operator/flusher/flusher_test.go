@@ -1,25 +1,56 @@
 package flusher
 
 import (
+	"bufio"
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"math/rand"
+	"os"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/observiq/stanza/entry"
+	"github.com/observiq/stanza/metrics"
+	"github.com/observiq/stanza/operator"
+	"github.com/observiq/stanza/operator/buffer"
+	"github.com/observiq/stanza/operator/deadletter"
+	"github.com/observiq/stanza/operator/helper"
+	"github.com/observiq/stanza/testutil"
 	"github.com/stretchr/testify/require"
-	"go.uber.org/zap/zaptest"
+	yaml "gopkg.in/yaml.v2"
 )
 
-func TestFlusher(t *testing.T) {
+func newTestFlusher(t *testing.T, cfg Config) *Flusher {
+	flusher, err := cfg.Build(testutil.NewBuildContext(t), "test")
+	require.NoError(t, err)
+	t.Cleanup(flusher.Stop)
+	return flusher
+}
 
-	// Override setting for test
-	maxElapsedTime = 5 * time.Second
+// testClearer counts how often all entries were marked as flushed
+type testClearer struct {
+	flushed int64
+}
 
-	outChan := make(chan struct{}, 100)
+func (c *testClearer) MarkAllAsFlushed() error {
+	atomic.AddInt64(&c.flushed, 1)
+	return nil
+}
+
+func (c *testClearer) MarkRangeAsFlushed(uint, uint) error {
+	return nil
+}
+
+func TestFlusher(t *testing.T) {
 	flusherCfg := NewConfig()
-	flusher := flusherCfg.Build(zaptest.NewLogger(t).Sugar())
+	flusherCfg.Retry.MaxElapsedTime = helper.NewDuration(5 * time.Second)
+	flusher := newTestFlusher(t, flusherCfg)
 
+	outChan := make(chan struct{}, 100)
 	failed := errors.New("test failure")
 	for i := 0; i < 100; i++ {
 		flusher.Do(func(_ context.Context) error {
@@ -41,17 +72,590 @@ func TestFlusher(t *testing.T) {
 	}
 }
 
+func TestConfigBuild(t *testing.T) {
+	cases := []struct {
+		name        string
+		modify      func(*Config)
+		expectedErr string
+	}{
+		{"Default", func(*Config) {}, ""},
+		{"ZeroRetry", func(c *Config) { c.Retry = RetryConfig{} }, ""},
+		{"RetryForever", func(c *Config) { c.Retry.MaxElapsedTime = helper.NewDuration(0) }, ""},
+		{"InitialInterval", func(c *Config) { c.Retry.InitialInterval = helper.NewDuration(0) }, "'initial_interval' must be positive"},
+		{"MaxInterval", func(c *Config) { c.Retry.MaxInterval = helper.NewDuration(time.Millisecond) }, "'max_interval' must not be less than 'initial_interval'"},
+		{"Multiplier", func(c *Config) { c.Retry.Multiplier = 0.5 }, "'multiplier' must be at least 1"},
+		{"Jitter", func(c *Config) { c.Retry.Jitter = 1.5 }, "'jitter' must be between 0 and 1"},
+		{"MaxAttempts", func(c *Config) { c.Retry.MaxAttempts = -1 }, "'max_attempts' must not be negative"},
+		{"OnExhausted", func(c *Config) { c.Retry.OnExhausted = "retry" }, "invalid 'on_exhausted' 'retry'"},
+		{"Adaptive", func(c *Config) { c.Adaptive.Enabled = true }, ""},
+		{"ZeroAdaptive", func(c *Config) { c.Adaptive = AdaptiveConfig{} }, ""},
+		{"MinConcurrent", func(c *Config) { c.Adaptive.Enabled, c.Adaptive.MinConcurrent = true, 0 }, "'min_concurrent' must be at least 1"},
+		{"MinConcurrentAboveMax", func(c *Config) { c.Adaptive.Enabled, c.Adaptive.MinConcurrent = true, 32 }, "'min_concurrent' must not be greater than 'max_concurrent'"},
+		{"DecreaseFactor", func(c *Config) { c.Adaptive.Enabled, c.Adaptive.DecreaseFactor = true, 1 }, "'decrease_factor' must be between 0 and 1"},
+		{"DisabledAdaptiveNotValidated", func(c *Config) { c.Adaptive.MinConcurrent = 0 }, ""},
+		{"DeadLetterWithoutQueue", func(c *Config) { c.Retry.OnExhausted = OnExhaustedDeadLetter }, "neither the flusher nor the pipeline has a 'dead_letter' queue"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := NewConfig()
+			tc.modify(&cfg)
+			flusher, err := cfg.Build(testutil.NewBuildContext(t), "test")
+			if tc.expectedErr != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tc.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			flusher.Stop()
+		})
+	}
+}
+
+func TestConfigInherit(t *testing.T) {
+	parent := NewConfig()
+	parent.MaxConcurrent = 4
+	parent.Retry.MaxAttempts = 10
+	parent.Retry.InitialInterval = helper.NewDuration(time.Second)
+	bc := testutil.NewBuildContext(t)
+	bc.Defaults = map[string]interface{}{DefaultsKey: parent}
+
+	// Settings that are left at their defaults are inherited one by one
+	cfg := NewConfig()
+	cfg.Retry.InitialInterval = helper.NewDuration(2 * time.Second)
+	inherited := cfg.inherit(bc)
+	require.Equal(t, 4, inherited.MaxConcurrent)
+	require.Equal(t, 10, inherited.Retry.MaxAttempts)
+	require.Equal(t, 2*time.Second, inherited.Retry.InitialInterval.Raw())
+	require.Equal(t, NewRetryConfig().MaxInterval, inherited.Retry.MaxInterval)
+
+	flusher, err := cfg.Build(bc, "$.output")
+	require.NoError(t, err)
+	defer flusher.Stop()
+	require.Equal(t, 4, flusher.ConcurrencyLimit())
+
+	// Without defaults, the config is unchanged
+	require.Equal(t, cfg, cfg.inherit(testutil.NewBuildContext(t)))
+}
+
+func TestConfigUnmarshal(t *testing.T) {
+	raw := `
+max_concurrent: 4
+adaptive:
+  enabled: true
+  min_concurrent: 2
+retry:
+  max_interval: 10s
+  max_attempts: 5
+  on_exhausted: dead_letter
+dead_letter:
+  path: /tmp/dead_letter.jsonl
+`
+	cfg := NewConfig()
+	require.NoError(t, yaml.UnmarshalStrict([]byte(raw), &cfg))
+
+	expected := NewConfig()
+	expected.MaxConcurrent = 4
+	expected.Adaptive.Enabled = true
+	expected.Adaptive.MinConcurrent = 2
+	expected.Retry.MaxInterval = helper.NewDuration(10 * time.Second)
+	expected.Retry.MaxAttempts = 5
+	expected.Retry.OnExhausted = OnExhaustedDeadLetter
+	expected.DeadLetter.Path = "/tmp/dead_letter.jsonl"
+	expected.set = map[string]bool{
+		"max_concurrent":          true,
+		"adaptive":                false,
+		"adaptive.enabled":        true,
+		"adaptive.min_concurrent": true,
+		"retry":                   false,
+		"retry.max_interval":      true,
+		"retry.max_attempts":      true,
+		"retry.on_exhausted":      true,
+		"dead_letter":             false,
+		"dead_letter.path":        true,
+	}
+	require.Equal(t, expected, cfg)
+}
+
+func TestConfigInheritExplicitDefaults(t *testing.T) {
+	parent := NewConfig()
+	parent.MaxConcurrent = 4
+	parent.Retry.MaxAttempts = 10
+	parent.Retry.InitialInterval = helper.NewDuration(time.Second)
+	parent.Adaptive.Enabled = true
+	bc := testutil.NewBuildContext(t)
+	bc.Defaults = map[string]interface{}{DefaultsKey: parent}
+
+	// Settings that are set to their default values are not inherited
+	check := func(t *testing.T, cfg Config) {
+		inherited := cfg.inherit(bc)
+		require.Equal(t, 16, inherited.MaxConcurrent)
+		require.Equal(t, 0, inherited.Retry.MaxAttempts)
+		require.Equal(t, time.Second, inherited.Retry.InitialInterval.Raw())
+		require.Equal(t, NewRetryConfig().MaxInterval, inherited.Retry.MaxInterval)
+		require.False(t, inherited.Adaptive.Enabled)
+	}
+
+	t.Run("YAML", func(t *testing.T) {
+		cfg := NewConfig()
+		raw := "max_concurrent: 16\nretry:\n  max_attempts: 0\nadaptive:\n  enabled: false\n"
+		require.NoError(t, yaml.UnmarshalStrict([]byte(raw), &cfg))
+		check(t, cfg)
+	})
+
+	t.Run("JSON", func(t *testing.T) {
+		cfg := NewConfig()
+		raw := `{"max_concurrent": 16, "retry": {"max_attempts": 0}, "adaptive": {"enabled": false}}`
+		require.NoError(t, json.Unmarshal([]byte(raw), &cfg))
+		check(t, cfg)
+	})
+
+	t.Run("Duration", func(t *testing.T) {
+		cfg := NewConfig()
+		require.NoError(t, yaml.UnmarshalStrict([]byte("retry:\n  initial_interval: 500ms\n"), &cfg))
+		inherited := cfg.inherit(bc)
+		require.Equal(t, 500*time.Millisecond, inherited.Retry.InitialInterval.Raw())
+		require.Equal(t, 4, inherited.MaxConcurrent)
+		require.Equal(t, 10, inherited.Retry.MaxAttempts)
+	})
+}
+
 func TestMaxElapsedTime(t *testing.T) {
+	maxElapsedTime := 100 * time.Millisecond
+	flusherCfg := NewConfig()
+	flusherCfg.Retry.MaxElapsedTime = helper.NewDuration(maxElapsedTime)
+	flusher := newTestFlusher(t, flusherCfg)
 
-	// Override setting for test
-	maxElapsedTime = 100 * time.Millisecond
+	start := time.Now()
+	flusher.flushWithRetry(context.Background(), chunk{flush: func(_ context.Context) error {
+		return errors.New("never flushes")
+	}})
+	require.WithinDuration(t, start.Add(maxElapsedTime), time.Now(), maxElapsedTime)
+}
+
+func TestMaxAttempts(t *testing.T) {
+	flusherCfg := NewConfig()
+	flusherCfg.Retry.InitialInterval = helper.NewDuration(time.Millisecond)
+	flusherCfg.Retry.MaxAttempts = 3
+	flusher := newTestFlusher(t, flusherCfg)
+
+	attempts := 0
+	flusher.flushWithRetry(context.Background(), chunk{flush: func(_ context.Context) error {
+		attempts++
+		return errors.New("never flushes")
+	}})
+	require.Equal(t, 3, attempts)
+}
 
+func TestRetryAfter(t *testing.T) {
 	flusherCfg := NewConfig()
-	flusher := flusherCfg.Build(zaptest.NewLogger(t).Sugar())
+	flusherCfg.Retry.MaxElapsedTime = helper.NewDuration(5 * time.Second)
+	flusher := newTestFlusher(t, flusherCfg)
 
+	retryAfter := 200 * time.Millisecond
+	attempts := 0
 	start := time.Now()
-	flusher.flushWithRetry(context.Background(), func(_ context.Context) error {
+	flusher.flushWithRetry(context.Background(), chunk{flush: func(_ context.Context) error {
+		attempts++
+		if attempts == 1 {
+			return NewRetryAfterError(errors.New("rate limited"), retryAfter)
+		}
+		return nil
+	}})
+	require.Equal(t, 2, attempts)
+	require.GreaterOrEqual(t, int64(time.Since(start)), int64(retryAfter))
+}
+
+func TestMetrics(t *testing.T) {
+	bc := testutil.NewBuildContext(t)
+	bc.Metrics = metrics.NewRegistry()
+	bc.Metrics.Operator("$.output").SetType("test_output")
+
+	cfg := NewConfig()
+	cfg.MaxConcurrent = 4
+	cfg.Retry.InitialInterval = helper.NewDuration(time.Millisecond)
+	cfg.Retry.MaxAttempts = 2
+	flusher, err := cfg.Build(bc, "$.output")
+	require.NoError(t, err)
+	defer flusher.Stop()
+
+	// The first chunk is flushed by the second attempt, and the second chunk is dropped
+	attempts := 0
+	flusher.flushWithRetry(context.Background(), chunk{entries: []*entry.Entry{entry.New(), entry.New()}, flush: func(_ context.Context) error {
+		attempts++
+		if attempts == 1 {
+			return errors.New("flushes on retry")
+		}
+		return nil
+	}})
+	flusher.flushWithRetry(context.Background(), chunk{entries: []*entry.Entry{entry.New()}, flush: func(_ context.Context) error {
 		return errors.New("never flushes")
+	}})
+
+	body := testutil.ScrapeMetrics(t, bc.Metrics)
+	labels := `operator_id="$.output",operator_type="test_output"`
+	require.Contains(t, body, `stanza_flush_duration_seconds_count{`+labels+`} 4`)
+	require.Contains(t, body, `stanza_flush_retries_total{`+labels+`} 2`)
+	require.Contains(t, body, `stanza_flush_chunks_total{`+labels+`,result="flushed"} 1`)
+	require.Contains(t, body, `stanza_flush_chunks_total{`+labels+`,result="dropped"} 1`)
+	require.Contains(t, body, `stanza_flush_undelivered_entries_total{`+labels+`,result="dropped"} 1`)
+	require.Contains(t, body, `stanza_flush_concurrency_limit{`+labels+`} 4`)
+	require.Contains(t, body, `stanza_operator_entries_out_total{`+labels+`} 2`)
+}
+
+func TestRejected(t *testing.T) {
+	bc := testutil.NewBuildContext(t)
+	bc.Metrics = metrics.NewRegistry()
+	bc.Metrics.Operator("$.output").SetType("test_output")
+
+	cfg := NewConfig()
+	flusher, err := cfg.Build(bc, "$.output")
+	require.NoError(t, err)
+	defer flusher.Stop()
+
+	entries := func(n int) []*entry.Entry {
+		entries := make([]*entry.Entry, n)
+		for i := range entries {
+			entries[i] = entry.New()
+		}
+		return entries
+	}
+
+	// Rejected chunks are not retried, and only their accepted entries count as flushed
+	attempts := 0
+	rejected := func(dropped, deadLettered int) FlushFunc {
+		return func(_ context.Context) error {
+			attempts++
+			return NewRejectedError(errors.New("invalid entry"), dropped, deadLettered)
+		}
+	}
+	flusher.flushWithRetry(context.Background(), chunk{entries: entries(4), flush: rejected(1, 0)})
+	flusher.flushWithRetry(context.Background(), chunk{entries: entries(3), flush: rejected(0, 3)})
+	flusher.flushWithRetry(context.Background(), chunk{entries: entries(2), flush: rejected(0, 0)})
+	require.Equal(t, 3, attempts)
+	require.Equal(t, time.Duration(0), flusher.RetryingFor())
+
+	body := testutil.ScrapeMetrics(t, bc.Metrics)
+	labels := `operator_id="$.output",operator_type="test_output"`
+	require.Contains(t, body, `stanza_flush_chunks_total{`+labels+`,result="flushed"} 1`)
+	require.Contains(t, body, `stanza_flush_chunks_total{`+labels+`,result="dropped"} 1`)
+	require.Contains(t, body, `stanza_flush_chunks_total{`+labels+`,result="dead_lettered"} 1`)
+	require.Contains(t, body, `stanza_flush_undelivered_entries_total{`+labels+`,result="dropped"} 1`)
+	require.Contains(t, body, `stanza_flush_undelivered_entries_total{`+labels+`,result="dead_lettered"} 3`)
+	require.Contains(t, body, `stanza_operator_entries_out_total{`+labels+`} 5`)
+	require.Contains(t, body, `stanza_flush_retries_total{`+labels+`} 0`)
+}
+
+func TestHealth(t *testing.T) {
+	cfg := NewConfig()
+	cfg.Retry.InitialInterval = helper.NewDuration(time.Millisecond)
+	cfg.Retry.MaxInterval = helper.NewDuration(time.Millisecond)
+	flusher := newTestFlusher(t, cfg)
+
+	memoryCfg := buffer.NewMemoryBufferConfig()
+	memoryCfg.MaxEntries = 4
+	b, err := memoryCfg.Build(testutil.NewBuildContext(t), "test")
+	require.NoError(t, err)
+	defer b.Close()
+	require.NoError(t, b.Add(context.Background(), entry.New()))
+	require.Equal(t, operator.Health{BufferUsage: 0.25}, flusher.Health(b))
+
+	// The chunk is retried until it is flushed
+	flushed := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		flusher.flushWithRetry(context.Background(), chunk{flush: func(_ context.Context) error {
+			select {
+			case <-flushed:
+				return nil
+			default:
+				return errors.New("not flushed yet")
+			}
+		}})
+	}()
+
+	require.Eventually(t, func() bool {
+		return flusher.Health(b).RetryingFor > 20*time.Millisecond
+	}, time.Second, 5*time.Millisecond)
+	close(flushed)
+	<-done
+	require.Equal(t, time.Duration(0), flusher.RetryingFor())
+}
+
+func TestOnExhausted(t *testing.T) {
+	newConfig := func(onExhausted string) Config {
+		cfg := NewConfig()
+		cfg.Retry.InitialInterval = helper.NewDuration(time.Millisecond)
+		cfg.Retry.MaxInterval = helper.NewDuration(10 * time.Millisecond)
+		cfg.Retry.MaxAttempts = 2
+		cfg.Retry.OnExhausted = onExhausted
+		return cfg
+	}
+	neverFlushes := func(_ context.Context) error {
+		return errors.New("never flushes")
+	}
+
+	t.Run("Drop", func(t *testing.T) {
+		flusher := newTestFlusher(t, newConfig(OnExhaustedDrop))
+
+		var clearer testClearer
+		flusher.flushWithRetry(context.Background(), chunk{entries: []*entry.Entry{entry.New()}, clearer: &clearer, flush: neverFlushes})
+		require.Equal(t, int64(1), clearer.flushed, "dropped entries are marked as flushed")
 	})
-	require.WithinDuration(t, start.Add(maxElapsedTime), time.Now(), maxElapsedTime)
+
+	t.Run("DeadLetter", func(t *testing.T) {
+		cfg := newConfig(OnExhaustedDeadLetter)
+		cfg.DeadLetter.Path = filepath.Join(t.TempDir(), "dead_letter.jsonl")
+		flusher := newTestFlusher(t, cfg)
+
+		entries := []*entry.Entry{entry.New(), entry.New()}
+		entries[0].Record = "first"
+		entries[1].Record = "second"
+		var clearer testClearer
+		flusher.flushWithRetry(context.Background(), chunk{entries: entries, clearer: &clearer, flush: neverFlushes})
+		require.Equal(t, int64(1), clearer.flushed, "dead-lettered entries are marked as flushed")
+
+		file, err := os.Open(cfg.DeadLetter.Path)
+		require.NoError(t, err)
+		defer file.Close()
+
+		var records []deadletter.Record
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var record deadletter.Record
+			require.NoError(t, json.Unmarshal(scanner.Bytes(), &record))
+			records = append(records, record)
+		}
+		require.Len(t, records, 2)
+		for i, record := range records {
+			require.Equal(t, "test", record.Operator)
+			require.Equal(t, "never flushes", record.Reason)
+			require.Equal(t, entries[i].Record, record.Entry.Record)
+		}
+	})
+
+	t.Run("PipelineDeadLetter", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "dead_letter.jsonl")
+		queue := deadletter.NewFileQueue(path)
+		defer queue.Close()
+		bc := testutil.NewBuildContext(t)
+		bc.DeadLetter = queue
+
+		cfg := newConfig(OnExhaustedDeadLetter)
+		flusher, err := cfg.Build(bc, "test")
+		require.NoError(t, err)
+		var clearer testClearer
+		flusher.flushWithRetry(context.Background(), chunk{entries: []*entry.Entry{entry.New()}, clearer: &clearer, flush: neverFlushes})
+		flusher.Stop()
+		require.Equal(t, int64(1), clearer.flushed)
+
+		// The queue of the pipeline is not closed by the flusher
+		require.True(t, flusher.DeadLetter(context.Background(), []*entry.Entry{entry.New()}, errors.New("rejected")))
+		require.NoError(t, queue.Close())
+
+		var lines int
+		require.NoError(t, deadletter.ReadFile(path, func(*entry.Entry) error {
+			lines++
+			return nil
+		}))
+		require.Equal(t, 2, lines)
+	})
+
+	t.Run("DeadLetterFailed", func(t *testing.T) {
+		cfg := newConfig(OnExhaustedDeadLetter)
+		cfg.DeadLetter.Path = filepath.Join(t.TempDir(), "missing", "dead_letter.jsonl")
+		flusher := newTestFlusher(t, cfg)
+
+		var clearer testClearer
+		flusher.flushWithRetry(context.Background(), chunk{entries: []*entry.Entry{entry.New()}, clearer: &clearer, flush: neverFlushes})
+		require.Zero(t, clearer.flushed, "entries that could not be dead-lettered stay in the buffer")
+	})
+
+	t.Run("Pause", func(t *testing.T) {
+		flusher := newTestFlusher(t, newConfig(OnExhaustedPause))
+
+		var recovered int64
+		var clearer testClearer
+		flusher.DoChunk(nil, &clearer, func(_ context.Context) error {
+			if atomic.LoadInt64(&recovered) == 0 {
+				return errors.New("destination is down")
+			}
+			return clearer.MarkAllAsFlushed()
+		})
+		require.Eventually(t, flusher.Paused, time.Second, time.Millisecond)
+
+		// New chunks are not flushed while paused
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			flusher.Do(func(_ context.Context) error { return nil })
+		}()
+		select {
+		case <-done:
+			require.FailNow(t, "chunk was flushed while paused")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		atomic.StoreInt64(&recovered, 1)
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			require.FailNow(t, "flushes were not resumed")
+		}
+		require.False(t, flusher.Paused())
+		require.Equal(t, int64(1), atomic.LoadInt64(&clearer.flushed))
+	})
+}
+
+// statusErr is an error caused by a response with a status code
+type statusErr int
+
+func (e statusErr) Error() string   { return fmt.Sprintf("status %d", int(e)) }
+func (e statusErr) StatusCode() int { return int(e) }
+
+// timeoutErr is a network timeout
+type timeoutErr struct{}
+
+func (timeoutErr) Error() string   { return "i/o timeout" }
+func (timeoutErr) Timeout() bool   { return true }
+func (timeoutErr) Temporary() bool { return true }
+
+func TestAdaptiveConcurrency(t *testing.T) {
+	newFlusher := func(t *testing.T) *Flusher {
+		cfg := NewConfig()
+		cfg.MaxConcurrent = 4
+		cfg.Adaptive.Enabled = true
+		cfg.Adaptive.LatencyThreshold = helper.NewDuration(time.Second)
+		return newTestFlusher(t, cfg)
+	}
+	succeed := func(f *Flusher, n int) {
+		for i := 0; i < n; i++ {
+			f.adjustConcurrency(time.Now(), nil)
+		}
+	}
+
+	t.Run("Increase", func(t *testing.T) {
+		flusher := newFlusher(t)
+		require.Equal(t, 1, flusher.ConcurrencyLimit(), "the limit starts at min_concurrent")
+
+		// The limit is raised by one after a full limit of successful flushes
+		succeed(flusher, 1)
+		require.Equal(t, 2, flusher.ConcurrencyLimit())
+		succeed(flusher, 1)
+		require.Equal(t, 2, flusher.ConcurrencyLimit())
+		succeed(flusher, 1)
+		require.Equal(t, 3, flusher.ConcurrencyLimit())
+		succeed(flusher, 10)
+		require.Equal(t, 4, flusher.ConcurrencyLimit(), "the limit is not raised above max_concurrent")
+
+		// Slow flushes do not raise the limit
+		flusher = newFlusher(t)
+		flusher.adjustConcurrency(time.Now().Add(-2*time.Second), nil)
+		require.Equal(t, 1, flusher.ConcurrencyLimit())
+	})
+
+	t.Run("Decrease", func(t *testing.T) {
+		flusher := newFlusher(t)
+		succeed(flusher, 10)
+		require.Equal(t, 4, flusher.ConcurrencyLimit())
+
+		start := time.Now()
+		flusher.adjustConcurrency(start, statusErr(503))
+		require.Equal(t, 2, flusher.ConcurrencyLimit())
+
+		// Flushes that started before the limit was cut do not cut it again
+		flusher.adjustConcurrency(start, timeoutErr{})
+		require.Equal(t, 2, flusher.ConcurrencyLimit())
+
+		flusher.adjustConcurrency(time.Now(), NewRetryAfterError(statusErr(429), time.Second))
+		require.Equal(t, 1, flusher.ConcurrencyLimit())
+		flusher.adjustConcurrency(time.Now(), timeoutErr{})
+		require.Equal(t, 1, flusher.ConcurrencyLimit(), "the limit is not cut below min_concurrent")
+	})
+
+	t.Run("OtherErrors", func(t *testing.T) {
+		flusher := newFlusher(t)
+		succeed(flusher, 10)
+		flusher.adjustConcurrency(time.Now(), statusErr(400))
+		flusher.adjustConcurrency(time.Now(), errors.New("invalid entry"))
+		require.Equal(t, 4, flusher.ConcurrencyLimit())
+	})
+
+	t.Run("Metrics", func(t *testing.T) {
+		bc := testutil.NewBuildContext(t)
+		bc.Metrics = metrics.NewRegistry()
+		bc.Metrics.Operator("$.output").SetType("test_output")
+
+		cfg := NewConfig()
+		cfg.MaxConcurrent = 4
+		cfg.Adaptive.Enabled = true
+		cfg.Adaptive.LatencyThreshold = helper.NewDuration(time.Second)
+		flusher, err := cfg.Build(bc, "$.output")
+		require.NoError(t, err)
+		defer flusher.Stop()
+
+		// The gauge reports the limit as it is raised and cut
+		gauge := `stanza_flush_concurrency_limit{operator_id="$.output",operator_type="test_output"} `
+		require.Contains(t, testutil.ScrapeMetrics(t, bc.Metrics), gauge+"1\n")
+		succeed(flusher, 10)
+		require.Contains(t, testutil.ScrapeMetrics(t, bc.Metrics), gauge+"4\n")
+		flusher.adjustConcurrency(time.Now(), statusErr(503))
+		require.Contains(t, testutil.ScrapeMetrics(t, bc.Metrics), gauge+"2\n")
+	})
+
+	t.Run("LimitsFlushes", func(t *testing.T) {
+		flusher := newFlusher(t)
+
+		var inFlight, maxInFlight int64
+		release := make(chan struct{})
+		done := make(chan struct{}, 3)
+		go func() {
+			for i := 0; i < 3; i++ {
+				flusher.Do(func(_ context.Context) error {
+					n := atomic.AddInt64(&inFlight, 1)
+					if n > atomic.LoadInt64(&maxInFlight) {
+						atomic.StoreInt64(&maxInFlight, n)
+					}
+					<-release
+					atomic.AddInt64(&inFlight, -1)
+					done <- struct{}{}
+					return nil
+				})
+			}
+		}()
+
+		require.Eventually(t, func() bool { return atomic.LoadInt64(&inFlight) == 1 }, time.Second, time.Millisecond)
+		time.Sleep(20 * time.Millisecond)
+		require.Equal(t, int64(1), atomic.LoadInt64(&inFlight), "only one chunk is flushed at the initial limit")
+
+		close(release)
+		for i := 0; i < 3; i++ {
+			<-done
+		}
+		require.Equal(t, int64(1), atomic.LoadInt64(&maxInFlight))
+	})
+}
+
+func TestOverloaded(t *testing.T) {
+	cases := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{"RetryAfter", NewRetryAfterError(errors.New("rate limited"), time.Second), true},
+		{"TooManyRequests", statusErr(429), true},
+		{"ServerError", fmt.Errorf("send: %w", statusErr(502)), true},
+		{"BadRequest", statusErr(400), false},
+		{"Timeout", fmt.Errorf("send: %w", timeoutErr{}), true},
+		{"DeadlineExceeded", context.DeadlineExceeded, true},
+		{"Canceled", context.Canceled, false},
+		{"Other", errors.New("connection refused"), false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.expected, overloaded(tc.err))
+		})
+	}
 }
@@ -0,0 +1,215 @@
+package flusher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/observiq/stanza/operator/deadletter"
+	"github.com/observiq/stanza/operator/helper"
+)
+
+// AdaptiveConfig configures adaptive concurrency. If it is enabled, the number of chunks
+// that are flushed concurrently starts at MinConcurrent and is raised up to the
+// MaxConcurrent of the flusher while flushes succeed quickly. It is cut when flushes
+// time out or the destination reports that it is overloaded.
+type AdaptiveConfig struct {
+	// Enabled turns on adaptive concurrency
+	Enabled bool `json:"enabled" yaml:"enabled"`
+
+	// MinConcurrent is the lowest that the concurrency limit is cut to
+	MinConcurrent int `json:"min_concurrent" yaml:"min_concurrent"`
+
+	// LatencyThreshold is the duration that a flush must succeed within to raise the
+	// limit. Zero means that every successful flush counts.
+	LatencyThreshold helper.Duration `json:"latency_threshold" yaml:"latency_threshold"`
+
+	// DecreaseFactor is the factor by which the limit is multiplied when it is cut
+	DecreaseFactor float64 `json:"decrease_factor" yaml:"decrease_factor"`
+}
+
+// NewAdaptiveConfig creates a new default adaptive concurrency config
+func NewAdaptiveConfig() AdaptiveConfig {
+	return AdaptiveConfig{
+		MinConcurrent:    1,
+		LatencyThreshold: helper.NewDuration(5 * time.Second),
+		DecreaseFactor:   0.5,
+	}
+}
+
+// validate returns an error if the config is invalid for a flusher with the given max concurrency
+func (c AdaptiveConfig) validate(maxConcurrent int) error {
+	if !c.Enabled {
+		return nil
+	}
+
+	switch {
+	case c.MinConcurrent < 1:
+		return fmt.Errorf("'min_concurrent' must be at least 1")
+	case c.MinConcurrent > maxConcurrent:
+		return fmt.Errorf("'min_concurrent' must not be greater than 'max_concurrent'")
+	case c.LatencyThreshold.Raw() < 0:
+		return fmt.Errorf("'latency_threshold' must not be negative")
+	case c.DecreaseFactor <= 0 || c.DecreaseFactor >= 1:
+		return fmt.Errorf("'decrease_factor' must be between 0 and 1")
+	}
+	return nil
+}
+
+// limiter limits the number of chunks that are flushed concurrently. A fixed limiter
+// always allows max chunks. An adaptive limiter raises its limit by one once a full
+// limit of flushes succeeded quickly, and multiplies it by the decrease factor when
+// a flush indicates that the destination is overloaded.
+type limiter struct {
+	adaptive         bool
+	min              int
+	max              int
+	latencyThreshold time.Duration
+	decreaseFactor   float64
+
+	mux      sync.Mutex
+	limit    int
+	inFlight int
+	// successes is the number of quick successful flushes since the limit last changed
+	successes int
+	// lastDecrease is the time the limit was last cut. Flushes that started
+	// before it do not cut it again, because they ran with the old limit.
+	lastDecrease time.Time
+	// released is closed and replaced when a chunk may be able to acquire a slot
+	released chan struct{}
+}
+
+func newFixedLimiter(max int) *limiter {
+	return &limiter{
+		min:      max,
+		max:      max,
+		limit:    max,
+		released: make(chan struct{}),
+	}
+}
+
+func newAdaptiveLimiter(cfg AdaptiveConfig, max int) *limiter {
+	return &limiter{
+		adaptive:         true,
+		min:              cfg.MinConcurrent,
+		max:              max,
+		latencyThreshold: cfg.LatencyThreshold.Raw(),
+		decreaseFactor:   cfg.DecreaseFactor,
+		limit:            cfg.MinConcurrent,
+		released:         make(chan struct{}),
+	}
+}
+
+// acquire blocks until fewer chunks than the limit are being flushed, or the context is done
+func (l *limiter) acquire(ctx context.Context) error {
+	for {
+		l.mux.Lock()
+		if l.inFlight < l.limit {
+			l.inFlight++
+			l.mux.Unlock()
+			return nil
+		}
+		released := l.released
+		l.mux.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-released:
+		}
+	}
+}
+
+// release frees the slot of a chunk that is done
+func (l *limiter) release() {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.inFlight--
+	l.notify()
+}
+
+// notify wakes up the chunks waiting for a slot. The mutex must be held.
+func (l *limiter) notify() {
+	close(l.released)
+	l.released = make(chan struct{})
+}
+
+// current returns the current limit
+func (l *limiter) current() int {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return l.limit
+}
+
+// observe adjusts the limit of an adaptive limiter with the result of a flush that started
+// at the given time. It returns the new limit, and whether the limit was changed.
+func (l *limiter) observe(start time.Time, err error) (int, bool) {
+	if !l.adaptive {
+		return l.max, false
+	}
+	latency := time.Since(start)
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	switch {
+	case err == nil:
+		if l.latencyThreshold > 0 && latency > l.latencyThreshold {
+			return l.limit, false
+		}
+		if l.limit >= l.max {
+			return l.limit, false
+		}
+		l.successes++
+		if l.successes < l.limit {
+			return l.limit, false
+		}
+		l.limit++
+		l.successes = 0
+		l.notify()
+		return l.limit, true
+	case overloaded(err):
+		if start.Before(l.lastDecrease) {
+			return l.limit, false
+		}
+		l.lastDecrease = time.Now()
+		l.successes = 0
+		limit := int(float64(l.limit) * l.decreaseFactor)
+		if limit < l.min {
+			limit = l.min
+		}
+		if limit == l.limit {
+			return l.limit, false
+		}
+		l.limit = limit
+		return l.limit, true
+	default:
+		// Other errors, such as rejected entries, say nothing about the load of the destination
+		return l.limit, false
+	}
+}
+
+// overloaded returns true if a flush error indicates that the destination is overloaded.
+// These are timeouts, requests to retry later, and responses with a 429 or 5xx status code.
+func overloaded(err error) bool {
+	var retryAfter *RetryAfterError
+	if errors.As(err, &retryAfter) {
+		return true
+	}
+
+	var coder deadletter.StatusCoder
+	if errors.As(err, &coder) {
+		code := coder.StatusCode()
+		return code == http.StatusTooManyRequests || code >= http.StatusInternalServerError
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,95 @@
+package flusher
+
+import (
+	"fmt"
+	"time"
+
+	backoff "github.com/cenkalti/backoff/v4"
+	"github.com/observiq/stanza/operator/helper"
+)
+
+// Actions taken when a chunk could not be flushed before the retries were exhausted
+const (
+	// OnExhaustedDrop drops the chunk
+	OnExhaustedDrop = "drop"
+	// OnExhaustedDeadLetter writes the entries of the chunk to the dead-letter sink
+	OnExhaustedDeadLetter = "dead_letter"
+	// OnExhaustedPause keeps retrying the chunk and stops flushing new chunks until it is flushed
+	OnExhaustedPause = "pause"
+)
+
+// RetryConfig configures how failed flushes are retried
+type RetryConfig struct {
+	// InitialInterval is the time to wait before the first retry
+	InitialInterval helper.Duration `json:"initial_interval" yaml:"initial_interval"`
+
+	// MaxInterval is the maximum time to wait between two retries
+	MaxInterval helper.Duration `json:"max_interval" yaml:"max_interval"`
+
+	// Multiplier is the factor by which the interval grows after every retry
+	Multiplier float64 `json:"multiplier" yaml:"multiplier"`
+
+	// Jitter randomizes every interval by up to this fraction of the interval
+	Jitter float64 `json:"jitter" yaml:"jitter"`
+
+	// MaxElapsedTime is the time after which a chunk is no longer retried.
+	// Zero means that there is no time limit.
+	MaxElapsedTime helper.Duration `json:"max_elapsed_time" yaml:"max_elapsed_time"`
+
+	// MaxAttempts is the number of attempts after which a chunk is no longer retried.
+	// Zero means that there is no limit.
+	MaxAttempts int `json:"max_attempts" yaml:"max_attempts"`
+
+	// OnExhausted is the action taken when a chunk is no longer retried
+	OnExhausted string `json:"on_exhausted" yaml:"on_exhausted"`
+}
+
+// NewRetryConfig creates a new default retry config
+func NewRetryConfig() RetryConfig {
+	return RetryConfig{
+		InitialInterval: helper.NewDuration(50 * time.Millisecond),
+		MaxInterval:     helper.NewDuration(time.Minute),
+		Multiplier:      backoff.DefaultMultiplier,
+		Jitter:          backoff.DefaultRandomizationFactor,
+		MaxElapsedTime:  helper.NewDuration(time.Hour),
+		OnExhausted:     OnExhaustedDrop,
+	}
+}
+
+// validate returns an error if the config is invalid
+func (c RetryConfig) validate() error {
+	switch {
+	case c.InitialInterval.Raw() <= 0:
+		return fmt.Errorf("'initial_interval' must be positive")
+	case c.MaxInterval.Raw() < c.InitialInterval.Raw():
+		return fmt.Errorf("'max_interval' must not be less than 'initial_interval'")
+	case c.Multiplier < 1:
+		return fmt.Errorf("'multiplier' must be at least 1")
+	case c.Jitter < 0 || c.Jitter > 1:
+		return fmt.Errorf("'jitter' must be between 0 and 1")
+	case c.MaxAttempts < 0:
+		return fmt.Errorf("'max_attempts' must not be negative")
+	}
+
+	switch c.OnExhausted {
+	case OnExhaustedDrop, OnExhaustedDeadLetter, OnExhaustedPause:
+		return nil
+	default:
+		return fmt.Errorf("invalid 'on_exhausted' '%s'", c.OnExhausted)
+	}
+}
+
+// newBackoff creates the backoff of a chunk
+func (c RetryConfig) newBackoff() *backoff.ExponentialBackOff {
+	b := &backoff.ExponentialBackOff{
+		InitialInterval:     c.InitialInterval.Raw(),
+		RandomizationFactor: c.Jitter,
+		Multiplier:          c.Multiplier,
+		MaxInterval:         c.MaxInterval.Raw(),
+		MaxElapsedTime:      c.MaxElapsedTime.Raw(),
+		Stop:                backoff.Stop,
+		Clock:               backoff.SystemClock,
+	}
+	b.Reset()
+	return b
+}
@@ -0,0 +1,19 @@
+package operator
+
+import "time"
+
+// Health is the health of a running operator
+type Health struct {
+	// Err is set if the operator cannot do its work
+	Err error
+	// RetryingFor is how long the operator has been retrying to send entries without success
+	RetryingFor time.Duration
+	// BufferUsage is the fraction of the capacity of the buffer of the operator that is used
+	BufferUsage float64
+}
+
+// HealthReporter is implemented by operators that report their health, such as the
+// outputs that buffer entries.
+type HealthReporter interface {
+	Health() Health
+}
@@ -0,0 +1,125 @@
+package helper
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// Supported compression algorithms
+const (
+	CompressionNone    = "none"
+	CompressionGzip    = "gzip"
+	CompressionDeflate = "deflate"
+)
+
+// NewCompressionConfig creates a new compression config using the given algorithm by default
+func NewCompressionConfig(compression string) CompressionConfig {
+	return CompressionConfig{
+		Compression:      compression,
+		CompressionLevel: gzip.DefaultCompression,
+	}
+}
+
+// CompressionConfig is the configuration of request body compression
+type CompressionConfig struct {
+	Compression      string `json:"compression,omitempty"       yaml:"compression,omitempty"`
+	CompressionLevel int    `json:"compression_level,omitempty" yaml:"compression_level,omitempty"`
+}
+
+// Build will build a Compressor from the config
+func (c CompressionConfig) Build() (*Compressor, error) {
+	compression := strings.ToLower(c.Compression)
+	switch compression {
+	case "", CompressionNone:
+		return &Compressor{compression: CompressionNone}, nil
+	case CompressionGzip, CompressionDeflate:
+	default:
+		return nil, fmt.Errorf("unsupported compression '%s'", c.Compression)
+	}
+
+	// gzip and zlib share the same compression levels
+	if c.CompressionLevel < gzip.HuffmanOnly || c.CompressionLevel > gzip.BestCompression {
+		return nil, fmt.Errorf("invalid compression_level %d, must be between %d and %d",
+			c.CompressionLevel, gzip.HuffmanOnly, gzip.BestCompression)
+	}
+
+	return &Compressor{
+		compression: compression,
+		level:       c.CompressionLevel,
+	}, nil
+}
+
+// Compressor compresses request bodies
+type Compressor struct {
+	compression string
+	level       int
+}
+
+// ContentEncoding returns the value of the Content-Encoding header for compressed
+// bodies. It returns an empty string if bodies are not compressed.
+func (c *Compressor) ContentEncoding() string {
+	if c.compression == CompressionNone {
+		return ""
+	}
+	return c.compression
+}
+
+// Compress returns the compressed data
+func (c *Compressor) Compress(data []byte) ([]byte, error) {
+	if c.compression == CompressionNone {
+		return data, nil
+	}
+
+	var buf bytes.Buffer
+	wr, err := c.NewWriter(&buf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := wr.Write(data); err != nil {
+		return nil, err
+	}
+	if err := wr.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// NewWriter returns a writer that compresses everything written to w. The writer
+// must be closed to flush the compressed data.
+func (c *Compressor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	switch c.compression {
+	case CompressionGzip:
+		return gzip.NewWriterLevel(w, c.level)
+	case CompressionDeflate:
+		// The deflate content encoding is the zlib format (RFC 1950)
+		return zlib.NewWriterLevel(w, c.level)
+	default:
+		return nopWriteCloser{w}, nil
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// NewDecompressingReader returns a reader that decompresses r according to the
+// value of a Content-Encoding header
+func NewDecompressingReader(contentEncoding string, r io.Reader) (io.ReadCloser, error) {
+	switch strings.ToLower(strings.TrimSpace(contentEncoding)) {
+	case "", "identity":
+		return ioutil.NopCloser(r), nil
+	case CompressionGzip:
+		return gzip.NewReader(r)
+	case CompressionDeflate:
+		return zlib.NewReader(r)
+	default:
+		return nil, fmt.Errorf("unsupported content encoding '%s'", contentEncoding)
+	}
+}
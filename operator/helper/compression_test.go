@@ -0,0 +1,78 @@
+package helper
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressionConfigBuild(t *testing.T) {
+	cases := []struct {
+		name        string
+		config      CompressionConfig
+		expectedErr string
+	}{
+		{"Empty", CompressionConfig{}, ""},
+		{"None", NewCompressionConfig("none"), ""},
+		{"Gzip", NewCompressionConfig("gzip"), ""},
+		{"Deflate", NewCompressionConfig("deflate"), ""},
+		{"UpperCase", NewCompressionConfig("GZIP"), ""},
+		{"BestSpeed", CompressionConfig{Compression: "gzip", CompressionLevel: gzip.BestSpeed}, ""},
+		{"Unsupported", NewCompressionConfig("zstd"), "unsupported compression 'zstd'"},
+		{"InvalidLevel", CompressionConfig{Compression: "gzip", CompressionLevel: 10}, "invalid compression_level 10, must be between -2 and 9"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := tc.config.Build()
+			if tc.expectedErr == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.EqualError(t, err, tc.expectedErr)
+		})
+	}
+}
+
+func TestCompressor(t *testing.T) {
+	data := []byte(strings.Repeat("a log message that compresses well\n", 100))
+
+	cases := []struct {
+		compression     string
+		contentEncoding string
+	}{
+		{"none", ""},
+		{"gzip", "gzip"},
+		{"deflate", "deflate"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.compression, func(t *testing.T) {
+			compressor, err := NewCompressionConfig(tc.compression).Build()
+			require.NoError(t, err)
+			require.Equal(t, tc.contentEncoding, compressor.ContentEncoding())
+
+			compressed, err := compressor.Compress(data)
+			require.NoError(t, err)
+			if tc.contentEncoding != "" {
+				require.Less(t, len(compressed), len(data))
+			}
+
+			rd, err := NewDecompressingReader(compressor.ContentEncoding(), bytes.NewReader(compressed))
+			require.NoError(t, err)
+			decompressed, err := ioutil.ReadAll(rd)
+			require.NoError(t, err)
+			require.NoError(t, rd.Close())
+			require.Equal(t, data, decompressed)
+		})
+	}
+}
+
+func TestNewDecompressingReaderUnsupported(t *testing.T) {
+	_, err := NewDecompressingReader("br", bytes.NewReader(nil))
+	require.EqualError(t, err, "unsupported content encoding 'br'")
+}
@@ -131,6 +131,7 @@ func GetExprEnv(e *entry.Entry) map[string]interface{} {
 	env["$labels"] = e.Labels
 	env["$resource"] = e.Resource
 	env["$timestamp"] = e.Timestamp
+	env["$severity"] = int(e.Severity)
 
 	return env
 }
@@ -49,6 +49,8 @@ func (c InputConfig) Build(context operator.BuildContext) (InputOperator, error)
 		Identifier:     identifier,
 		WriterOperator: writerOperator,
 		WriteTo:        c.WriteTo,
+		globalLabels:   context.Labels,
+		globalResource: context.Resource,
 	}
 
 	return inputOperator, nil
@@ -60,6 +62,10 @@ type InputOperator struct {
 	Identifier
 	WriterOperator
 	WriteTo entry.Field
+
+	// globalLabels and globalResource are added to every entry that the input writes
+	globalLabels   map[string]string
+	globalResource map[string]string
 }
 
 // NewEntry will create a new entry using the `write_to`, `labels`, and `resource` configuration.
@@ -80,6 +86,22 @@ func (i *InputOperator) NewEntry(value interface{}) (*entry.Entry, error) {
 	return entry, nil
 }
 
+// Write adds the global labels and resource keys that the entry does not have yet,
+// and writes it to the outputs of the input.
+func (i *InputOperator) Write(ctx context.Context, e *entry.Entry) {
+	for k, v := range i.globalLabels {
+		if _, ok := e.Labels[k]; !ok {
+			e.AddLabel(k, v)
+		}
+	}
+	for k, v := range i.globalResource {
+		if _, ok := e.Resource[k]; !ok {
+			e.AddResourceKey(k, v)
+		}
+	}
+	i.WriterOperator.Write(ctx, e)
+}
+
 // CanProcess will always return false for an input operator.
 func (i *InputOperator) CanProcess() bool {
 	return false
@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	"github.com/observiq/stanza/entry"
+	"github.com/observiq/stanza/operator"
 	"github.com/observiq/stanza/testutil"
 	"github.com/stretchr/testify/require"
 )
@@ -131,3 +132,25 @@ func TestInputOperatorNewEntry(t *testing.T) {
 	require.True(t, exists)
 	require.Equal(t, "resource", resourceValue)
 }
+
+func TestInputOperatorWriteGlobals(t *testing.T) {
+	buildContext := testutil.NewBuildContext(t)
+	buildContext.Labels = map[string]string{"env": "prod", "team": "platform"}
+	buildContext.Resource = map[string]string{"host": "global"}
+
+	config := NewInputConfig("test-id", "test-type")
+	config.OutputIDs = []string{"fake"}
+	input, err := config.Build(buildContext)
+	require.NoError(t, err)
+
+	output := testutil.NewFakeOutput(t)
+	require.NoError(t, input.SetOutputs([]operator.Operator{output}))
+
+	e := entry.New()
+	e.AddLabel("env", "dev")
+	input.Write(context.Background(), e)
+
+	received := <-output.Received
+	require.Equal(t, map[string]string{"env": "dev", "team": "platform"}, received.Labels)
+	require.Equal(t, map[string]string{"host": "global"}, received.Resource)
+}
@@ -2,6 +2,7 @@ package helper
 
 import (
 	"github.com/observiq/stanza/errors"
+	"github.com/observiq/stanza/metrics"
 	"github.com/observiq/stanza/operator"
 	"go.uber.org/zap"
 )
@@ -57,7 +58,9 @@ func (c BasicConfig) Build(context operator.BuildContext) (BasicOperator, error)
 		OperatorID:    namespacedID,
 		OperatorType:  c.Type(),
 		SugaredLogger: context.Logger.With("operator_id", namespacedID, "operator_type", c.Type()),
+		metrics:       context.Metrics.Operator(namespacedID),
 	}
+	operator.metrics.SetType(c.Type())
 
 	return operator, nil
 }
@@ -67,6 +70,7 @@ type BasicOperator struct {
 	OperatorID   string
 	OperatorType string
 	*zap.SugaredLogger
+	metrics *metrics.Operator
 }
 
 // ID will return the operator id.
@@ -87,6 +91,11 @@ func (p *BasicOperator) Logger() *zap.SugaredLogger {
 	return p.SugaredLogger
 }
 
+// Metrics returns the operator's metrics. It is nil if metrics are not enabled.
+func (p *BasicOperator) Metrics() *metrics.Operator {
+	return p.metrics
+}
+
 // Start will start the operator.
 func (p *BasicOperator) Start() error {
 	return nil
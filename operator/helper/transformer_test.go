@@ -6,6 +6,7 @@ import (
 	"testing"
 
 	"github.com/observiq/stanza/entry"
+	"github.com/observiq/stanza/metrics"
 	"github.com/observiq/stanza/operator"
 	"github.com/observiq/stanza/testutil"
 	"github.com/stretchr/testify/mock"
@@ -111,6 +112,24 @@ func TestTransformerSendOnError(t *testing.T) {
 	output.AssertCalled(t, "Process", mock.Anything, mock.Anything)
 }
 
+func TestTransformerEntryErrorMetrics(t *testing.T) {
+	bc := testutil.NewBuildContext(t)
+	bc.Metrics = metrics.NewRegistry()
+	cfg := NewTransformerConfig("test", "test_transformer")
+	cfg.OnError = DropOnError
+	transformer, err := cfg.Build(bc)
+	require.NoError(t, err)
+
+	transform := func(e *entry.Entry) error {
+		return fmt.Errorf("Failure")
+	}
+	require.Error(t, transformer.ProcessWith(context.Background(), entry.New(), transform))
+
+	body := testutil.ScrapeMetrics(t, bc.Metrics)
+	require.Contains(t, body, `stanza_operator_entry_errors_total{operator_id="$.test",operator_type="test_transformer"} 1`)
+	require.Contains(t, body, `stanza_operator_entries_out_total{operator_id="$.test",operator_type="test_transformer"} 0`)
+}
+
 func TestTransformerProcessWithValid(t *testing.T) {
 	output := &testutil.Operator{}
 	output.On("ID").Return("test-output")
@@ -4,8 +4,10 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"sync"
 
 	"github.com/observiq/stanza/entry"
+	"github.com/observiq/stanza/metrics"
 	"github.com/observiq/stanza/operator"
 )
 
@@ -47,10 +49,30 @@ type WriterOperator struct {
 	BasicOperator
 	OutputIDs       OutputIDs
 	OutputOperators []operator.Operator
+
+	// outputMetrics are the metrics of the output operators, in the same order
+	outputMetrics []*metrics.Operator
+
+	// outputsMux guards the outputs of a writer, so that a reload can connect it to new
+	// outputs while it is running. It is created when the outputs are first set, which
+	// is before the operator is started.
+	outputsMux *sync.RWMutex
 }
 
 // Write will write an entry to the outputs of the operator.
 func (w *WriterOperator) Write(ctx context.Context, e *entry.Entry) {
+	// The lock is held while the entry is processed, so that the previous outputs
+	// receive no entries once the outputs were set
+	if w.outputsMux != nil {
+		w.outputsMux.RLock()
+		defer w.outputsMux.RUnlock()
+	}
+
+	w.metrics.AddEntriesOut(1)
+	for _, m := range w.outputMetrics {
+		m.AddEntriesIn(1)
+	}
+
 	for i, operator := range w.OutputOperators {
 		if i == len(w.OutputOperators)-1 {
 			if err := operator.Process(ctx, e); err != nil {
@@ -71,6 +93,10 @@ func (w *WriterOperator) CanOutput() bool {
 
 // Outputs returns the outputs of the writer operator.
 func (w *WriterOperator) Outputs() []operator.Operator {
+	if w.outputsMux != nil {
+		w.outputsMux.RLock()
+		defer w.outputsMux.RUnlock()
+	}
 	return w.OutputOperators
 }
 
@@ -91,7 +117,13 @@ func (w *WriterOperator) SetOutputs(operators []operator.Operator) error {
 		outputOperators = append(outputOperators, operator)
 	}
 
+	if w.outputsMux == nil {
+		w.outputsMux = &sync.RWMutex{}
+	}
+	w.outputsMux.Lock()
+	defer w.outputsMux.Unlock()
 	w.OutputOperators = outputOperators
+	w.outputMetrics = OutputMetrics(outputOperators)
 	return nil
 }
 
@@ -105,6 +137,19 @@ func (w *WriterOperator) findOperator(operators []operator.Operator, operatorID
 	return nil, false
 }
 
+// OutputMetrics returns the metrics of the operators that record metrics. Writers count the
+// entries they write to an operator with its metrics, because operators process entries in
+// many different ways.
+func OutputMetrics(operators []operator.Operator) []*metrics.Operator {
+	outputMetrics := make([]*metrics.Operator, 0, len(operators))
+	for _, op := range operators {
+		if m, ok := op.(interface{ Metrics() *metrics.Operator }); ok && m.Metrics() != nil {
+			outputMetrics = append(outputMetrics, m.Metrics())
+		}
+	}
+	return outputMetrics
+}
+
 // OutputIDs is a collection of operator IDs used as outputs.
 type OutputIDs []string
 
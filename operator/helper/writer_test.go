@@ -6,6 +6,7 @@ import (
 	"testing"
 
 	"github.com/observiq/stanza/entry"
+	"github.com/observiq/stanza/metrics"
 	"github.com/observiq/stanza/operator"
 	"github.com/observiq/stanza/testutil"
 	"github.com/stretchr/testify/mock"
@@ -53,6 +54,37 @@ func TestWriterOperatorWrite(t *testing.T) {
 	output2.AssertCalled(t, "Process", ctx, mock.Anything)
 }
 
+func TestWriterOperatorWriteMetrics(t *testing.T) {
+	bc := testutil.NewBuildContext(t)
+	bc.Metrics = metrics.NewRegistry()
+
+	writer, err := NewWriterConfig("writer", "test_writer").Build(bc)
+	require.NoError(t, err)
+	writer.OutputIDs = OutputIDs{"$.output"}
+
+	outputWriter, err := NewWriterConfig("output", "test_output").Build(bc)
+	require.NoError(t, err)
+	output := &metricsOperator{WriterOperator: outputWriter}
+	require.NoError(t, writer.SetOutputs([]operator.Operator{output}))
+
+	writer.Write(context.Background(), entry.New())
+	writer.Write(context.Background(), entry.New())
+
+	body := testutil.ScrapeMetrics(t, bc.Metrics)
+	require.Contains(t, body, `stanza_operator_entries_out_total{operator_id="$.writer",operator_type="test_writer"} 2`)
+	require.Contains(t, body, `stanza_operator_entries_in_total{operator_id="$.output",operator_type="test_output"} 2`)
+	require.Contains(t, body, `stanza_operator_entries_in_total{operator_id="$.writer",operator_type="test_writer"} 0`)
+}
+
+// metricsOperator is an operator that processes entries without doing anything
+type metricsOperator struct {
+	WriterOperator
+}
+
+func (o *metricsOperator) CanProcess() bool { return true }
+
+func (o *metricsOperator) Process(context.Context, *entry.Entry) error { return nil }
+
 func TestWriterOperatorCanOutput(t *testing.T) {
 	writer := WriterOperator{}
 	require.True(t, writer.CanOutput())
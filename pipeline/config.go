@@ -27,16 +27,41 @@ func (c Config) BuildPipeline(bc operator.BuildContext, defaultOperator operator
 		bc.DefaultOutputIDs = []string{defaultOperator.ID()}
 	}
 
-	operators, err := c.BuildOperators(bc)
-	if err != nil {
-		return nil, err
+	built := make([]builtConfig, 0, len(c))
+	operators := make([]operator.Operator, 0, len(c))
+	for i := range c {
+		b, err := c.build(i, bc)
+		if err != nil {
+			return nil, err
+		}
+		built = append(built, b)
+		operators = append(operators, b.operators...)
 	}
 
 	if defaultOperator != nil {
 		operators = append(operators, defaultOperator)
 	}
 
-	return NewDirectedPipeline(operators)
+	pipeline, err := NewDirectedPipeline(operators)
+	if err != nil {
+		return nil, err
+	}
+	pipeline.source = &source{config: c, bc: bc, defaultOperator: defaultOperator, built: built}
+	return pipeline, nil
+}
+
+// build builds the operators of the config at index i
+func (c Config) build(i int, bc operator.BuildContext) (builtConfig, error) {
+	nbc := getBuildContextWithDefaultOutput(c, i, bc)
+	operators, err := c[i].Build(nbc)
+	if err != nil {
+		return builtConfig{}, err
+	}
+	return builtConfig{
+		id:        bc.PrependNamespace(c[i].ID()),
+		key:       configKey(c[i], nbc),
+		operators: operators,
+	}, nil
 }
 
 func getBuildContextWithDefaultOutput(configs []operator.Config, i int, bc operator.BuildContext) operator.BuildContext {
@@ -3,6 +3,7 @@ package pipeline
 import (
 	"fmt"
 	"strings"
+	"sync"
 
 	"github.com/observiq/stanza/errors"
 	"github.com/observiq/stanza/operator"
@@ -16,6 +17,15 @@ var _ Pipeline = (*DirectedPipeline)(nil)
 // DirectedPipeline is a pipeline backed by a directed graph
 type DirectedPipeline struct {
 	Graph *simple.DirectedGraph
+
+	// source is the config that the pipeline was built from, if it was built from one
+	source *source
+
+	// started is true while the operators of the pipeline are running, and missing holds the
+	// ids of the operator configs whose operators could not be restored by a failed reload
+	stateMux sync.Mutex
+	started  bool
+	missing  []string
 }
 
 // Start will start the operators in a pipeline in reverse topological order
@@ -33,11 +43,13 @@ func (p *DirectedPipeline) Start() error {
 		operator.Logger().Debug("Started operator")
 	}
 
+	p.setStarted(true, nil)
 	return nil
 }
 
 // Stop will stop the operators in a pipeline in topological order
 func (p *DirectedPipeline) Stop() error {
+	p.setStarted(false, nil)
 	sortedNodes, err := topo.Sort(p.Graph)
 	if err != nil {
 		return err
@@ -142,14 +154,14 @@ func connectNode(graph *simple.DirectedGraph, inputNode OperatorNode) error {
 	return nil
 }
 
-// setOperatorOutputs will set the outputs on operators that can output.
-func setOperatorOutputs(operators []operator.Operator) error {
+// setOperatorOutputs will set the outputs on operators that can output, looking them up in outputs.
+func setOperatorOutputs(operators []operator.Operator, outputs []operator.Operator) error {
 	for _, operator := range operators {
 		if !operator.CanOutput() {
 			continue
 		}
 
-		if err := operator.SetOutputs(operators); err != nil {
+		if err := operator.SetOutputs(outputs); err != nil {
 			return errors.WithDetails(err, "operator_id", operator.ID())
 		}
 	}
@@ -158,7 +170,14 @@ func setOperatorOutputs(operators []operator.Operator) error {
 
 // NewDirectedPipeline creates a new directed pipeline
 func NewDirectedPipeline(operators []operator.Operator) (*DirectedPipeline, error) {
-	if err := setOperatorOutputs(operators); err != nil {
+	return newDirectedPipeline(operators, operators)
+}
+
+// newDirectedPipeline creates a new directed pipeline, only setting the outputs of the
+// unconnected operators. The outputs of the other operators are already set, and they
+// may be running.
+func newDirectedPipeline(operators []operator.Operator, unconnected []operator.Operator) (*DirectedPipeline, error) {
+	if err := setOperatorOutputs(unconnected, operators); err != nil {
 		return nil, err
 	}
 
@@ -0,0 +1,84 @@
+package pipeline
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/observiq/stanza/operator"
+)
+
+// Readiness holds the limits beyond which a running pipeline is not ready
+type Readiness struct {
+	// MaxRetryDuration is how long an operator may retry to send entries without success.
+	// It is not checked if it is zero.
+	MaxRetryDuration time.Duration
+	// MaxBufferUsage is the fraction of the capacity of the buffer of an operator that may be used.
+	// It is not checked if it is zero.
+	MaxBufferUsage float64
+}
+
+// Started returns true if the operators of the pipeline were started and not stopped
+func (p *DirectedPipeline) Started() bool {
+	p.stateMux.Lock()
+	defer p.stateMux.Unlock()
+	return p.started
+}
+
+// setStarted records whether the operators of the pipeline are running, and the ids of the
+// operator configs whose operators are missing from it
+func (p *DirectedPipeline) setStarted(started bool, missing []string) {
+	p.stateMux.Lock()
+	defer p.stateMux.Unlock()
+	p.started = started
+	p.missing = missing
+}
+
+// Health returns the health of the operators of the pipeline that report it, by operator id
+func (p *DirectedPipeline) Health() map[string]operator.Health {
+	health := make(map[string]operator.Health)
+	for _, op := range p.Operators() {
+		if reporter, ok := op.(operator.HealthReporter); ok {
+			health[op.ID()] = reporter.Health()
+		}
+	}
+	return health
+}
+
+// NotReady returns the reasons why the pipeline is not ready, or nil if it is ready. A
+// pipeline is ready if all of its operators are running and healthy, and none of them
+// exceeds the limits of the readiness.
+func (p *DirectedPipeline) NotReady(r Readiness) []string {
+	p.stateMux.Lock()
+	started, missing := p.started, p.missing
+	p.stateMux.Unlock()
+	if !started {
+		return []string{"pipeline is not started"}
+	}
+
+	var reasons []string
+	for _, id := range missing {
+		reasons = append(reasons, fmt.Sprintf("operator '%s' is not running, because it could not be restored by a reload", id))
+	}
+
+	health := p.Health()
+	ids := make([]string, 0, len(health))
+	for id := range health {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		h := health[id]
+		if h.Err != nil {
+			reasons = append(reasons, fmt.Sprintf("operator '%s' is unhealthy: %s", id, h.Err))
+		}
+		if r.MaxRetryDuration > 0 && h.RetryingFor > r.MaxRetryDuration {
+			reasons = append(reasons, fmt.Sprintf("operator '%s' has been retrying for %s, longer than %s", id, h.RetryingFor.Round(time.Second), r.MaxRetryDuration))
+		}
+		if r.MaxBufferUsage > 0 && h.BufferUsage > r.MaxBufferUsage {
+			reasons = append(reasons, fmt.Sprintf("buffer of operator '%s' is %.0f%% full, more than %.0f%%", id, 100*h.BufferUsage, 100*r.MaxBufferUsage))
+		}
+	}
+	return reasons
+}
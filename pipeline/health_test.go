@@ -0,0 +1,92 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/observiq/stanza/entry"
+	"github.com/observiq/stanza/operator"
+	"github.com/observiq/stanza/operator/helper"
+	"github.com/observiq/stanza/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+// healthOperator is an output that reports a fixed health
+type healthOperator struct {
+	helper.OutputOperator
+	health operator.Health
+}
+
+func (o *healthOperator) Process(ctx context.Context, e *entry.Entry) error { return nil }
+
+func (o *healthOperator) Health() operator.Health { return o.health }
+
+func newHealthOperator(t *testing.T, id string, health operator.Health) *healthOperator {
+	output, err := helper.NewOutputConfig(id, "health").Build(testutil.NewBuildContext(t))
+	require.NoError(t, err)
+	return &healthOperator{OutputOperator: output, health: health}
+}
+
+func TestPipelineReadiness(t *testing.T) {
+	readiness := Readiness{MaxRetryDuration: time.Minute, MaxBufferUsage: 0.9}
+
+	t.Run("NotStarted", func(t *testing.T) {
+		p, err := NewDirectedPipeline([]operator.Operator{newHealthOperator(t, "output", operator.Health{})})
+		require.NoError(t, err)
+		require.False(t, p.Started())
+		require.Equal(t, []string{"pipeline is not started"}, p.NotReady(readiness))
+
+		require.NoError(t, p.Start())
+		require.True(t, p.Started())
+		require.Empty(t, p.NotReady(readiness))
+
+		require.NoError(t, p.Stop())
+		require.False(t, p.Started())
+		require.Equal(t, []string{"pipeline is not started"}, p.NotReady(readiness))
+	})
+
+	t.Run("Unhealthy", func(t *testing.T) {
+		p, err := NewDirectedPipeline([]operator.Operator{
+			newHealthOperator(t, "healthy", operator.Health{RetryingFor: 30 * time.Second, BufferUsage: 0.5}),
+			newHealthOperator(t, "retrying", operator.Health{RetryingFor: 2 * time.Minute}),
+			newHealthOperator(t, "full", operator.Health{BufferUsage: 0.95}),
+			newHealthOperator(t, "failed", operator.Health{Err: errors.New("connection refused")}),
+		})
+		require.NoError(t, err)
+		require.NoError(t, p.Start())
+		defer p.Stop()
+
+		require.Len(t, p.Health(), 4)
+		require.Equal(t, []string{
+			"operator '$.failed' is unhealthy: connection refused",
+			"buffer of operator '$.full' is 95% full, more than 90%",
+			"operator '$.retrying' has been retrying for 2m0s, longer than 1m0s",
+		}, p.NotReady(readiness))
+
+		// The limits are not checked if they are zero
+		require.Equal(t, []string{
+			"operator '$.failed' is unhealthy: connection refused",
+		}, p.NotReady(Readiness{}))
+	})
+
+	t.Run("OperatorsNotRestoredByReload", func(t *testing.T) {
+		r := &reloadTest{}
+		p := r.start(t, r.config("a", "b", "c"))
+
+		// The new config of b cannot be started, and the previous config of b cannot be built again
+		config := r.config("a", "b", "c")
+		config[1].Builder.(*reloadConfig).FailStart = true
+		config[1].Builder.(*reloadConfig).Value = "changed"
+		p.source.config[1].Builder.(*reloadConfig).FailBuild = true
+		next, _, err := p.Reload(config)
+		require.Error(t, err)
+
+		// a is stopped as well, because it writes to b
+		require.Equal(t, []string{
+			"operator '$.a' is not running, because it could not be restored by a reload",
+			"operator '$.b' is not running, because it could not be restored by a reload",
+		}, next.NotReady(readiness))
+	})
+}
@@ -0,0 +1,139 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/observiq/stanza/entry"
+	"github.com/observiq/stanza/operator"
+	"go.uber.org/zap"
+)
+
+// heldOutput takes the place of an operator that is stopped by a reload. The running operators
+// that write to it wait until it is released, and then write to the operator that replaces it.
+type heldOutput struct {
+	stopped  operator.Operator
+	released chan struct{}
+	target   operator.Operator
+}
+
+// ID returns the id of the stopped operator
+func (h *heldOutput) ID() string { return h.stopped.ID() }
+
+// Type returns the type of the stopped operator
+func (h *heldOutput) Type() string { return h.stopped.Type() }
+
+// Start does nothing, because a held output is never started
+func (h *heldOutput) Start() error { return nil }
+
+// Stop does nothing, because a held output is never started
+func (h *heldOutput) Stop() error { return nil }
+
+// CanOutput returns false, because a held output only forwards entries to its target
+func (h *heldOutput) CanOutput() bool { return false }
+
+// Outputs returns no operators
+func (h *heldOutput) Outputs() []operator.Operator { return nil }
+
+// SetOutputs does nothing
+func (h *heldOutput) SetOutputs([]operator.Operator) error { return nil }
+
+// CanProcess returns true
+func (h *heldOutput) CanProcess() bool { return true }
+
+// Logger returns the logger of the stopped operator
+func (h *heldOutput) Logger() *zap.SugaredLogger { return h.stopped.Logger() }
+
+// Process waits until the output is released, and writes the entry to the operator that replaces
+// the stopped operator
+func (h *heldOutput) Process(ctx context.Context, e *entry.Entry) error {
+	select {
+	case <-h.released:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if h.target == nil {
+		return fmt.Errorf("operator '%s' is not running, because it could not be restored by a reload", h.ID())
+	}
+	return h.target.Process(ctx, e)
+}
+
+// heldOutputs are the held outputs of a reload
+type heldOutputs struct {
+	outputs []*heldOutput
+	once    sync.Once
+}
+
+// hold connects the running operators that write to an operator of the stale operator configs
+// to held outputs, so that they do not write to the operators while they are stopped. The
+// held outputs must be released even if an error is returned.
+func (s *source) hold(stale map[string]bool, running map[string]builtConfig) (*heldOutputs, error) {
+	held := &heldOutputs{}
+	operators := make([]operator.Operator, 0)
+	for _, b := range s.built {
+		if _, ok := running[b.id]; ok {
+			operators = append(operators, b.operators...)
+			continue
+		}
+		if !stale[b.id] {
+			continue
+		}
+		for _, op := range b.operators {
+			output := &heldOutput{stopped: op, released: make(chan struct{})}
+			held.outputs = append(held.outputs, output)
+			operators = append(operators, output)
+		}
+	}
+	if s.defaultOperator != nil {
+		operators = append(operators, s.defaultOperator)
+	}
+
+	holding := make(map[string]bool, len(held.outputs))
+	for _, output := range held.outputs {
+		holding[output.ID()] = true
+	}
+	for _, b := range s.built {
+		if _, ok := running[b.id]; !ok {
+			continue
+		}
+		for _, op := range b.operators {
+			if !op.CanOutput() || !writesToAny(op, holding) {
+				continue
+			}
+			if err := op.SetOutputs(operators); err != nil {
+				return held, err
+			}
+		}
+	}
+	return held, nil
+}
+
+// writesToAny returns true if an operator writes to one of the operators with the given ids
+func writesToAny(op operator.Operator, ids map[string]bool) bool {
+	for _, output := range op.Outputs() {
+		if ids[output.ID()] {
+			return true
+		}
+	}
+	return false
+}
+
+// release releases the held outputs to the operators of the same ids in a pipeline. The
+// entries that are written to them afterwards fail if the pipeline is nil, or has no
+// operator of their id.
+func (h *heldOutputs) release(p *DirectedPipeline) {
+	h.once.Do(func() {
+		targets := make(map[string]operator.Operator)
+		if p != nil {
+			for _, op := range p.Operators() {
+				targets[op.ID()] = op
+			}
+		}
+		for _, output := range h.outputs {
+			output.target = targets[output.ID()]
+			close(output.released)
+		}
+	})
+}
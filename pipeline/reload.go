@@ -0,0 +1,419 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/observiq/stanza/database"
+	"github.com/observiq/stanza/errors"
+	"github.com/observiq/stanza/operator"
+	"go.uber.org/zap"
+	"gonum.org/v1/gonum/graph/topo"
+)
+
+// source is the config that a pipeline was built from
+type source struct {
+	config          Config
+	bc              operator.BuildContext
+	defaultOperator operator.Operator
+
+	// built holds the operators built from each operator config, in the order of the config
+	built []builtConfig
+}
+
+// builtConfig holds the operators built from an operator config
+type builtConfig struct {
+	// id is the namespaced id of the operator config
+	id string
+	// key identifies the operator config and the outputs it defaults to. The operators
+	// are only kept running by a reload if the key of their config did not change.
+	key       string
+	operators []operator.Operator
+}
+
+// configKey returns the key of an operator config that is built with a build context
+func configKey(cfg operator.Config, bc operator.BuildContext) string {
+	raw, err := json.Marshal(cfg)
+	if err != nil {
+		// A config that cannot be compared is rebuilt by every reload
+		return ""
+	}
+	return string(raw) + "\n" + strings.Join(bc.DefaultOutputIDs, ",")
+}
+
+// Changes describes how a reload changed a pipeline
+type Changes struct {
+	// Kept are the ids of the operator configs whose operators kept running
+	Kept []string
+	// Stopped are the ids of the operator configs whose operators were stopped
+	Stopped []string
+	// Started are the ids of the operator configs whose operators were built and started
+	Started []string
+}
+
+// Reload applies a new config to a running pipeline that was built by BuildPipeline, and
+// returns the pipeline that runs afterwards. The operators of operator configs that did not
+// change keep running, and the running operators that write to a changed operator are
+// connected to the operator that replaces it. The operators of operator configs that changed
+// or were removed are stopped, and the operators of the new config are started in their place.
+//
+// The new config is validated before any operator is stopped, so the pipeline keeps running
+// unchanged if it is invalid. The operators of the new config are only built once the operators
+// they replace are stopped, so that they do not open the buffers of those operators while they
+// are in use. Meanwhile, the running operators that write to them are held. If the new
+// operators cannot be built or started, the operators that were stopped are built from the
+// previous config and started again, and the returned pipeline runs the previous config.
+func (p *DirectedPipeline) Reload(c Config) (*DirectedPipeline, Changes, error) {
+	if p.source == nil {
+		return p, Changes{}, errors.NewError("pipeline cannot be reloaded, because it was not built from a config", "")
+	}
+	s := p.source
+
+	keys := make(map[string]string, len(c))
+	for i, cfg := range c {
+		id := s.bc.PrependNamespace(cfg.ID())
+		if _, ok := keys[id]; ok {
+			return p, Changes{}, errors.NewError(
+				fmt.Sprintf("operator with id '%s' already exists in pipeline", id),
+				"ensure that each operator has a unique `type` or `id`",
+			)
+		}
+		keys[id] = configKey(cfg, getBuildContextWithDefaultOutput(c, i, s.bc))
+	}
+
+	stopped := s.stale(keys)
+	running := make(map[string]builtConfig, len(s.built))
+	changes := Changes{}
+	for _, b := range s.built {
+		if stopped[b.id] {
+			changes.Stopped = append(changes.Stopped, b.id)
+			continue
+		}
+		running[b.id] = b
+		changes.Kept = append(changes.Kept, b.id)
+	}
+	for _, cfg := range c {
+		id := s.bc.PrependNamespace(cfg.ID())
+		if _, ok := running[id]; !ok {
+			changes.Started = append(changes.Started, id)
+		}
+	}
+	if len(changes.Stopped) == 0 && len(changes.Started) == 0 {
+		return p, changes, nil
+	}
+
+	if err := s.validate(c, running); err != nil {
+		return p, Changes{}, err
+	}
+
+	held, err := s.hold(stopped, running)
+	if err != nil {
+		held.release(p)
+		_ = setOperatorOutputs(reconnected(p.Operators()), p.Operators())
+		return p, Changes{}, err
+	}
+	p.stopConfigs(stopped)
+
+	next, err := s.assemble(c, running)
+	if err != nil {
+		changes = Changes{}
+		previous, restoreErr := s.assemble(s.config, running)
+		if restoreErr != nil {
+			held.release(nil)
+			orphaned := s.orphaned(running)
+			p.stopConfigs(orphaned)
+			for id := range orphaned {
+				delete(running, id)
+			}
+			next, err = s.keep(running), fmt.Errorf("%s, and the previous config could not be restored: %s", err, restoreErr)
+			s.retainMetrics(next)
+			return next, changes, err
+		}
+		next = previous
+	}
+
+	// The held entries are released before the running operators are connected, because
+	// connecting an operator waits for the entries it is writing
+	held.release(next)
+	if connectErr := setOperatorOutputs(reconnected(next.Operators()), next.Operators()); connectErr != nil && err == nil {
+		err = connectErr
+	}
+
+	s.retainMetrics(next)
+	return next, changes, err
+}
+
+// retainMetrics stops collecting the metrics of the operators that are not in the pipeline anymore
+func (s *source) retainMetrics(p *DirectedPipeline) {
+	if p == nil || s.bc.Metrics == nil {
+		return
+	}
+	ids := make([]string, 0)
+	for _, op := range p.Operators() {
+		ids = append(ids, op.ID())
+	}
+	s.bc.Metrics.Retain(ids)
+}
+
+// stale returns the ids of the built operator configs whose operators must be stopped to
+// apply a new config, given the keys of its operator configs by id. These are the operator
+// configs that changed or were removed.
+func (s *source) stale(keys map[string]string) map[string]bool {
+	stale := make(map[string]bool, len(s.built))
+	for _, b := range s.built {
+		if key, ok := keys[b.id]; !ok || key == "" || key != b.key {
+			stale[b.id] = true
+		}
+	}
+	return stale
+}
+
+// validate builds the operators of a config that are not running, and checks that they can be
+// connected to each other and to the running operators. The operators are built without
+// their database, metrics and disk buffers, so that building them does not change the
+// state of the running operators, and they are closed afterwards.
+func (s *source) validate(c Config, running map[string]builtConfig) error {
+	bc := s.bc.Copy()
+	bc.Database = database.NewStubDatabase()
+	bc.Metrics = nil
+	bc.MemoryBuffers = true
+
+	operators, fresh, _, err := s.build(c, running, bc)
+	if err != nil {
+		return err
+	}
+	defer closeOperators(fresh)
+
+	_, err = newDirectedPipeline(operators, fresh)
+	return err
+}
+
+// build builds the operators of a config, reusing the running operators of the operator configs
+// in running. It returns the operators of the config, the operators it built and the operators
+// of each operator config. If an operator config cannot be built, the operators it built are closed.
+func (s *source) build(c Config, running map[string]builtConfig, bc operator.BuildContext) ([]operator.Operator, []operator.Operator, []builtConfig, error) {
+	built := make([]builtConfig, 0, len(c))
+	operators := make([]operator.Operator, 0, len(c))
+	fresh := make([]operator.Operator, 0)
+	for i, cfg := range c {
+		b, ok := running[s.bc.PrependNamespace(cfg.ID())]
+		if !ok {
+			var err error
+			b, err = c.build(i, bc)
+			if err != nil {
+				closeOperators(fresh)
+				return nil, nil, nil, err
+			}
+			fresh = append(fresh, b.operators...)
+		}
+		built = append(built, b)
+		operators = append(operators, b.operators...)
+	}
+
+	if s.defaultOperator != nil {
+		operators = append(operators, s.defaultOperator)
+	}
+	return operators, fresh, built, nil
+}
+
+// assemble builds a pipeline from a config, reusing the running operators of the operator
+// configs in running, and starts the operators that it built. The running operators are not
+// connected to the operators it built. If the pipeline cannot be built or started, the
+// operators that it built are stopped or closed.
+func (s *source) assemble(c Config, running map[string]builtConfig) (*DirectedPipeline, error) {
+	operators, fresh, built, err := s.build(c, running, s.bc)
+	if err != nil {
+		return nil, err
+	}
+
+	pipeline, err := newDirectedPipeline(operators, fresh)
+	if err != nil {
+		closeOperators(fresh)
+		return nil, err
+	}
+	if err := pipeline.startOperators(fresh); err != nil {
+		return nil, err
+	}
+
+	pipeline.source = &source{config: c, bc: s.bc, defaultOperator: s.defaultOperator, built: built}
+	pipeline.setStarted(true, nil)
+	return pipeline, nil
+}
+
+// reconnected returns the operators that write to an operator that is not one of the operators
+func reconnected(operators []operator.Operator) []operator.Operator {
+	current := make(map[operator.Operator]bool, len(operators))
+	for _, op := range operators {
+		current[op] = true
+	}
+
+	result := make([]operator.Operator, 0)
+	for _, op := range operators {
+		if !op.CanOutput() {
+			continue
+		}
+		for _, output := range op.Outputs() {
+			if !current[output] {
+				result = append(result, op)
+				break
+			}
+		}
+	}
+	return result
+}
+
+// orphaned returns the ids of the operator configs in running whose operators write to an
+// operator that is not running, either directly or through other operators
+func (s *source) orphaned(running map[string]builtConfig) map[string]bool {
+	orphaned := make(map[string]bool)
+	for {
+		current := make(map[string]bool)
+		for id, b := range running {
+			if orphaned[id] {
+				continue
+			}
+			for _, op := range b.operators {
+				current[op.ID()] = true
+			}
+		}
+		if s.defaultOperator != nil {
+			current[s.defaultOperator.ID()] = true
+		}
+
+		changed := false
+		for id, b := range running {
+			if orphaned[id] || !writesToMissing(b.operators, current) {
+				continue
+			}
+			orphaned[id] = true
+			changed = true
+		}
+		if !changed {
+			return orphaned
+		}
+	}
+}
+
+// writesToMissing returns true if one of the operators writes to an operator whose id is not current
+func writesToMissing(operators []operator.Operator, current map[string]bool) bool {
+	for _, op := range operators {
+		if !op.CanOutput() {
+			continue
+		}
+		for _, output := range op.Outputs() {
+			if !current[output.ID()] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// keep returns a pipeline of the running operators only. It is used when neither the new
+// nor the previous config could be started, so that the running operators can still be stopped.
+// The running operators must not write to operators that are not running.
+func (s *source) keep(running map[string]builtConfig) *DirectedPipeline {
+	config := make(Config, 0, len(running))
+	built := make([]builtConfig, 0, len(running))
+	operators := make([]operator.Operator, 0)
+	missing := make([]string, 0)
+	for i, b := range s.built {
+		if _, ok := running[b.id]; !ok {
+			missing = append(missing, b.id)
+			continue
+		}
+		config = append(config, s.config[i])
+		built = append(built, b)
+		operators = append(operators, b.operators...)
+	}
+	if s.defaultOperator != nil {
+		operators = append(operators, s.defaultOperator)
+	}
+
+	// The running operators only write to each other, so they can always be connected
+	pipeline, err := newDirectedPipeline(operators, nil)
+	if err != nil {
+		return nil
+	}
+	pipeline.source = &source{config: config, bc: s.bc, defaultOperator: s.defaultOperator, built: built}
+	pipeline.setStarted(true, missing)
+	return pipeline
+}
+
+// stopConfigs stops the operators of the given operator configs in topological order
+func (p *DirectedPipeline) stopConfigs(configs map[string]bool) {
+	stopped := make(map[string]bool)
+	for _, b := range p.source.built {
+		if configs[b.id] {
+			for _, op := range b.operators {
+				stopped[op.ID()] = true
+			}
+		}
+	}
+
+	// The graph was sorted when the pipeline was built, so this cannot fail
+	sortedNodes, _ := topo.Sort(p.Graph)
+	for _, node := range sortedNodes {
+		operator := node.(OperatorNode).Operator()
+		if !stopped[operator.ID()] {
+			continue
+		}
+		operator.Logger().Debug("Stopping operator")
+		_ = operator.Stop()
+		operator.Logger().Debug("Stopped operator")
+	}
+}
+
+// startOperators starts the given operators of the pipeline in reverse topological order.
+// If an operator fails to start, the operators that were started are stopped, and the
+// others are closed.
+func (p *DirectedPipeline) startOperators(operators []operator.Operator) error {
+	pending := make(map[string]operator.Operator, len(operators))
+	for _, op := range operators {
+		pending[op.ID()] = op
+	}
+
+	sortedNodes, err := topo.Sort(p.Graph)
+	if err != nil {
+		closeOperators(operators)
+		return err
+	}
+
+	started := make([]operator.Operator, 0, len(operators))
+	for i := len(sortedNodes) - 1; i >= 0; i-- {
+		op := sortedNodes[i].(OperatorNode).Operator()
+		if _, ok := pending[op.ID()]; !ok {
+			continue
+		}
+		op.Logger().Debug("Starting operator")
+		if err := op.Start(); err != nil {
+			for j := len(started) - 1; j >= 0; j-- {
+				_ = started[j].Stop()
+			}
+			unstarted := make([]operator.Operator, 0, len(pending))
+			for _, unstartedOp := range pending {
+				unstarted = append(unstarted, unstartedOp)
+			}
+			closeOperators(unstarted)
+			return err
+		}
+		delete(pending, op.ID())
+		started = append(started, op)
+		op.Logger().Debug("Started operator")
+	}
+	return nil
+}
+
+// closeOperators releases the resources of operators that were built but not started
+func closeOperators(operators []operator.Operator) {
+	for _, op := range operators {
+		closer, ok := op.(operator.Closer)
+		if !ok {
+			continue
+		}
+		if err := closer.Close(); err != nil {
+			op.Logger().Errorw("Failed to close operator", zap.Error(err))
+		}
+	}
+}
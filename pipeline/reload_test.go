@@ -0,0 +1,326 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	"github.com/observiq/stanza/entry"
+	"github.com/observiq/stanza/metrics"
+	"github.com/observiq/stanza/operator"
+	"github.com/observiq/stanza/operator/helper"
+	"github.com/observiq/stanza/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+// reloadConfig builds a reloadOperator, and records it in built
+type reloadConfig struct {
+	helper.WriterConfig
+	Value     string `json:"value"`
+	FailBuild bool   `json:"fail_build"`
+	FailStart bool   `json:"fail_start"`
+
+	built   *[]*reloadOperator
+	onBuild func(*reloadOperator)
+}
+
+func (c reloadConfig) Build(bc operator.BuildContext) ([]operator.Operator, error) {
+	if c.FailBuild {
+		return nil, fmt.Errorf("failed to build %s", c.ID())
+	}
+	writer, err := c.WriterConfig.Build(bc)
+	if err != nil {
+		return nil, err
+	}
+	op := &reloadOperator{WriterOperator: writer, config: c, validated: bc.MemoryBuffers}
+	*c.built = append(*c.built, op)
+	if c.onBuild != nil {
+		c.onBuild(op)
+	}
+	return []operator.Operator{op}, nil
+}
+
+// reloadOperator records whether it was started, stopped or closed, and whether it was only
+// built to validate a config
+type reloadOperator struct {
+	helper.WriterOperator
+	config                   reloadConfig
+	running, stopped, closed bool
+	validated                bool
+	processed                int64
+}
+
+func (o *reloadOperator) CanProcess() bool { return true }
+
+func (o *reloadOperator) Process(ctx context.Context, e *entry.Entry) error {
+	atomic.AddInt64(&o.processed, 1)
+	return nil
+}
+
+func (o *reloadOperator) Start() error {
+	if o.config.FailStart {
+		return fmt.Errorf("failed to start %s", o.ID())
+	}
+	o.running = true
+	return nil
+}
+
+func (o *reloadOperator) Stop() error {
+	o.running, o.stopped = false, true
+	return nil
+}
+
+func (o *reloadOperator) Close() error {
+	o.closed = true
+	return nil
+}
+
+type reloadTest struct {
+	built []*reloadOperator
+}
+
+// config returns a config of operators that each write to the next, with the given ids
+func (r *reloadTest) config(ids ...string) Config {
+	config := make(Config, 0, len(ids))
+	for _, id := range ids {
+		config = append(config, operator.Config{Builder: &reloadConfig{
+			WriterConfig: helper.NewWriterConfig(id, "reload"),
+			built:        &r.built,
+		}})
+	}
+	return config
+}
+
+// operators returns the operators of a pipeline by id
+func (r *reloadTest) operators(p *DirectedPipeline) map[string]*reloadOperator {
+	operators := make(map[string]*reloadOperator)
+	for _, op := range p.Operators() {
+		operators[op.ID()] = op.(*reloadOperator)
+	}
+	return operators
+}
+
+func (r *reloadTest) start(t *testing.T, config Config) *DirectedPipeline {
+	p, err := config.BuildPipeline(testutil.NewBuildContext(t), nil)
+	require.NoError(t, err)
+	require.NoError(t, p.Start())
+	return p
+}
+
+func TestReload(t *testing.T) {
+	t.Run("NoChanges", func(t *testing.T) {
+		r := &reloadTest{}
+		p := r.start(t, r.config("a", "b", "c"))
+
+		next, changes, err := p.Reload(r.config("a", "b", "c"))
+		require.NoError(t, err)
+		require.Equal(t, p, next)
+		require.Equal(t, []string{"$.a", "$.b", "$.c"}, changes.Kept)
+		require.Len(t, r.built, 3)
+		for _, op := range r.built {
+			require.True(t, op.running)
+		}
+	})
+
+	t.Run("UnchangedOperatorsKeepRunning", func(t *testing.T) {
+		r := &reloadTest{}
+		p := r.start(t, r.config("a", "b", "c"))
+		previous := r.operators(p)
+
+		config := r.config("a", "b", "c")
+		config[1].Builder.(*reloadConfig).Value = "changed"
+		next, changes, err := p.Reload(config)
+		require.NoError(t, err)
+		require.Equal(t, []string{"$.a", "$.c"}, changes.Kept)
+		require.Equal(t, []string{"$.b"}, changes.Stopped)
+		require.Equal(t, []string{"$.b"}, changes.Started)
+
+		current := r.operators(next)
+		require.True(t, previous["$.b"].stopped)
+		require.NotEqual(t, previous["$.b"], current["$.b"])
+		require.True(t, current["$.b"].running)
+		require.Equal(t, "changed", current["$.b"].config.Value)
+		require.Equal(t, []operator.Operator{current["$.c"]}, current["$.b"].Outputs())
+
+		// The operator that writes to the changed operator keeps running, and writes to its replacement
+		for _, id := range []string{"$.a", "$.c"} {
+			require.Equal(t, previous[id], current[id])
+			require.True(t, current[id].running)
+			require.False(t, current[id].stopped)
+		}
+		require.Equal(t, []operator.Operator{current["$.b"]}, current["$.a"].Outputs())
+	})
+
+	t.Run("ChangedOutputsAreRestarted", func(t *testing.T) {
+		r := &reloadTest{}
+		p := r.start(t, r.config("a", "b", "c"))
+		previous := r.operators(p)
+
+		config := r.config("a", "b", "c")
+		config[0].Builder.(*reloadConfig).OutputIDs = []string{"c"}
+		next, changes, err := p.Reload(config)
+		require.NoError(t, err)
+		require.Equal(t, []string{"$.b", "$.c"}, changes.Kept)
+		require.Equal(t, []string{"$.a"}, changes.Stopped)
+
+		current := r.operators(next)
+		require.True(t, previous["$.a"].stopped)
+		require.Equal(t, []operator.Operator{current["$.c"]}, current["$.a"].Outputs())
+		require.Equal(t, previous["$.b"], current["$.b"])
+	})
+
+	t.Run("WritesDuringReloadReachReplacements", func(t *testing.T) {
+		r := &reloadTest{}
+		p := r.start(t, r.config("a", "b", "c"))
+		previous := r.operators(p)
+
+		written := make(chan struct{})
+		config := r.config("a", "b", "c")
+		config[1].Builder.(*reloadConfig).Value = "changed"
+		config[1].Builder.(*reloadConfig).onBuild = func(op *reloadOperator) {
+			if op.validated {
+				return
+			}
+			require.True(t, previous["$.b"].stopped, "the changed operator is stopped before its replacement is built")
+			go func() {
+				previous["$.a"].Write(context.Background(), entry.New())
+				close(written)
+			}()
+		}
+		next, _, err := p.Reload(config)
+		require.NoError(t, err)
+		<-written
+
+		current := r.operators(next)
+		require.Equal(t, int64(0), atomic.LoadInt64(&previous["$.b"].processed))
+		require.Equal(t, int64(1), atomic.LoadInt64(&current["$.b"].processed))
+	})
+
+	t.Run("RemovedOperatorsAreStopped", func(t *testing.T) {
+		r := &reloadTest{}
+		p := r.start(t, r.config("a", "b", "c"))
+		previous := r.operators(p)
+
+		config := r.config("a", "c")
+		next, changes, err := p.Reload(config)
+		require.NoError(t, err)
+		require.Equal(t, []string{"$.c"}, changes.Kept)
+		require.Equal(t, []string{"$.a", "$.b"}, changes.Stopped)
+		require.Equal(t, []string{"$.a"}, changes.Started)
+		require.True(t, previous["$.b"].stopped)
+		require.Len(t, next.Operators(), 2)
+	})
+
+	t.Run("RemovedOperatorsStopReportingMetrics", func(t *testing.T) {
+		r := &reloadTest{}
+		bc := testutil.NewBuildContext(t)
+		bc.Metrics = metrics.NewRegistry()
+		p, err := r.config("a", "b", "c").BuildPipeline(bc, nil)
+		require.NoError(t, err)
+		require.NoError(t, p.Start())
+
+		_, _, err = p.Reload(r.config("a", "c"))
+		require.NoError(t, err)
+
+		body := testutil.ScrapeMetrics(t, bc.Metrics)
+		require.Contains(t, body, `operator_id="$.a"`)
+		require.NotContains(t, body, `operator_id="$.b"`)
+		require.Contains(t, body, `operator_id="$.c"`)
+	})
+
+	t.Run("BuildFailureKeepsPreviousPipeline", func(t *testing.T) {
+		r := &reloadTest{}
+		p := r.start(t, r.config("a", "b", "c"))
+		previous := r.operators(p)
+
+		config := r.config("a", "b", "c", "d")
+		config[1].Builder.(*reloadConfig).Value = "changed"
+		config[3].Builder.(*reloadConfig).FailBuild = true
+		next, changes, err := p.Reload(config)
+		require.EqualError(t, err, "failed to build d")
+		require.Equal(t, Changes{}, changes)
+		require.Equal(t, p, next)
+
+		current := r.operators(next)
+		require.Equal(t, previous, current)
+		for id, op := range current {
+			require.True(t, op.running, id)
+			require.False(t, op.stopped, id)
+		}
+		require.Equal(t, []operator.Operator{current["$.b"]}, current["$.a"].Outputs())
+		for _, op := range r.built[3:] {
+			require.True(t, op.validated, "the failed config is only built to validate it")
+			require.True(t, op.closed, "the operators built from the failed config are closed")
+		}
+	})
+
+	t.Run("InvalidConfigKeepsPreviousPipeline", func(t *testing.T) {
+		r := &reloadTest{}
+		p := r.start(t, r.config("a", "b", "c"))
+		previous := r.operators(p)
+
+		config := r.config("a", "b", "c")
+		config[1].Builder.(*reloadConfig).OutputIDs = []string{"missing"}
+		next, _, err := p.Reload(config)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "does not exist")
+		require.Equal(t, p, next)
+
+		for id, op := range r.operators(next) {
+			require.True(t, op.running, id)
+			require.False(t, op.stopped, id)
+		}
+		require.Equal(t, []operator.Operator{previous["$.b"]}, previous["$.a"].Outputs())
+		for _, op := range r.built[3:] {
+			require.True(t, op.validated)
+			require.True(t, op.closed)
+		}
+	})
+
+	t.Run("StartFailureRestoresPreviousConfig", func(t *testing.T) {
+		r := &reloadTest{}
+		p := r.start(t, r.config("a", "b", "c"))
+		previous := r.operators(p)
+
+		config := r.config("a", "b", "c")
+		config[1].Builder.(*reloadConfig).FailStart = true
+		next, _, err := p.Reload(config)
+		require.EqualError(t, err, "failed to start $.b")
+
+		require.True(t, r.built[3].validated)
+		failedB := r.built[4]
+		require.False(t, failedB.validated)
+		require.True(t, failedB.closed)
+		require.False(t, failedB.running)
+
+		// The stopped operator is built from the previous config, and the running operators write to it
+		current := r.operators(next)
+		require.True(t, previous["$.b"].stopped)
+		require.NotEqual(t, previous["$.b"], current["$.b"])
+		require.True(t, current["$.b"].running)
+		require.Equal(t, previous["$.a"], current["$.a"])
+		require.Equal(t, previous["$.c"], current["$.c"])
+		require.Equal(t, []operator.Operator{current["$.b"]}, current["$.a"].Outputs())
+	})
+
+	t.Run("DuplicateID", func(t *testing.T) {
+		r := &reloadTest{}
+		p := r.start(t, r.config("a", "b"))
+
+		next, _, err := p.Reload(r.config("a", "a"))
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "operator with id '$.a' already exists in pipeline")
+		require.Equal(t, p, next)
+		for _, op := range r.built {
+			require.True(t, op.running)
+		}
+	})
+
+	t.Run("NotBuiltFromConfig", func(t *testing.T) {
+		p, err := NewDirectedPipeline(nil)
+		require.NoError(t, err)
+		_, _, err = p.Reload(Config{})
+		require.Error(t, err)
+	})
+}
@@ -2,12 +2,14 @@ package testutil
 
 import (
 	"io/ioutil"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
 
 	"github.com/observiq/stanza/logger"
+	"github.com/observiq/stanza/metrics"
 	"github.com/observiq/stanza/operator"
 	"go.etcd.io/bbolt"
 	"go.uber.org/zap/zapcore"
@@ -82,3 +84,13 @@ func Trim(s string) string {
 
 	return strings.Join(trimmed, "\n")
 }
+
+// ScrapeMetrics returns the metrics served by a metrics registry in the Prometheus text format
+func ScrapeMetrics(t testing.TB, r *metrics.Registry) string {
+	recorder := httptest.NewRecorder()
+	r.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if recorder.Code != 200 {
+		t.Fatalf("scrape metrics: status %d", recorder.Code)
+	}
+	return recorder.Body.String()
+}